@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/term"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/console"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/launcher"
+)
+
+// scriptOptions configure a non-interactive console session.
+type scriptOptions struct {
+	steps    []string
+	login    string
+	password string
+	timeout  time.Duration
+	drain    time.Duration
+}
+
+func (o *scriptOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringArrayVar(&o.steps, "step", nil, "Script step, repeatable and run in order: expect=REGEX, send=LINE, login=USER:PASSWORD or sleep=DURATION")
+	fs.StringVar(&o.login, "login", "", "Log in as this user before running the steps")
+	fs.StringVar(&o.password, "password", "", "Password for --login (default: $VM_CONSOLE_PASSWORD)")
+	fs.DurationVar(&o.timeout, "timeout", time.Minute, "Timeout for each expect and login step")
+	fs.DurationVar(&o.drain, "drain", time.Second, "When piping stdin, keep printing output until it has been idle this long")
+}
+
+// scripted reports whether a script was given; without one, a non-terminal
+// stdin is simply piped to the console.
+func (o *scriptOptions) scripted() bool {
+	return len(o.steps) > 0 || o.login != ""
+}
+
+func (o *scriptOptions) parse() ([]console.Step, error) {
+	var steps []console.Step
+	if o.login != "" {
+		password := o.password
+		if password == "" {
+			password = os.Getenv("VM_CONSOLE_PASSWORD")
+		}
+		steps = append(steps, console.Step{Action: "login", Value: o.login + ":" + password})
+	}
+	for _, s := range o.steps {
+		step, err := console.ParseStep(s)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// args renders the options as flags for the in-container attach command. The
+// password is passed through the environment instead of the command line.
+func (o *scriptOptions) args() []string {
+	args := []string{"--timeout", o.timeout.String(), "--drain", o.drain.String()}
+	for _, s := range o.steps {
+		args = append(args, "--step", s)
+	}
+	if o.login != "" {
+		args = append(args, "--login", o.login)
+	}
+	return args
+}
+
+// exitError makes the process exit with code. A nil err means the failure has
+// already been reported.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return ""
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// consoleMethods are the ways to reach a serial console from the host, in the
+// order --method=auto tries them.
+var consoleMethods = []string{"unix", "tcp", "exec"}
+
+// connectOptions select how the console command reaches the serial console.
+type connectOptions struct {
+	method   string
+	address  string
+	view     bool
+	takeover bool
+}
+
+func newConsoleCmd() *cobra.Command {
+	var (
+		record  string
+		escape  string
+		connect connectOptions
+		script  scriptOptions
+	)
+
+	cmd := &cobra.Command{
+		Use:   "console <vm-name>",
+		Short: "Attach to the serial console of a running VM",
+		Long: `Opens an interactive serial console to a VM running in a podman pod.
+Press Ctrl+] (or the sequence given with --escape) to disconnect.
+
+The console is reached from the host. --method=auto tries, in order:
+
+  unix  the console proxy's socket on the Pod's shared volume
+  tcp   the console proxy's TCP endpoint (Pods generated with --proxy-publish)
+  exec  virsh console in the compute container, through podman exec
+
+--method=copy copies this binary into the compute container and runs it there
+instead, for launchers without virsh.
+
+When stdin is not a terminal, it is piped to the console instead. With --step
+or --login the session is scripted, for use in CI:
+
+  kubevirt-vm-to-pod console myvm --login cirros --step 'send=uname -a' --step 'expect=Linux'
+
+Exit codes: 0 success, 1 error, 2 timeout waiting for output, 3 login failed.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+			steps, err := script.parse()
+			if err != nil {
+				return err
+			}
+			escapeSeq, err := console.ParseEscape(escape)
+			if err != nil {
+				return err
+			}
+
+			var stdout io.Writer = os.Stdout
+			if record != "" {
+				rec, err := newCastRecorder(record, "Serial console "+vmName)
+				if err != nil {
+					return err
+				}
+				defer rec.Close()
+				stdout = io.MultiWriter(os.Stdout, rec)
+			}
+
+			if connect.method == "copy" {
+				return runCopiedConsole(vmName, escape, &script, stdout)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			conn, err := connectConsole(ctx, vmName, connect)
+			cancel()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			switch {
+			case script.scripted():
+				err = console.NewSession(conn, stdout).Run(steps, script.timeout)
+			case !term.IsTerminal(int(os.Stdin.Fd())):
+				err = console.Pipe(conn, os.Stdin, stdout, script.drain)
+			default:
+				return console.Interactive(conn, os.Stdin, stdout, escapeSeq, escape)
+			}
+			if err != nil {
+				return &exitError{code: console.ExitCode(err), err: err}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&connect.method, "method", "auto", "How to reach the console: auto, unix, tcp, exec or copy")
+	cmd.Flags().StringVar(&connect.address, "address", "127.0.0.1:8080", "Address of the console proxy for --method=tcp")
+	cmd.Flags().BoolVar(&connect.view, "view", false, "Attach to the console proxy as a read-only viewer")
+	cmd.Flags().BoolVar(&connect.takeover, "takeover", false, "Take the console proxy's write lock from the current writer")
+	cmd.Flags().StringVar(&escape, "escape", console.DefaultEscape, "Escape sequence that disconnects, in caret notation (e.g. ^], ^A, ~.) or \"none\"")
+	cmd.Flags().StringVar(&record, "record", "", "Record the session as an asciicast v2 file")
+	script.addFlags(cmd.Flags())
+	return cmd
+}
+
+// connectConsole connects to the serial console of vmName with the method in
+// o, trying each method in turn for auto.
+func connectConsole(ctx context.Context, vmName string, o connectOptions) (io.ReadWriteCloser, error) {
+	methods := []string{o.method}
+	if o.method == "auto" {
+		methods = consoleMethods
+	}
+
+	var errs []string
+	for _, method := range methods {
+		var (
+			conn io.ReadWriteCloser
+			err  error
+		)
+		dialOpts := console.DialOptions{ReadOnly: o.view, Takeover: o.takeover}
+		switch method {
+		case "unix":
+			var sockPath string
+			sockPath, err = proxySocketPath(ctx, vmName)
+			if err == nil {
+				conn, err = console.DialProxy(ctx, "unix", sockPath, dialOpts)
+			}
+		case "tcp":
+			conn, err = console.DialProxy(ctx, "tcp", o.address, dialOpts)
+		case "exec":
+			if o.view || o.takeover {
+				err = fmt.Errorf("--view and --takeover need the console proxy")
+			} else {
+				conn, err = execConsole(ctx, vmName)
+			}
+		default:
+			return nil, fmt.Errorf("unknown console method %q (expected auto, unix, tcp, exec or copy)", method)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", method, err))
+	}
+	return nil, fmt.Errorf("failed to connect to the serial console of %s:\n  %s", vmName, strings.Join(errs, "\n  "))
+}
+
+// proxySocketPath finds the host path of the console proxy's unix socket
+// through the source of the volume shared with the compute container.
+func proxySocketPath(ctx context.Context, vmName string) (string, error) {
+	containerName := launcher.ContainerName(vmName, launcher.ProxyContainer)
+	format := `{{range .Mounts}}{{if eq .Destination "/var/run/kubevirt-private"}}{{.Source}}{{end}}{{end}}`
+	out, err := exec.CommandContext(ctx, "podman", "inspect", "--format", format, containerName).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect %s (was the Pod generated with --add-console-proxy?): %v", containerName, err)
+	}
+	source := strings.TrimSpace(string(out))
+	if source == "" {
+		return "", fmt.Errorf("%s has no /var/run/kubevirt-private mount", containerName)
+	}
+	return filepath.Join(source, "console-proxy.sock"), nil
+}
+
+// execConsole streams virsh console in the compute container through podman
+// exec. virsh needs a terminal, so one is allocated in the container even
+// when stdin is not one.
+func execConsole(ctx context.Context, vmName string) (io.ReadWriteCloser, error) {
+	containerName := launcher.ContainerName(vmName, launcher.ComputeContainer)
+	domain, err := launcher.Domain(ctx, launcher.PodmanExec(containerName))
+	if err != nil {
+		return nil, err
+	}
+
+	c := exec.Command("podman", "exec", "-i", "-t", containerName, "virsh", "console", domain)
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.Stderr = os.Stderr
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start virsh console: %v", err)
+	}
+	return &cmdConn{cmd: c, stdin: stdin, stdout: stdout}, nil
+}
+
+// cmdConn is a console connection over the stdin and stdout of a command.
+type cmdConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (c *cmdConn) Read(p []byte) (int, error)  { return c.stdout.Read(p) }
+func (c *cmdConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+func (c *cmdConn) Close() error {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+// runCopiedConsole copies this binary into the compute container and runs its
+// attach command there, connected to the serial socket directly.
+func runCopiedConsole(vmName, escape string, script *scriptOptions, stdout io.Writer) error {
+	containerName := launcher.ContainerName(vmName, launcher.ComputeContainer)
+
+	// Copy ourselves into the container
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable path: %v", err)
+	}
+
+	copyCmd := exec.Command("podman", "cp", self, containerName+":/tmp/vm-console")
+	copyCmd.Stderr = os.Stderr
+	if err := copyCmd.Run(); err != nil {
+		return fmt.Errorf("failed to copy binary into container (is %s running?): %v", containerName, err)
+	}
+
+	// Exec ourselves inside the container in attach mode. Only
+	// allocate a TTY for interactive sessions.
+	execArgs := []string{"exec", "-i"}
+	if !script.scripted() && term.IsTerminal(int(os.Stdin.Fd())) {
+		execArgs = append(execArgs, "-t")
+	}
+	execArgs = append(execArgs, "--env", "VM_CONSOLE_PASSWORD", containerName,
+		"/tmp/vm-console", "attach",
+		"--socket", "/var/run/kubevirt-private/virt-serial0",
+		"--escape", escape)
+	execArgs = append(execArgs, script.args()...)
+
+	execCmd := exec.Command("podman", execArgs...)
+	execCmd.Env = os.Environ()
+	if script.password != "" {
+		execCmd.Env = append(execCmd.Env, "VM_CONSOLE_PASSWORD="+script.password)
+	}
+	execCmd.Stdin = os.Stdin
+	execCmd.Stdout = stdout
+	execCmd.Stderr = os.Stderr
+	if err := execCmd.Run(); err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			return &exitError{code: ee.ExitCode()}
+		}
+		return err
+	}
+	return nil
+}
+
+// newAttachCmd returns the attach subcommand — it runs inside the container and
+// connects stdin/stdout to a Unix socket.
+func newAttachCmd() *cobra.Command {
+	var (
+		escape string
+		script scriptOptions
+	)
+
+	cmd := &cobra.Command{
+		Use:    "attach",
+		Short:  "Connect stdin/stdout to a serial socket (runs inside container)",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			socketPath, _ := cmd.Flags().GetString("socket")
+			steps, err := script.parse()
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case script.scripted():
+				err = runScript(socketPath, steps, script.timeout)
+			case !term.IsTerminal(int(os.Stdin.Fd())):
+				err = runPipe(socketPath, script.drain)
+			default:
+				return runAttach(socketPath, escape)
+			}
+			if err != nil {
+				return &exitError{code: console.ExitCode(err), err: err}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().String("socket", "/var/run/kubevirt-private/virt-serial0", "Path to serial Unix socket")
+	cmd.Flags().StringVar(&escape, "escape", console.DefaultEscape, "Escape sequence that disconnects")
+	script.addFlags(cmd.Flags())
+	return cmd
+}
+
+// newCastRecorder creates an asciicast recording at path, sized to the current
+// terminal. Closing the recorder closes the file.
+func newCastRecorder(path, title string) (*console.Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %v", err)
+	}
+
+	header := console.CastHeader{
+		Title: title,
+		Env:   map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	}
+	if w, h, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		header.Width, header.Height = w, h
+	}
+
+	rec, err := console.NewRecorder(f, header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rec, nil
+}
+
+func runScript(socketPath string, steps []console.Step, timeout time.Duration) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", socketPath, err)
+	}
+	defer conn.Close()
+
+	return console.NewSession(conn, os.Stdout).Run(steps, timeout)
+}
+
+func runPipe(socketPath string, drain time.Duration) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", socketPath, err)
+	}
+	defer conn.Close()
+
+	return console.Pipe(conn, os.Stdin, os.Stdout, drain)
+}
+
+func runAttach(socketPath, escape string) error {
+	escapeSeq, err := console.ParseEscape(escape)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", socketPath, err)
+	}
+	defer conn.Close()
+
+	return console.Interactive(conn, os.Stdin, os.Stdout, escapeSeq, escape)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/guestagent"
+)
+
+func newCpCmd() *cobra.Command {
+	var (
+		timeout    time.Duration
+		noPreserve bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "cp <src> <dst>",
+		Short: "Copy files into and out of a VM through its guest agent",
+		Long: `Copies a file between the host and a running VM using the qemu-guest-agent
+file commands, so no guest networking is needed. One side is written as
+<vm-name>:<path>, the other is a local path or - for stdin/stdout:
+
+  kubevirt-vm-to-pod cp ./app.conf myvm:/etc/app.conf
+  kubevirt-vm-to-pod cp myvm:/var/log/messages ./messages
+
+Permissions are copied too when the guest agent allows running chmod and
+stat in the guest; otherwise a warning is printed.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			srcVM, srcPath, srcRemote := splitGuestPath(args[0])
+			dstVM, dstPath, dstRemote := splitGuestPath(args[1])
+
+			switch {
+			case srcRemote && dstRemote:
+				return fmt.Errorf("copying between VMs is not supported, one side must be a local path")
+			case !srcRemote && !dstRemote:
+				return fmt.Errorf("one side must be a VM path written as <vm-name>:<path>")
+			case dstRemote:
+				return withGuestAgent(dstVM, timeout, func(ctx context.Context, agent *guestagent.Agent) error {
+					return copyToGuest(ctx, agent, srcPath, dstPath, !noPreserve)
+				})
+			default:
+				return withGuestAgent(srcVM, timeout, func(ctx context.Context, agent *guestagent.Agent) error {
+					return copyFromGuest(ctx, agent, srcPath, dstPath, !noPreserve)
+				})
+			}
+		},
+	}
+
+	cmd.Flags().DurationVar(&timeout, "timeout", 10*time.Minute, "Timeout for the whole copy")
+	cmd.Flags().BoolVar(&noPreserve, "no-preserve", false, "Do not copy file permissions")
+	return cmd
+}
+
+// splitGuestPath splits "vm:/path" into its parts. Anything else, including
+// paths whose part before the colon contains a slash, is a local path.
+func splitGuestPath(arg string) (vm, p string, remote bool) {
+	vm, p, ok := strings.Cut(arg, ":")
+	if !ok || vm == "" || strings.ContainsAny(vm, `/\`) {
+		return "", arg, false
+	}
+	return vm, p, true
+}
+
+func copyToGuest(ctx context.Context, agent *guestagent.Agent, src, dst string, preserve bool) error {
+	// Check the agent first so a missing agent is reported as such.
+	if err := agent.Ping(ctx); err != nil {
+		return err
+	}
+
+	var (
+		r    io.Reader = os.Stdin
+		mode os.FileMode
+	)
+	if src != "-" {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory, only files can be copied", src)
+		}
+		r, mode = f, info.Mode().Perm()
+		if strings.HasSuffix(dst, "/") {
+			dst += filepath.Base(src)
+		}
+	}
+
+	n, err := agent.WriteFile(ctx, dst, r)
+	if err != nil {
+		return err
+	}
+	if preserve && mode != 0 {
+		if err := agent.Chmod(ctx, dst, mode); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not set permissions of %s in the guest: %v\n", dst, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Copied %d bytes to %s\n", n, dst)
+	return nil
+}
+
+func copyFromGuest(ctx context.Context, agent *guestagent.Agent, src, dst string, preserve bool) error {
+	if err := agent.Ping(ctx); err != nil {
+		return err
+	}
+
+	if dst == "-" {
+		_, err := agent.ReadFile(ctx, src, os.Stdout)
+		return err
+	}
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dst = filepath.Join(dst, path.Base(src))
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	n, err := agent.ReadFile(ctx, src, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	if preserve {
+		mode, err := agent.FileMode(ctx, src)
+		if err == nil {
+			err = os.Chmod(dst, mode)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not copy permissions of %s: %v\n", src, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Copied %d bytes to %s\n", n, dst)
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/guestagent"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/launcher"
+)
+
+func newGuestCmd() *cobra.Command {
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "guest",
+		Short: "Query and control a VM through its guest agent",
+		Long: `Runs qemu-guest-agent commands through libvirt in the compute container
+and prints the result as JSON. The output uses the same shapes KubeVirt
+reports (virtctl guestosinfo, userlist, VMI interface status), so scripts work
+in both environments. The guest must run qemu-guest-agent.`,
+	}
+	cmd.PersistentFlags().DurationVar(&timeout, "timeout", time.Minute, "Timeout for the guest agent to respond")
+
+	run := func(args []string, f func(ctx context.Context, agent *guestagent.Agent) error) error {
+		return withGuestAgent(args[0], timeout, f)
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "info <vm-name>",
+		Short: "Print guest OS, agent, user and filesystem information",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(args, func(ctx context.Context, agent *guestagent.Agent) error {
+				info, err := agent.Info(ctx)
+				if err != nil {
+					return err
+				}
+				return printJSON(os.Stdout, info)
+			})
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "users <vm-name>",
+		Short: "List the users logged in to the guest",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(args, func(ctx context.Context, agent *guestagent.Agent) error {
+				users, err := agent.Users(ctx)
+				if err != nil {
+					return err
+				}
+				return printJSON(os.Stdout, users)
+			})
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "network <vm-name>",
+		Short: "List the guest network interfaces as in the VMI status",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(args, func(ctx context.Context, agent *guestagent.Agent) error {
+				ifaces, err := agent.Interfaces(ctx)
+				if err != nil {
+					return err
+				}
+				return printJSON(os.Stdout, ifaces)
+			})
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:       "fsfreeze <vm-name> freeze|thaw|status",
+		Short:     "Freeze, thaw or check the guest filesystems",
+		Args:      cobra.ExactArgs(2),
+		ValidArgs: []string{"freeze", "thaw", "status"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(args, func(ctx context.Context, agent *guestagent.Agent) error {
+				var err error
+				switch args[1] {
+				case "freeze":
+					_, err = agent.FSFreeze(ctx)
+				case "thaw":
+					_, err = agent.FSThaw(ctx)
+				case "status":
+				default:
+					return fmt.Errorf("unknown fsfreeze action %q (expected freeze, thaw or status)", args[1])
+				}
+				if err != nil {
+					return err
+				}
+				status, err := agent.FSFreezeStatus(ctx)
+				if err != nil {
+					return err
+				}
+				return printJSON(os.Stdout, struct {
+					FSFreezeStatus string `json:"fsFreezeStatus"`
+				}{status})
+			})
+		},
+	})
+
+	var stdin bool
+	execCmd := &cobra.Command{
+		Use:   "exec <vm-name> -- <command> [args...]",
+		Short: "Run a command in the guest",
+		Long: `Runs a command in the guest and prints its exit code and output as JSON.
+The command is not run through a shell. The exit code of this command is the
+guest command's exit code, or 128 plus the signal if it was killed by one.`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var input []byte
+			if stdin {
+				var err error
+				if input, err = io.ReadAll(os.Stdin); err != nil {
+					return fmt.Errorf("failed to read stdin: %v", err)
+				}
+			}
+			return run(args, func(ctx context.Context, agent *guestagent.Agent) error {
+				result, err := agent.Exec(ctx, args[1], args[2:], input)
+				if err != nil {
+					return err
+				}
+				if err := printJSON(os.Stdout, result); err != nil {
+					return err
+				}
+				if code := result.ExitStatus(); code != 0 {
+					return &exitError{code: code}
+				}
+				return nil
+			})
+		},
+	}
+	execCmd.Flags().BoolVar(&stdin, "stdin", false, "Pass this command's stdin to the guest command")
+	cmd.AddCommand(execCmd)
+
+	return cmd
+}
+
+// withGuestAgent connects to the guest agent of vmName and calls f, giving up
+// after timeout.
+func withGuestAgent(vmName string, timeout time.Duration, f func(ctx context.Context, agent *guestagent.Agent) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	exec := launcher.PodmanExec(launcher.ContainerName(vmName, launcher.ComputeContainer))
+	domain, err := launcher.Domain(ctx, exec)
+	if err != nil {
+		return err
+	}
+	return f(ctx, guestagent.New(exec, domain))
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal output: %v", err)
+	}
+	fmt.Fprintln(w, string(data))
+	return nil
+}
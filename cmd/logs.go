@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/console"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
+)
+
+func newLogsCmd() *cobra.Command {
+	var (
+		follow bool
+		lines  int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "logs <vm-name>",
+		Short: "Print the serial console log of a VM",
+		Long: `Prints the serial console log captured by the console proxy.
+The Pod must have been generated with --console-log. The log lives on the
+<vm-name>-console-log Podman volume, so it is available even after the Pod
+has stopped.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			volume := transformer.ConsoleLogVolumeName(args[0])
+			out, err := exec.Command("podman", "volume", "inspect", "--format", "{{.Mountpoint}}", volume).Output()
+			if err != nil {
+				return fmt.Errorf("failed to find console log volume %s (was the Pod generated with --console-log?): %v", volume, err)
+			}
+			logPath := filepath.Join(strings.TrimSpace(string(out)), transformer.ConsoleLogFile)
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return console.Tail(ctx, logPath, lines, follow, os.Stdout)
+		},
+	}
+
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "Keep printing new console output")
+	cmd.Flags().IntVar(&lines, "tail", -1, "Number of lines to show from the end of the log (-1 for all)")
+	return cmd
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	virtv1 "kubevirt.io/api/core/v1"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/preflight"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
+)
+
+func newPreflightCmd() *cobra.Command {
+	var (
+		root         string
+		output       string
+		noPasst      bool
+		mountDevices bool
+		emulation    string
+		deviceMap    string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "preflight [vm-file]",
+		Short: "Check that the host can run a VM",
+		Long: `Renders the Pod for a VM and checks the host for everything it needs:
+hardware or nested virtualization, cgroup v2, every device the Pod mounts,
+passt for Passt interfaces, memory, free hugepages, an IOMMU for host devices
+and the SELinux booleans for device access. Every requirement is reported as
+pass, warn or fail with a hint on how to fix it, and the exit code is 1 if any
+failed. Without a VM file, the requirements every VM has are checked; "-"
+reads the VM from stdin:
+
+  kubevirt-vm-to-pod preflight
+  kubevirt-vm-to-pod preflight vm.yaml
+  kubevirt-vm-to-pod preflight --root=/host vm.yaml`,
+		Args: cobra.MaximumNArgs(1),
+		// Failed checks are the output; main reports other errors itself.
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != "text" && output != "json" {
+				return fmt.Errorf("output must be 'text' or 'json'")
+			}
+
+			useEmulation, err := resolveEmulation(emulation, root)
+			if err != nil {
+				return err
+			}
+			m, err := loadDeviceMap(deviceMap)
+			if err != nil {
+				return err
+			}
+			t := transformer.NewVMToPodTransformer(
+				transformer.WithForcePasst(!noPasst),
+				transformer.WithMountDevices(mountDevices),
+				transformer.WithEmulation(useEmulation),
+				transformer.WithDeviceMap(m, root),
+			)
+			var pod *k8sv1.Pod
+			switch {
+			case len(args) == 0:
+				pod, err = t.TransformVMContext(cmd.Context(), minimalVM())
+			case args[0] == "-":
+				pod, err = t.TransformReaderContext(cmd.Context(), os.Stdin)
+			default:
+				pod, err = t.TransformContext(cmd.Context(), args[0])
+			}
+			if err != nil {
+				return fmt.Errorf("failed to transform VM to Pod: %v", err)
+			}
+
+			results, err := preflight.Check(pod, preflight.Options{Root: root})
+			if err != nil {
+				return err
+			}
+			if output == "json" {
+				if err := printJSON(os.Stdout, results); err != nil {
+					return err
+				}
+			} else {
+				printPreflight(results)
+			}
+			if preflight.Failed(results) {
+				return &exitError{code: 1}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&root, "root", "/", "Root of the host filesystem to inspect, e.g. /host when running in a container")
+	cmd.Flags().StringVar(&output, "output", "text", "Output format: text or json")
+	cmd.Flags().BoolVar(&noPasst, "no-passt", false, "Check for the original network bindings instead of Passt")
+	cmd.Flags().BoolVar(&mountDevices, "mount-devices", true, "Check the KVM devices the Pod mounts by default")
+	cmd.Flags().StringVar(&emulation, "emulation", "off", "Check for a Pod with software emulation: on, off, or auto to use it when /dev/kvm is missing")
+	cmd.Flags().Lookup("emulation").NoOptDefVal = "on"
+	cmd.Flags().StringVar(&deviceMap, "device-map", "", "Check the exact device nodes of the host devices assigned from this permittedHostDevices file")
+	return cmd
+}
+
+// minimalVM is a VM with nothing but defaults, for checking the requirements
+// every VM has.
+func minimalVM() *virtv1.VirtualMachine {
+	return &virtv1.VirtualMachine{
+		TypeMeta:   metav1.TypeMeta{APIVersion: virtv1.GroupVersion.String(), Kind: "VirtualMachine"},
+		ObjectMeta: metav1.ObjectMeta{Name: "preflight"},
+		Spec: virtv1.VirtualMachineSpec{
+			Template: &virtv1.VirtualMachineInstanceTemplateSpec{},
+		},
+	}
+}
+
+func printPreflight(results []preflight.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", strings.ToUpper(string(r.Status)), r.Requirement, r.Message)
+		if r.Hint != "" && r.Status != preflight.Pass {
+			fmt.Fprintf(w, "\t\tfix: %s\n", r.Hint)
+		}
+	}
+	w.Flush()
+}
@@ -1,23 +1,39 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/console"
 )
 
 var (
 	port       = flag.String("port", "8080", "Port to listen on")
 	socketDir  = flag.String("socket-dir", "/var/run/kubevirt-private", "Directory containing the virt-serial0 socket")
-	listenMode = flag.String("listen", "tcp", "Listen mode: tcp or unix (unix socket at /var/run/kubevirt-private/console-proxy.sock)")
+	listenMode = flag.String("listen", "tcp", "Listen mode: tcp, unix or unix,tcp (unix socket at <socket-dir>/console-proxy.sock)")
+	scrollback = flag.Int("scrollback", 64*1024, "Bytes of console output replayed to newly attached clients")
+	logFile    = flag.String("log-file", "", "Write all console output to this file (disabled if empty)")
+	logMaxSize = flag.Int("log-max-size", 10, "Rotate the console log once it exceeds this many MiB (0 disables rotation)")
+	logMaxKeep = flag.Int("log-max-files", 5, "Number of rotated console log files to keep")
+	logStamps  = flag.Bool("log-timestamps", true, "Prefix every console log line with a timestamp")
+	recordDir  = flag.String("record-dir", "", "Record console output as an asciicast v2 file in this directory (disabled if empty)")
+	sshPort    = flag.Int("ssh-port", 0, "Serve the console over SSH on this port (disabled if 0)")
+	sshHostKey = flag.String("ssh-host-key", "", "PEM private host key for the SSH server (an ephemeral key is generated if empty)")
+	sshAuthKey = flag.String("ssh-authorized-keys", "", "authorized_keys file listing the public keys allowed to connect over SSH")
 	socketName = "virt-serial0"
 )
 
@@ -40,31 +56,140 @@ func main() {
 	}
 	log.Printf("Using serial console socket: %s", socketPath)
 
-	http.HandleFunc("/console", func(w http.ResponseWriter, r *http.Request) {
-		handler(w, r, socketPath)
-	})
+	// Sinks that hold files are closed on shutdown, so recordings are
+	// complete.
+	var closers []io.Closer
+
+	// Keep a single connection to the serial socket and share it between
+	// all clients.
+	hub := console.NewHub(func() (net.Conn, error) {
+		return net.Dial("unix", socketPath)
+	}, *scrollback)
+
+	if *logFile != "" {
+		f, err := console.OpenRotatingFile(*logFile, int64(*logMaxSize)*1024*1024, *logMaxKeep)
+		if err != nil {
+			log.Fatalf("Failed to open console log: %v", err)
+		}
+		closers = append(closers, f)
+		if *logStamps {
+			hub.AddSink(console.NewTimestampWriter(f))
+		} else {
+			hub.AddSink(f)
+		}
+		log.Printf("Logging console output to %s", *logFile)
+	}
+
+	if *recordDir != "" {
+		// A new file per proxy start keeps every cast self-contained.
+		castPath := filepath.Join(*recordDir, fmt.Sprintf("serial-%s.cast", time.Now().UTC().Format("20060102T150405Z")))
+		f, err := os.Create(castPath)
+		if err != nil {
+			log.Fatalf("Failed to create console recording: %v", err)
+		}
+		rec, err := console.NewRecorder(f, console.CastHeader{Title: "Serial console " + filepath.Base(socketPath)})
+		if err != nil {
+			log.Fatalf("Failed to start console recording: %v", err)
+		}
+		hub.AddSink(rec)
+		closers = append(closers, rec)
+		log.Printf("Recording console output to %s", castPath)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hubDone := make(chan struct{})
+	go func() {
+		hub.Run(ctx)
+		close(hubDone)
+	}()
+
+	http.Handle("/console", console.NewWebSocketHandler(hub))
+	http.Handle("/console/clients", console.NewClientsHandler(hub))
 
-	var ln net.Listener
+	// Listen on every requested endpoint; the unix socket is reachable
+	// from the host through the shared volume, TCP only if published.
+	errCh := make(chan error, 3)
+	if *sshPort != 0 {
+		serve, err := listenSSH(hub)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() { errCh <- serve() }()
+	}
+	for _, mode := range strings.Split(*listenMode, ",") {
+		ln, err := listen(mode)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() { errCh <- http.Serve(ln, nil) }()
+	}
 	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		log.Printf("Shutting down")
+	}
+	// The hub writes to the sinks until Run returns.
+	stop()
+	<-hubDone
+	for _, c := range closers {
+		c.Close()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	if *listenMode == "unix" {
+func listen(mode string) (net.Listener, error) {
+	switch mode {
+	case "unix":
 		sockPath := filepath.Join(*socketDir, "console-proxy.sock")
 		os.Remove(sockPath) // clean up stale socket
-		ln, err = net.Listen("unix", sockPath)
+		ln, err := net.Listen("unix", sockPath)
 		if err != nil {
-			log.Fatalf("Failed to listen on unix socket: %v", err)
+			return nil, fmt.Errorf("failed to listen on unix socket: %v", err)
 		}
 		os.Chmod(sockPath, 0666)
 		log.Printf("Listening on unix socket: %s", sockPath)
-	} else {
-		ln, err = net.Listen("tcp", ":"+*port)
+		return ln, nil
+	case "tcp":
+		ln, err := net.Listen("tcp", ":"+*port)
 		if err != nil {
-			log.Fatalf("Failed to listen on port %s: %v", *port, err)
+			return nil, fmt.Errorf("failed to listen on port %s: %v", *port, err)
 		}
 		log.Printf("Listening on TCP port %s", *port)
+		return ln, nil
+	default:
+		return nil, fmt.Errorf("unknown listen mode %q (expected tcp, unix or both separated by a comma)", mode)
 	}
+}
 
-	log.Fatal(http.Serve(ln, nil))
+// listenSSH sets up the SSH gateway and returns a function serving it.
+func listenSSH(hub *console.Hub) (func() error, error) {
+	if *sshAuthKey == "" {
+		return nil, fmt.Errorf("-ssh-port requires -ssh-authorized-keys")
+	}
+	keys, err := console.LoadAuthorizedKeys(*sshAuthKey)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := console.LoadHostKey(*sshHostKey)
+	if err != nil {
+		return nil, err
+	}
+	if *sshHostKey == "" {
+		log.Printf("No SSH host key given, generated %s", ssh.FingerprintSHA256(hostKey.PublicKey()))
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *sshPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on SSH port %d: %v", *sshPort, err)
+	}
+	log.Printf("Serving console over SSH on port %d for %d authorized keys", *sshPort, len(keys))
+	return func() error {
+		return console.ServeSSH(ln, hub, console.NewSSHServerConfig(hostKey, keys))
+	}, nil
 }
 
 func discoverSocketPath(dir string) (string, error) {
@@ -96,63 +221,3 @@ func discoverSocketPath(dir string) (string, error) {
 
 	return filepath.Join(dir, subdirs[0], socketName), nil
 }
-
-func handler(w http.ResponseWriter, r *http.Request, socketPath string) {
-	upgrader := websocket.Upgrader{
-		Subprotocols: []string{"binary.kubevirt.io"},
-		CheckOrigin:  func(r *http.Request) bool { return true },
-	}
-
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
-		return
-	}
-	defer ws.Close()
-
-	ws.SetReadDeadline(time.Now().Add(5 * time.Minute))
-
-	conn, err := net.Dial("unix", socketPath)
-	if err != nil {
-		log.Printf("Failed to dial Unix socket: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	errChan := make(chan error, 2)
-
-	go func() {
-		buf := make([]byte, 8192)
-		for {
-			n, err := conn.Read(buf)
-			if err != nil {
-				errChan <- err
-				return
-			}
-			if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-				errChan <- err
-				return
-			}
-		}
-	}()
-
-	go func() {
-		for {
-			mt, data, err := ws.ReadMessage()
-			if err != nil {
-				errChan <- err
-				return
-			}
-			if mt != websocket.BinaryMessage {
-				continue
-			}
-			if _, err := conn.Write(data); err != nil {
-				errChan <- err
-				return
-			}
-		}
-	}()
-
-	<-errChan
-	log.Println("Connection closed")
-}
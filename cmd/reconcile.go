@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/reconcile"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
+)
+
+func newReconcileCmd() *cobra.Command {
+	var (
+		dir             string
+		once            bool
+		resync          time.Duration
+		noPasst         bool
+		mountDevices    bool
+		launcherImage   string
+		addConsoleProxy bool
+		proxyImage      string
+		proxyPort       int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "reconcile --dir <dir>",
+		Short: "Keep Podman Pods in sync with a directory of VM manifests",
+		Long: `Treats a directory of VirtualMachine manifests as the desired state: one VM per
+.yaml, .yml or .json file. A Pod is created for every VM, recreated when its
+rendered Pod changes and removed when its file is deleted; named volumes are
+kept. Unchanged VMs are left running.
+
+VMs follow their runStrategy: Always (the default when neither runStrategy nor
+running is set) also restarts stopped Pods, Once and RerunOnFailure create the
+Pod but leave restarts to its restart policy, Halted removes the Pod and
+Manual leaves it alone. Pods are only removed when every manifest can be read,
+so a broken edit never tears a VM down.
+
+The directory is watched for changes and fully resynced every --resync.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if dir == "" {
+				return fmt.Errorf("--dir is required")
+			}
+			if addConsoleProxy && proxyImage == "" {
+				proxyImage = "quay.io/vladikr/kubevirt-console-proxy:latest"
+			}
+			t := transformer.NewVMToPodTransformer(
+				transformer.WithLauncherImage(launcherImage),
+				transformer.WithAddConsoleProxy(addConsoleProxy, proxyImage, proxyPort),
+				transformer.WithForcePasst(!noPasst),
+				transformer.WithMountDevices(mountDevices),
+			)
+			r := reconcile.New(dir, t, reconcile.PodmanCLI{})
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			if once {
+				actions, err := r.Reconcile(ctx)
+				if failed := logActions(actions, err); failed > 0 {
+					return fmt.Errorf("%d of %d changes failed", failed, len(actions))
+				}
+				return err
+			}
+			log.Printf("Watching %s", dir)
+			return r.Watch(ctx, resync, func(actions []reconcile.Action, err error) {
+				logActions(actions, err)
+			})
+		},
+	}
+
+	cmd.Flags().StringVar(&dir, "dir", "", "Directory of VirtualMachine manifests")
+	cmd.Flags().BoolVar(&once, "once", false, "Reconcile once and exit instead of watching")
+	cmd.Flags().DurationVar(&resync, "resync", time.Minute, "Interval of full resyncs while watching")
+	cmd.Flags().BoolVar(&noPasst, "no-passt", false, "Preserve original network bindings instead of converting to Passt (requires CNI plugins)")
+	cmd.Flags().BoolVar(&mountDevices, "mount-devices", true, "Mount KVM devices (/dev/kvm, /dev/vhost-net, /dev/net/tun) for standalone execution")
+	cmd.Flags().StringVar(&launcherImage, "launcher-image", "quay.io/kubevirt/virt-launcher:v1.8.0", "Virt-launcher image")
+	cmd.Flags().BoolVar(&addConsoleProxy, "add-console-proxy", false, "Add console proxy sidecar to the Pods")
+	cmd.Flags().StringVar(&proxyImage, "proxy-image", "", "Console proxy image (default: quay.io/vladikr/kubevirt-console-proxy:latest)")
+	cmd.Flags().IntVar(&proxyPort, "proxy-port", 8080, "Port for the console proxy to listen on")
+	return cmd
+}
+
+// logActions logs the outcome of a reconcile pass and returns the number of
+// failed actions.
+func logActions(actions []reconcile.Action, err error) int {
+	if err != nil {
+		log.Printf("Reconcile failed: %v", err)
+	}
+	failed := 0
+	for _, a := range actions {
+		if a.Err != nil {
+			failed++
+		}
+		log.Print(a)
+	}
+	return failed
+}
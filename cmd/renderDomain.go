@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
+)
+
+func newRenderDomainCmd() *cobra.Command {
+	var (
+		file      string
+		noPasst   bool
+		emulation string
+		hostRoot  string
+		strict    bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "render-domain [vm-file]",
+		Short: "Print the libvirt domain XML virt-launcher would define for a VM",
+		Long: `Runs the same VMI pipeline as Pod generation, then KubeVirt's VMI to domain
+converter, without starting anything. Prints the libvirt domain XML, preceded
+by a comment listing the approximate QEMU devices and the host facts that were
+assumed (CPU model, NUMA placement, host devices, disk formats), so domain
+changes can be reviewed and diffed:
+
+  kubevirt-vm-to-pod render-domain vm.yaml > domain.xml
+  diff <(kubevirt-vm-to-pod render-domain old.yaml) <(kubevirt-vm-to-pod render-domain new.yaml)`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				file = args[0]
+			}
+
+			useEmulation, err := resolveEmulation(emulation, hostRoot)
+			if err != nil {
+				return err
+			}
+			t := transformer.NewVMToPodTransformer(transformer.WithForcePasst(!noPasst), transformer.WithEmulation(useEmulation), transformer.WithStrict(strict))
+
+			var preview *transformer.DomainPreview
+			if file != "" && file != "-" {
+				preview, err = t.RenderDomain(cmd.Context(), file)
+			} else {
+				preview, err = t.RenderDomainReader(cmd.Context(), os.Stdin)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to render domain: %v", err)
+			}
+			printWarnings(preview.Warnings)
+
+			data, err := preview.XML()
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(data)
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&file, "vm-file", "", "Path to VirtualMachine YAML file (reads stdin if omitted)")
+	cmd.Flags().BoolVar(&noPasst, "no-passt", false, "Preserve original network bindings instead of converting to Passt")
+	cmd.Flags().StringVar(&emulation, "emulation", "off", "Render the domain for QEMU software emulation instead of KVM: on, off, or auto to use it when /dev/kvm is missing")
+	cmd.Flags().Lookup("emulation").NoOptDefVal = "on"
+	cmd.Flags().StringVar(&hostRoot, "host-root", "/", "Root of the host filesystem to look for /dev/kvm in with --emulation=auto, e.g. /host when running in a container")
+	cmd.Flags().BoolVar(&strict, "strict", false, "Reject VMs the KubeVirt API would, with every finding and its line: unknown fields, duplicate keys, schema and webhook violations")
+	return cmd
+}
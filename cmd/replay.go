@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/console"
+)
+
+func newReplayCmd() *cobra.Command {
+	var (
+		speed   float64
+		maxIdle time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:   "replay <file.cast>",
+		Short: "Play back a recorded console session",
+		Long:  "Plays back an asciicast v2 recording made with 'console --record' or the console proxy's -record-dir option.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to open recording: %v", err)
+			}
+			defer f.Close()
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			_, err = console.Replay(ctx, f, os.Stdout, console.ReplayOptions{Speed: speed, MaxIdle: maxIdle})
+			if err == context.Canceled {
+				return nil
+			}
+			return err
+		},
+	}
+
+	cmd.Flags().Float64Var(&speed, "speed", 1, "Playback speed multiplier")
+	cmd.Flags().DurationVar(&maxIdle, "max-idle", 2*time.Second, "Cap pauses between output at this duration (0 for none)")
+	return cmd
+}
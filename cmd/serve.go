@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/server"
+)
+
+func newServeCmd() *cobra.Command {
+	var (
+		listen       string
+		maxBodyBytes int64
+		timeout      time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the VM to Pod transformation over HTTP",
+		Long: `Serves the transformation over HTTP for tools that are not written in Go.
+
+  POST /v1/transform  VM YAML or JSON; options as query parameters, or a JSON
+                      body {"vm": {...}, "options": {...}}. Returns the Pod and
+                      diagnostics as JSON.
+  GET  /healthz       liveness
+  GET  /metrics       Prometheus metrics
+
+Options are named like the flags in camelCase, e.g. ?noPasst=true&addConsoleProxy=true.
+--listen takes host:port or unix:/path/to.sock.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			l, err := server.Listen(listen)
+			if err != nil {
+				return err
+			}
+
+			srv := &http.Server{
+				Handler:           server.New(server.Options{MaxBodyBytes: maxBodyBytes, Timeout: timeout}).Handler(),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				srv.Shutdown(shutdownCtx)
+			}()
+
+			log.Printf("Serving on %s", listen)
+			if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return fmt.Errorf("server failed: %v", err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&listen, "listen", "127.0.0.1:8090", "Address to listen on: host:port or unix:/path/to.sock")
+	cmd.Flags().Int64Var(&maxBodyBytes, "max-body-size", server.DefaultMaxBodyBytes, "Largest request body accepted, in bytes")
+	cmd.Flags().DurationVar(&timeout, "timeout", server.DefaultTimeout, "Time a transformation may take")
+	return cmd
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	v1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/launcher"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/status"
+)
+
+func newStatusCmd() *cobra.Command {
+	var (
+		output  string
+		timeout time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:   "status <vm-name>",
+		Short: "Print the VMI of a running VM with its status filled in",
+		Long: `Builds the VirtualMachineInstance status of a VM from the Pod's container
+state, the libvirt domain, the guest agent and the VMI embedded in the Pod, and
+prints the whole VMI. Phase, conditions, interfaces with their IPs, guest OS
+info and volume targets match what KubeVirt reports, so VMI-aware tooling can
+read the output. Guest agent data is left out when the agent is not running.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != "yaml" && output != "json" {
+				return fmt.Errorf("output must be 'yaml' or 'json'")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			vmi, err := vmStatus(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			if output == "json" {
+				return printJSON(os.Stdout, vmi)
+			}
+			data, err := yaml.Marshal(vmi)
+			if err != nil {
+				return fmt.Errorf("failed to marshal output: %v", err)
+			}
+			_, err = os.Stdout.Write(data)
+			return err
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "yaml", "Output format: yaml or json")
+	cmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Timeout for collecting the status")
+	return cmd
+}
+
+func vmStatus(ctx context.Context, vmName string) (*v1.VirtualMachineInstance, error) {
+	container := launcher.ContainerName(vmName, launcher.ComputeContainer)
+	compute, err := launcher.Inspect(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+	if compute == nil {
+		return nil, fmt.Errorf("VM %s is not running: container %s not found", vmName, container)
+	}
+
+	src := status.Sources{VMI: &v1.VirtualMachineInstance{}, Compute: compute}
+	if err := json.Unmarshal([]byte(compute.Env["STANDALONE_VMI"]), src.VMI); err != nil {
+		return nil, fmt.Errorf("failed to read the VMI from container %s: %v", container, err)
+	}
+	src.NodeName, _ = os.Hostname()
+
+	if !compute.Running {
+		return status.Build(src), nil
+	}
+
+	if err := status.Collect(ctx, launcher.PodmanExec(container), &src); err != nil {
+		return nil, err
+	}
+	return status.Build(src), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/validate"
+)
+
+func newValidateCmd() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "validate [vm-file...]",
+		Short: "Check VM manifests against the KubeVirt schema and webhook rules",
+		Long: `Checks VirtualMachine manifests the way the KubeVirt API would: strict YAML
+decoding (duplicate keys), the KubeVirt OpenAPI schema (unknown or misspelled
+fields, wrong types) and the validation of the KubeVirt webhook (disks without
+volumes, interfaces without networks, bad run strategies). Every finding is
+printed with its file, line and column, and the exit code is 1 if there are
+any. Reads stdin without arguments:
+
+  kubevirt-vm-to-pod validate vm.yaml other-vm.yaml
+  kubevirt-vm-to-pod validate --output=json < vm.yaml
+
+The main command checks the same before transforming with --strict.`,
+		// Findings are the output; main reports other errors itself.
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if output != "text" && output != "json" {
+				return fmt.Errorf("output must be 'text' or 'json'")
+			}
+			if len(args) == 0 {
+				args = []string{"-"}
+			}
+
+			config := transformer.NewVMToPodTransformer().ClusterConfig
+			findings := []validate.Finding{}
+			for _, file := range args {
+				var data []byte
+				var err error
+				if file == "-" {
+					file = ""
+					data, err = io.ReadAll(os.Stdin)
+				} else {
+					data, err = os.ReadFile(file)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to read VM: %v", err)
+				}
+				findings = append(findings, validate.Validate(file, data, config)...)
+			}
+
+			if output == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(findings); err != nil {
+					return err
+				}
+			} else {
+				for _, f := range findings {
+					fmt.Println(f)
+				}
+			}
+			if len(findings) > 0 {
+				return &exitError{code: 1}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&output, "output", "text", "Output format: text or json")
+	return cmd
+}
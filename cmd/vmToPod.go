@@ -1,20 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net"
 	"os"
-	"os/exec"
-	"os/signal"
-	"syscall"
 
 	"github.com/spf13/cobra"
-	"golang.org/x/term"
-	k8sv1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/yaml"
 
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/hostdevices"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/preflight"
 	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
 )
 
@@ -29,6 +26,20 @@ var (
 	proxyPort        int
 	noPasst          bool
 	mountDevices     bool
+	consoleLog       bool
+	consoleLogSize   int
+	consoleLogFiles  int
+	consoleRecord    bool
+	proxyPublish     bool
+	proxySSHKeys     string
+	proxySSHHostKey  string
+	explain          string
+	deterministic    bool
+	strict           bool
+	emulation        string
+	deviceMapFile    string
+	hostRoot         string
+	createMDEVs      bool
 )
 
 func main() {
@@ -54,10 +65,21 @@ or piped through stdin:
 			if output != "yaml" && output != "json" {
 				return fmt.Errorf("output must be 'yaml' or 'json'")
 			}
+			if explain != "" && explain != "text" && explain != "json" {
+				return fmt.Errorf("explain must be 'text' or 'json'")
+			}
+			useEmulation, err := resolveEmulation(emulation, hostRoot)
+			if err != nil {
+				return err
+			}
+			deviceMap, err := loadDeviceMap(deviceMapFile)
+			if err != nil {
+				return err
+			}
 			if launcherImage == "" {
 				launcherImage = "quay.io/kubevirt/virt-launcher:v1.8.0"
 			}
-			if addConsoleProxy && proxyImage == "" {
+			if (addConsoleProxy || consoleLog || consoleRecord || proxyPublish || proxySSHKeys != "") && proxyImage == "" {
 				proxyImage = "quay.io/vladikr/kubevirt-console-proxy:latest"
 			}
 
@@ -68,18 +90,32 @@ or piped through stdin:
 				transformer.WithAddConsoleProxy(addConsoleProxy, proxyImage, proxyPort),
 				transformer.WithForcePasst(!noPasst),
 				transformer.WithMountDevices(mountDevices),
+				transformer.WithConsoleLog(consoleLog, consoleLogSize, consoleLogFiles),
+				transformer.WithConsoleRecord(consoleRecord),
+				transformer.WithPublishConsoleProxy(proxyPublish),
+				transformer.WithConsoleSSH(proxySSHKeys, proxySSHHostKey),
+				transformer.WithDeterministic(deterministic),
+				transformer.WithStrict(strict),
+				transformer.WithEmulation(useEmulation),
+				transformer.WithDeviceMap(deviceMap, hostRoot),
+				transformer.WithCreateMDEVs(createMDEVs),
 			)
 
-			var pod *k8sv1.Pod
-			var err error
+			if explain != "" {
+				return explainTransform(cmd.Context(), t)
+			}
+
+			var result *transformer.Result
 			if vmFile != "" && vmFile != "-" {
-				pod, err = t.Transform(vmFile)
+				result, err = t.TransformResult(cmd.Context(), vmFile)
 			} else {
-				pod, err = t.TransformReader(os.Stdin)
+				result, err = t.TransformReaderResult(cmd.Context(), os.Stdin)
 			}
 			if err != nil {
 				return fmt.Errorf("failed to transform VM to Pod: %v", err)
 			}
+			printWarnings(result.Warnings)
+			pod := result.Pod
 
 			var outputBytes []byte
 			if output == "yaml" {
@@ -104,118 +140,105 @@ or piped through stdin:
 	rootCmd.Flags().BoolVar(&addConsoleProxy, "add-console-proxy", false, "Add console proxy sidecar to the Pod")
 	rootCmd.Flags().StringVar(&proxyImage, "proxy-image", "", "Console proxy image (default: quay.io/vladikr/kubevirt-console-proxy:latest)")
 	rootCmd.Flags().IntVar(&proxyPort, "proxy-port", 8080, "Port for the console proxy to listen on")
+	rootCmd.Flags().BoolVar(&proxyPublish, "proxy-publish", false, "Publish the console proxy port on 127.0.0.1 of the host (implies the console proxy sidecar)")
+	rootCmd.Flags().StringVar(&proxySSHKeys, "proxy-ssh-authorized-keys", "", "Serve the serial console over SSH on --proxy-port to the keys in this authorized_keys file (implies the console proxy sidecar)")
+	rootCmd.Flags().StringVar(&proxySSHHostKey, "proxy-ssh-host-key", "", "Private SSH host key for the console proxy (default: a new key on every start)")
 	rootCmd.Flags().BoolVar(&noPasst, "no-passt", false, "Preserve original network bindings instead of converting to Passt (requires CNI plugins)")
 	rootCmd.Flags().BoolVar(&mountDevices, "mount-devices", true, "Mount KVM devices (/dev/kvm, /dev/vhost-net, /dev/net/tun) for standalone execution")
-
-	consoleCmd := &cobra.Command{
-		Use:   "console <vm-name>",
-		Short: "Attach to the serial console of a running VM",
-		Long:  "Opens an interactive serial console to a VM running in a podman pod.\nCopies itself into the container and connects to the serial socket directly.\nPress Ctrl+] to disconnect.",
-		Args:  cobra.ExactArgs(1),
-		RunE: func(cmd *cobra.Command, args []string) error {
-			vmName := args[0]
-			containerName := fmt.Sprintf("virt-launcher-%s-compute", vmName)
-
-			// Copy ourselves into the container
-			self, err := os.Executable()
-			if err != nil {
-				return fmt.Errorf("failed to find executable path: %v", err)
-			}
-
-			copyCmd := exec.Command("podman", "cp", self, containerName+":/tmp/vm-console")
-			copyCmd.Stderr = os.Stderr
-			if err := copyCmd.Run(); err != nil {
-				return fmt.Errorf("failed to copy binary into container (is %s running?): %v", containerName, err)
-			}
-
-			// Exec ourselves inside the container in attach mode
-			execCmd := exec.Command("podman", "exec", "-it", containerName,
-				"/tmp/vm-console", "attach",
-				"--socket", "/var/run/kubevirt-private/virt-serial0")
-			execCmd.Stdin = os.Stdin
-			execCmd.Stdout = os.Stdout
-			execCmd.Stderr = os.Stderr
-			return execCmd.Run()
-		},
-	}
-
-	// attach subcommand — runs inside the container, connects stdin/stdout to a Unix socket
-	attachCmd := &cobra.Command{
-		Use:    "attach",
-		Short:  "Connect stdin/stdout to a serial socket (runs inside container)",
-		Hidden: true,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			socketPath, _ := cmd.Flags().GetString("socket")
-			return runAttach(socketPath)
-		},
-	}
-	attachCmd.Flags().String("socket", "/var/run/kubevirt-private/virt-serial0", "Path to serial Unix socket")
-
-	rootCmd.AddCommand(consoleCmd)
-	rootCmd.AddCommand(attachCmd)
+	rootCmd.Flags().BoolVar(&consoleLog, "console-log", false, "Capture serial console output to a rotated log on a named volume (implies the console proxy sidecar)")
+	rootCmd.Flags().IntVar(&consoleLogSize, "console-log-max-size", 10, "Rotate the console log once it exceeds this many MiB")
+	rootCmd.Flags().IntVar(&consoleLogFiles, "console-log-max-files", 5, "Number of rotated console log files to keep")
+	rootCmd.Flags().StringVar(&explain, "explain", "", "Print what every pipeline stage changed instead of the Pod: text or json")
+	rootCmd.Flags().Lookup("explain").NoOptDefVal = "text"
+	rootCmd.Flags().BoolVar(&deterministic, "deterministic", false, "Render identical bytes for identical input: sort volumes, mounts and env, fix the QEMU timeout and drop generated metadata from the embedded VMI")
+	rootCmd.Flags().BoolVar(&strict, "strict", false, "Reject VMs the KubeVirt API would, with every finding and its line: unknown fields, duplicate keys, schema and webhook violations")
+	rootCmd.Flags().StringVar(&emulation, "emulation", "off", "Run the VM with QEMU software emulation instead of KVM: on, off, or auto to use it when /dev/kvm is missing")
+	rootCmd.Flags().Lookup("emulation").NoOptDefVal = "on"
+	rootCmd.Flags().StringVar(&deviceMapFile, "device-map", "", "Assign GPUs and host devices PCI and mediated devices from this permittedHostDevices file, mount their device nodes and pass them to virt-launcher")
+	rootCmd.Flags().BoolVar(&createMDEVs, "create-mdevs", false, "Create the mediated devices of the device map on the host when no free one exists")
+	rootCmd.Flags().StringVar(&hostRoot, "host-root", "/", "Root of the host filesystem to read devices from, e.g. /host when running in a container")
+	rootCmd.Flags().BoolVar(&consoleRecord, "console-record", false, "Record serial console output as asciicast files on the console log volume (implies the console proxy sidecar)")
+
+	rootCmd.AddCommand(newConsoleCmd())
+	rootCmd.AddCommand(newAttachCmd())
+	rootCmd.AddCommand(newLogsCmd())
+	rootCmd.AddCommand(newReplayCmd())
+	rootCmd.AddCommand(newGuestCmd())
+	rootCmd.AddCommand(newCpCmd())
+	rootCmd.AddCommand(newStatusCmd())
+	rootCmd.AddCommand(newRenderDomainCmd())
+	rootCmd.AddCommand(newServeCmd())
+	rootCmd.AddCommand(newReconcileCmd())
+	rootCmd.AddCommand(newValidateCmd())
+	rootCmd.AddCommand(newPreflightCmd())
 
 	if err := rootCmd.Execute(); err != nil {
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			if exitErr.err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", exitErr.err)
+			}
+			os.Exit(exitErr.code)
+		}
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func runAttach(socketPath string) error {
-	conn, err := net.Dial("unix", socketPath)
-	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %v", socketPath, err)
+// explainTransform prints the explanation of the transformation of the VM in
+// vmFile, or stdin, in the --explain format.
+func explainTransform(ctx context.Context, t *transformer.VMToPodTransformer) error {
+	in := os.Stdin
+	if vmFile != "" && vmFile != "-" {
+		f, err := os.Open(vmFile)
+		if err != nil {
+			return fmt.Errorf("failed to read VM file: %v", err)
+		}
+		defer f.Close()
+		in = f
 	}
-	defer conn.Close()
 
-	// Put terminal in raw mode
-	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	result, err := t.TransformDetailed(ctx, in)
 	if err != nil {
-		return fmt.Errorf("failed to set raw terminal: %v", err)
+		return fmt.Errorf("failed to transform VM to Pod: %v", err)
 	}
-	defer term.Restore(int(os.Stdin.Fd()), oldState)
-
-	// Handle signals to restore terminal
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigCh
-		term.Restore(int(os.Stdin.Fd()), oldState)
-		os.Exit(0)
-	}()
-
-	fmt.Fprintf(os.Stdout, "Connected to serial console. Press Ctrl+] to disconnect.\r\n")
-
-	errCh := make(chan error, 2)
-
-	// socket -> stdout
-	go func() {
-		_, err := io.Copy(os.Stdout, conn)
-		errCh <- err
-	}()
-
-	// stdin -> socket (with Ctrl+] detection)
-	go func() {
-		buf := make([]byte, 256)
-		for {
-			n, err := os.Stdin.Read(buf)
-			if err != nil {
-				errCh <- err
-				return
-			}
-			for i := 0; i < n; i++ {
-				if buf[i] == 0x1d { // Ctrl+]
-					fmt.Fprintf(os.Stdout, "\r\nDisconnected.\r\n")
-					errCh <- nil
-					return
-				}
-			}
-			if _, err := conn.Write(buf[:n]); err != nil {
-				errCh <- err
-				return
-			}
+	printWarnings(result.Warnings)
+	if explain == "json" {
+		return printJSON(os.Stdout, result.Explanation)
+	}
+	result.Explanation.WriteText(os.Stdout)
+	return nil
+}
+
+// resolveEmulation turns an --emulation mode into whether to emulate. auto
+// emulates when the host below root has no /dev/kvm.
+func resolveEmulation(mode, root string) (bool, error) {
+	switch mode {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	case "auto":
+		if preflight.HasKVM(preflight.Options{Root: root}) {
+			return false, nil
 		}
-	}()
+		fmt.Fprintln(os.Stderr, "Warning: /dev/kvm not found, falling back to software emulation")
+		return true, nil
+	}
+	return false, fmt.Errorf("emulation must be 'on', 'off' or 'auto'")
+}
 
-	<-errCh
-	return nil
+// loadDeviceMap reads the --device-map file, if any.
+func loadDeviceMap(file string) (*hostdevices.DeviceMap, error) {
+	if file == "" {
+		return nil, nil
+	}
+	return hostdevices.LoadDeviceMap(file)
+}
+
+// printWarnings prints the warnings of a transformation to stderr.
+func printWarnings(warnings []string) {
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
 }
@@ -0,0 +1,187 @@
+package console
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// CastHeader is the first line of an asciicast v2 file.
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Title     string            `json:"title,omitempty"`
+}
+
+// Recorder writes everything written to it as asciicast v2 output events.
+type Recorder struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+	now   func() time.Time
+	// pending holds a trailing partial UTF-8 sequence until the rest of it
+	// arrives; asciicast event data must be valid UTF-8.
+	pending []byte
+}
+
+// NewRecorder writes the cast header to w and returns a Recorder that appends
+// events to it. Width and height default to 80x24 and the timestamp to now.
+// Closing the Recorder closes w if it is an io.Closer.
+func NewRecorder(w io.Writer, header CastHeader) (*Recorder, error) {
+	r := &Recorder{w: w, now: time.Now}
+	r.start = r.now()
+
+	header.Version = 2
+	if header.Width == 0 {
+		header.Width = 80
+	}
+	if header.Height == 0 {
+		header.Height = 24
+	}
+	if header.Timestamp == 0 {
+		header.Timestamp = r.start.Unix()
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", data); err != nil {
+		return nil, fmt.Errorf("failed to write cast header: %v", err)
+	}
+	return r, nil
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.pending, p...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.pending = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return len(p), nil
+	}
+
+	if err := r.event(data[:cut]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close records output still held back as a partial UTF-8 sequence and
+// closes the underlying writer.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	if len(r.pending) > 0 {
+		err = r.event(r.pending)
+		r.pending = nil
+	}
+	if c, ok := r.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (r *Recorder) event(data []byte) error {
+	elapsed := r.now().Sub(r.start).Seconds()
+	event, err := json.Marshal([]interface{}{elapsed, "o", string(data)})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(r.w, "%s\n", event)
+	return err
+}
+
+// ReplayOptions controls playback speed.
+type ReplayOptions struct {
+	// Speed multiplies playback speed; values <= 0 mean real time.
+	Speed float64
+	// MaxIdle caps the pause between two events; zero means no cap.
+	MaxIdle time.Duration
+}
+
+// Replay plays the asciicast read from r to w, honouring the recorded timing.
+// Only output events are written; input and resize events are skipped.
+func Replay(ctx context.Context, r io.Reader, w io.Writer, opts ReplayOptions) (*CastHeader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("empty cast file")
+	}
+	header := &CastHeader{}
+	if err := json.Unmarshal(scanner.Bytes(), header); err != nil {
+		return nil, fmt.Errorf("invalid cast header: %v", err)
+	}
+	if header.Version != 2 {
+		return nil, fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+
+	speed := opts.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+
+	last := 0.0
+	line := 1
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			return header, fmt.Errorf("invalid event on line %d", line)
+		}
+		at, ok1 := event[0].(float64)
+		kind, ok2 := event[1].(string)
+		data, ok3 := event[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return header, fmt.Errorf("invalid event on line %d", line)
+		}
+		if kind != "o" {
+			continue
+		}
+
+		delay := time.Duration((at - last) / speed * float64(time.Second))
+		if opts.MaxIdle > 0 && delay > opts.MaxIdle {
+			delay = opts.MaxIdle
+		}
+		last = at
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return header, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+		if _, err := io.WriteString(w, data); err != nil {
+			return header, err
+		}
+	}
+	return header, scanner.Err()
+}
@@ -0,0 +1,93 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	rec, err := NewRecorder(&buf, CastHeader{Title: "test", Timestamp: 1700000000})
+	require.NoError(t, err)
+
+	clock := rec.start
+	rec.now = func() time.Time { return clock }
+
+	clock = clock.Add(500 * time.Millisecond)
+	_, err = rec.Write([]byte("login: "))
+	require.NoError(t, err)
+
+	// "é" split across two reads must be emitted as one event.
+	clock = clock.Add(time.Second)
+	_, err = rec.Write([]byte{'c', 0xc3})
+	require.NoError(t, err)
+	_, err = rec.Write([]byte{0xa9, '\r', '\n'})
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 4)
+	require.JSONEq(t, `{"version":2,"width":80,"height":24,"timestamp":1700000000,"title":"test"}`, lines[0])
+	require.JSONEq(t, `[0.5,"o","login: "]`, lines[1])
+	require.JSONEq(t, `[1.5,"o","c"]`, lines[2])
+	require.JSONEq(t, `[1.5,"o","é\r\n"]`, lines[3])
+}
+
+func TestRecorderClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	rec, err := NewRecorder(f, CastHeader{Timestamp: 1700000000})
+	require.NoError(t, err)
+	rec.now = func() time.Time { return rec.start }
+
+	_, err = rec.Write([]byte{'o', 'k', 0xc3})
+	require.NoError(t, err)
+	require.NoError(t, rec.Close())
+	_, err = f.Write([]byte("x"))
+	require.ErrorIs(t, err, os.ErrClosed, "the recording file is closed")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+	require.JSONEq(t, `[0,"o","ok"]`, lines[1])
+	require.JSONEq(t, `[0,"o","\ufffd"]`, lines[2], "a partial sequence left at the end is recorded")
+}
+
+func TestReplay(t *testing.T) {
+	cast := `{"version": 2, "width": 80, "height": 24}
+[0.1, "o", "Booting"]
+[0.2, "i", "ignored input"]
+[5.0, "o", " Linux\r\n"]
+`
+
+	t.Run("plays output events with capped idle time", func(t *testing.T) {
+		var out bytes.Buffer
+		start := time.Now()
+		header, err := Replay(context.Background(), strings.NewReader(cast), &out, ReplayOptions{Speed: 10, MaxIdle: 50 * time.Millisecond})
+		require.NoError(t, err)
+		require.Less(t, time.Since(start), 2*time.Second)
+		require.Equal(t, 80, header.Width)
+		require.Equal(t, "Booting Linux\r\n", out.String())
+	})
+
+	t.Run("stops when cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var out bytes.Buffer
+		_, err := Replay(ctx, strings.NewReader(cast), &out, ReplayOptions{})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("rejects other versions", func(t *testing.T) {
+		_, err := Replay(context.Background(), strings.NewReader(`{"version": 1}`), &bytes.Buffer{}, ReplayOptions{})
+		require.ErrorContains(t, err, "unsupported asciicast version")
+	})
+}
@@ -0,0 +1,107 @@
+package console
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// DialOptions select how a client attaches to the console proxy.
+type DialOptions struct {
+	// ReadOnly attaches as a viewer.
+	ReadOnly bool
+	// Takeover takes the write lock from the current writer.
+	Takeover bool
+}
+
+// DialProxy connects to the console proxy's WebSocket endpoint. network is
+// "unix" with address set to the path of console-proxy.sock, or "tcp" with a
+// host:port address. The returned connection carries raw console bytes.
+func DialProxy(ctx context.Context, network, address string, opts DialOptions) (io.ReadWriteCloser, error) {
+	u := url.URL{Scheme: "ws", Host: address, Path: "/console"}
+	dialer := websocket.Dialer{Subprotocols: []string{Subprotocol}}
+	if network == "unix" {
+		// The host is only used for the Host header.
+		u.Host = "localhost"
+		dialer.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", address)
+		}
+	}
+
+	q := url.Values{}
+	if opts.ReadOnly {
+		q.Set("mode", "view")
+	}
+	if opts.Takeover {
+		q.Set("takeover", "true")
+	}
+	u.RawQuery = q.Encode()
+
+	ws, resp, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect to console proxy at %s: %v (HTTP %s)", address, err, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to connect to console proxy at %s: %v", address, err)
+	}
+	return &wsConn{ws: ws}, nil
+}
+
+// wsConn adapts a WebSocket connection to a byte stream. Text frames carry
+// control messages and are skipped.
+type wsConn struct {
+	ws *websocket.Conn
+	r  io.Reader
+
+	writeMu sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			mt, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.writeMu.Lock()
+	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.writeMu.Unlock()
+	return c.ws.Close()
+}
@@ -0,0 +1,322 @@
+package console
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReadOnly     = errors.New("client is attached read-only")
+	ErrNotWriter    = errors.New("another client holds the console write lock")
+	ErrNotConnected = errors.New("serial console is not connected")
+)
+
+// clientQueueLen is the number of output chunks buffered per client. A client
+// that falls this far behind is detached so it cannot stall everyone else.
+const clientQueueLen = 256
+
+// DialFunc opens a new connection to the serial console socket.
+type DialFunc func() (net.Conn, error)
+
+// Hub keeps a single connection to the VM serial console and fans its output
+// out to every attached client. QEMU only serves one client on virt-serial0 at
+// a time, so all clients share this connection. Only one client, the writer,
+// may send input at any time; all other clients are viewers.
+type Hub struct {
+	dial       DialFunc
+	scrollback *Ring
+	retry      time.Duration
+
+	mu      sync.Mutex
+	conn    net.Conn
+	clients map[*Client]struct{}
+	writer  *Client
+	nextID  int
+	sinks   []io.Writer
+}
+
+// AttachOptions controls how a client joins the hub.
+type AttachOptions struct {
+	// Name identifies the client in logs and listings, e.g. its remote address.
+	Name string
+	// ReadOnly clients never receive the write lock.
+	ReadOnly bool
+	// Takeover moves the write lock to the new client even if it is held.
+	Takeover bool
+}
+
+// ClientInfo describes an attached client.
+type ClientInfo struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	ReadOnly    bool      `json:"readOnly"`
+	Writer      bool      `json:"writer"`
+	ConnectedAt time.Time `json:"connectedAt"`
+}
+
+func NewHub(dial DialFunc, scrollbackSize int) *Hub {
+	return &Hub{
+		dial:       dial,
+		scrollback: NewRing(scrollbackSize),
+		retry:      2 * time.Second,
+		clients:    make(map[*Client]struct{}),
+	}
+}
+
+// AddSink registers w to receive all console output, whether or not any client
+// is attached. It is used for persistent logs and recordings.
+func (h *Hub) AddSink(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sinks = append(h.sinks, w)
+}
+
+// Run connects to the serial console and pumps its output to all clients,
+// reconnecting whenever the connection drops (e.g. when the guest reboots and
+// QEMU recreates the socket). It returns when ctx is cancelled.
+func (h *Hub) Run(ctx context.Context) error {
+	for {
+		conn, err := h.dial()
+		if err != nil {
+			log.Printf("Failed to dial serial console: %v", err)
+		} else {
+			log.Printf("Connected to serial console")
+			h.pump(ctx, conn)
+			log.Printf("Serial console connection closed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(h.retry):
+		}
+	}
+}
+
+func (h *Hub) pump(ctx context.Context, conn net.Conn) {
+	h.mu.Lock()
+	h.conn = conn
+	h.mu.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, 8192)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			h.broadcast(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	h.mu.Lock()
+	h.conn = nil
+	h.mu.Unlock()
+	conn.Close()
+}
+
+func (h *Hub) broadcast(p []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.scrollback.Write(p)
+	for _, w := range h.sinks {
+		if _, err := w.Write(p); err != nil {
+			log.Printf("Failed to write console output to sink: %v", err)
+		}
+	}
+	for c := range h.clients {
+		chunk := make([]byte, len(p))
+		copy(chunk, p)
+		select {
+		case c.out <- chunk:
+		default:
+			log.Printf("Client %d (%s) is too slow, detaching", c.ID, c.Name)
+			h.detachLocked(c)
+		}
+	}
+}
+
+// Attach registers a new client. The scrollback is queued as the client's
+// first output chunk so that no output is lost or duplicated between the
+// replay and the live stream.
+func (h *Hub) Attach(opts AttachOptions) *Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	c := &Client{
+		ID:          h.nextID,
+		Name:        opts.Name,
+		ReadOnly:    opts.ReadOnly,
+		ConnectedAt: time.Now(),
+		hub:         h,
+		out:         make(chan []byte, clientQueueLen),
+	}
+	if scrollback := h.scrollback.Bytes(); len(scrollback) > 0 {
+		c.out <- scrollback
+	}
+	h.clients[c] = struct{}{}
+
+	if !c.ReadOnly && (h.writer == nil || opts.Takeover) {
+		h.setWriterLocked(c)
+	}
+	log.Printf("Client %d (%s) attached, read-only=%v writer=%v", c.ID, c.Name, c.ReadOnly, h.writer == c)
+	return c
+}
+
+// Takeover moves the write lock to c.
+func (h *Hub) Takeover(c *Client) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; !ok {
+		return errors.New("client is not attached")
+	}
+	h.setWriterLocked(c)
+	return nil
+}
+
+// Release gives up the write lock held by c, handing it to the longest
+// attached interactive client if there is one.
+func (h *Hub) Release(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.writer != c {
+		return
+	}
+	h.setWriterLocked(h.nextWriterLocked(c))
+}
+
+// Clients lists the attached clients ordered by ID.
+func (h *Hub) Clients() []ClientInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	infos := make([]ClientInfo, 0, len(h.clients))
+	for c := range h.clients {
+		infos = append(infos, ClientInfo{
+			ID:          c.ID,
+			Name:        c.Name,
+			ReadOnly:    c.ReadOnly,
+			Writer:      h.writer == c,
+			ConnectedAt: c.ConnectedAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+func (h *Hub) write(c *Client, p []byte) (int, error) {
+	if c.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	h.mu.Lock()
+	conn := h.conn
+	isWriter := h.writer == c
+	h.mu.Unlock()
+
+	if !isWriter {
+		return 0, ErrNotWriter
+	}
+	if conn == nil {
+		return 0, ErrNotConnected
+	}
+	return conn.Write(p)
+}
+
+func (h *Hub) detach(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.detachLocked(c)
+}
+
+func (h *Hub) detachLocked(c *Client) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	close(c.out)
+	if h.writer == c {
+		h.setWriterLocked(h.nextWriterLocked(c))
+	}
+	log.Printf("Client %d (%s) detached", c.ID, c.Name)
+}
+
+// nextWriterLocked picks the interactive client, other than exclude, that has
+// been attached the longest.
+func (h *Hub) nextWriterLocked(exclude *Client) *Client {
+	var next *Client
+	for c := range h.clients {
+		if c == exclude || c.ReadOnly {
+			continue
+		}
+		if next == nil || c.ID < next.ID {
+			next = c
+		}
+	}
+	return next
+}
+
+func (h *Hub) setWriterLocked(c *Client) {
+	if h.writer == c {
+		return
+	}
+	h.writer = c
+	if c != nil {
+		log.Printf("Client %d (%s) now holds the write lock", c.ID, c.Name)
+	}
+}
+
+// Client is a single attachment to a Hub.
+type Client struct {
+	ID          int
+	Name        string
+	ReadOnly    bool
+	ConnectedAt time.Time
+
+	hub *Hub
+	out chan []byte
+}
+
+// Output delivers console output, starting with the scrollback. The channel is
+// closed when the client is detached.
+func (c *Client) Output() <-chan []byte {
+	return c.out
+}
+
+// Write sends input to the serial console. It fails unless c holds the write
+// lock.
+func (c *Client) Write(p []byte) (int, error) {
+	return c.hub.write(c, p)
+}
+
+// IsWriter reports whether c currently holds the write lock.
+func (c *Client) IsWriter() bool {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	return c.hub.writer == c
+}
+
+// Close detaches c from the hub, passing on the write lock if c held it.
+func (c *Client) Close() {
+	c.hub.detach(c)
+}
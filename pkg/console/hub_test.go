@@ -0,0 +1,275 @@
+package console
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSerial is a unix socket standing in for virt-serial0.
+type fakeSerial struct {
+	ln    net.Listener
+	conns chan net.Conn
+}
+
+func newFakeSerial(t *testing.T) *fakeSerial {
+	path := filepath.Join(t.TempDir(), "virt-serial0")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	s := &fakeSerial{ln: ln, conns: make(chan net.Conn, 4)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- conn
+		}
+	}()
+	return s
+}
+
+func (s *fakeSerial) dial() (net.Conn, error) {
+	return net.Dial("unix", s.ln.Addr().String())
+}
+
+func (s *fakeSerial) accept(t *testing.T) net.Conn {
+	select {
+	case conn := <-s.conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub did not connect to the serial socket")
+		return nil
+	}
+}
+
+func startHub(t *testing.T, scrollback int) (*Hub, net.Conn) {
+	serial := newFakeSerial(t)
+	hub := NewHub(serial.dial, scrollback)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go hub.Run(ctx)
+	return hub, serial.accept(t)
+}
+
+func readOutput(t *testing.T, c *Client, want string) {
+	var got strings.Builder
+	deadline := time.After(5 * time.Second)
+	for !strings.Contains(got.String(), want) {
+		select {
+		case data, ok := <-c.Output():
+			require.True(t, ok, "client detached while waiting for %q, got %q", want, got.String())
+			got.Write(data)
+		case <-deadline:
+			t.Fatalf("timed out waiting for %q, got %q", want, got.String())
+		}
+	}
+}
+
+func readInput(t *testing.T, conn net.Conn, want string) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(want))
+	_, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, want, string(buf))
+}
+
+func TestRing(t *testing.T) {
+	t.Run("keeps everything until full", func(t *testing.T) {
+		r := NewRing(8)
+		r.Write([]byte("abc"))
+		r.Write([]byte("de"))
+		require.Equal(t, "abcde", string(r.Bytes()))
+	})
+
+	t.Run("drops oldest bytes on wrap", func(t *testing.T) {
+		r := NewRing(8)
+		r.Write([]byte("abcdef"))
+		r.Write([]byte("ghij"))
+		require.Equal(t, "cdefghij", string(r.Bytes()))
+		r.Write([]byte("kl"))
+		require.Equal(t, "efghijkl", string(r.Bytes()))
+	})
+
+	t.Run("write larger than buffer keeps the tail", func(t *testing.T) {
+		r := NewRing(4)
+		r.Write([]byte("abcdefgh"))
+		require.Equal(t, "efgh", string(r.Bytes()))
+	})
+
+	t.Run("zero size keeps nothing", func(t *testing.T) {
+		r := NewRing(0)
+		n, err := r.Write([]byte("abc"))
+		require.NoError(t, err)
+		require.Equal(t, 3, n)
+		require.Empty(t, r.Bytes())
+	})
+}
+
+func TestHub(t *testing.T) {
+	t.Run("fans output out to every client", func(t *testing.T) {
+		hub, serial := startHub(t, 1024)
+		a := hub.Attach(AttachOptions{Name: "a"})
+		b := hub.Attach(AttachOptions{Name: "b", ReadOnly: true})
+
+		_, err := serial.Write([]byte("login: "))
+		require.NoError(t, err)
+		readOutput(t, a, "login: ")
+		readOutput(t, b, "login: ")
+	})
+
+	t.Run("replays scrollback to late clients", func(t *testing.T) {
+		hub, serial := startHub(t, 1024)
+		early := hub.Attach(AttachOptions{Name: "early"})
+		_, err := serial.Write([]byte("Booting Linux"))
+		require.NoError(t, err)
+		readOutput(t, early, "Booting Linux")
+
+		late := hub.Attach(AttachOptions{Name: "late"})
+		readOutput(t, late, "Booting Linux")
+	})
+
+	t.Run("only the writer sends input", func(t *testing.T) {
+		hub, serial := startHub(t, 1024)
+		writer := hub.Attach(AttachOptions{Name: "writer"})
+		second := hub.Attach(AttachOptions{Name: "second"})
+		viewer := hub.Attach(AttachOptions{Name: "viewer", ReadOnly: true})
+
+		require.Eventually(t, func() bool {
+			_, err := writer.Write([]byte("ls\n"))
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		readInput(t, serial, "ls\n")
+
+		_, err := second.Write([]byte("x"))
+		require.ErrorIs(t, err, ErrNotWriter)
+		_, err = viewer.Write([]byte("x"))
+		require.ErrorIs(t, err, ErrReadOnly)
+	})
+
+	t.Run("write lock can be taken over and released", func(t *testing.T) {
+		hub, _ := startHub(t, 1024)
+		first := hub.Attach(AttachOptions{Name: "first"})
+		second := hub.Attach(AttachOptions{Name: "second"})
+		viewer := hub.Attach(AttachOptions{Name: "viewer", ReadOnly: true})
+		require.True(t, first.IsWriter())
+
+		require.NoError(t, hub.Takeover(second))
+		require.True(t, second.IsWriter())
+		require.False(t, first.IsWriter())
+		require.ErrorIs(t, hub.Takeover(viewer), ErrReadOnly)
+
+		hub.Release(second)
+		require.True(t, first.IsWriter())
+
+		third := hub.Attach(AttachOptions{Name: "third", Takeover: true})
+		require.True(t, third.IsWriter())
+	})
+
+	t.Run("write lock passes on when the writer detaches", func(t *testing.T) {
+		hub, _ := startHub(t, 1024)
+		first := hub.Attach(AttachOptions{Name: "first"})
+		hub.Attach(AttachOptions{Name: "viewer", ReadOnly: true})
+		second := hub.Attach(AttachOptions{Name: "second"})
+
+		first.Close()
+		require.True(t, second.IsWriter())
+		_, ok := <-first.Output()
+		require.False(t, ok, "output channel should be closed after detach")
+
+		infos := hub.Clients()
+		require.Len(t, infos, 2)
+		require.Equal(t, "viewer", infos[0].Name)
+		require.True(t, infos[1].Writer)
+	})
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	hub, serial := startHub(t, 1024)
+	srv := httptest.NewServer(NewWebSocketHandler(hub))
+	defer srv.Close()
+
+	dial := func(query string) *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/console" + query
+		dialer := websocket.Dialer{Subprotocols: []string{Subprotocol}}
+		ws, _, err := dialer.Dial(url, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { ws.Close() })
+		return ws
+	}
+	expect := func(ws *websocket.Conn, want string) {
+		var got strings.Builder
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for !strings.Contains(got.String(), want) {
+			mt, data, err := ws.ReadMessage()
+			require.NoError(t, err)
+			require.Equal(t, websocket.BinaryMessage, mt)
+			got.Write(data)
+		}
+	}
+
+	_, err := serial.Write([]byte("Welcome\r\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return strings.Contains(string(hub.scrollback.Bytes()), "Welcome")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	writer := dial("")
+	viewer := dial("?mode=view")
+	expect(writer, "Welcome")
+	expect(viewer, "Welcome")
+
+	require.NoError(t, viewer.WriteMessage(websocket.BinaryMessage, []byte("ignored")))
+	require.NoError(t, writer.WriteMessage(websocket.BinaryMessage, []byte("root\n")))
+	readInput(t, serial, "root\n")
+
+	_, err = serial.Write([]byte("Password: "))
+	require.NoError(t, err)
+	expect(writer, "Password: ")
+	expect(viewer, "Password: ")
+
+	require.Eventually(t, func() bool {
+		infos := hub.Clients()
+		return len(infos) == 2 && infos[0].Writer && infos[1].ReadOnly
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDialProxy(t *testing.T) {
+	hub, serial := startHub(t, 1024)
+
+	sockPath := filepath.Join(t.TempDir(), "console-proxy.sock")
+	ln, err := net.Listen("unix", sockPath)
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(NewWebSocketHandler(hub))
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := DialProxy(context.Background(), "unix", sockPath, DialOptions{})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = serial.Write([]byte("login: "))
+	require.NoError(t, err)
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "login: ", string(buf[:n]))
+
+	_, err = conn.Write([]byte("root\n"))
+	require.NoError(t, err)
+	readInput(t, serial, "root\n")
+
+	_, err = DialProxy(context.Background(), "unix", filepath.Join(t.TempDir(), "missing.sock"), DialOptions{})
+	require.Error(t, err)
+}
@@ -0,0 +1,231 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an append-only log file that is rotated once it grows past
+// maxSize bytes. Rotated files are kept as path.1 (newest) to path.N.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending. A maxSize of zero disables
+// rotation; maxFiles is the number of rotated files to keep.
+func OpenRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the log aside and opens a new one. Whatever fails, the log
+// is reopened at path, so later writes append to it instead of failing.
+func (r *RotatingFile) rotate() error {
+	closeErr := r.f.Close()
+	r.f = nil
+	err := r.shift()
+	if err == nil {
+		err = closeErr
+	}
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// shift renames path.N to path.N+1 and path to path.1, dropping the oldest.
+func (r *RotatingFile) shift() error {
+	if r.maxFiles <= 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", r.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", r.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(r.path, r.path+".1")
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// TimestampWriter prefixes every line written through it with the time at
+// which its first byte arrived.
+type TimestampWriter struct {
+	w       io.Writer
+	now     func() time.Time
+	midLine bool
+}
+
+func NewTimestampWriter(w io.Writer) *TimestampWriter {
+	return &TimestampWriter{w: w, now: time.Now}
+}
+
+func (t *TimestampWriter) Write(p []byte) (int, error) {
+	var out bytes.Buffer
+	rest := p
+	for len(rest) > 0 {
+		if !t.midLine {
+			out.WriteString(t.now().UTC().Format(time.RFC3339Nano))
+			out.WriteByte(' ')
+			t.midLine = true
+		}
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			out.Write(rest)
+			break
+		}
+		out.Write(rest[:i+1])
+		rest = rest[i+1:]
+		t.midLine = false
+	}
+	if _, err := t.w.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Tail writes the last lines of the file at path to w; a negative lines
+// writes the whole file. With follow set it keeps copying new output until
+// ctx is cancelled, reopening the file whenever it is rotated.
+func Tail(ctx context.Context, path string, lines int, follow bool, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(lastLines(data, lines)); err != nil {
+		return err
+	}
+	if !follow {
+		return nil
+	}
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+
+		// Detect rotation: the path now names a different file, or the file
+		// was truncated below what we have already read.
+		current, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		opened, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if os.SameFile(current, opened) && current.Size() >= offset {
+			continue
+		}
+
+		next, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		f.Close()
+		f = next
+	}
+}
+
+func lastLines(data []byte, n int) []byte {
+	if n < 0 {
+		return data
+	}
+	if n == 0 {
+		return nil
+	}
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if data[i] == '\n' {
+			n--
+			if n == 0 {
+				return data[i+1:]
+			}
+		}
+	}
+	return data
+}
@@ -0,0 +1,156 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer that is safe to read while Tail writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRotatingFile(t *testing.T) {
+	t.Run("rotates once the size limit is reached", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "serial.log")
+		f, err := OpenRotatingFile(path, 10, 2)
+		require.NoError(t, err)
+		defer f.Close()
+
+		for _, chunk := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+			_, err := f.Write([]byte(chunk))
+			require.NoError(t, err)
+		}
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "dddddddd\n", string(data))
+		data, err = os.ReadFile(path + ".1")
+		require.NoError(t, err)
+		require.Equal(t, "cccccccc\n", string(data))
+		data, err = os.ReadFile(path + ".2")
+		require.NoError(t, err)
+		require.Equal(t, "bbbbbbbb\n", string(data))
+		require.NoFileExists(t, path+".3")
+	})
+
+	t.Run("keeps writing when rotation fails", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "serial.log")
+		f, err := OpenRotatingFile(path, 10, 1)
+		require.NoError(t, err)
+		defer f.Close()
+
+		// A directory in the way of serial.log.1 makes the rename fail.
+		require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "busy"), 0755))
+		_, err = f.Write([]byte("aaaaaaaa\n"))
+		require.NoError(t, err)
+		_, err = f.Write([]byte("bbbbbbbb\n"))
+		require.Error(t, err)
+
+		require.NoError(t, os.RemoveAll(path+".1"))
+		_, err = f.Write([]byte("cccccccc\n"))
+		require.NoError(t, err, "the log is reopened after the failed rotation")
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "cccccccc\n", string(data))
+		data, err = os.ReadFile(path + ".1")
+		require.NoError(t, err)
+		require.Equal(t, "aaaaaaaa\n", string(data))
+	})
+
+	t.Run("appends to an existing log", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "serial.log")
+		require.NoError(t, os.WriteFile(path, []byte("before restart\n"), 0644))
+
+		f, err := OpenRotatingFile(path, 0, 0)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("after restart\n"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "before restart\nafter restart\n", string(data))
+	})
+}
+
+func TestTimestampWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewTimestampWriter(&buf)
+	w.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	_, err := w.Write([]byte("Booting"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte(" Linux\nlogin: "))
+	require.NoError(t, err)
+
+	require.Equal(t, "2024-01-02T03:04:05Z Booting Linux\n2024-01-02T03:04:05Z login: ", buf.String())
+}
+
+func TestTail(t *testing.T) {
+	t.Run("prints the last lines", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "serial.log")
+		require.NoError(t, os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0644))
+
+		var buf bytes.Buffer
+		require.NoError(t, Tail(context.Background(), path, 2, false, &buf))
+		require.Equal(t, "two\nthree\n", buf.String())
+
+		buf.Reset()
+		require.NoError(t, Tail(context.Background(), path, -1, false, &buf))
+		require.Equal(t, "one\ntwo\nthree\n", buf.String())
+	})
+
+	t.Run("follows across rotation", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "serial.log")
+		f, err := OpenRotatingFile(path, 16, 1)
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.Write([]byte("first line\n"))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var out syncBuffer
+		done := make(chan error)
+		go func() { done <- Tail(ctx, path, -1, true, &out) }()
+
+		require.Eventually(t, func() bool {
+			return strings.Contains(out.String(), "first line")
+		}, 5*time.Second, 10*time.Millisecond)
+
+		_, err = f.Write([]byte("second line\n"))
+		require.NoError(t, err)
+		require.FileExists(t, path+".1")
+
+		require.Eventually(t, func() bool {
+			return strings.Contains(out.String(), "second line")
+		}, 5*time.Second, 10*time.Millisecond)
+
+		cancel()
+		require.NoError(t, <-done)
+		require.Equal(t, "first line\nsecond line\n", out.String())
+	})
+}
@@ -0,0 +1,72 @@
+package console
+
+import "sync"
+
+// Ring is a fixed-size byte buffer that keeps the most recent output written
+// to it. It is used as scrollback so that clients attaching late still see
+// boot messages that were printed before they connected.
+type Ring struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int
+	// start is the index of the oldest byte, full reports whether buf has
+	// wrapped at least once.
+	start int
+	full  bool
+}
+
+func NewRing(size int) *Ring {
+	if size < 0 {
+		size = 0
+	}
+	return &Ring{buf: make([]byte, 0, size), size: size}
+}
+
+// Write appends p, discarding the oldest bytes once the buffer is full.
+func (r *Ring) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(p)
+	if r.size == 0 {
+		return n, nil
+	}
+	if len(p) >= r.size {
+		r.buf = append(r.buf[:0], p[len(p)-r.size:]...)
+		r.start = 0
+		r.full = true
+		return n, nil
+	}
+
+	if !r.full {
+		free := r.size - len(r.buf)
+		if len(p) <= free {
+			r.buf = append(r.buf, p...)
+			return n, nil
+		}
+		r.buf = append(r.buf, p[:free]...)
+		p = p[free:]
+		r.full = true
+		r.start = 0
+	}
+
+	for len(p) > 0 {
+		c := copy(r.buf[r.start:], p)
+		p = p[c:]
+		r.start = (r.start + c) % r.size
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the buffered output, oldest byte first.
+func (r *Ring) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]byte, 0, len(r.buf))
+	if !r.full {
+		return append(out, r.buf...)
+	}
+	out = append(out, r.buf[r.start:]...)
+	return append(out, r.buf[:r.start]...)
+}
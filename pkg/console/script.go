@@ -0,0 +1,296 @@
+package console
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exit codes returned by non-interactive console sessions, so that scripts can
+// tell a hung guest from a wrong password.
+const (
+	ExitOK          = 0
+	ExitError       = 1
+	ExitTimeout     = 2
+	ExitLoginFailed = 3
+)
+
+var (
+	ErrTimeout     = errors.New("timed out")
+	ErrLoginFailed = errors.New("login failed")
+)
+
+// ExitCode maps an error returned by a Session to a process exit code.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrTimeout):
+		return ExitTimeout
+	case errors.Is(err, ErrLoginFailed):
+		return ExitLoginFailed
+	default:
+		return ExitError
+	}
+}
+
+// maxSessionBuffer bounds the output kept for matching; older output is
+// discarded.
+const maxSessionBuffer = 1024 * 1024
+
+var (
+	loginPrompt    = regexp.MustCompile(`(?i)login:\s*$`)
+	passwordPrompt = regexp.MustCompile(`(?i)password:\s*$`)
+	shellPrompt    = regexp.MustCompile(`[#$>]\s*$`)
+	loginIncorrect = regexp.MustCompile(`(?i)login incorrect`)
+)
+
+// Step is one action of a console script.
+type Step struct {
+	// Action is one of expect, send, login or sleep.
+	Action string
+	Value  string
+}
+
+// ParseStep parses a step written as action=value, e.g. "expect=login:",
+// "send=uname -a", "login=cirros:gocubsgo" or "sleep=2s".
+func ParseStep(s string) (Step, error) {
+	action, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return Step{}, fmt.Errorf("invalid step %q: expected action=value", s)
+	}
+	step := Step{Action: action, Value: value}
+	switch action {
+	case "expect":
+		if _, err := regexp.Compile(value); err != nil {
+			return Step{}, fmt.Errorf("invalid expect pattern %q: %v", value, err)
+		}
+	case "send":
+	case "login":
+		if _, _, ok := strings.Cut(value, ":"); !ok {
+			return Step{}, fmt.Errorf("invalid login step %q: expected user:password", s)
+		}
+	case "sleep":
+		if _, err := time.ParseDuration(value); err != nil {
+			return Step{}, fmt.Errorf("invalid sleep duration %q: %v", value, err)
+		}
+	default:
+		return Step{}, fmt.Errorf("unknown step action %q (expected expect, send, login or sleep)", action)
+	}
+	return step, nil
+}
+
+// Session drives a serial console programmatically. All console output is
+// echoed to the writer given to NewSession and kept for matching by Expect.
+type Session struct {
+	w io.Writer
+
+	mu     sync.Mutex
+	buf    []byte
+	err    error
+	notify chan struct{}
+}
+
+func NewSession(conn io.ReadWriter, echo io.Writer) *Session {
+	s := &Session{w: conn, notify: make(chan struct{}, 1)}
+	go s.read(conn, echo)
+	return s
+}
+
+func (s *Session) read(r io.Reader, echo io.Writer) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		s.mu.Lock()
+		if n > 0 {
+			if echo != nil {
+				echo.Write(buf[:n])
+			}
+			s.buf = append(s.buf, buf[:n]...)
+			if len(s.buf) > maxSessionBuffer {
+				s.buf = s.buf[len(s.buf)-maxSessionBuffer:]
+			}
+		}
+		if err != nil {
+			s.err = err
+		}
+		s.mu.Unlock()
+
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Expect waits until output matching re arrives and returns the match.
+// Output up to the end of the match is consumed.
+func (s *Session) Expect(re *regexp.Regexp, timeout time.Duration) (string, error) {
+	_, match, err := s.ExpectAny([]*regexp.Regexp{re}, timeout)
+	return match, err
+}
+
+// ExpectAny waits until one of patterns matches and returns its index. If
+// several match, the one matching earliest in the output wins.
+func (s *Session) ExpectAny(patterns []*regexp.Regexp, timeout time.Duration) (int, string, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		s.mu.Lock()
+		best, bestLoc := -1, []int(nil)
+		for i, re := range patterns {
+			if loc := re.FindIndex(s.buf); loc != nil && (bestLoc == nil || loc[0] < bestLoc[0]) {
+				best, bestLoc = i, loc
+			}
+		}
+		if best >= 0 {
+			match := string(s.buf[bestLoc[0]:bestLoc[1]])
+			s.buf = s.buf[bestLoc[1]:]
+			s.mu.Unlock()
+			return best, match, nil
+		}
+		readErr := s.err
+		s.mu.Unlock()
+
+		if readErr != nil {
+			return -1, "", fmt.Errorf("console closed while waiting for %s: %v", describePatterns(patterns), readErr)
+		}
+		select {
+		case <-s.notify:
+		case <-deadline.C:
+			return -1, "", fmt.Errorf("%w after %v waiting for %s", ErrTimeout, timeout, describePatterns(patterns))
+		}
+	}
+}
+
+// Send writes text to the console as is.
+func (s *Session) Send(text string) error {
+	_, err := io.WriteString(s.w, text)
+	return err
+}
+
+// SendLine writes line followed by a carriage return, like pressing Enter.
+func (s *Session) SendLine(line string) error {
+	return s.Send(line + "\r")
+}
+
+// Login logs in at a getty prompt. If a shell prompt shows up instead, the
+// console is assumed to be logged in already.
+func (s *Session) Login(user, password string, timeout time.Duration) error {
+	if err := s.Send("\r"); err != nil {
+		return err
+	}
+	idx, _, err := s.ExpectAny([]*regexp.Regexp{loginPrompt, shellPrompt}, timeout)
+	if err != nil {
+		return err
+	}
+	if idx == 1 {
+		return nil
+	}
+
+	if err := s.SendLine(user); err != nil {
+		return err
+	}
+	if _, err := s.Expect(passwordPrompt, timeout); err != nil {
+		return err
+	}
+	if err := s.SendLine(password); err != nil {
+		return err
+	}
+	idx, _, err = s.ExpectAny([]*regexp.Regexp{shellPrompt, loginIncorrect, loginPrompt}, timeout)
+	if err != nil {
+		return err
+	}
+	if idx != 0 {
+		return fmt.Errorf("%w for user %s", ErrLoginFailed, user)
+	}
+	return nil
+}
+
+// Run executes steps in order, applying timeout to every expect and login.
+func (s *Session) Run(steps []Step, timeout time.Duration) error {
+	for _, step := range steps {
+		var err error
+		switch step.Action {
+		case "expect":
+			_, err = s.Expect(regexp.MustCompile(step.Value), timeout)
+		case "send":
+			err = s.SendLine(step.Value)
+		case "login":
+			user, password, _ := strings.Cut(step.Value, ":")
+			err = s.Login(user, password, timeout)
+		case "sleep":
+			d, _ := time.ParseDuration(step.Value)
+			time.Sleep(d)
+		default:
+			err = fmt.Errorf("unknown step action %q", step.Action)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pipe copies in to the console and console output to out. Once in is
+// exhausted it keeps copying output until none has arrived for drain.
+func Pipe(conn io.ReadWriter, in io.Reader, out io.Writer, drain time.Duration) error {
+	activity := make(chan struct{}, 1)
+	readErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				out.Write(buf[:n])
+				select {
+				case activity <- struct{}{}:
+				default:
+				}
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	if _, err := io.Copy(conn, in); err != nil {
+		return err
+	}
+
+	idle := time.NewTimer(drain)
+	defer idle.Stop()
+	for {
+		select {
+		case <-activity:
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(drain)
+		case <-idle.C:
+			return nil
+		case err := <-readErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func describePatterns(patterns []*regexp.Regexp) string {
+	quoted := make([]string, len(patterns))
+	for i, re := range patterns {
+		quoted[i] = fmt.Sprintf("%q", re.String())
+	}
+	return strings.Join(quoted, " or ")
+}
@@ -0,0 +1,122 @@
+package console
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGuest emulates a getty on the far end of a pipe. Every line it receives
+// is answered by respond.
+func fakeGuest(t *testing.T, respond func(line string) string) net.Conn {
+	client, guest := net.Pipe()
+	t.Cleanup(func() { client.Close(); guest.Close() })
+
+	go func() {
+		r := bufio.NewReader(guest)
+		for {
+			line, err := r.ReadString('\r')
+			if err != nil {
+				return
+			}
+			if reply := respond(strings.TrimSuffix(line, "\r")); reply != "" {
+				if _, err := guest.Write([]byte(reply)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return client
+}
+
+func getty(password string) func(string) string {
+	state := "login"
+	return func(line string) string {
+		switch {
+		case state == "login" && line == "":
+			return "\r\ncirros login: "
+		case state == "login":
+			state = "password"
+			return line + "\r\nPassword: "
+		case state == "password" && line == password:
+			state = "shell"
+			return "\r\n$ "
+		case state == "password":
+			state = "login"
+			return "\r\nLogin incorrect\r\ncirros login: "
+		case line == "uname":
+			return "uname\r\nLinux\r\n$ "
+		default:
+			return line + "\r\n$ "
+		}
+	}
+}
+
+func TestParseStep(t *testing.T) {
+	step, err := ParseStep("send=echo a=b")
+	require.NoError(t, err)
+	require.Equal(t, Step{Action: "send", Value: "echo a=b"}, step)
+
+	_, err = ParseStep("login=cirros:gocubsgo")
+	require.NoError(t, err)
+
+	for _, bad := range []string{"expect", "expect=(", "login=cirros", "sleep=soon", "type=x"} {
+		_, err := ParseStep(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestSession(t *testing.T) {
+	t.Run("logs in and runs commands", func(t *testing.T) {
+		s := NewSession(fakeGuest(t, getty("gocubsgo")), nil)
+
+		err := s.Run([]Step{
+			{Action: "login", Value: "cirros:gocubsgo"},
+			{Action: "send", Value: "uname"},
+			{Action: "expect", Value: "Linux"},
+		}, 5*time.Second)
+		require.NoError(t, err)
+	})
+
+	t.Run("reports a wrong password", func(t *testing.T) {
+		s := NewSession(fakeGuest(t, getty("gocubsgo")), nil)
+		err := s.Login("cirros", "wrong", 5*time.Second)
+		require.ErrorIs(t, err, ErrLoginFailed)
+		require.Equal(t, ExitLoginFailed, ExitCode(err))
+	})
+
+	t.Run("skips login at a shell prompt", func(t *testing.T) {
+		s := NewSession(fakeGuest(t, func(string) string { return "\r\n# " }), nil)
+		require.NoError(t, s.Login("root", "", 5*time.Second))
+	})
+
+	t.Run("times out when nothing matches", func(t *testing.T) {
+		s := NewSession(fakeGuest(t, func(string) string { return "" }), nil)
+		_, err := s.Expect(regexp.MustCompile("never"), 50*time.Millisecond)
+		require.ErrorIs(t, err, ErrTimeout)
+		require.Equal(t, ExitTimeout, ExitCode(err))
+	})
+
+	t.Run("earliest match wins", func(t *testing.T) {
+		s := NewSession(fakeGuest(t, func(string) string { return "first second" }), nil)
+		require.NoError(t, s.SendLine(""))
+		idx, match, err := s.ExpectAny([]*regexp.Regexp{regexp.MustCompile("second"), regexp.MustCompile("first")}, 5*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, 1, idx)
+		require.Equal(t, "first", match)
+	})
+}
+
+func TestPipe(t *testing.T) {
+	conn := fakeGuest(t, func(line string) string { return "echo: " + line + "\r\n" })
+	var out bytes.Buffer
+	err := Pipe(conn, strings.NewReader("hello\r"), &out, 200*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, "echo: hello\r\n", out.String())
+}
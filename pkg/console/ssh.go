@@ -0,0 +1,211 @@
+package console
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Commands an SSH client may run instead of a shell to choose how it attaches,
+// e.g. "ssh -p 2222 console@host view".
+const (
+	SSHCommandConsole  = "console"
+	SSHCommandView     = "view"
+	SSHCommandTakeover = "takeover"
+)
+
+// LoadAuthorizedKeys parses an OpenSSH authorized_keys file.
+func LoadAuthorizedKeys(path string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorized keys: %v", err)
+	}
+
+	var keys []ssh.PublicKey
+	for len(data) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// ParseAuthorizedKey skips blank lines and comments, so
+			// this is only reached when nothing is left to parse.
+			break
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", path)
+	}
+	return keys, nil
+}
+
+// LoadHostKey reads a PEM encoded private host key. Without a path an
+// ephemeral ed25519 key is generated, which clients will see change on every
+// restart.
+func LoadHostKey(path string) (ssh.Signer, error) {
+	if path == "" {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate host key: %v", err)
+		}
+		return ssh.NewSignerFromKey(priv)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key %s: %v", path, err)
+	}
+	return signer, nil
+}
+
+// NewSSHServerConfig returns a server configuration that only accepts public
+// key authentication with one of authorized.
+func NewSSHServerConfig(hostKey ssh.Signer, authorized []ssh.PublicKey) *ssh.ServerConfig {
+	allowed := make(map[string]struct{}, len(authorized))
+	for _, k := range authorized {
+		allowed[string(k.Marshal())] = struct{}{}
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if _, ok := allowed[string(key.Marshal())]; ok {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", meta.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+	return config
+}
+
+// ServeSSH accepts SSH connections on ln and bridges every session to a hub
+// client, with the same write lock semantics as the WebSocket endpoint.
+func ServeSSH(ln net.Listener, hub *Hub, config *ssh.ServerConfig) error {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSSHConn(nc, hub, config)
+	}
+}
+
+func serveSSHConn(nc net.Conn, hub *Hub, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		log.Printf("SSH handshake with %s failed: %v", nc.RemoteAddr(), err)
+		nc.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	name := fmt.Sprintf("ssh:%s@%s", sconn.User(), sconn.RemoteAddr())
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, requests, err := newCh.Accept()
+		if err != nil {
+			log.Printf("Failed to accept SSH channel from %s: %v", name, err)
+			continue
+		}
+		go serveSSHSession(ch, requests, hub, name)
+	}
+}
+
+// serveSSHSession waits for a shell or exec request and then bridges the
+// channel to the console. A PTY is accepted but not needed: the terminal is on
+// the guest's side of the serial line.
+func serveSSHSession(ch ssh.Channel, requests <-chan *ssh.Request, hub *Hub, name string) {
+	defer ch.Close()
+
+	var opts AttachOptions
+	started := false
+	for req := range requests {
+		switch req.Type {
+		case "shell":
+			started = true
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			switch payload.Command {
+			case "", SSHCommandConsole:
+			case SSHCommandView:
+				opts.ReadOnly = true
+			case SSHCommandTakeover:
+				opts.Takeover = true
+			default:
+				fmt.Fprintf(ch.Stderr(), "unknown command %q (expected %s, %s or %s)\r\n",
+					payload.Command, SSHCommandConsole, SSHCommandView, SSHCommandTakeover)
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+		case "pty-req", "env", "window-change":
+		default:
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		if started {
+			break
+		}
+	}
+	if !started {
+		return
+	}
+	go func() {
+		for req := range requests {
+			req.Reply(req.Type == "window-change", nil)
+		}
+	}()
+
+	opts.Name = name
+	client := hub.Attach(opts)
+	defer client.Close()
+
+	// SSH -> console
+	go func() {
+		defer client.Close()
+		buf := make([]byte, 1024)
+		for {
+			n, err := ch.Read(buf)
+			if n > 0 {
+				if _, werr := client.Write(buf[:n]); werr != nil &&
+					!errors.Is(werr, ErrReadOnly) && !errors.Is(werr, ErrNotWriter) && !errors.Is(werr, ErrNotConnected) {
+					log.Printf("Failed to write to serial console: %v", werr)
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("SSH session %s: %v", name, err)
+				}
+				return
+			}
+		}
+	}()
+
+	// console -> SSH, until the client is detached
+	for data := range client.Output() {
+		if _, err := ch.Write(data); err != nil {
+			client.Close()
+			break
+		}
+	}
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+}
@@ -0,0 +1,139 @@
+package console
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSSHKey(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+func startSSHServer(t *testing.T, hub *Hub, authorized ...ssh.PublicKey) string {
+	hostKey, err := LoadHostKey("")
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go ServeSSH(ln, hub, NewSSHServerConfig(hostKey, authorized))
+	return ln.Addr().String()
+}
+
+func dialSSH(addr string, key ssh.Signer) (*ssh.Client, error) {
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "console",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// sshSession starts a session running command, or a shell if it is empty.
+func sshSession(t *testing.T, client *ssh.Client, command string) (io.Writer, io.Reader) {
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	t.Cleanup(func() { session.Close() })
+
+	stdin, err := session.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := session.StdoutPipe()
+	require.NoError(t, err)
+
+	if command == "" {
+		require.NoError(t, session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}))
+		require.NoError(t, session.Shell())
+	} else {
+		require.NoError(t, session.Start(command))
+	}
+	return stdin, stdout
+}
+
+func expectSSH(t *testing.T, r io.Reader, want string) {
+	got := make(chan string, 1)
+	go func() {
+		var sb strings.Builder
+		buf := make([]byte, 256)
+		for !strings.Contains(sb.String(), want) {
+			n, err := r.Read(buf)
+			sb.Write(buf[:n])
+			if err != nil {
+				break
+			}
+		}
+		got <- sb.String()
+	}()
+	select {
+	case s := <-got:
+		require.Contains(t, s, want)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+func TestLoadAuthorizedKeys(t *testing.T) {
+	key := newSSHKey(t)
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	content := "# admins\n\n" + string(ssh.MarshalAuthorizedKey(key.PublicKey()))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+	keys, err := LoadAuthorizedKeys(path)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, key.PublicKey().Marshal(), keys[0].Marshal())
+
+	require.NoError(t, os.WriteFile(path, []byte("# nobody\n"), 0600))
+	_, err = LoadAuthorizedKeys(path)
+	require.Error(t, err)
+}
+
+func TestSSHGateway(t *testing.T) {
+	hub, serial := startHub(t, 1024)
+	key := newSSHKey(t)
+	addr := startSSHServer(t, hub, key.PublicKey())
+
+	_, err := dialSSH(addr, newSSHKey(t))
+	require.Error(t, err, "unknown keys must be rejected")
+
+	client, err := dialSSH(addr, key)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = serial.Write([]byte("login: "))
+	require.NoError(t, err)
+
+	writerIn, writerOut := sshSession(t, client, "")
+	viewerIn, viewerOut := sshSession(t, client, SSHCommandView)
+	expectSSH(t, writerOut, "login: ")
+	expectSSH(t, viewerOut, "login: ")
+
+	_, err = viewerIn.Write([]byte("ignored"))
+	require.NoError(t, err)
+	_, err = writerIn.Write([]byte("root\n"))
+	require.NoError(t, err)
+	readInput(t, serial, "root\n")
+
+	require.Eventually(t, func() bool {
+		infos := hub.Clients()
+		return len(infos) == 2 && infos[0].Writer && infos[1].ReadOnly
+	}, 5*time.Second, 10*time.Millisecond)
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+	require.Error(t, session.Run("rm -rf /"), "arbitrary commands must be refused")
+}
@@ -0,0 +1,167 @@
+package console
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// DefaultEscape is the escape sequence that ends an interactive session.
+const DefaultEscape = "^]"
+
+// ParseEscape parses an escape sequence. Caret notation denotes control
+// characters ("^]" is Ctrl+], "^A" is Ctrl+A), "^^" is a literal caret and
+// everything else is taken literally, so "~." works like in ssh. "none"
+// disables the escape sequence.
+func ParseEscape(s string) ([]byte, error) {
+	if s == "none" {
+		return nil, nil
+	}
+	if s == "" {
+		return nil, fmt.Errorf("escape sequence must not be empty (use \"none\" to disable it)")
+	}
+
+	var seq []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '^' {
+			seq = append(seq, s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			return nil, fmt.Errorf("invalid escape sequence %q: trailing ^", s)
+		}
+		i++
+		c := strings.ToUpper(s[i : i+1])[0]
+		switch {
+		case c == '^':
+			seq = append(seq, '^')
+		case c == '?':
+			seq = append(seq, 0x7f)
+		case c >= '@' && c <= '_':
+			seq = append(seq, c-'@')
+		default:
+			return nil, fmt.Errorf("invalid escape sequence %q: ^%c is not a control character", s, s[i])
+		}
+	}
+	return seq, nil
+}
+
+// EscapeFilter watches keyboard input for an escape sequence. Bytes that may
+// start the sequence are held back until it is clear whether they do.
+type EscapeFilter struct {
+	seq     []byte
+	matched int
+	// fallback[i] is the length of the longest proper prefix of seq[:i+1]
+	// that is also a suffix of it: how much of a partial match still counts
+	// when the next byte does not continue it.
+	fallback []int
+}
+
+func NewEscapeFilter(seq []byte) *EscapeFilter {
+	f := &EscapeFilter{seq: seq, fallback: make([]int, len(seq))}
+	for i, k := 1, 0; i < len(seq); i++ {
+		for k > 0 && seq[i] != seq[k] {
+			k = f.fallback[k-1]
+		}
+		if seq[i] == seq[k] {
+			k++
+		}
+		f.fallback[i] = k
+	}
+	return f
+}
+
+// Filter returns the input to forward and whether the escape sequence was
+// completed. Input following the sequence is dropped.
+func (f *EscapeFilter) Filter(p []byte) ([]byte, bool) {
+	if len(f.seq) == 0 {
+		return p, false
+	}
+
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		// Forward the held back bytes that can no longer start the
+		// sequence, keeping those that still can.
+		for f.matched > 0 && b != f.seq[f.matched] {
+			next := f.fallback[f.matched-1]
+			out = append(out, f.seq[:f.matched-next]...)
+			f.matched = next
+		}
+		if b == f.seq[f.matched] {
+			f.matched++
+			if f.matched == len(f.seq) {
+				f.matched = 0
+				return out, true
+			}
+			continue
+		}
+		out = append(out, b)
+	}
+	return out, false
+}
+
+// Interactive connects the terminal in/out to conn until escape is typed, the
+// connection closes or the process gets SIGINT or SIGTERM. The terminal is put in raw mode for the duration.
+func Interactive(conn io.ReadWriter, in *os.File, out io.Writer, escape []byte, escapeName string) error {
+	oldState, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return fmt.Errorf("failed to set raw terminal: %v", err)
+	}
+	defer term.Restore(int(in.Fd()), oldState)
+
+	// A signal ends the session like the escape sequence, so the terminal
+	// is restored and the caller can close what it opened for it.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	if len(escape) > 0 {
+		fmt.Fprintf(out, "Connected to serial console. Press %s to disconnect.\r\n", escapeName)
+	} else {
+		fmt.Fprintf(out, "Connected to serial console.\r\n")
+	}
+
+	errCh := make(chan error, 2)
+
+	// console -> terminal
+	go func() {
+		_, err := io.Copy(out, conn)
+		errCh <- err
+	}()
+
+	// terminal -> console, watching for the escape sequence
+	go func() {
+		filter := NewEscapeFilter(escape)
+		buf := make([]byte, 256)
+		for {
+			n, err := in.Read(buf)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			data, escaped := filter.Filter(buf[:n])
+			if len(data) > 0 {
+				if _, err := conn.Write(data); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			if escaped {
+				fmt.Fprintf(out, "\r\nDisconnected.\r\n")
+				errCh <- nil
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-errCh:
+	case <-sigCh:
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package console
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEscape(t *testing.T) {
+	for in, want := range map[string][]byte{
+		"^]":   {0x1d},
+		"^a":   {0x01},
+		"~.":   []byte("~."),
+		"^^x":  []byte("^x"),
+		"^?":   {0x7f},
+		"none": nil,
+	} {
+		got, err := ParseEscape(in)
+		require.NoError(t, err, in)
+		require.Equal(t, want, got, in)
+	}
+
+	for _, bad := range []string{"", "^", "^1"} {
+		_, err := ParseEscape(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestEscapeFilter(t *testing.T) {
+	t.Run("single byte", func(t *testing.T) {
+		f := NewEscapeFilter([]byte{0x1d})
+		out, escaped := f.Filter([]byte("ls\x1dignored"))
+		require.True(t, escaped)
+		require.Equal(t, "ls", string(out))
+	})
+
+	t.Run("sequence split across reads", func(t *testing.T) {
+		f := NewEscapeFilter([]byte("~."))
+		out, escaped := f.Filter([]byte("a~"))
+		require.False(t, escaped)
+		require.Equal(t, "a", string(out))
+		out, escaped = f.Filter([]byte("."))
+		require.True(t, escaped)
+		require.Empty(t, out)
+	})
+
+	t.Run("partial match is forwarded", func(t *testing.T) {
+		f := NewEscapeFilter([]byte("~."))
+		out, escaped := f.Filter([]byte("~~x~"))
+		require.False(t, escaped)
+		require.Equal(t, "~~x", string(out))
+		out, escaped = f.Filter([]byte("y"))
+		require.False(t, escaped)
+		require.Equal(t, "~y", string(out))
+	})
+
+	t.Run("overlapping input", func(t *testing.T) {
+		for _, tc := range []struct {
+			seq, in, out string
+		}{
+			{"~~.", "~~~.", "~"},
+			{"~~.", "a~~~~.", "a~~"},
+			{"aab", "aaab", "a"},
+			{"abab", "abaabab", "aba"},
+		} {
+			out, escaped := NewEscapeFilter([]byte(tc.seq)).Filter([]byte(tc.in))
+			require.True(t, escaped, "%q in %q", tc.seq, tc.in)
+			require.Equal(t, tc.out, string(out), "%q in %q", tc.seq, tc.in)
+		}
+
+		// The same input arriving a byte at a time.
+		f := NewEscapeFilter([]byte("~~."))
+		var forwarded string
+		for _, b := range []byte("x~~~") {
+			out, escaped := f.Filter([]byte{b})
+			require.False(t, escaped)
+			forwarded += string(out)
+		}
+		out, escaped := f.Filter([]byte("."))
+		require.True(t, escaped)
+		require.Equal(t, "x~", forwarded+string(out))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		out, escaped := NewEscapeFilter(nil).Filter([]byte("\x1d"))
+		require.False(t, escaped)
+		require.Equal(t, "\x1d", string(out))
+	})
+}
@@ -0,0 +1,138 @@
+package console
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Subprotocol is the WebSocket subprotocol spoken by KubeVirt serial
+	// console clients.
+	Subprotocol = "binary.kubevirt.io"
+
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait / 2
+	writeWait  = 10 * time.Second
+)
+
+// Control messages a client may send as WebSocket text frames. Binary frames
+// are always treated as console input.
+const (
+	ControlTakeover = "takeover"
+	ControlRelease  = "release"
+)
+
+// NewWebSocketHandler serves the console over WebSocket. Query parameters:
+//
+//	mode=view      attach as a read-only viewer
+//	takeover=true  take the write lock from the current writer
+func NewWebSocketHandler(hub *Hub) http.Handler {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{Subprotocol},
+		CheckOrigin:  func(r *http.Request) bool { return true },
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		takeover, _ := strconv.ParseBool(r.URL.Query().Get("takeover"))
+		opts := AttachOptions{
+			Name:     r.RemoteAddr,
+			ReadOnly: r.URL.Query().Get("mode") == "view",
+			Takeover: takeover,
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade failed: %v", err)
+			return
+		}
+		defer ws.Close()
+
+		client := hub.Attach(opts)
+		defer client.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			writeLoop(ws, client)
+			// Unblock readLoop once the client is gone.
+			ws.Close()
+		}()
+
+		readLoop(ws, client)
+		client.Close()
+		<-done
+	})
+}
+
+// NewClientsHandler lists the clients attached to hub as JSON.
+func NewClientsHandler(hub *Hub) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hub.Clients())
+	})
+}
+
+func writeLoop(ws *websocket.Conn, client *Client) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data, ok := <-client.Output():
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				client.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+func readLoop(ws *websocket.Conn, client *Client) {
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		mt, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+
+		switch mt {
+		case websocket.BinaryMessage:
+			if _, err := client.Write(data); err != nil {
+				if errors.Is(err, ErrReadOnly) || errors.Is(err, ErrNotWriter) || errors.Is(err, ErrNotConnected) {
+					continue
+				}
+				log.Printf("Failed to write to serial console: %v", err)
+			}
+		case websocket.TextMessage:
+			switch string(data) {
+			case ControlTakeover:
+				if err := client.hub.Takeover(client); err != nil {
+					log.Printf("Client %d takeover refused: %v", client.ID, err)
+				}
+			case ControlRelease:
+				client.hub.Release(client)
+			}
+		}
+	}
+}
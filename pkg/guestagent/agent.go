@@ -0,0 +1,338 @@
+package guestagent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt/pkg/network/vmispec"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/launcher"
+)
+
+// Filesystem freeze states, as reported by guest-fsfreeze-status.
+const (
+	FSFrozen = "frozen"
+	FSThawed = "thawed"
+)
+
+// ErrNotConnected is returned when libvirt has no connection to the guest
+// agent, typically because qemu-guest-agent is not running in the guest.
+var ErrNotConnected = errors.New("guest agent is not connected (is qemu-guest-agent running in the guest?)")
+
+// execPollInterval is how often Exec checks whether a guest command exited.
+var execPollInterval = 100 * time.Millisecond
+
+// Agent runs qemu-guest-agent commands through libvirt in the compute
+// container. Results use the types KubeVirt reports for a VMI, so the output
+// looks the same as on a cluster.
+type Agent struct {
+	run    launcher.RunFunc
+	domain string
+}
+
+func New(run launcher.RunFunc, domain string) *Agent {
+	return &Agent{run: run, domain: domain}
+}
+
+// Command runs a raw guest agent command and decodes its return value into
+// result, which may be nil.
+func (a *Agent) Command(ctx context.Context, command string, args interface{}, result interface{}) error {
+	req := map[string]interface{}{"execute": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	out, err := a.run(ctx, "virsh", "qemu-agent-command", a.domain, string(data))
+	if err != nil {
+		msg := strings.ToLower(err.Error())
+		if strings.Contains(msg, "agent is not connected") || strings.Contains(msg, "agent is not responding") {
+			return fmt.Errorf("%w: %v", ErrNotConnected, err)
+		}
+		return fmt.Errorf("guest agent command %s failed: %v", command, err)
+	}
+
+	var reply struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err := json.Unmarshal(out, &reply); err != nil {
+		return fmt.Errorf("failed to parse reply to %s: %v", command, err)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(reply.Return, result); err != nil {
+		return fmt.Errorf("failed to parse reply to %s: %v", command, err)
+	}
+	return nil
+}
+
+// Info collects what KubeVirt reports as guestosinfo. Only the agent version
+// is required; information the agent does not support is left empty.
+func (a *Agent) Info(ctx context.Context) (*v1.VirtualMachineInstanceGuestAgentInfo, error) {
+	var agent struct {
+		Version           string                     `json:"version"`
+		SupportedCommands []v1.GuestAgentCommandInfo `json:"supported_commands"`
+	}
+	if err := a.Command(ctx, "guest-info", nil, &agent); err != nil {
+		return nil, err
+	}
+	info := &v1.VirtualMachineInstanceGuestAgentInfo{
+		GAVersion:         agent.Version,
+		SupportedCommands: agent.SupportedCommands,
+	}
+
+	var host struct {
+		Name string `json:"host-name"`
+	}
+	if a.Command(ctx, "guest-get-host-name", nil, &host) == nil {
+		info.Hostname = host.Name
+	}
+
+	var osInfo struct {
+		ID            string `json:"id"`
+		Name          string `json:"name"`
+		PrettyName    string `json:"pretty-name"`
+		Version       string `json:"version"`
+		VersionID     string `json:"version-id"`
+		KernelRelease string `json:"kernel-release"`
+		KernelVersion string `json:"kernel-version"`
+		Machine       string `json:"machine"`
+	}
+	if a.Command(ctx, "guest-get-osinfo", nil, &osInfo) == nil {
+		info.OS = v1.VirtualMachineInstanceGuestOSInfo{
+			Name:          osInfo.Name,
+			KernelRelease: osInfo.KernelRelease,
+			Version:       osInfo.Version,
+			PrettyName:    osInfo.PrettyName,
+			VersionID:     osInfo.VersionID,
+			KernelVersion: osInfo.KernelVersion,
+			Machine:       osInfo.Machine,
+			ID:            osInfo.ID,
+		}
+	}
+
+	var tz struct {
+		Zone   string `json:"zone"`
+		Offset int    `json:"offset"`
+	}
+	if a.Command(ctx, "guest-get-timezone", nil, &tz) == nil {
+		info.Timezone = fmt.Sprintf("%s, %d", tz.Zone, tz.Offset)
+	}
+
+	if users, err := a.Users(ctx); err == nil {
+		info.UserList = users.Items
+	}
+	if fs, err := a.Filesystems(ctx); err == nil {
+		info.FSInfo = *fs
+	}
+	// Like KubeVirt, only a frozen filesystem is reported.
+	if status, err := a.FSFreezeStatus(ctx); err == nil && status == FSFrozen {
+		info.FSFreezeStatus = status
+	}
+	return info, nil
+}
+
+// Users lists the users logged in to the guest.
+func (a *Agent) Users(ctx context.Context) (*v1.VirtualMachineInstanceGuestOSUserList, error) {
+	var users []struct {
+		User      string  `json:"user"`
+		Domain    string  `json:"domain"`
+		LoginTime float64 `json:"login-time"`
+	}
+	if err := a.Command(ctx, "guest-get-users", nil, &users); err != nil {
+		return nil, err
+	}
+
+	list := &v1.VirtualMachineInstanceGuestOSUserList{Items: []v1.VirtualMachineInstanceGuestOSUser{}}
+	for _, u := range users {
+		list.Items = append(list.Items, v1.VirtualMachineInstanceGuestOSUser{
+			UserName:  u.User,
+			Domain:    u.Domain,
+			LoginTime: u.LoginTime,
+		})
+	}
+	return list, nil
+}
+
+// Filesystems lists the mounted guest filesystems and their usage.
+func (a *Agent) Filesystems(ctx context.Context) (*v1.VirtualMachineInstanceFileSystemInfo, error) {
+	var filesystems []struct {
+		Name       string `json:"name"`
+		Mountpoint string `json:"mountpoint"`
+		Type       string `json:"type"`
+		UsedBytes  int    `json:"used-bytes"`
+		TotalBytes int    `json:"total-bytes"`
+		Disk       []struct {
+			Serial  string `json:"serial"`
+			BusType string `json:"bus-type"`
+		} `json:"disk"`
+	}
+	if err := a.Command(ctx, "guest-get-fsinfo", nil, &filesystems); err != nil {
+		return nil, err
+	}
+
+	info := &v1.VirtualMachineInstanceFileSystemInfo{Filesystems: []v1.VirtualMachineInstanceFileSystem{}}
+	for _, fs := range filesystems {
+		disks := []v1.VirtualMachineInstanceFileSystemDisk{}
+		for _, d := range fs.Disk {
+			disks = append(disks, v1.VirtualMachineInstanceFileSystemDisk{Serial: d.Serial, BusType: d.BusType})
+		}
+		info.Filesystems = append(info.Filesystems, v1.VirtualMachineInstanceFileSystem{
+			DiskName:       fs.Name,
+			MountPoint:     fs.Mountpoint,
+			FileSystemType: fs.Type,
+			UsedBytes:      fs.UsedBytes,
+			TotalBytes:     fs.TotalBytes,
+			Disk:           disks,
+		})
+	}
+	return info, nil
+}
+
+// Interfaces lists the guest network interfaces the way KubeVirt reports
+// them in the VMI status: loopback is skipped and the first IPv4 address is
+// the primary one.
+func (a *Agent) Interfaces(ctx context.Context) ([]v1.VirtualMachineInstanceNetworkInterface, error) {
+	var ifaces []struct {
+		Name            string `json:"name"`
+		HardwareAddress string `json:"hardware-address"`
+		IPAddresses     []struct {
+			Type    string `json:"ip-address-type"`
+			Address string `json:"ip-address"`
+		} `json:"ip-addresses"`
+	}
+	if err := a.Command(ctx, "guest-network-get-interfaces", nil, &ifaces); err != nil {
+		return nil, err
+	}
+
+	result := []v1.VirtualMachineInstanceNetworkInterface{}
+	for _, iface := range ifaces {
+		if iface.Name == "lo" {
+			continue
+		}
+		status := v1.VirtualMachineInstanceNetworkInterface{
+			MAC:           iface.HardwareAddress,
+			InterfaceName: iface.Name,
+			InfoSource:    vmispec.InfoSourceGuestAgent,
+		}
+		for _, addr := range iface.IPAddresses {
+			if addr.Type == "ipv4" && status.IP == "" {
+				status.IP = addr.Address
+			}
+			status.IPs = append(status.IPs, addr.Address)
+		}
+		if status.IP == "" && len(status.IPs) > 0 {
+			status.IP = status.IPs[0]
+		}
+		result = append(result, status)
+	}
+	return result, nil
+}
+
+// FSFreezeStatus returns FSFrozen or FSThawed.
+func (a *Agent) FSFreezeStatus(ctx context.Context) (string, error) {
+	var status string
+	err := a.Command(ctx, "guest-fsfreeze-status", nil, &status)
+	return status, err
+}
+
+// FSFreeze freezes all guest filesystems and returns how many were frozen.
+func (a *Agent) FSFreeze(ctx context.Context) (int, error) {
+	var n int
+	err := a.Command(ctx, "guest-fsfreeze-freeze", nil, &n)
+	return n, err
+}
+
+// FSThaw thaws all guest filesystems and returns how many were thawed.
+func (a *Agent) FSThaw(ctx context.Context) (int, error) {
+	var n int
+	err := a.Command(ctx, "guest-fsfreeze-thaw", nil, &n)
+	return n, err
+}
+
+// ExecResult is the outcome of a command run in the guest.
+type ExecResult struct {
+	ExitCode int    `json:"exitCode"`
+	Signal   int    `json:"signal,omitempty"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	// Truncated is set when the agent dropped output beyond its buffer.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ExitStatus returns the status a shell would report for the command: its
+// exit code, or 128 plus the signal that killed it, for which the agent
+// reports exit code 0.
+func (r *ExecResult) ExitStatus() int {
+	if r.Signal != 0 {
+		return 128 + r.Signal
+	}
+	return r.ExitCode
+}
+
+// Exec runs path with args in the guest, feeding it stdin, and waits until it
+// exits or ctx is done.
+func (a *Agent) Exec(ctx context.Context, path string, args []string, stdin []byte) (*ExecResult, error) {
+	req := map[string]interface{}{
+		"path":           path,
+		"arg":            args,
+		"capture-output": true,
+	}
+	if len(stdin) > 0 {
+		req["input-data"] = base64.StdEncoding.EncodeToString(stdin)
+	}
+	var started struct {
+		PID int `json:"pid"`
+	}
+	if err := a.Command(ctx, "guest-exec", req, &started); err != nil {
+		return nil, err
+	}
+
+	for {
+		var status struct {
+			Exited       bool   `json:"exited"`
+			ExitCode     int    `json:"exitcode"`
+			Signal       int    `json:"signal"`
+			OutData      string `json:"out-data"`
+			ErrData      string `json:"err-data"`
+			OutTruncated bool   `json:"out-truncated"`
+			ErrTruncated bool   `json:"err-truncated"`
+		}
+		if err := a.Command(ctx, "guest-exec-status", map[string]int{"pid": started.PID}, &status); err != nil {
+			return nil, err
+		}
+		if status.Exited {
+			stdout, err := base64.StdEncoding.DecodeString(status.OutData)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode command output: %v", err)
+			}
+			stderr, err := base64.StdEncoding.DecodeString(status.ErrData)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode command error output: %v", err)
+			}
+			return &ExecResult{
+				ExitCode:  status.ExitCode,
+				Signal:    status.Signal,
+				Stdout:    string(stdout),
+				Stderr:    string(stderr),
+				Truncated: status.OutTruncated || status.ErrTruncated,
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(execPollInterval):
+		}
+	}
+}
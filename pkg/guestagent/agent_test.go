@@ -0,0 +1,157 @@
+package guestagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	v1 "kubevirt.io/api/core/v1"
+)
+
+// fakeAgent answers guest agent commands from replies, keyed by command name.
+// Commands without a reply fail like an agent that does not support them.
+func fakeAgent(t *testing.T, replies map[string]func(args json.RawMessage) string) *Agent {
+	run := func(ctx context.Context, args ...string) ([]byte, error) {
+		require.Equal(t, []string{"virsh", "qemu-agent-command", "default_testvm"}, args[:3])
+		var req struct {
+			Execute   string          `json:"execute"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(args[3]), &req))
+		reply, ok := replies[req.Execute]
+		if !ok {
+			return nil, fmt.Errorf("error: internal error: unable to execute QEMU agent command '%s'", req.Execute)
+		}
+		return []byte(`{"return":` + reply(req.Arguments) + `}`), nil
+	}
+	return New(run, "default_testvm")
+}
+
+func static(reply string) func(json.RawMessage) string {
+	return func(json.RawMessage) string { return reply }
+}
+
+func TestInfo(t *testing.T) {
+	agent := fakeAgent(t, map[string]func(json.RawMessage) string{
+		"guest-info":            static(`{"version":"8.2.0","supported_commands":[{"name":"guest-exec","enabled":true}]}`),
+		"guest-get-host-name":   static(`{"host-name":"cirros"}`),
+		"guest-get-osinfo":      static(`{"id":"fedora","name":"Fedora Linux","pretty-name":"Fedora Linux 40","version-id":"40","kernel-release":"6.8.5","machine":"x86_64"}`),
+		"guest-get-timezone":    static(`{"zone":"UTC","offset":0}`),
+		"guest-get-users":       static(`[{"user":"fedora","login-time":1700000000.5}]`),
+		"guest-get-fsinfo":      static(`[{"name":"vda1","mountpoint":"/","type":"ext4","used-bytes":100,"total-bytes":1000,"disk":[{"serial":"abc","bus-type":"virtio"}]}]`),
+		"guest-fsfreeze-status": static(`"thawed"`),
+	})
+
+	info, err := agent.Info(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, &v1.VirtualMachineInstanceGuestAgentInfo{
+		GAVersion:         "8.2.0",
+		SupportedCommands: []v1.GuestAgentCommandInfo{{Name: "guest-exec", Enabled: true}},
+		Hostname:          "cirros",
+		OS: v1.VirtualMachineInstanceGuestOSInfo{
+			Name:          "Fedora Linux",
+			KernelRelease: "6.8.5",
+			PrettyName:    "Fedora Linux 40",
+			VersionID:     "40",
+			Machine:       "x86_64",
+			ID:            "fedora",
+		},
+		Timezone: "UTC, 0",
+		UserList: []v1.VirtualMachineInstanceGuestOSUser{{UserName: "fedora", LoginTime: 1700000000.5}},
+		FSInfo: v1.VirtualMachineInstanceFileSystemInfo{Filesystems: []v1.VirtualMachineInstanceFileSystem{{
+			DiskName:       "vda1",
+			MountPoint:     "/",
+			FileSystemType: "ext4",
+			UsedBytes:      100,
+			TotalBytes:     1000,
+			Disk:           []v1.VirtualMachineInstanceFileSystemDisk{{Serial: "abc", BusType: "virtio"}},
+		}}},
+	}, info)
+}
+
+func TestInfoWithMinimalAgent(t *testing.T) {
+	agent := fakeAgent(t, map[string]func(json.RawMessage) string{
+		"guest-info": static(`{"version":"2.5.0"}`),
+	})
+	info, err := agent.Info(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "2.5.0", info.GAVersion)
+	require.Empty(t, info.Hostname)
+
+	_, err = fakeAgent(t, nil).Info(context.Background())
+	require.ErrorContains(t, err, "guest-info")
+}
+
+func TestInterfaces(t *testing.T) {
+	agent := fakeAgent(t, map[string]func(json.RawMessage) string{
+		"guest-network-get-interfaces": static(`[
+			{"name":"lo","hardware-address":"00:00:00:00:00:00","ip-addresses":[{"ip-address-type":"ipv4","ip-address":"127.0.0.1"}]},
+			{"name":"eth0","hardware-address":"52:54:00:12:34:56","ip-addresses":[
+				{"ip-address-type":"ipv6","ip-address":"fe80::1"},
+				{"ip-address-type":"ipv4","ip-address":"10.0.2.15"}]},
+			{"name":"eth1","hardware-address":"52:54:00:12:34:57","ip-addresses":[{"ip-address-type":"ipv6","ip-address":"fd00::2"}]}
+		]`),
+	})
+
+	ifaces, err := agent.Interfaces(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []v1.VirtualMachineInstanceNetworkInterface{
+		{MAC: "52:54:00:12:34:56", InterfaceName: "eth0", InfoSource: "guest-agent", IP: "10.0.2.15", IPs: []string{"fe80::1", "10.0.2.15"}},
+		{MAC: "52:54:00:12:34:57", InterfaceName: "eth1", InfoSource: "guest-agent", IP: "fd00::2", IPs: []string{"fd00::2"}},
+	}, ifaces)
+}
+
+func TestExec(t *testing.T) {
+	polls := 0
+	agent := fakeAgent(t, map[string]func(json.RawMessage) string{
+		"guest-exec": func(args json.RawMessage) string {
+			require.JSONEq(t, `{"path":"/bin/sh","arg":["-c","cat; echo oops >&2; exit 3"],"capture-output":true,"input-data":"aGk="}`, string(args))
+			return `{"pid":42}`
+		},
+		"guest-exec-status": func(args json.RawMessage) string {
+			require.JSONEq(t, `{"pid":42}`, string(args))
+			polls++
+			if polls < 2 {
+				return `{"exited":false}`
+			}
+			return `{"exited":true,"exitcode":3,"out-data":"aGk=","err-data":"b29wcwo="}`
+		},
+	})
+	execPollInterval = 0
+
+	result, err := agent.Exec(context.Background(), "/bin/sh", []string{"-c", "cat; echo oops >&2; exit 3"}, []byte("hi"))
+	require.NoError(t, err)
+	require.Equal(t, &ExecResult{ExitCode: 3, Stdout: "hi", Stderr: "oops\n"}, result)
+	require.Equal(t, 2, polls)
+}
+
+func TestExecSignal(t *testing.T) {
+	agent := fakeAgent(t, map[string]func(json.RawMessage) string{
+		"guest-exec":        static(`{"pid":42}`),
+		"guest-exec-status": static(`{"exited":true,"exitcode":0,"signal":9}`),
+	})
+	execPollInterval = 0
+
+	result, err := agent.Exec(context.Background(), "/usr/bin/sleep", []string{"600"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 9, result.Signal)
+	require.Equal(t, 137, result.ExitStatus(), "killed by SIGKILL, as a shell reports it")
+	require.Equal(t, 3, (&ExecResult{ExitCode: 3}).ExitStatus())
+}
+
+func TestFSFreeze(t *testing.T) {
+	agent := fakeAgent(t, map[string]func(json.RawMessage) string{
+		"guest-fsfreeze-freeze": static(`2`),
+		"guest-fsfreeze-status": static(`"frozen"`),
+	})
+
+	n, err := agent.FSFreeze(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	status, err := agent.FSFreezeStatus(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, FSFrozen, status)
+}
@@ -0,0 +1,156 @@
+package guestagent
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fileChunkSize is the amount of file data moved per guest agent command. The
+// base64 encoded chunk is passed to virsh on the command line, so it has to
+// stay well below the kernel's 128KiB limit for a single argument.
+const fileChunkSize = 32 * 1024
+
+// Ping checks that the guest agent answers.
+func (a *Agent) Ping(ctx context.Context) error {
+	return a.Command(ctx, "guest-ping", nil, nil)
+}
+
+func (a *Agent) openFile(ctx context.Context, path, mode string) (int, error) {
+	var handle int
+	if err := a.Command(ctx, "guest-file-open", map[string]string{"path": path, "mode": mode}, &handle); err != nil {
+		return 0, fmt.Errorf("failed to open %s in the guest: %w", path, err)
+	}
+	return handle, nil
+}
+
+func (a *Agent) closeFile(ctx context.Context, handle int) error {
+	return a.Command(ctx, "guest-file-close", map[string]int{"handle": handle}, nil)
+}
+
+// WriteFile creates or truncates path in the guest and copies r into it, in
+// chunks. It returns the number of bytes written.
+func (a *Agent) WriteFile(ctx context.Context, path string, r io.Reader) (written int64, err error) {
+	handle, err := a.openFile(ctx, path, "w")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := a.closeFile(ctx, handle); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to close %s in the guest: %v", path, cerr)
+		}
+	}()
+
+	buf := make([]byte, fileChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		for chunk := buf[:n]; len(chunk) > 0; {
+			var reply struct {
+				Count int `json:"count"`
+			}
+			args := map[string]interface{}{"handle": handle, "buf-b64": base64.StdEncoding.EncodeToString(chunk)}
+			if err := a.Command(ctx, "guest-file-write", args, &reply); err != nil {
+				return written, fmt.Errorf("failed to write %s in the guest: %w", path, err)
+			}
+			if reply.Count <= 0 {
+				return written, fmt.Errorf("failed to write %s in the guest: no progress", path)
+			}
+			written += int64(reply.Count)
+			chunk = chunk[reply.Count:]
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// ReadFile copies path in the guest to w, in chunks. It returns the number of
+// bytes read.
+func (a *Agent) ReadFile(ctx context.Context, path string, w io.Writer) (read int64, err error) {
+	handle, err := a.openFile(ctx, path, "r")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := a.closeFile(ctx, handle); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to close %s in the guest: %v", path, cerr)
+		}
+	}()
+
+	for {
+		var reply struct {
+			Count int    `json:"count"`
+			Buf   string `json:"buf-b64"`
+			EOF   bool   `json:"eof"`
+		}
+		args := map[string]int{"handle": handle, "count": fileChunkSize}
+		if err := a.Command(ctx, "guest-file-read", args, &reply); err != nil {
+			return read, fmt.Errorf("failed to read %s in the guest: %w", path, err)
+		}
+		data, err := base64.StdEncoding.DecodeString(reply.Buf)
+		if err != nil {
+			return read, fmt.Errorf("failed to decode data read from %s: %v", path, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return read, err
+		}
+		read += int64(len(data))
+		if reply.EOF || len(data) == 0 {
+			return read, nil
+		}
+	}
+}
+
+// err returns an error describing how the command name run on path failed,
+// or nil if it succeeded.
+func (r *ExecResult) err(name, path string) error {
+	var msg string
+	switch {
+	case r.Signal != 0:
+		msg = fmt.Sprintf("%s %s was killed by signal %d", name, path, r.Signal)
+	case r.ExitCode != 0:
+		msg = fmt.Sprintf("%s %s exited with %d", name, path, r.ExitCode)
+	default:
+		return nil
+	}
+	if stderr := strings.TrimSpace(r.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return errors.New(msg)
+}
+
+// Chmod sets the permission bits of path in the guest. The agent has no
+// command for it, so this runs chmod through guest-exec, which not every guest
+// allows.
+func (a *Agent) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	result, err := a.Exec(ctx, "chmod", []string{strconv.FormatUint(uint64(mode.Perm()), 8), path}, nil)
+	if err != nil {
+		return err
+	}
+	return result.err("chmod", path)
+}
+
+// FileMode returns the permission bits of path in the guest, through stat
+// run by guest-exec.
+func (a *Agent) FileMode(ctx context.Context, path string) (os.FileMode, error) {
+	result, err := a.Exec(ctx, "stat", []string{"-c", "%a", path}, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := result.err("stat", path); err != nil {
+		return 0, err
+	}
+	mode, err := strconv.ParseUint(strings.TrimSpace(result.Stdout), 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected mode %q for %s", strings.TrimSpace(result.Stdout), path)
+	}
+	return os.FileMode(mode).Perm(), nil
+}
@@ -0,0 +1,160 @@
+package guestagent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFiles emulates the guest-file-* commands on top of an in-memory file
+// system.
+type fakeFiles struct {
+	t       *testing.T
+	files   map[string][]byte
+	open    map[int]string
+	offsets map[int]int
+	next    int
+	writes  int
+}
+
+func newFakeFiles(t *testing.T) *fakeFiles {
+	return &fakeFiles{t: t, files: map[string][]byte{}, open: map[int]string{}, offsets: map[int]int{}}
+}
+
+func (f *fakeFiles) replies() map[string]func(json.RawMessage) string {
+	return map[string]func(json.RawMessage) string{
+		"guest-file-open": func(raw json.RawMessage) string {
+			var args struct{ Path, Mode string }
+			require.NoError(f.t, json.Unmarshal(raw, &args))
+			if args.Mode == "w" {
+				f.files[args.Path] = nil
+			}
+			f.next++
+			f.open[f.next] = args.Path
+			return fmt.Sprint(f.next)
+		},
+		"guest-file-write": func(raw json.RawMessage) string {
+			var args struct {
+				Handle int    `json:"handle"`
+				Buf    string `json:"buf-b64"`
+			}
+			require.NoError(f.t, json.Unmarshal(raw, &args))
+			data, err := base64.StdEncoding.DecodeString(args.Buf)
+			require.NoError(f.t, err)
+			path := f.open[args.Handle]
+			f.files[path] = append(f.files[path], data...)
+			f.writes++
+			return fmt.Sprintf(`{"count":%d,"eof":false}`, len(data))
+		},
+		"guest-file-read": func(raw json.RawMessage) string {
+			var args struct{ Handle, Count int }
+			require.NoError(f.t, json.Unmarshal(raw, &args))
+			data := f.files[f.open[args.Handle]][f.offsets[args.Handle]:]
+			if len(data) > args.Count {
+				data = data[:args.Count]
+			}
+			f.offsets[args.Handle] += len(data)
+			eof := f.offsets[args.Handle] == len(f.files[f.open[args.Handle]])
+			return fmt.Sprintf(`{"count":%d,"buf-b64":%q,"eof":%v}`, len(data), base64.StdEncoding.EncodeToString(data), eof)
+		},
+		"guest-file-close": func(raw json.RawMessage) string {
+			var args struct{ Handle int }
+			require.NoError(f.t, json.Unmarshal(raw, &args))
+			require.Contains(f.t, f.open, args.Handle)
+			delete(f.open, args.Handle)
+			return "{}"
+		},
+	}
+}
+
+func TestFileCopy(t *testing.T) {
+	files := newFakeFiles(t)
+	agent := fakeAgent(t, files.replies())
+
+	data := make([]byte, 2*fileChunkSize+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	n, err := agent.WriteFile(context.Background(), "/tmp/blob", bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, 3, files.writes)
+	require.Equal(t, data, files.files["/tmp/blob"])
+
+	var out bytes.Buffer
+	n, err = agent.ReadFile(context.Background(), "/tmp/blob", &out)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, out.Bytes())
+	require.Empty(t, files.open, "all handles must be closed")
+
+	n, err = agent.WriteFile(context.Background(), "/tmp/empty", bytes.NewReader(nil))
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Contains(t, files.files, "/tmp/empty")
+}
+
+func TestFileMode(t *testing.T) {
+	var chmodArgs []string
+	agent := fakeAgent(t, map[string]func(json.RawMessage) string{
+		"guest-exec": func(raw json.RawMessage) string {
+			var args struct {
+				Path string   `json:"path"`
+				Arg  []string `json:"arg"`
+			}
+			require.NoError(t, json.Unmarshal(raw, &args))
+			if args.Path == "chmod" {
+				chmodArgs = args.Arg
+				return `{"pid":1}`
+			}
+			return `{"pid":2}`
+		},
+		"guest-exec-status": func(raw json.RawMessage) string {
+			var args struct{ PID int }
+			require.NoError(t, json.Unmarshal(raw, &args))
+			if args.PID == 1 {
+				return `{"exited":true,"exitcode":0}`
+			}
+			return `{"exited":true,"exitcode":0,"out-data":"` + base64.StdEncoding.EncodeToString([]byte("750\n")) + `"}`
+		},
+	})
+
+	require.NoError(t, agent.Chmod(context.Background(), "/tmp/script", 0755))
+	require.Equal(t, []string{"755", "/tmp/script"}, chmodArgs)
+
+	mode, err := agent.FileMode(context.Background(), "/tmp/script")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), mode)
+}
+
+func TestFileModeSignal(t *testing.T) {
+	agent := fakeAgent(t, map[string]func(json.RawMessage) string{
+		"guest-exec":        static(`{"pid":1}`),
+		"guest-exec-status": static(`{"exited":true,"exitcode":0,"signal":9}`),
+	})
+	execPollInterval = 0
+
+	require.EqualError(t, agent.Chmod(context.Background(), "/tmp/script", 0755), "chmod /tmp/script was killed by signal 9")
+	_, err := agent.FileMode(context.Background(), "/tmp/script")
+	require.EqualError(t, err, "stat /tmp/script was killed by signal 9")
+}
+
+func TestNotConnected(t *testing.T) {
+	agent := New(func(ctx context.Context, args ...string) ([]byte, error) {
+		return nil, errors.New("virsh: exit status 1: error: Guest agent is not responding: QEMU guest agent is not connected")
+	}, "default_testvm")
+
+	err := agent.Ping(context.Background())
+	require.ErrorIs(t, err, ErrNotConnected)
+
+	_, err = agent.WriteFile(context.Background(), "/tmp/x", bytes.NewReader([]byte("x")))
+	require.ErrorIs(t, err, ErrNotConnected)
+}
@@ -0,0 +1,226 @@
+package hostdevices
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Allocator hands out the host devices of a DeviceMap to the devices of one
+// VM, each host device at most once. PCI devices bound to vfio-pci and
+// mediated devices whose VFIO group is open, as it is while a VM uses them,
+// are not handed out. Other devices, such as GPUs bound to the NVIDIA
+// driver, and devices assigned by earlier renders to VMs that are not
+// running are free as far as the allocator can tell.
+type Allocator struct {
+	// CreateMDEVs makes AllocateMDEV create a mediated device when no free
+	// one of the resource exists.
+	CreateMDEVs bool
+
+	m       *DeviceMap
+	host    Host
+	pci     []*PCIDevice
+	mdevs   []*MDEV
+	usb     []*USBDevice
+	used    map[string]bool
+	inUse   map[string]bool
+	newUUID func() string
+}
+
+// NewAllocator returns an allocator of the devices in m found on host.
+func NewAllocator(m *DeviceMap, host Host) *Allocator {
+	return &Allocator{m: m, host: host, used: map[string]bool{}, newUUID: uuid.NewString}
+}
+
+// AllocatePCI returns the next free PCI device of resource: the next pinned
+// address from pciAddresses, or the next device matching the selectors of
+// the resource in address order.
+func (a *Allocator) AllocatePCI(resource string) (*PCIDevice, error) {
+	selectors := a.m.pciSelectors(resource)
+	if len(selectors) == 0 {
+		return nil, fmt.Errorf("resource %s is not in the device map", resource)
+	}
+
+	candidates, err := a.pciCandidates(resource, selectors)
+	if err != nil {
+		return nil, err
+	}
+	busy := 0
+	for _, dev := range candidates {
+		if a.used[dev.Address] {
+			continue
+		}
+		if dev.Driver == "vfio-pci" && a.groupInUse(dev.IOMMUGroup) {
+			busy++
+			continue
+		}
+		a.used[dev.Address] = true
+		return dev, nil
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no PCI device of resource %s (%s) on the host", resource, strings.Join(selectors, ", "))
+	}
+	if busy > 0 {
+		return nil, fmt.Errorf("all %d PCI devices of resource %s are already assigned or in use, %d by another process", len(candidates), resource, busy)
+	}
+	return nil, fmt.Errorf("all %d PCI devices of resource %s are already assigned", len(candidates), resource)
+}
+
+func (a *Allocator) pciCandidates(resource string, selectors []string) ([]*PCIDevice, error) {
+	matches := func(dev *PCIDevice) bool {
+		for _, s := range selectors {
+			if dev.Matches(s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if addresses, ok := a.m.PCIAddresses[resource]; ok {
+		var devices []*PCIDevice
+		for _, address := range addresses {
+			dev, err := a.host.PCIDevice(address)
+			if err != nil {
+				return nil, fmt.Errorf("resource %s: %v", resource, err)
+			}
+			if !matches(dev) {
+				return nil, fmt.Errorf("resource %s: PCI device %s is %s:%s, which does not match %s", resource, dev.Address, dev.Vendor, dev.Device, strings.Join(selectors, ", "))
+			}
+			devices = append(devices, dev)
+		}
+		return devices, nil
+	}
+
+	if a.pci == nil {
+		devices, err := a.host.PCIDevices()
+		if err != nil {
+			return nil, err
+		}
+		a.pci = devices
+	}
+	var devices []*PCIDevice
+	for _, dev := range a.pci {
+		if matches(dev) {
+			devices = append(devices, dev)
+		}
+	}
+	return devices, nil
+}
+
+// AllocateMDEV returns the next free mediated device of resource, in UUID
+// order, skipping those whose VFIO group is open. With CreateMDEVs, a new one is created on the first parent device
+// with an available instance of a matching type if none is free.
+func (a *Allocator) AllocateMDEV(resource string) (*MDEV, error) {
+	selectors := a.m.mdevSelectors(resource)
+	if len(selectors) == 0 {
+		return nil, fmt.Errorf("resource %s is not in the device map", resource)
+	}
+	matches := func(matches func(string) bool) bool {
+		for _, s := range selectors {
+			if matches(s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if a.mdevs == nil {
+		mdevs, err := a.host.MDEVs()
+		if err != nil {
+			return nil, err
+		}
+		a.mdevs = mdevs
+	}
+	for _, mdev := range a.mdevs {
+		if !a.used[mdev.UUID] && matches(mdev.Matches) && !a.groupInUse(mdev.IOMMUGroup) {
+			a.used[mdev.UUID] = true
+			return mdev, nil
+		}
+	}
+
+	if !a.CreateMDEVs {
+		return nil, fmt.Errorf("no free mediated device of resource %s (%s) on the host", resource, strings.Join(selectors, ", "))
+	}
+	types, err := a.host.MDEVTypes()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if t.Available > 0 && matches(t.Matches) {
+			mdev, err := a.host.CreateMDEV(t, a.newUUID())
+			if err != nil {
+				return nil, fmt.Errorf("resource %s: %v", resource, err)
+			}
+			a.mdevs = append(a.mdevs, mdev)
+			a.used[mdev.UUID] = true
+			return mdev, nil
+		}
+	}
+	return nil, fmt.Errorf("no free mediated device of resource %s (%s) on the host and no device can create one", resource, strings.Join(selectors, ", "))
+}
+
+// groupInUse reports whether a process of the host has VFIO group open.
+func (a *Allocator) groupInUse(group string) bool {
+	if group == "" {
+		return false
+	}
+	if a.inUse == nil {
+		a.inUse = a.host.VFIOGroupsInUse()
+	}
+	return a.inUse[group]
+}
+
+// AllocateUSB returns the next free USB devices of resource: one device
+// matching each of its selectors, in bus and device number order.
+func (a *Allocator) AllocateUSB(resource string) ([]*USBDevice, error) {
+	entries := a.m.usbDevices(resource)
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("resource %s is not in the device map", resource)
+	}
+	if a.usb == nil {
+		devices, err := a.host.USBDevices()
+		if err != nil {
+			return nil, err
+		}
+		a.usb = devices
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		var found []*USBDevice
+		taken := map[string]bool{}
+		for _, selector := range entry.Selectors {
+			ids = append(ids, selector.Vendor+":"+selector.Product)
+			for _, dev := range a.usb {
+				if !a.used["usb:"+dev.Name] && !taken[dev.Name] && dev.Matches(selector) {
+					found = append(found, dev)
+					taken[dev.Name] = true
+					break
+				}
+			}
+		}
+		if len(found) == len(entry.Selectors) {
+			for _, dev := range found {
+				a.used["usb:"+dev.Name] = true
+			}
+			return found, nil
+		}
+	}
+	return nil, fmt.Errorf("no free USB devices of resource %s (%s) on the host", resource, strings.Join(ids, ", "))
+}
+
+// IsMDEV reports whether resource is a mediated device in the map.
+func (a *Allocator) IsMDEV(resource string) bool {
+	return a.m.IsMDEV(resource)
+}
+
+// IsUSB reports whether resource is a USB device in the map.
+func (a *Allocator) IsUSB(resource string) bool {
+	return a.m.IsUSB(resource)
+}
+
+// Host returns the host the allocator reads devices from.
+func (a *Allocator) Host() Host {
+	return a.host
+}
@@ -0,0 +1,149 @@
+package hostdevices
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	virtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// DeviceMap turns the resource names VMs request, such as
+// nvidia.com/TU104GL_Tesla_T4, into host devices. It has the fields of
+// permittedHostDevices in the KubeVirt CR, so a cluster configuration can be
+// reused as is:
+//
+//	pciHostDevices:
+//	- pciVendorSelector: 10DE:1EB8
+//	  resourceName: nvidia.com/TU104GL_Tesla_T4
+//	mediatedDevices:
+//	- mdevNameSelector: GRID T4-1Q
+//	  resourceName: nvidia.com/GRID_T4-1Q
+//	usb:
+//	- resourceName: yubico.com/yubikey
+//	  selectors:
+//	  - vendor: "1050"
+//	    product: "0407"
+//	pciAddresses:
+//	  nvidia.com/TU104GL_Tesla_T4: ["0000:3b:00.0"]
+type DeviceMap struct {
+	virtv1.PermittedHostDevices `json:",inline"`
+	// PCIAddresses limits resources to the listed PCI addresses, handed out
+	// in order. Without an entry, every device matching the selector of the
+	// resource is used, in address order.
+	PCIAddresses map[string][]string `json:"pciAddresses,omitempty"`
+}
+
+// LoadDeviceMap reads a device map from a YAML or JSON file.
+func LoadDeviceMap(file string) (*DeviceMap, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device map: %v", err)
+	}
+	m := &DeviceMap{}
+	if err := yaml.UnmarshalStrict(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse device map %s: %v", file, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid device map %s: %v", file, err)
+	}
+	return m, nil
+}
+
+// Validate checks the selectors and addresses of the map.
+func (m *DeviceMap) Validate() error {
+	for _, dev := range m.PciHostDevices {
+		if dev.ResourceName == "" {
+			return fmt.Errorf("PCI device %q has no resourceName", dev.PCIVendorSelector)
+		}
+		if _, _, err := parseSelector(dev.PCIVendorSelector); err != nil {
+			return fmt.Errorf("resource %s: %v", dev.ResourceName, err)
+		}
+	}
+	for _, dev := range m.MediatedDevices {
+		if dev.ResourceName == "" {
+			return fmt.Errorf("mediated device %q has no resourceName", dev.MDEVNameSelector)
+		}
+		if strings.TrimSpace(dev.MDEVNameSelector) == "" {
+			return fmt.Errorf("resource %s: empty mdevNameSelector", dev.ResourceName)
+		}
+	}
+	for _, dev := range m.USB {
+		if dev.ResourceName == "" {
+			return fmt.Errorf("USB device has no resourceName")
+		}
+		if len(dev.Selectors) == 0 {
+			return fmt.Errorf("resource %s: no USB selectors", dev.ResourceName)
+		}
+		for _, selector := range dev.Selectors {
+			if _, _, err := parseUSBSelector(selector); err != nil {
+				return fmt.Errorf("resource %s: %v", dev.ResourceName, err)
+			}
+		}
+	}
+	for resource, addresses := range m.PCIAddresses {
+		if len(m.pciSelectors(resource)) == 0 {
+			return fmt.Errorf("pciAddresses: resource %s has no pciHostDevices entry", resource)
+		}
+		for _, address := range addresses {
+			if !pciAddress.MatchString(address) {
+				return fmt.Errorf("pciAddresses: resource %s: invalid PCI address %q, expected e.g. 0000:3b:00.0", resource, address)
+			}
+		}
+	}
+	return nil
+}
+
+// pciSelectors returns the vendor:device selectors of resource.
+func (m *DeviceMap) pciSelectors(resource string) []string {
+	var selectors []string
+	for _, dev := range m.PciHostDevices {
+		if dev.ResourceName == resource {
+			selectors = append(selectors, dev.PCIVendorSelector)
+		}
+	}
+	return selectors
+}
+
+// mdevSelectors returns the mdev type selectors of resource.
+func (m *DeviceMap) mdevSelectors(resource string) []string {
+	var selectors []string
+	for _, dev := range m.MediatedDevices {
+		if dev.ResourceName == resource {
+			selectors = append(selectors, dev.MDEVNameSelector)
+		}
+	}
+	return selectors
+}
+
+// IsMDEV reports whether resource is a mediated device in the map.
+func (m *DeviceMap) IsMDEV(resource string) bool {
+	return len(m.mdevSelectors(resource)) > 0
+}
+
+// usbDevices returns the USB entries of resource.
+func (m *DeviceMap) usbDevices(resource string) []virtv1.USBHostDevice {
+	var devices []virtv1.USBHostDevice
+	for _, dev := range m.USB {
+		if dev.ResourceName == resource {
+			devices = append(devices, dev)
+		}
+	}
+	return devices
+}
+
+// IsUSB reports whether resource is a USB device in the map.
+func (m *DeviceMap) IsUSB(resource string) bool {
+	return len(m.usbDevices(resource)) > 0
+}
+
+// parseSelector splits a pciVendorSelector such as 10DE:1EB8 into lower case
+// vendor and device IDs, as sysfs has them.
+func parseSelector(selector string) (vendor, device string, err error) {
+	vendor, device, ok := strings.Cut(strings.ToLower(selector), ":")
+	if !ok || !hexID.MatchString(vendor) || !hexID.MatchString(device) {
+		return "", "", fmt.Errorf("invalid pciVendorSelector %q, expected vendor:device such as 10DE:1EB8", selector)
+	}
+	return vendor, device, nil
+}
@@ -0,0 +1,377 @@
+package hostdevices
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	virtv1 "kubevirt.io/api/core/v1"
+)
+
+// fakeDevice is a PCI device of a fixture sysfs.
+type fakeDevice struct {
+	address, vendor, device, driver, group string
+	drm                                    []string
+	nvidiaMinor                            string
+}
+
+// fakeSysfs lays out devices below a new root the way sysfs and procfs do,
+// with driver and iommu_group as symlinks. files are created as well.
+func fakeSysfs(t *testing.T, devices []fakeDevice, files ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	write := func(path, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	for _, d := range devices {
+		dir := filepath.Join(root, pciDevicesDir, d.address)
+		write(filepath.Join(dir, "vendor"), "0x"+d.vendor+"\n")
+		write(filepath.Join(dir, "device"), "0x"+d.device+"\n")
+		if d.driver != "" {
+			require.NoError(t, os.Symlink("../../../bus/pci/drivers/"+d.driver, filepath.Join(dir, "driver")))
+		}
+		if d.group != "" {
+			require.NoError(t, os.Symlink("../../../kernel/iommu_groups/"+d.group, filepath.Join(dir, "iommu_group")))
+		}
+		for _, node := range d.drm {
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "drm", node), 0755))
+		}
+		if d.nvidiaMinor != "" {
+			write(filepath.Join(root, "proc/driver/nvidia/gpus", d.address, "information"), "Model: \t\t Tesla T4\nIRQ:   \t\t 42\nDevice Minor: \t "+d.nvidiaMinor+"\n")
+		}
+	}
+	for _, file := range files {
+		write(filepath.Join(root, file), "")
+	}
+	return root
+}
+
+// fakeMDEVType adds an mdev type to a parent device of a fixture sysfs.
+func fakeMDEVType(t *testing.T, root, parent, id, name, available string) {
+	t.Helper()
+	dir := filepath.Join(root, mdevBusDir, parent, "mdev_supported_types", id)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "name"), []byte(name+"\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "available_instances"), []byte(available+"\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "create"), nil, 0644))
+}
+
+// fakeMDEV adds a mediated device of a type added with fakeMDEVType, the way
+// the kernel does when the UUID is written to create.
+func fakeMDEV(t *testing.T, root, parent, id, uuid, group string) {
+	t.Helper()
+	dir := filepath.Join(root, mdevDevicesDir, uuid)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.Symlink(filepath.Join(root, mdevBusDir, parent, "mdev_supported_types", id), filepath.Join(dir, "mdev_type")))
+	require.NoError(t, os.Symlink("../../../kernel/iommu_groups/"+group, filepath.Join(dir, "iommu_group")))
+}
+
+// fakeUSB adds a USB device to a fixture sysfs, with its IDs in uevent the
+// way the kernel writes them.
+// fakeOpenFD makes process pid of the host hold target open.
+func fakeOpenFD(t *testing.T, root string, pid, fd int, target string) {
+	dir := filepath.Join(root, "proc", strconv.Itoa(pid), "fd")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.Symlink(target, filepath.Join(dir, strconv.Itoa(fd))))
+}
+
+func fakeUSB(t *testing.T, root, name, product string, bus, devnum int) {
+	t.Helper()
+	dir := filepath.Join(root, usbDevicesDir, name)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "idVendor"), nil, 0644))
+	uevent := fmt.Sprintf("MAJOR=189\nMINOR=%d\nDEVNAME=bus/usb/%03d/%03d\nDEVTYPE=usb_device\nDRIVER=usb\nPRODUCT=%s\nTYPE=0/0/0\nBUSNUM=%03d\nDEVNUM=%03d\n",
+		(bus-1)*128+devnum-1, bus, devnum, product, bus, devnum)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "uevent"), []byte(uevent), 0644))
+}
+
+var t4Map = &DeviceMap{
+	PermittedHostDevices: virtv1.PermittedHostDevices{
+		PciHostDevices: []virtv1.PciHostDevice{
+			{PCIVendorSelector: "10DE:1EB8", ResourceName: "nvidia.com/TU104GL_Tesla_T4"},
+			{PCIVendorSelector: "1002:73BF", ResourceName: "amd.com/Navi21"},
+		},
+	},
+}
+
+func TestPCIDevices(t *testing.T) {
+	root := fakeSysfs(t, []fakeDevice{
+		{address: "0000:af:00.0", vendor: "10de", device: "1eb8", driver: "nvidia", group: "80", nvidiaMinor: "1"},
+		{address: "0000:3b:00.0", vendor: "10de", device: "1eb8", driver: "vfio-pci", group: "42"},
+		{address: "0000:00:02.0", vendor: "8086", device: "3e92", driver: "i915", drm: []string{"card0", "renderD128", "controlD64"}},
+		{address: "0000:00:1f.0", vendor: "8086", device: "a305"},
+	}, "dev/nvidiactl", "dev/nvidia-uvm")
+	host := Host{Root: root}
+
+	devices, err := host.PCIDevices()
+	require.NoError(t, err)
+	require.Len(t, devices, 4)
+	require.Equal(t, []string{"0000:00:02.0", "0000:00:1f.0", "0000:3b:00.0", "0000:af:00.0"},
+		[]string{devices[0].Address, devices[1].Address, devices[2].Address, devices[3].Address})
+
+	require.Equal(t, &PCIDevice{Address: "0000:3b:00.0", Vendor: "10de", Device: "1eb8", Driver: "vfio-pci", IOMMUGroup: "42", NvidiaMinor: -1}, devices[2])
+	require.True(t, devices[2].Matches("10DE:1EB8"))
+	require.False(t, devices[2].Matches("10DE:1EB9"))
+
+	require.Equal(t, []string{"/dev/vfio/vfio", "/dev/vfio/42"}, devices[2].Nodes(host))
+	require.Equal(t, []string{"/dev/nvidia1", "/dev/nvidiactl", "/dev/nvidia-uvm"}, devices[3].Nodes(host))
+	require.Equal(t, []string{"/dev/dri/card0", "/dev/dri/renderD128"}, devices[0].Nodes(host))
+	require.Empty(t, devices[1].Nodes(host))
+
+	_, err = host.PCIDevice("0000:01:00.0")
+	require.EqualError(t, err, "no PCI device 0000:01:00.0 on the host")
+	dev, err := host.PCIDevice("0000:AF:00.0")
+	require.NoError(t, err)
+	require.Equal(t, 1, dev.NvidiaMinor)
+
+	_, err = Host{Root: t.TempDir()}.PCIDevices()
+	require.Error(t, err)
+}
+
+func TestCheckVFIO(t *testing.T) {
+	require.NoError(t, (&PCIDevice{Address: "0000:3b:00.0", Driver: "vfio-pci", IOMMUGroup: "42"}).CheckVFIO())
+	require.EqualError(t, (&PCIDevice{Address: "0000:3b:00.0"}).CheckVFIO(),
+		"PCI device 0000:3b:00.0 is not bound to a driver; bind it to vfio-pci: sudo driverctl set-override 0000:3b:00.0 vfio-pci")
+	require.EqualError(t, (&PCIDevice{Address: "0000:3b:00.0", Driver: "ice", IOMMUGroup: "42"}).CheckVFIO(),
+		"PCI device 0000:3b:00.0 is bound to ice, not vfio-pci; bind it to vfio-pci: sudo driverctl set-override 0000:3b:00.0 vfio-pci")
+	err := (&PCIDevice{Address: "0000:3b:00.0", Driver: "vfio-pci"}).CheckVFIO()
+	require.Equal(t, &VFIOError{Address: "0000:3b:00.0", Problem: "is in no IOMMU group", Fix: "enable VT-d or AMD-Vi in the firmware and boot with intel_iommu=on iommu=pt"}, err)
+}
+
+func TestAllocatePCI(t *testing.T) {
+	root := fakeSysfs(t, []fakeDevice{
+		{address: "0000:af:00.0", vendor: "10de", device: "1eb8", driver: "vfio-pci", group: "80"},
+		{address: "0000:3b:00.0", vendor: "10de", device: "1eb8", driver: "vfio-pci", group: "42"},
+		{address: "0000:00:02.0", vendor: "8086", device: "3e92", driver: "i915"},
+	})
+	host := Host{Root: root}
+
+	t.Run("by selector in address order", func(t *testing.T) {
+		a := NewAllocator(t4Map, host)
+		dev, err := a.AllocatePCI("nvidia.com/TU104GL_Tesla_T4")
+		require.NoError(t, err)
+		require.Equal(t, "0000:3b:00.0", dev.Address)
+		dev, err = a.AllocatePCI("nvidia.com/TU104GL_Tesla_T4")
+		require.NoError(t, err)
+		require.Equal(t, "0000:af:00.0", dev.Address)
+		_, err = a.AllocatePCI("nvidia.com/TU104GL_Tesla_T4")
+		require.EqualError(t, err, "all 2 PCI devices of resource nvidia.com/TU104GL_Tesla_T4 are already assigned")
+	})
+
+	t.Run("pinned addresses", func(t *testing.T) {
+		m := *t4Map
+		m.PCIAddresses = map[string][]string{"nvidia.com/TU104GL_Tesla_T4": {"0000:AF:00.0"}}
+		a := NewAllocator(&m, host)
+		dev, err := a.AllocatePCI("nvidia.com/TU104GL_Tesla_T4")
+		require.NoError(t, err)
+		require.Equal(t, "0000:af:00.0", dev.Address)
+		_, err = a.AllocatePCI("nvidia.com/TU104GL_Tesla_T4")
+		require.EqualError(t, err, "all 1 PCI devices of resource nvidia.com/TU104GL_Tesla_T4 are already assigned")
+
+		m.PCIAddresses = map[string][]string{"nvidia.com/TU104GL_Tesla_T4": {"0000:00:02.0"}}
+		_, err = NewAllocator(&m, host).AllocatePCI("nvidia.com/TU104GL_Tesla_T4")
+		require.EqualError(t, err, "resource nvidia.com/TU104GL_Tesla_T4: PCI device 0000:00:02.0 is 8086:3e92, which does not match 10DE:1EB8")
+
+		m.PCIAddresses = map[string][]string{"nvidia.com/TU104GL_Tesla_T4": {"0000:01:00.0"}}
+		_, err = NewAllocator(&m, host).AllocatePCI("nvidia.com/TU104GL_Tesla_T4")
+		require.EqualError(t, err, "resource nvidia.com/TU104GL_Tesla_T4: no PCI device 0000:01:00.0 on the host")
+	})
+
+	t.Run("in use by a running VM", func(t *testing.T) {
+		root := fakeSysfs(t, []fakeDevice{
+			{address: "0000:af:00.0", vendor: "10de", device: "1eb8", driver: "vfio-pci", group: "80"},
+			{address: "0000:3b:00.0", vendor: "10de", device: "1eb8", driver: "vfio-pci", group: "42"},
+		})
+		fakeOpenFD(t, root, 4242, 3, "/dev/vfio/vfio")
+		fakeOpenFD(t, root, 4242, 4, "/dev/vfio/42")
+		fakeOpenFD(t, root, 4242, 5, "/dev/null")
+		host := Host{Root: root}
+		require.Equal(t, map[string]bool{"42": true}, host.VFIOGroupsInUse())
+
+		a := NewAllocator(t4Map, host)
+		dev, err := a.AllocatePCI("nvidia.com/TU104GL_Tesla_T4")
+		require.NoError(t, err)
+		require.Equal(t, "0000:af:00.0", dev.Address)
+		_, err = a.AllocatePCI("nvidia.com/TU104GL_Tesla_T4")
+		require.EqualError(t, err, "all 2 PCI devices of resource nvidia.com/TU104GL_Tesla_T4 are already assigned or in use, 1 by another process")
+	})
+
+	t.Run("unknown or missing resources", func(t *testing.T) {
+		a := NewAllocator(t4Map, host)
+		_, err := a.AllocatePCI("nvidia.com/GA102GL_A10")
+		require.EqualError(t, err, "resource nvidia.com/GA102GL_A10 is not in the device map")
+		_, err = a.AllocatePCI("amd.com/Navi21")
+		require.EqualError(t, err, "no PCI device of resource amd.com/Navi21 (1002:73BF) on the host")
+	})
+}
+
+func TestAllocateMDEV(t *testing.T) {
+	root := t.TempDir()
+	fakeMDEVType(t, root, "0000:3b:00.0", "nvidia-222", "GRID T4-1Q", "14")
+	fakeMDEVType(t, root, "0000:3b:00.0", "nvidia-223", "GRID T4-2Q", "0")
+	fakeMDEV(t, root, "0000:3b:00.0", "nvidia-222", "b1ae0ae5-1b94-4c3b-8c8a-bd7bbea8a0b2", "101")
+	fakeMDEV(t, root, "0000:3b:00.0", "nvidia-222", "0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a", "100")
+	fakeMDEV(t, root, "0000:3b:00.0", "nvidia-223", "5f1f4d2c-7d8e-4f3a-a1c2-93b1e7f0d6a4", "102")
+	host := Host{Root: root}
+	m := &DeviceMap{PermittedHostDevices: virtv1.PermittedHostDevices{
+		MediatedDevices: []virtv1.MediatedHostDevice{
+			{MDEVNameSelector: "GRID T4-1Q", ResourceName: "nvidia.com/GRID_T4-1Q"},
+			{MDEVNameSelector: "nvidia-223", ResourceName: "nvidia.com/GRID_T4-2Q"},
+			{MDEVNameSelector: "i915-GVTg_V5_4", ResourceName: "intel.com/U630"},
+		},
+	}}
+
+	mdevs, err := host.MDEVs()
+	require.NoError(t, err)
+	require.Len(t, mdevs, 3)
+	require.Equal(t, &MDEV{UUID: "0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a", Type: "GRID_T4-1Q", TypeID: "nvidia-222", Parent: "0000:3b:00.0", IOMMUGroup: "100"}, mdevs[0])
+	require.Equal(t, []string{"/dev/vfio/vfio", "/dev/vfio/100"}, mdevs[0].Nodes())
+	require.True(t, m.IsMDEV("nvidia.com/GRID_T4-1Q"))
+	require.False(t, t4Map.IsMDEV("nvidia.com/TU104GL_Tesla_T4"))
+
+	t.Run("existing", func(t *testing.T) {
+		a := NewAllocator(m, host)
+		for _, want := range []string{"0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a", "b1ae0ae5-1b94-4c3b-8c8a-bd7bbea8a0b2"} {
+			mdev, err := a.AllocateMDEV("nvidia.com/GRID_T4-1Q")
+			require.NoError(t, err)
+			require.Equal(t, want, mdev.UUID)
+		}
+		_, err := a.AllocateMDEV("nvidia.com/GRID_T4-1Q")
+		require.EqualError(t, err, "no free mediated device of resource nvidia.com/GRID_T4-1Q (GRID T4-1Q) on the host")
+
+		mdev, err := a.AllocateMDEV("nvidia.com/GRID_T4-2Q")
+		require.NoError(t, err, "selected by type ID")
+		require.Equal(t, "5f1f4d2c-7d8e-4f3a-a1c2-93b1e7f0d6a4", mdev.UUID)
+		_, err = a.AllocateMDEV("nvidia.com/GRID_T4-8Q")
+		require.EqualError(t, err, "resource nvidia.com/GRID_T4-8Q is not in the device map")
+	})
+
+	t.Run("in use by a running VM", func(t *testing.T) {
+		root := t.TempDir()
+		fakeMDEVType(t, root, "0000:3b:00.0", "nvidia-222", "GRID T4-1Q", "0")
+		fakeMDEV(t, root, "0000:3b:00.0", "nvidia-222", "b1ae0ae5-1b94-4c3b-8c8a-bd7bbea8a0b2", "101")
+		fakeMDEV(t, root, "0000:3b:00.0", "nvidia-222", "0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a", "100")
+		fakeOpenFD(t, root, 4242, 7, "/dev/vfio/100")
+
+		a := NewAllocator(m, Host{Root: root})
+		a.CreateMDEVs = true
+		mdev, err := a.AllocateMDEV("nvidia.com/GRID_T4-1Q")
+		require.NoError(t, err)
+		require.Equal(t, "b1ae0ae5-1b94-4c3b-8c8a-bd7bbea8a0b2", mdev.UUID)
+		_, err = a.AllocateMDEV("nvidia.com/GRID_T4-1Q")
+		require.EqualError(t, err, "no free mediated device of resource nvidia.com/GRID_T4-1Q (GRID T4-1Q) on the host and no device can create one")
+	})
+
+	t.Run("created", func(t *testing.T) {
+		a := NewAllocator(m, host)
+		a.CreateMDEVs = true
+		a.newUUID = func() string {
+			// The kernel creates the device when the UUID is written.
+			fakeMDEV(t, root, "0000:3b:00.0", "nvidia-222", "f3a1b2c4-0000-4000-8000-000000000001", "103")
+			return "f3a1b2c4-0000-4000-8000-000000000001"
+		}
+		for i := 0; i < 2; i++ {
+			_, err := a.AllocateMDEV("nvidia.com/GRID_T4-1Q")
+			require.NoError(t, err)
+		}
+		mdev, err := a.AllocateMDEV("nvidia.com/GRID_T4-1Q")
+		require.NoError(t, err)
+		require.Equal(t, &MDEV{UUID: "f3a1b2c4-0000-4000-8000-000000000001", Type: "GRID_T4-1Q", TypeID: "nvidia-222", Parent: "0000:3b:00.0", IOMMUGroup: "103"}, mdev)
+		created, err := os.ReadFile(filepath.Join(root, mdevBusDir, "0000:3b:00.0/mdev_supported_types/nvidia-222/create"))
+		require.NoError(t, err)
+		require.Equal(t, "f3a1b2c4-0000-4000-8000-000000000001", string(created))
+
+		_, err = a.AllocateMDEV("nvidia.com/GRID_T4-2Q")
+		require.NoError(t, err)
+		_, err = a.AllocateMDEV("nvidia.com/GRID_T4-2Q")
+		require.EqualError(t, err, "no free mediated device of resource nvidia.com/GRID_T4-2Q (nvidia-223) on the host and no device can create one")
+	})
+}
+
+func TestAllocateUSB(t *testing.T) {
+	root := t.TempDir()
+	fakeUSB(t, root, "1-4", "1050/407/526", 1, 4)
+	fakeUSB(t, root, "1-1.2", "1050/407/543", 1, 2)
+	fakeUSB(t, root, "2-1", "403/6001/600", 2, 3)
+	fakeUSB(t, root, "2-2", "46d/c52b/1211", 2, 5)
+	// Root hubs and interfaces are not devices to pass through.
+	fakeUSB(t, root, "usb1", "1d6b/2/612", 1, 1)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, usbDevicesDir, "1-4:1.0"), 0755))
+	host := Host{Root: root}
+	m := &DeviceMap{PermittedHostDevices: virtv1.PermittedHostDevices{
+		USB: []virtv1.USBHostDevice{
+			{ResourceName: "yubico.com/yubikey", Selectors: []virtv1.USBSelector{{Vendor: "1050", Product: "0407"}}},
+			{ResourceName: "lab.example.com/console", Selectors: []virtv1.USBSelector{
+				{Vendor: "0403", Product: "6001"},
+				{Vendor: "046d", Product: "c52b"},
+			}},
+			{ResourceName: "lab.example.com/console", Selectors: []virtv1.USBSelector{{Vendor: "0403", Product: "6015"}}},
+		},
+	}}
+
+	devices, err := host.USBDevices()
+	require.NoError(t, err)
+	require.Len(t, devices, 4)
+	require.Equal(t, &USBDevice{Name: "1-1.2", Vendor: 0x1050, Product: 0x0407, Bus: 1, DeviceNumber: 2, Node: "/dev/bus/usb/001/002"}, devices[0])
+	require.Equal(t, "1:2", devices[0].Address())
+	require.True(t, m.IsUSB("yubico.com/yubikey"))
+	require.False(t, t4Map.IsUSB("nvidia.com/TU104GL_Tesla_T4"))
+
+	a := NewAllocator(m, host)
+	for _, want := range []string{"1-1.2", "1-4"} {
+		usb, err := a.AllocateUSB("yubico.com/yubikey")
+		require.NoError(t, err)
+		require.Len(t, usb, 1)
+		require.Equal(t, want, usb[0].Name)
+	}
+	_, err = a.AllocateUSB("yubico.com/yubikey")
+	require.EqualError(t, err, "no free USB devices of resource yubico.com/yubikey (1050:0407) on the host")
+
+	usb, err := a.AllocateUSB("lab.example.com/console")
+	require.NoError(t, err, "one device per selector")
+	require.Equal(t, []string{"2:3", "2:5"}, []string{usb[0].Address(), usb[1].Address()})
+	_, err = a.AllocateUSB("lab.example.com/console")
+	require.EqualError(t, err, "no free USB devices of resource lab.example.com/console (0403:6001, 046d:c52b, 0403:6015) on the host")
+	_, err = a.AllocateUSB("ftdi.com/serial")
+	require.EqualError(t, err, "resource ftdi.com/serial is not in the device map")
+}
+
+func TestLoadDeviceMap(t *testing.T) {
+	load := func(content string) (*DeviceMap, error) {
+		file := filepath.Join(t.TempDir(), "devices.yaml")
+		require.NoError(t, os.WriteFile(file, []byte(content), 0644))
+		return LoadDeviceMap(file)
+	}
+
+	m, err := load(`pciHostDevices:
+- pciVendorSelector: 10DE:1EB8
+  resourceName: nvidia.com/TU104GL_Tesla_T4
+pciAddresses:
+  nvidia.com/TU104GL_Tesla_T4: ["0000:3b:00.0", "0000:af:00.0"]
+`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"10DE:1EB8"}, m.pciSelectors("nvidia.com/TU104GL_Tesla_T4"))
+	require.Equal(t, []string{"0000:3b:00.0", "0000:af:00.0"}, m.PCIAddresses["nvidia.com/TU104GL_Tesla_T4"])
+
+	for content, want := range map[string]string{
+		"pciHostDevice: []\n": `unknown field "pciHostDevice"`,
+		"pciHostDevices:\n- pciVendorSelector: 10DE-1EB8\n  resourceName: nvidia.com/T4\n":                                                `resource nvidia.com/T4: invalid pciVendorSelector "10DE-1EB8"`,
+		"mediatedDevices:\n- mdevNameSelector: GRID T4-1Q\n":                                                                              `mediated device "GRID T4-1Q" has no resourceName`,
+		"pciHostDevices:\n- pciVendorSelector: 10DE:1EB8\n":                                                                               `PCI device "10DE:1EB8" has no resourceName`,
+		"usb:\n- selectors:\n  - {vendor: \"1050\", product: \"0407\"}\n":                                                                 "USB device has no resourceName",
+		"usb:\n- resourceName: yubico.com/yubikey\n":                                                                                      "resource yubico.com/yubikey: no USB selectors",
+		"usb:\n- resourceName: yubico.com/yubikey\n  selectors:\n  - {vendor: \"1050\", product: \"yubi\"}\n":                             "resource yubico.com/yubikey: invalid USB selector 1050:yubi",
+		"pciAddresses:\n  nvidia.com/T4: [\"0000:3b:00.0\"]\n":                                                                            "resource nvidia.com/T4 has no pciHostDevices entry",
+		"pciHostDevices:\n- pciVendorSelector: 10DE:1EB8\n  resourceName: nvidia.com/T4\npciAddresses:\n  nvidia.com/T4: [\"3b:00.0\"]\n": `invalid PCI address "3b:00.0"`,
+	} {
+		_, err := load(content)
+		require.ErrorContains(t, err, want)
+	}
+
+	_, err = LoadDeviceMap(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.ErrorContains(t, err, "failed to read device map")
+}
@@ -0,0 +1,148 @@
+package hostdevices
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	mdevDevicesDir = "/sys/bus/mdev/devices"
+	mdevBusDir     = "/sys/class/mdev_bus"
+)
+
+// MDEV is a mediated device of the host, such as a vGPU.
+type MDEV struct {
+	UUID string
+	// Type is the name of the mdev type with spaces replaced by _, e.g.
+	// GRID_T4-1Q, as KubeVirt matches mdevNameSelector against it.
+	Type string
+	// TypeID is the ID of the mdev type, e.g. nvidia-222.
+	TypeID string
+	// Parent is the PCI address of the device the mdev was created on.
+	Parent string
+	// IOMMUGroup is the IOMMU group of the mdev, the number of its VFIO
+	// group.
+	IOMMUGroup string
+}
+
+// MDEVs returns the mediated devices of the host, ordered by UUID.
+func (h Host) MDEVs() ([]*MDEV, error) {
+	entries, err := os.ReadDir(h.path(mdevDevicesDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mediated devices: %v", err)
+	}
+	var mdevs []*MDEV
+	for _, e := range entries {
+		mdevs = append(mdevs, h.mdev(e.Name()))
+	}
+	sort.Slice(mdevs, func(i, j int) bool { return mdevs[i].UUID < mdevs[j].UUID })
+	return mdevs, nil
+}
+
+// MDEV returns the mediated device with uuid.
+func (h Host) MDEV(uuid string) (*MDEV, error) {
+	if !h.exists(filepath.Join(mdevDevicesDir, uuid)) {
+		return nil, fmt.Errorf("no mediated device %s on the host", uuid)
+	}
+	return h.mdev(uuid), nil
+}
+
+func (h Host) mdev(uuid string) *MDEV {
+	dir := filepath.Join(mdevDevicesDir, uuid)
+	mdev := &MDEV{UUID: uuid, IOMMUGroup: h.link(dir + "/iommu_group")}
+	// mdev_type links to <parent>/mdev_supported_types/<type ID>.
+	if target, err := os.Readlink(h.path(dir + "/mdev_type")); err == nil {
+		mdev.TypeID = filepath.Base(target)
+		mdev.Parent = filepath.Base(filepath.Dir(filepath.Dir(target)))
+	}
+	mdev.Type = typeName(h.read(dir+"/mdev_type/name"), mdev.TypeID)
+	return mdev
+}
+
+// typeName returns the name of an mdev type the way KubeVirt compares it,
+// with spaces replaced by _, or its ID if it has no name.
+func typeName(name, id string) string {
+	if name == "" {
+		return id
+	}
+	return strings.ReplaceAll(name, " ", "_")
+}
+
+// matchesType reports whether an mdevNameSelector selects the type with name
+// and id.
+func matchesType(selector, name, id string) bool {
+	selector = strings.ReplaceAll(strings.TrimSpace(selector), " ", "_")
+	return selector == name || selector == id
+}
+
+// Matches reports whether the mdev matches an mdevNameSelector, by type name
+// or type ID.
+func (d *MDEV) Matches(selector string) bool {
+	return matchesType(selector, d.Type, d.TypeID)
+}
+
+// Nodes returns the VFIO device nodes of the mdev, or nil if it is in no
+// IOMMU group.
+func (d *MDEV) Nodes() []string {
+	if d.IOMMUGroup == "" {
+		return nil
+	}
+	return []string{"/dev/vfio/vfio", "/dev/vfio/" + d.IOMMUGroup}
+}
+
+// MDEVType is a type of mediated device a parent device can create.
+type MDEVType struct {
+	// Parent is the PCI address of the parent device.
+	Parent string
+	ID     string
+	// Name is the type name with spaces replaced by _.
+	Name string
+	// Available is how many more mdevs of the type the parent can create.
+	Available int
+}
+
+// MDEVTypes returns the mdev types the devices of the host support, ordered
+// by parent and ID.
+func (h Host) MDEVTypes() ([]*MDEVType, error) {
+	dirs, err := filepath.Glob(h.path(mdevBusDir + "/*/mdev_supported_types/*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mdev types: %v", err)
+	}
+	var types []*MDEVType
+	for _, dir := range dirs {
+		parent := filepath.Base(filepath.Dir(filepath.Dir(dir)))
+		id := filepath.Base(dir)
+		rel := filepath.Join(mdevBusDir, parent, "mdev_supported_types", id)
+		available, _ := strconv.Atoi(h.read(rel + "/available_instances"))
+		types = append(types, &MDEVType{Parent: parent, ID: id, Name: typeName(h.read(rel+"/name"), id), Available: available})
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Parent != types[j].Parent {
+			return types[i].Parent < types[j].Parent
+		}
+		return types[i].ID < types[j].ID
+	})
+	return types, nil
+}
+
+// Matches reports whether the type matches an mdevNameSelector.
+func (t *MDEVType) Matches(selector string) bool {
+	return matchesType(selector, t.Name, t.ID)
+}
+
+// CreateMDEV creates a mediated device of type t with uuid, as
+// echo <uuid> > mdev_supported_types/<type>/create does.
+func (h Host) CreateMDEV(t *MDEVType, uuid string) (*MDEV, error) {
+	create := h.path(filepath.Join(mdevBusDir, t.Parent, "mdev_supported_types", t.ID, "create"))
+	if err := os.WriteFile(create, []byte(uuid), 0200); err != nil {
+		return nil, fmt.Errorf("failed to create mediated device of type %s on %s: %v", t.Name, t.Parent, err)
+	}
+	return h.MDEV(uuid)
+}
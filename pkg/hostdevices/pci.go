@@ -0,0 +1,193 @@
+package hostdevices
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	hexID      = regexp.MustCompile(`^[0-9a-f]{4}$`)
+	pciAddress = regexp.MustCompile(`^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+)
+
+// Host reads the devices of a host from its sysfs and procfs.
+type Host struct {
+	// Root is where the host's /sys, /proc and /dev are, so a host mounted
+	// elsewhere or a fixture tree can be read. Empty means /.
+	Root string
+}
+
+func (h Host) path(path string) string {
+	return filepath.Join("/", h.Root, path)
+}
+
+func (h Host) exists(path string) bool {
+	_, err := os.Stat(h.path(path))
+	return err == nil
+}
+
+func (h Host) read(path string) string {
+	data, _ := os.ReadFile(h.path(path))
+	return strings.TrimSpace(string(data))
+}
+
+// link returns the base name of the target of a symlink, e.g. the driver of
+// a device, or "" if there is none.
+func (h Host) link(path string) string {
+	target, err := os.Readlink(h.path(path))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// VFIOGroupsInUse returns the VFIO groups some process of the host has
+// open, from the /dev/vfio/<group> links in /proc/<pid>/fd. A VFIO group can
+// be open only once, so a device whose group is in use belongs to a running
+// VM. Processes whose descriptors cannot be read, such as those of other
+// users when not running as root, are not seen.
+func (h Host) VFIOGroupsInUse() map[string]bool {
+	groups := map[string]bool{}
+	fds, _ := filepath.Glob(h.path("/proc/[0-9]*/fd/*"))
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil {
+			continue
+		}
+		if group, ok := strings.CutPrefix(target, "/dev/vfio/"); ok && group != "vfio" {
+			groups[group] = true
+		}
+	}
+	return groups
+}
+
+// PCIDevice is a PCI device of the host.
+type PCIDevice struct {
+	// Address is the full PCI address, e.g. 0000:3b:00.0.
+	Address string
+	// Vendor and Device are the lower case hex IDs, e.g. 10de and 1eb8.
+	Vendor string
+	Device string
+	// Driver is the bound driver, e.g. vfio-pci or nvidia; empty if unbound.
+	Driver string
+	// IOMMUGroup is the IOMMU group number; empty without an IOMMU.
+	IOMMUGroup string
+	// NvidiaMinor is the minor of /dev/nvidiaN for devices bound to the
+	// NVIDIA driver, otherwise -1.
+	NvidiaMinor int
+	// DRMNodes are the /dev/dri nodes of the device, e.g. /dev/dri/card1.
+	DRMNodes []string
+}
+
+const pciDevicesDir = "/sys/bus/pci/devices"
+
+// PCIDevices returns the PCI devices of the host, ordered by address.
+func (h Host) PCIDevices() ([]*PCIDevice, error) {
+	entries, err := os.ReadDir(h.path(pciDevicesDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PCI devices: %v", err)
+	}
+	var devices []*PCIDevice
+	for _, e := range entries {
+		devices = append(devices, h.pciDevice(e.Name()))
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Address < devices[j].Address })
+	return devices, nil
+}
+
+// PCIDevice returns the PCI device at address.
+func (h Host) PCIDevice(address string) (*PCIDevice, error) {
+	address = strings.ToLower(address)
+	if !h.exists(filepath.Join(pciDevicesDir, address)) {
+		return nil, fmt.Errorf("no PCI device %s on the host", address)
+	}
+	return h.pciDevice(address), nil
+}
+
+func (h Host) pciDevice(address string) *PCIDevice {
+	dir := filepath.Join(pciDevicesDir, address)
+	dev := &PCIDevice{
+		Address:     address,
+		Vendor:      strings.TrimPrefix(h.read(dir+"/vendor"), "0x"),
+		Device:      strings.TrimPrefix(h.read(dir+"/device"), "0x"),
+		Driver:      h.link(dir + "/driver"),
+		IOMMUGroup:  h.link(dir + "/iommu_group"),
+		NvidiaMinor: -1,
+	}
+	if dev.Driver == "nvidia" {
+		for _, line := range strings.Split(h.read("/proc/driver/nvidia/gpus/"+address+"/information"), "\n") {
+			if name, value, ok := strings.Cut(line, ":"); ok && strings.TrimSpace(name) == "Device Minor" {
+				fmt.Sscanf(strings.TrimSpace(value), "%d", &dev.NvidiaMinor)
+			}
+		}
+	}
+	if entries, err := os.ReadDir(h.path(dir + "/drm")); err == nil {
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), "card") || strings.HasPrefix(e.Name(), "renderD") {
+				dev.DRMNodes = append(dev.DRMNodes, "/dev/dri/"+e.Name())
+			}
+		}
+	}
+	return dev
+}
+
+// Matches reports whether the device matches a pciVendorSelector.
+func (d *PCIDevice) Matches(selector string) bool {
+	vendor, device, err := parseSelector(selector)
+	return err == nil && d.Vendor == vendor && d.Device == device
+}
+
+// Nodes returns the device nodes that give access to the device, depending
+// on its driver: its VFIO group for vfio-pci, /dev/nvidiaN and the control
+// nodes present on the host for nvidia, and its DRM nodes for other GPU
+// drivers.
+func (d *PCIDevice) Nodes(h Host) []string {
+	switch {
+	case d.Driver == "vfio-pci" && d.IOMMUGroup != "":
+		return []string{"/dev/vfio/vfio", "/dev/vfio/" + d.IOMMUGroup}
+	case d.Driver == "nvidia" && d.NvidiaMinor >= 0:
+		nodes := []string{fmt.Sprintf("/dev/nvidia%d", d.NvidiaMinor)}
+		for _, node := range []string{"/dev/nvidiactl", "/dev/nvidia-uvm", "/dev/nvidia-uvm-tools", "/dev/nvidia-modeset"} {
+			if h.exists(node) {
+				nodes = append(nodes, node)
+			}
+		}
+		return nodes
+	}
+	return d.DRMNodes
+}
+
+// VFIOError is why a PCI device cannot be passed through with VFIO.
+type VFIOError struct {
+	Address string
+	// Problem says what is wrong, e.g. that the device is bound to another
+	// driver, and Fix how to fix it.
+	Problem string
+	Fix     string
+}
+
+func (e *VFIOError) Error() string {
+	return fmt.Sprintf("PCI device %s %s; %s", e.Address, e.Problem, e.Fix)
+}
+
+// CheckVFIO checks that the device can be passed through: it must be bound
+// to vfio-pci and be in an IOMMU group. The error is a *VFIOError.
+func (d *PCIDevice) CheckVFIO() error {
+	switch {
+	case d.Driver == "":
+		return &VFIOError{Address: d.Address, Problem: "is not bound to a driver", Fix: d.bindHint()}
+	case d.Driver != "vfio-pci":
+		return &VFIOError{Address: d.Address, Problem: fmt.Sprintf("is bound to %s, not vfio-pci", d.Driver), Fix: d.bindHint()}
+	case d.IOMMUGroup == "":
+		return &VFIOError{Address: d.Address, Problem: "is in no IOMMU group", Fix: "enable VT-d or AMD-Vi in the firmware and boot with intel_iommu=on iommu=pt"}
+	}
+	return nil
+}
+
+func (d *PCIDevice) bindHint() string {
+	return fmt.Sprintf("bind it to vfio-pci: sudo driverctl set-override %s vfio-pci", d.Address)
+}
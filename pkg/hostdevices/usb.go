@@ -0,0 +1,114 @@
+package hostdevices
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	virtv1 "kubevirt.io/api/core/v1"
+)
+
+const usbDevicesDir = "/sys/bus/usb/devices"
+
+// USBDevice is a USB device of the host.
+type USBDevice struct {
+	// Name is the name of the device in sysfs, e.g. 1-1.2.
+	Name    string
+	Vendor  int
+	Product int
+	// Bus and DeviceNumber address the device; the device number changes
+	// every time it is plugged in.
+	Bus          int
+	DeviceNumber int
+	// Node is the device node, e.g. /dev/bus/usb/001/004.
+	Node string
+}
+
+// Address returns the bus:device address of the device, as virt-launcher
+// reads it from the USB_RESOURCE_* variables.
+func (d *USBDevice) Address() string {
+	return fmt.Sprintf("%d:%d", d.Bus, d.DeviceNumber)
+}
+
+// USBDevices returns the USB devices of the host, ordered by bus and device
+// number. Root hubs and interfaces are left out.
+func (h Host) USBDevices() ([]*USBDevice, error) {
+	entries, err := os.ReadDir(h.path(usbDevicesDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list USB devices: %v", err)
+	}
+	var devices []*USBDevice
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "usb") || !h.exists(filepath.Join(usbDevicesDir, e.Name(), "idVendor")) {
+			continue
+		}
+		if dev := h.usbDevice(e.Name()); dev != nil {
+			devices = append(devices, dev)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Bus != devices[j].Bus {
+			return devices[i].Bus < devices[j].Bus
+		}
+		return devices[i].DeviceNumber < devices[j].DeviceNumber
+	})
+	return devices, nil
+}
+
+// usbDevice reads a device from its uevent file, as KubeVirt does, or
+// returns nil if the file is incomplete.
+func (h Host) usbDevice(name string) *USBDevice {
+	dev := &USBDevice{Name: name}
+	var hasProduct, hasBus, hasDevice bool
+	for _, line := range strings.Split(h.read(filepath.Join(usbDevicesDir, name, "uevent")), "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		var err error
+		switch key {
+		case "BUSNUM":
+			dev.Bus, err = strconv.Atoi(value)
+			hasBus = err == nil
+		case "DEVNUM":
+			dev.DeviceNumber, err = strconv.Atoi(value)
+			hasDevice = err == nil
+		case "PRODUCT":
+			// vendor/product/bcdDevice in hex without leading zeros
+			if ids := strings.Split(value, "/"); len(ids) == 3 {
+				vendor, verr := strconv.ParseInt(ids[0], 16, 32)
+				product, perr := strconv.ParseInt(ids[1], 16, 32)
+				dev.Vendor, dev.Product = int(vendor), int(product)
+				hasProduct = verr == nil && perr == nil
+			}
+		case "DEVNAME":
+			dev.Node = filepath.Join("/dev", value)
+		}
+	}
+	if !hasProduct || !hasBus || !hasDevice {
+		return nil
+	}
+	if dev.Node == "" {
+		dev.Node = fmt.Sprintf("/dev/bus/usb/%03d/%03d", dev.Bus, dev.DeviceNumber)
+	}
+	return dev
+}
+
+// Matches reports whether the device matches a USB selector.
+func (d *USBDevice) Matches(selector virtv1.USBSelector) bool {
+	vendor, product, err := parseUSBSelector(selector)
+	return err == nil && d.Vendor == vendor && d.Product == product
+}
+
+// parseUSBSelector parses the hex vendor and product IDs of a selector.
+func parseUSBSelector(selector virtv1.USBSelector) (vendor, product int, err error) {
+	v, verr := strconv.ParseUint(selector.Vendor, 16, 16)
+	p, perr := strconv.ParseUint(selector.Product, 16, 16)
+	if verr != nil || perr != nil {
+		return 0, 0, fmt.Errorf("invalid USB selector %s:%s, expected hex vendor and product IDs such as 1050:0407", selector.Vendor, selector.Product)
+	}
+	return int(v), int(p), nil
+}
@@ -0,0 +1,127 @@
+package launcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Names of the containers in a generated Pod.
+const (
+	ComputeContainer = "compute"
+	ProxyContainer   = "console-proxy"
+)
+
+// ContainerName returns the name podman kube play gives to container in the
+// Pod generated for vmName.
+func ContainerName(vmName, container string) string {
+	return fmt.Sprintf("virt-launcher-%s-%s", vmName, container)
+}
+
+// RunFunc runs a command inside a container and returns its standard output.
+type RunFunc func(ctx context.Context, args ...string) ([]byte, error)
+
+// PodmanExec returns a RunFunc that runs commands in container through
+// podman exec. The container's standard error is included in errors.
+func PodmanExec(container string) RunFunc {
+	return func(ctx context.Context, args ...string) ([]byte, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "podman", append([]string{"exec", container}, args...)...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("%s: %v: %s", args[0], err, msg)
+			}
+			return nil, fmt.Errorf("%s: %v", args[0], err)
+		}
+		return stdout.Bytes(), nil
+	}
+}
+
+// Domain returns the name of the libvirt domain defined in the compute
+// container reached through run, whether it is running or shut off.
+func Domain(ctx context.Context, run RunFunc) (string, error) {
+	out, err := run(ctx, "virsh", "list", "--all", "--name")
+	if err != nil {
+		return "", fmt.Errorf("failed to list domains (is the VM running?): %v", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no domain found")
+}
+
+// ContainerInfo is the part of podman inspect output the tool uses.
+type ContainerInfo struct {
+	Name       string
+	Image      string
+	Status     string
+	Running    bool
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Env        map[string]string
+}
+
+// Inspect returns the state of container, or nil if it does not exist.
+func Inspect(ctx context.Context, container string) (*ContainerInfo, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "podman", "container", "inspect", container)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "no such container") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to inspect %s: %v: %s", container, err, strings.TrimSpace(stderr.String()))
+	}
+	return parseInspect(stdout.Bytes())
+}
+
+func parseInspect(data []byte) (*ContainerInfo, error) {
+	var inspected []struct {
+		Name      string
+		ImageName string
+		State     struct {
+			Status     string
+			Running    bool
+			ExitCode   int
+			StartedAt  time.Time
+			FinishedAt time.Time
+		}
+		Config struct {
+			Env []string
+		}
+	}
+	if err := json.Unmarshal(data, &inspected); err != nil {
+		return nil, fmt.Errorf("failed to parse podman inspect output: %v", err)
+	}
+	if len(inspected) == 0 {
+		return nil, nil
+	}
+
+	c := inspected[0]
+	info := &ContainerInfo{
+		Name:       c.Name,
+		Image:      c.ImageName,
+		Status:     c.State.Status,
+		Running:    c.State.Running,
+		ExitCode:   c.State.ExitCode,
+		StartedAt:  c.State.StartedAt,
+		FinishedAt: c.State.FinishedAt,
+		Env:        map[string]string{},
+	}
+	for _, kv := range c.Config.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			info.Env[k] = v
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,53 @@
+package launcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerName(t *testing.T) {
+	require.Equal(t, "virt-launcher-myvm-compute", ContainerName("myvm", ComputeContainer))
+	require.Equal(t, "virt-launcher-myvm-console-proxy", ContainerName("myvm", ProxyContainer))
+}
+
+func TestDomain(t *testing.T) {
+	reply := func(out string, err error) RunFunc {
+		return func(ctx context.Context, args ...string) ([]byte, error) {
+			require.Equal(t, []string{"virsh", "list", "--all", "--name"}, args)
+			return []byte(out), err
+		}
+	}
+
+	name, err := Domain(context.Background(), reply("default_myvm\n\n", nil))
+	require.NoError(t, err)
+	require.Equal(t, "default_myvm", name)
+
+	_, err = Domain(context.Background(), reply("\n", nil))
+	require.ErrorContains(t, err, "no domain found")
+
+	_, err = Domain(context.Background(), reply("", errors.New("no such container")))
+	require.ErrorContains(t, err, "no such container")
+}
+
+func TestParseInspect(t *testing.T) {
+	info, err := parseInspect([]byte(`[{
+		"Name": "virt-launcher-myvm-compute",
+		"ImageName": "quay.io/kubevirt/virt-launcher:v1.8.0",
+		"State": {"Status": "running", "Running": true, "ExitCode": 0, "StartedAt": "2026-01-02T03:04:05.5Z", "FinishedAt": "0001-01-01T00:00:00Z"},
+		"Config": {"Env": ["PATH=/usr/bin", "STANDALONE_VMI={\"a\":\"b=c\"}"]}
+	}]`))
+	require.NoError(t, err)
+	require.Equal(t, "virt-launcher-myvm-compute", info.Name)
+	require.Equal(t, "quay.io/kubevirt/virt-launcher:v1.8.0", info.Image)
+	require.True(t, info.Running)
+	require.Equal(t, time.Date(2026, 1, 2, 3, 4, 5, 500000000, time.UTC), info.StartedAt.UTC())
+	require.Equal(t, `{"a":"b=c"}`, info.Env["STANDALONE_VMI"])
+
+	info, err = parseInspect([]byte(`[]`))
+	require.NoError(t, err)
+	require.Nil(t, info)
+}
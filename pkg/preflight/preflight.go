@@ -0,0 +1,635 @@
+package preflight
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "kubevirt.io/api/core/v1"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/hostdevices"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	Pass Status = "pass"
+	// Warn is for requirements that may be met but could not be confirmed,
+	// or that only some setups have.
+	Warn Status = "warn"
+	// Fail is for requirements that are not met; the Pod will not start or
+	// the VM will not boot.
+	Fail Status = "fail"
+)
+
+// Result is the outcome of checking one requirement of a Pod on the host.
+type Result struct {
+	// Requirement names what was checked, e.g. /dev/kvm or hugepages-2Mi.
+	Requirement string `json:"requirement"`
+	Status      Status `json:"status"`
+	Message     string `json:"message"`
+	// Hint says how to fix a warning or failure.
+	Hint string `json:"hint,omitempty"`
+}
+
+// Options select the host to inspect.
+type Options struct {
+	// Root is prepended to every host path, /dev, /proc, /sys and the
+	// directories searched for binaries, so a host mounted elsewhere or a
+	// fixture tree can be checked. Empty means /.
+	Root string
+	// Path lists the directories searched for helper binaries such as passt.
+	// nil means $PATH and the helper directories of Podman.
+	Path []string
+}
+
+// selfLimits holds the resource limits of this process. It is read from the
+// real /proc, not under Root, as the limit that counts is the one Podman
+// passes on from the process that runs it.
+var selfLimits = "/proc/self/limits"
+
+// podmanHelperDirs are where Podman looks for helper binaries besides $PATH.
+var podmanHelperDirs = []string{
+	"/usr/local/libexec/podman",
+	"/usr/local/lib/podman",
+	"/usr/libexec/podman",
+	"/usr/lib/podman",
+}
+
+// baseDevices are mounted into every Pod with --mount-devices.
+var baseDevices = map[string]bool{
+	"/dev/kvm":       true,
+	"/dev/net/tun":   true,
+	"/dev/vhost-net": true,
+}
+
+// Failed reports whether any of results failed.
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Check inspects the host for every requirement of pod, a Pod rendered by
+// the transformer: hardware virtualization, cgroup v2, the devices it
+// mounts, passt for Passt interfaces, memory and hugepages, an IOMMU, the
+// vfio-pci binding and the memlock limit for host devices and the SELinux
+// booleans for device access.
+func Check(pod *k8sv1.Pod, opts Options) ([]Result, error) {
+	vmi, err := embeddedVMI(pod)
+	if err != nil {
+		return nil, err
+	}
+	h := &host{root: opts.Root, path: opts.Path}
+	if h.path == nil {
+		h.path = append(filepath.SplitList(os.Getenv("PATH")), podmanHelperDirs...)
+	}
+
+	var results []Result
+	if emulated(pod) {
+		results = append(results, Result{
+			Requirement: "virtualization",
+			Status:      Warn,
+			Message:     "the Pod uses software emulation, the VM will be much slower than with KVM",
+			Hint:        "render without --emulation on a host with /dev/kvm",
+		})
+	} else {
+		results = append(results, h.checkVirtualization()...)
+	}
+	results = append(results, h.checkCgroup())
+	devices := charDevices(pod)
+	for _, dev := range devices {
+		results = append(results, h.checkDevice(dev))
+	}
+	if usesPasst(vmi) {
+		results = append(results, h.checkPasst())
+	}
+	if r, ok := h.checkMemory(pod); ok {
+		results = append(results, r)
+	}
+	results = append(results, h.checkHugepages(pod)...)
+	if len(vmi.Spec.Domain.Devices.HostDevices) > 0 || containsDevice(devices, "/dev/vfio/") {
+		results = append(results, h.checkIOMMU())
+	}
+	results = append(results, h.checkPCIDevices(pod)...)
+	if r, ok := h.checkMemlock(pod); ok {
+		results = append(results, r)
+	}
+	if r, ok := h.checkSELinux(devices); ok {
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// HasKVM reports whether the host has /dev/kvm, which Pods need unless they
+// use software emulation.
+func HasKVM(opts Options) bool {
+	h := &host{root: opts.Root}
+	fi, err := os.Stat(h.file("/dev/kvm"))
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// emulated reports whether virt-launcher in pod may fall back to software
+// emulation.
+func emulated(pod *k8sv1.Pod) bool {
+	for _, c := range pod.Spec.Containers {
+		if c.Name == "compute" && contains(c.Command, "--allow-emulation") {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddedVMI returns the VMI the transformer embedded in the compute
+// container.
+func embeddedVMI(pod *k8sv1.Pod) (*v1.VirtualMachineInstance, error) {
+	for _, c := range pod.Spec.Containers {
+		if c.Name != "compute" {
+			continue
+		}
+		for _, env := range c.Env {
+			if env.Name == "STANDALONE_VMI" {
+				vmi := &v1.VirtualMachineInstance{}
+				if err := json.Unmarshal([]byte(env.Value), vmi); err != nil {
+					return nil, fmt.Errorf("failed to decode the VMI of the Pod: %v", err)
+				}
+				return vmi, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Pod %s has no compute container with STANDALONE_VMI", pod.Name)
+}
+
+type host struct {
+	root string
+	path []string
+}
+
+func (h *host) file(path string) string {
+	return filepath.Join("/", h.root, path)
+}
+
+func (h *host) exists(path string) bool {
+	_, err := os.Stat(h.file(path))
+	return err == nil
+}
+
+func (h *host) read(path string) (string, error) {
+	data, err := os.ReadFile(h.file(path))
+	return strings.TrimSpace(string(data)), err
+}
+
+// checkVirtualization checks the CPU flags for VT-x or AMD-V. Without them,
+// a host that is itself a VM lacks nested virtualization. Only x86 reports
+// them in /proc/cpuinfo; elsewhere the /dev/kvm check has to do.
+func (h *host) checkVirtualization() []Result {
+	cpuinfo, err := h.read("/proc/cpuinfo")
+	if err != nil {
+		return []Result{{Requirement: "virtualization", Status: Warn, Message: fmt.Sprintf("cannot read CPU flags: %v", err)}}
+	}
+	var flags map[string]bool
+	for _, line := range strings.Split(cpuinfo, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.TrimSpace(name) == "flags" {
+			flags = map[string]bool{}
+			for _, f := range strings.Fields(value) {
+				flags[f] = true
+			}
+			break
+		}
+	}
+	switch {
+	case flags == nil:
+		return nil
+	case flags["vmx"] || flags["svm"]:
+		return []Result{{Requirement: "virtualization", Status: Pass, Message: "the CPU supports hardware virtualization"}}
+	case h.exists("/dev/kvm"):
+		// Some hypervisors hide the flags from nested guests that can
+		// use KVM.
+		return []Result{{Requirement: "virtualization", Status: Warn, Message: "the CPU flags show no VT-x or AMD-V, but /dev/kvm exists"}}
+	case flags["hypervisor"]:
+		return []Result{{
+			Requirement: "virtualization",
+			Status:      Fail,
+			Message:     "the host is a VM without nested virtualization",
+			Hint:        "enable nested virtualization on the hypervisor (kvm_intel or kvm_amd nested=1) and give this VM a host-passthrough CPU",
+		}}
+	default:
+		return []Result{{
+			Requirement: "virtualization",
+			Status:      Fail,
+			Message:     "the CPU has no VT-x or AMD-V",
+			Hint:        "enable virtualization (VT-x, AMD-V or SVM) in the firmware settings",
+		}}
+	}
+}
+
+// checkCgroup checks for the unified cgroup hierarchy; virt-launcher reads
+// cpuset.cpus.effective from it.
+func (h *host) checkCgroup() Result {
+	controllers, err := h.read("/sys/fs/cgroup/cgroup.controllers")
+	if err != nil {
+		return Result{
+			Requirement: "cgroup v2",
+			Status:      Fail,
+			Message:     "the host does not use cgroup v2",
+			Hint:        "boot with systemd.unified_cgroup_hierarchy=1",
+		}
+	}
+	var missing []string
+	available := strings.Fields(controllers)
+	for _, c := range []string{"cpuset", "memory", "pids"} {
+		if !contains(available, c) {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return Result{
+			Requirement: "cgroup v2",
+			Status:      Warn,
+			Message:     fmt.Sprintf("controllers not available: %s", strings.Join(missing, ", ")),
+			Hint:        "delegate the controllers to rootless users with a systemd user@.service drop-in setting Delegate=yes",
+		}
+	}
+	return Result{Requirement: "cgroup v2", Status: Pass, Message: "the unified hierarchy is mounted"}
+}
+
+// charDevices returns the character devices pod mounts from the host.
+func charDevices(pod *k8sv1.Pod) []string {
+	var devices []string
+	for _, v := range pod.Spec.Volumes {
+		if v.HostPath != nil && v.HostPath.Type != nil && *v.HostPath.Type == k8sv1.HostPathCharDev {
+			devices = append(devices, v.HostPath.Path)
+		}
+	}
+	return devices
+}
+
+func (h *host) checkDevice(dev string) Result {
+	fi, err := os.Stat(h.file(dev))
+	switch {
+	case os.IsNotExist(err):
+		return Result{Requirement: dev, Status: Fail, Message: "missing", Hint: deviceHint(dev)}
+	case err != nil:
+		return Result{Requirement: dev, Status: Fail, Message: err.Error(), Hint: deviceHint(dev)}
+	case fi.Mode()&os.ModeCharDevice == 0:
+		return Result{Requirement: dev, Status: Warn, Message: "exists but is not a character device", Hint: deviceHint(dev)}
+	}
+	return Result{Requirement: dev, Status: Pass, Message: "present"}
+}
+
+func deviceHint(dev string) string {
+	switch {
+	case dev == "/dev/kvm":
+		return "enable virtualization in the firmware and load kvm_intel or kvm_amd"
+	case dev == "/dev/net/tun":
+		return "load the tun module: modprobe tun"
+	case dev == "/dev/vhost-net":
+		return "load the vhost_net module: modprobe vhost_net"
+	case strings.HasPrefix(dev, "/dev/nvidia"):
+		return "install the NVIDIA driver and run nvidia-modprobe -u -c=0 to create the device nodes"
+	case strings.HasPrefix(dev, "/dev/dri/"):
+		return "load the driver of the GPU (amdgpu, i915 or xe)"
+	case strings.HasPrefix(dev, "/dev/vfio/"):
+		return "load vfio-pci and bind the device to it"
+	case strings.HasPrefix(dev, "/dev/bus/usb/"):
+		return "the USB device was unplugged or re-enumerated; plug it in and render the Pod again"
+	}
+	return "check that the device driver is loaded"
+}
+
+func usesPasst(vmi *v1.VirtualMachineInstance) bool {
+	for _, iface := range vmi.Spec.Domain.Devices.Interfaces {
+		if iface.PasstBinding != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPasst looks for passt and pasta, which Podman uses for the network
+// of rootless Pods and Passt interfaces.
+func (h *host) checkPasst() Result {
+	for _, dir := range h.path {
+		for _, name := range []string{"passt", "pasta"} {
+			fi, err := os.Stat(h.file(filepath.Join(dir, name)))
+			if err == nil && !fi.IsDir() {
+				return Result{Requirement: "passt", Status: Pass, Message: fmt.Sprintf("found %s", filepath.Join(dir, name))}
+			}
+		}
+	}
+	return Result{
+		Requirement: "passt",
+		Status:      Fail,
+		Message:     "passt is not installed",
+		Hint:        "install the passt package, or render with --no-passt and configure CNI networking",
+	}
+}
+
+// checkMemory compares the memory the containers ask for with the memory of
+// the host. Hugepages are checked separately.
+func (h *host) checkMemory(pod *k8sv1.Pod) (Result, bool) {
+	var need int64
+	for _, c := range pod.Spec.Containers {
+		need += maxValue(c.Resources, k8sv1.ResourceMemory)
+	}
+	if need == 0 {
+		return Result{}, false
+	}
+	meminfo, err := h.meminfo()
+	if err != nil {
+		return Result{Requirement: "memory", Status: Warn, Message: fmt.Sprintf("cannot read memory info: %v", err)}, true
+	}
+	total, available := meminfo["MemTotal"], meminfo["MemAvailable"]
+	message := fmt.Sprintf("needs %s, %s of %s available", formatBytes(need), formatBytes(available), formatBytes(total))
+	switch {
+	case need > total:
+		return Result{Requirement: "memory", Status: Fail, Message: message, Hint: "lower the VM memory"}, true
+	case need > available:
+		return Result{Requirement: "memory", Status: Warn, Message: message, Hint: "stop other workloads or lower the VM memory"}, true
+	}
+	return Result{Requirement: "memory", Status: Pass, Message: message}, true
+}
+
+// meminfo returns the fields of /proc/meminfo in bytes.
+func (h *host) meminfo() (map[string]int64, error) {
+	data, err := h.read("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]int64{}
+	for _, line := range strings.Split(data, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			n *= 1024
+		}
+		info[name] = n
+	}
+	return info, nil
+}
+
+// checkHugepages checks that the host has enough free hugepages of every
+// size the containers ask for.
+func (h *host) checkHugepages(pod *k8sv1.Pod) []Result {
+	need := map[k8sv1.ResourceName]int64{}
+	for _, c := range pod.Spec.Containers {
+		names := map[k8sv1.ResourceName]bool{}
+		for name := range c.Resources.Requests {
+			names[name] = true
+		}
+		for name := range c.Resources.Limits {
+			names[name] = true
+		}
+		for name := range names {
+			if strings.HasPrefix(string(name), k8sv1.ResourceHugePagesPrefix) {
+				need[name] += maxValue(c.Resources, name)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(need))
+	for name := range need {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	var results []Result
+	for _, name := range names {
+		results = append(results, h.checkHugepageSize(name, need[k8sv1.ResourceName(name)]))
+	}
+	return results
+}
+
+func (h *host) checkHugepageSize(name string, bytes int64) Result {
+	size, err := resource.ParseQuantity(strings.TrimPrefix(name, k8sv1.ResourceHugePagesPrefix))
+	if err != nil || size.Value() <= 0 {
+		return Result{Requirement: name, Status: Fail, Message: "invalid hugepage size"}
+	}
+	pages := (bytes + size.Value() - 1) / size.Value()
+	dir := fmt.Sprintf("/sys/kernel/mm/hugepages/hugepages-%dkB", size.Value()/1024)
+	freeStr, err := h.read(dir + "/free_hugepages")
+	if err != nil {
+		return Result{
+			Requirement: name,
+			Status:      Fail,
+			Message:     fmt.Sprintf("the host has no %s hugepages", size.String()),
+			Hint:        fmt.Sprintf("boot with hugepagesz=%s hugepages=%d", size.String(), pages),
+		}
+	}
+	free, _ := strconv.ParseInt(freeStr, 10, 64)
+	if free < pages {
+		total, _ := h.read(dir + "/nr_hugepages")
+		nr, _ := strconv.ParseInt(total, 10, 64)
+		return Result{
+			Requirement: name,
+			Status:      Fail,
+			Message:     fmt.Sprintf("needs %d free %s pages, %d free", pages, size.String(), free),
+			Hint:        fmt.Sprintf("echo %d | sudo tee %s/nr_hugepages", nr+pages-free, dir),
+		}
+	}
+	return Result{Requirement: name, Status: Pass, Message: fmt.Sprintf("needs %d free %s pages, %d free", pages, size.String(), free)}
+}
+
+// checkIOMMU checks that the kernel created IOMMU groups, without which
+// VFIO cannot assign host devices.
+func (h *host) checkIOMMU() Result {
+	groups, err := os.ReadDir(h.file("/sys/kernel/iommu_groups"))
+	if err != nil || len(groups) == 0 {
+		return Result{
+			Requirement: "iommu",
+			Status:      Fail,
+			Message:     "no IOMMU groups, host devices cannot be assigned",
+			Hint:        "enable VT-d or AMD-Vi in the firmware and boot with intel_iommu=on iommu=pt",
+		}
+	}
+	return Result{Requirement: "iommu", Status: Pass, Message: fmt.Sprintf("%d IOMMU groups", len(groups))}
+}
+
+// checkPCIDevices checks the devices the transformer assigned from a device
+// map: the PCI devices in the PCI_RESOURCE_* variables of the compute
+// container must be bound to vfio-pci, and the mediated devices in the
+// MDEV_PCI_RESOURCE_* variables must exist.
+func (h *host) checkPCIDevices(pod *k8sv1.Pod) []Result {
+	var results []Result
+	for _, c := range pod.Spec.Containers {
+		if c.Name != "compute" {
+			continue
+		}
+		for _, env := range c.Env {
+			if env.Value == "" {
+				continue
+			}
+			for _, id := range strings.Split(env.Value, ",") {
+				switch {
+				case strings.HasPrefix(env.Name, v1.PCIResourcePrefix+"_"):
+					results = append(results, h.checkPCIDevice(id))
+				case strings.HasPrefix(env.Name, v1.MDevResourcePrefix+"_"):
+					results = append(results, h.checkMDEV(id))
+				}
+			}
+		}
+	}
+	return results
+}
+
+func (h *host) checkMDEV(uuid string) Result {
+	requirement := "mdev " + uuid
+	mdev, err := hostdevices.Host{Root: h.root}.MDEV(uuid)
+	if err != nil {
+		return Result{Requirement: requirement, Status: Fail, Message: "missing", Hint: "render the Pod again with --create-mdevs, or create it with echo " + uuid + " > /sys/class/mdev_bus/<parent>/mdev_supported_types/<type>/create"}
+	}
+	return Result{Requirement: requirement, Status: Pass, Message: fmt.Sprintf("%s on %s", mdev.Type, mdev.Parent)}
+}
+
+func (h *host) checkPCIDevice(address string) Result {
+	requirement := "PCI " + address
+	dev, err := hostdevices.Host{Root: h.root}.PCIDevice(address)
+	if err != nil {
+		return Result{Requirement: requirement, Status: Fail, Message: "missing", Hint: "check the pciAddresses of the device map against lspci -D"}
+	}
+	var vfioErr *hostdevices.VFIOError
+	if err := dev.CheckVFIO(); errors.As(err, &vfioErr) {
+		return Result{Requirement: requirement, Status: Fail, Message: vfioErr.Problem, Hint: vfioErr.Fix}
+	}
+	return Result{Requirement: requirement, Status: Pass, Message: fmt.Sprintf("bound to vfio-pci, IOMMU group %s", dev.IOMMUGroup)}
+}
+
+// checkMemlock compares the locked memory limit of the Pod's VFIO devices to
+// the limit of this process, which Podman passes on to containers unless
+// containers.conf sets one.
+func (h *host) checkMemlock(pod *k8sv1.Pod) (Result, bool) {
+	value, ok := pod.Annotations[transformer.MemlockAnnotation]
+	if !ok {
+		return Result{}, false
+	}
+	need, err := resource.ParseQuantity(value)
+	if err != nil {
+		return Result{}, false
+	}
+	r := Result{Requirement: "memlock", Status: Pass}
+	limit, err := memlockLimit()
+	switch {
+	case err != nil:
+		r.Status, r.Message = Warn, fmt.Sprintf("needs %s for VFIO, the limit is unknown: %v", formatBytes(need.Value()), err)
+	case limit < 0:
+		r.Message = fmt.Sprintf("needs %s for VFIO, unlimited", formatBytes(need.Value()))
+	default:
+		r.Message = fmt.Sprintf("needs %s for VFIO, the limit is %s", formatBytes(need.Value()), formatBytes(limit))
+		if limit < need.Value() {
+			r.Status = Fail
+		}
+	}
+	if h.root != "" && err == nil {
+		r.Message += " for this process, not for the host under " + h.root
+	}
+	if r.Status != Pass {
+		r.Hint = `set default_ulimits = ["memlock=-1:-1"] in the [containers] table of /etc/containers/containers.conf`
+	}
+	return r, true
+}
+
+// memlockLimit returns the soft locked memory limit of this process in
+// bytes, or -1 if it is unlimited.
+func memlockLimit() (int64, error) {
+	data, err := os.ReadFile(selfLimits)
+	if err != nil {
+		return 0, err
+	}
+	limits := string(data)
+	for _, line := range strings.Split(limits, "\n") {
+		rest, ok := strings.CutPrefix(line, "Max locked memory")
+		if fields := strings.Fields(rest); ok && len(fields) > 0 {
+			if fields[0] == "unlimited" {
+				return -1, nil
+			}
+			return strconv.ParseInt(fields[0], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no Max locked memory in %s", selfLimits)
+}
+
+// checkSELinux checks the container_use_devices boolean when SELinux
+// enforces and the Pod mounts devices beyond the ones every VM needs.
+func (h *host) checkSELinux(devices []string) (Result, bool) {
+	enforce, err := h.read("/sys/fs/selinux/enforce")
+	if err != nil || enforce != "1" {
+		return Result{}, false
+	}
+	var extra []string
+	for _, dev := range devices {
+		if !baseDevices[dev] {
+			extra = append(extra, dev)
+		}
+	}
+	if len(extra) == 0 {
+		return Result{}, false
+	}
+	value, err := h.read("/sys/fs/selinux/booleans/container_use_devices")
+	if fields := strings.Fields(value); err == nil && len(fields) > 0 && fields[0] == "1" {
+		return Result{Requirement: "selinux", Status: Pass, Message: "container_use_devices is on"}, true
+	}
+	return Result{
+		Requirement: "selinux",
+		Status:      Fail,
+		Message:     fmt.Sprintf("SELinux is enforcing and container_use_devices is off, denying %s", strings.Join(extra, ", ")),
+		Hint:        "sudo setsebool -P container_use_devices=true",
+	}, true
+}
+
+// maxValue returns the larger of the request and the limit of name.
+func maxValue(r k8sv1.ResourceRequirements, name k8sv1.ResourceName) int64 {
+	request, limit := r.Requests[name], r.Limits[name]
+	if limit.Cmp(request) > 0 {
+		return limit.Value()
+	}
+	return request.Value()
+}
+
+func formatBytes(n int64) string {
+	const gib = 1 << 30
+	if n >= gib {
+		return fmt.Sprintf("%.1fGiB", float64(n)/gib)
+	}
+	return fmt.Sprintf("%dMiB", n>>20)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsDevice(devices []string, prefix string) bool {
+	for _, dev := range devices {
+		if strings.HasPrefix(dev, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,347 @@
+package preflight
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1 "kubevirt.io/api/core/v1"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/hostdevices"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
+)
+
+const hugepagesVM = `apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: hugepages
+spec:
+  template:
+    spec:
+      domain:
+        memory:
+          guest: 1Gi
+          hugepages:
+            pageSize: 2Mi
+        devices: {}
+`
+
+const hostDeviceVM = `apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: hostdev
+spec:
+  template:
+    spec:
+      domain:
+        memory:
+          guest: 1Gi
+        devices:
+          hostDevices:
+          - name: nic
+            deviceName: intel.com/x710
+`
+
+func render(t *testing.T, vm string) *k8sv1.Pod {
+	t.Helper()
+	tr := transformer.NewVMToPodTransformer(transformer.WithForcePasst(true), transformer.WithMountDevices(true))
+	pod, err := tr.TransformReader(strings.NewReader(vm))
+	require.NoError(t, err)
+	return pod
+}
+
+// fakeHost writes files below a new root. Values starting with -> become
+// symlinks, so devices can point at /dev/null to be character devices.
+func fakeHost(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		if target, ok := strings.CutPrefix(content, "->"); ok {
+			require.NoError(t, os.Symlink(target, path))
+			continue
+		}
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	return root
+}
+
+// fakeLimits makes the checks read the limits of this process from content.
+func fakeLimits(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "limits")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	old := selfLimits
+	selfLimits = path
+	t.Cleanup(func() { selfLimits = old })
+}
+
+func healthyHost() map[string]string {
+	return map[string]string{
+		"proc/cpuinfo":                     "processor\t: 0\nflags\t\t: fpu vmx sse2\n",
+		"proc/meminfo":                     "MemTotal:       16777216 kB\nMemAvailable:   12582912 kB\n",
+		"sys/fs/cgroup/cgroup.controllers": "cpuset cpu io memory pids",
+		"dev/kvm":                          "->/dev/null",
+		"dev/net/tun":                      "->/dev/null",
+		"dev/vhost-net":                    "->/dev/null",
+		"usr/bin/passt":                    "",
+	}
+}
+
+func byRequirement(results []Result) map[string]Result {
+	m := map[string]Result{}
+	for _, r := range results {
+		m[r.Requirement] = r
+	}
+	return m
+}
+
+func TestCheck(t *testing.T) {
+	vm, err := os.ReadFile(filepath.Join("..", "..", "test-vm.yaml"))
+	require.NoError(t, err)
+	pod := render(t, string(vm))
+	opts := func(root string) Options { return Options{Root: root, Path: []string{"/usr/bin"}} }
+
+	t.Run("healthy host", func(t *testing.T) {
+		results, err := Check(pod, opts(fakeHost(t, healthyHost())))
+		require.NoError(t, err)
+		require.False(t, Failed(results), "%+v", results)
+
+		got := byRequirement(results)
+		for _, req := range []string{"virtualization", "cgroup v2", "/dev/kvm", "/dev/net/tun", "/dev/vhost-net", "passt", "memory"} {
+			require.Equal(t, Pass, got[req].Status, req)
+		}
+		require.Equal(t, "found /usr/bin/passt", got["passt"].Message)
+		require.NotContains(t, got, "iommu")
+		require.NotContains(t, got, "selinux")
+	})
+
+	t.Run("broken host", func(t *testing.T) {
+		files := healthyHost()
+		files["proc/cpuinfo"] = "flags\t\t: fpu sse2 hypervisor\n"
+		files["proc/meminfo"] = "MemTotal:       262144 kB\nMemAvailable:   131072 kB\n"
+		files["dev/vhost-net"] = "not a device"
+		delete(files, "sys/fs/cgroup/cgroup.controllers")
+		delete(files, "dev/kvm")
+		delete(files, "usr/bin/passt")
+
+		results, err := Check(pod, opts(fakeHost(t, files)))
+		require.NoError(t, err)
+		require.True(t, Failed(results))
+
+		got := byRequirement(results)
+		require.Equal(t, Result{
+			Requirement: "virtualization",
+			Status:      Fail,
+			Message:     "the host is a VM without nested virtualization",
+			Hint:        "enable nested virtualization on the hypervisor (kvm_intel or kvm_amd nested=1) and give this VM a host-passthrough CPU",
+		}, got["virtualization"])
+		require.Equal(t, Fail, got["cgroup v2"].Status)
+		require.Equal(t, Result{Requirement: "/dev/kvm", Status: Fail, Message: "missing", Hint: "enable virtualization in the firmware and load kvm_intel or kvm_amd"}, got["/dev/kvm"])
+		require.Equal(t, Warn, got["/dev/vhost-net"].Status)
+		require.Equal(t, Pass, got["/dev/net/tun"].Status)
+		require.Equal(t, Fail, got["passt"].Status)
+		require.Equal(t, Fail, got["memory"].Status)
+		require.Contains(t, got["memory"].Message, "128MiB of 256MiB available")
+	})
+
+	t.Run("flags hidden from a nested guest", func(t *testing.T) {
+		files := healthyHost()
+		files["proc/cpuinfo"] = "flags\t\t: fpu sse2 hypervisor\n"
+		results, err := Check(pod, opts(fakeHost(t, files)))
+		require.NoError(t, err)
+		require.Equal(t, Warn, byRequirement(results)["virtualization"].Status)
+	})
+
+	t.Run("no Passt interfaces", func(t *testing.T) {
+		tr := transformer.NewVMToPodTransformer(transformer.WithMountDevices(true))
+		pod, err := tr.TransformReader(strings.NewReader(string(vm)))
+		require.NoError(t, err)
+		results, err := Check(pod, opts(fakeHost(t, healthyHost())))
+		require.NoError(t, err)
+		require.NotContains(t, byRequirement(results), "passt")
+	})
+
+	t.Run("software emulation", func(t *testing.T) {
+		tr := transformer.NewVMToPodTransformer(transformer.WithForcePasst(true), transformer.WithMountDevices(true), transformer.WithEmulation(true))
+		pod, err := tr.TransformReader(strings.NewReader(string(vm)))
+		require.NoError(t, err)
+		files := healthyHost()
+		files["proc/cpuinfo"] = "flags\t\t: fpu sse2\n"
+		delete(files, "dev/kvm")
+		results, err := Check(pod, opts(fakeHost(t, files)))
+		require.NoError(t, err)
+		require.False(t, Failed(results), "%+v", results)
+		got := byRequirement(results)
+		require.Equal(t, Warn, got["virtualization"].Status)
+		require.NotContains(t, got, "/dev/kvm")
+	})
+
+	t.Run("not a rendered Pod", func(t *testing.T) {
+		_, err := Check(&k8sv1.Pod{}, Options{})
+		require.Error(t, err)
+	})
+}
+
+func TestCheckHugepages(t *testing.T) {
+	pod := render(t, hugepagesVM)
+	dir := "sys/kernel/mm/hugepages/hugepages-2048kB"
+
+	files := healthyHost()
+	files[dir+"/nr_hugepages"] = "100"
+	files[dir+"/free_hugepages"] = "100"
+	results, err := Check(pod, Options{Root: fakeHost(t, files), Path: []string{"/usr/bin"}})
+	require.NoError(t, err)
+	require.Equal(t, Result{
+		Requirement: "hugepages-2Mi",
+		Status:      Fail,
+		Message:     "needs 512 free 2Mi pages, 100 free",
+		Hint:        "echo 512 | sudo tee /sys/kernel/mm/hugepages/hugepages-2048kB/nr_hugepages",
+	}, byRequirement(results)["hugepages-2Mi"])
+
+	files[dir+"/nr_hugepages"] = "1024"
+	files[dir+"/free_hugepages"] = "1024"
+	results, err = Check(pod, Options{Root: fakeHost(t, files), Path: []string{"/usr/bin"}})
+	require.NoError(t, err)
+	require.Equal(t, Pass, byRequirement(results)["hugepages-2Mi"].Status)
+
+	results, err = Check(pod, Options{Root: fakeHost(t, healthyHost()), Path: []string{"/usr/bin"}})
+	require.NoError(t, err)
+	require.Equal(t, "the host has no 2Mi hugepages", byRequirement(results)["hugepages-2Mi"].Message)
+}
+
+func TestCheckHostDevices(t *testing.T) {
+	pod := render(t, hostDeviceVM)
+
+	files := healthyHost()
+	files["sys/fs/selinux/enforce"] = "1"
+	files["sys/fs/selinux/booleans/container_use_devices"] = "0 0"
+	results, err := Check(pod, Options{Root: fakeHost(t, files), Path: []string{"/usr/bin"}})
+	require.NoError(t, err)
+	got := byRequirement(results)
+	require.Equal(t, Fail, got["iommu"].Status)
+	require.Equal(t, Fail, got["/dev/vfio/vfio"].Status)
+	require.Equal(t, "load vfio-pci and bind the device to it", got["/dev/vfio/vfio"].Hint)
+	require.Equal(t, Fail, got["selinux"].Status)
+	require.Equal(t, "sudo setsebool -P container_use_devices=true", got["selinux"].Hint)
+
+	files["sys/kernel/iommu_groups/0/type"] = "DMA"
+	files["sys/kernel/iommu_groups/1/type"] = "DMA"
+	files["dev/vfio/vfio"] = "->/dev/null"
+	files["sys/fs/selinux/booleans/container_use_devices"] = "1 1"
+	results, err = Check(pod, Options{Root: fakeHost(t, files), Path: []string{"/usr/bin"}})
+	require.NoError(t, err)
+	got = byRequirement(results)
+	require.Equal(t, Result{Requirement: "iommu", Status: Pass, Message: "2 IOMMU groups"}, got["iommu"])
+	require.Equal(t, Pass, got["/dev/vfio/vfio"].Status)
+	require.Equal(t, Pass, got["selinux"].Status)
+}
+
+func TestCheckPCIDevices(t *testing.T) {
+	files := healthyHost()
+	files["sys/kernel/iommu_groups/7/type"] = "DMA"
+	files["dev/vfio/vfio"] = "->/dev/null"
+	files["dev/vfio/7"] = "->/dev/null"
+	files["sys/bus/pci/devices/0000:3b:00.0/vendor"] = "0x8086"
+	files["sys/bus/pci/devices/0000:3b:00.0/device"] = "0x1592"
+	files["sys/bus/pci/devices/0000:3b:00.0/driver"] = "->../../../bus/pci/drivers/vfio-pci"
+	files["sys/bus/pci/devices/0000:3b:00.0/iommu_group"] = "->../../../kernel/iommu_groups/7"
+	fakeLimits(t, "Limit                     Soft Limit           Hard Limit           Units\nMax locked memory         unlimited            unlimited            bytes\n")
+	root := fakeHost(t, files)
+
+	m := &hostdevices.DeviceMap{PermittedHostDevices: v1.PermittedHostDevices{
+		PciHostDevices: []v1.PciHostDevice{{PCIVendorSelector: "8086:1592", ResourceName: "intel.com/x710"}},
+	}}
+	tr := transformer.NewVMToPodTransformer(transformer.WithForcePasst(true), transformer.WithMountDevices(true), transformer.WithDeviceMap(m, root))
+	pod, err := tr.TransformReader(strings.NewReader(hostDeviceVM))
+	require.NoError(t, err)
+
+	results, err := Check(pod, Options{Root: root, Path: []string{"/usr/bin"}})
+	require.NoError(t, err)
+	require.False(t, Failed(results), "%+v", results)
+	got := byRequirement(results)
+	require.Equal(t, Result{Requirement: "PCI 0000:3b:00.0", Status: Pass, Message: "bound to vfio-pci, IOMMU group 7"}, got["PCI 0000:3b:00.0"])
+	require.Equal(t, Pass, got["/dev/vfio/7"].Status)
+	require.Equal(t, Result{Requirement: "memlock", Status: Pass, Message: "needs 2.3GiB for VFIO, unlimited for this process, not for the host under " + root}, got["memlock"])
+
+	// The device was rebound and the limit lowered since rendering. The
+	// limit comes from this process, not from the /proc under Root.
+	files["sys/bus/pci/devices/0000:3b:00.0/driver"] = "->../../../bus/pci/drivers/ice"
+	files["proc/self/limits"] = "Max locked memory         unlimited            unlimited            bytes\n"
+	fakeLimits(t, "Max locked memory         8388608              8388608              bytes\n")
+	root = fakeHost(t, files)
+	results, err = Check(pod, Options{Root: root, Path: []string{"/usr/bin"}})
+	require.NoError(t, err)
+	got = byRequirement(results)
+	require.Equal(t, Result{
+		Requirement: "PCI 0000:3b:00.0",
+		Status:      Fail,
+		Message:     "is bound to ice, not vfio-pci",
+		Hint:        "bind it to vfio-pci: sudo driverctl set-override 0000:3b:00.0 vfio-pci",
+	}, got["PCI 0000:3b:00.0"])
+	require.Equal(t, Fail, got["memlock"].Status)
+	require.Equal(t, "needs 2.3GiB for VFIO, the limit is 8MiB for this process, not for the host under "+root, got["memlock"].Message)
+	require.Contains(t, got["memlock"].Hint, "memlock=-1:-1")
+
+	// Without Root the limit is the host's own.
+	pod.Annotations[transformer.MemlockAnnotation] = "4Mi"
+	r, ok := (&host{}).checkMemlock(pod)
+	require.True(t, ok)
+	require.Equal(t, Result{Requirement: "memlock", Status: Pass, Message: "needs 4MiB for VFIO, the limit is 8MiB"}, r)
+}
+
+func TestMemlockLimitIgnoresRoot(t *testing.T) {
+	// The limit under Root is not that of any process that will run Podman.
+	root := fakeHost(t, map[string]string{
+		"proc/self/limits": "Max locked memory         3145728              3145728              bytes\n",
+	})
+	pod := &k8sv1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{transformer.MemlockAnnotation: "1Mi"}}}
+
+	want, err := memlockLimit()
+	require.NoError(t, err, "read from the real /proc/self/limits")
+	message := "needs 1MiB for VFIO, unlimited"
+	if want >= 0 {
+		message = "needs 1MiB for VFIO, the limit is " + formatBytes(want)
+	}
+	r, ok := (&host{root: root}).checkMemlock(pod)
+	require.True(t, ok)
+	require.Equal(t, message+" for this process, not for the host under "+root, r.Message)
+	require.NotContains(t, r.Message, "3MiB")
+}
+
+func TestCheckMDEVs(t *testing.T) {
+	files := healthyHost()
+	files["sys/class/mdev_bus/0000:00:02.0/mdev_supported_types/i915-GVTg_V5_4/name"] = "GVTg_V5_4"
+	files["sys/bus/mdev/devices/0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a/mdev_type"] = "->../../../../class/mdev_bus/0000:00:02.0/mdev_supported_types/i915-GVTg_V5_4"
+	files["sys/bus/mdev/devices/0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a/iommu_group"] = "->../../../kernel/iommu_groups/12"
+	root := fakeHost(t, files)
+
+	m := &hostdevices.DeviceMap{PermittedHostDevices: v1.PermittedHostDevices{
+		MediatedDevices: []v1.MediatedHostDevice{{MDEVNameSelector: "i915-GVTg_V5_4", ResourceName: "intel.com/x710"}},
+	}}
+	tr := transformer.NewVMToPodTransformer(transformer.WithForcePasst(true), transformer.WithMountDevices(true), transformer.WithDeviceMap(m, root))
+	pod, err := tr.TransformReader(strings.NewReader(hostDeviceVM))
+	require.NoError(t, err)
+
+	results, err := Check(pod, Options{Root: root, Path: []string{"/usr/bin"}})
+	require.NoError(t, err)
+	require.Equal(t, Result{Requirement: "mdev 0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a", Status: Pass, Message: "GVTg_V5_4 on 0000:00:02.0"},
+		byRequirement(results)["mdev 0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a"])
+
+	results, err = Check(pod, Options{Root: fakeHost(t, healthyHost()), Path: []string{"/usr/bin"}})
+	require.NoError(t, err)
+	got := byRequirement(results)["mdev 0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a"]
+	require.Equal(t, Fail, got.Status)
+	require.Contains(t, got.Hint, "--create-mdevs")
+}
+
+func TestHasKVM(t *testing.T) {
+	require.True(t, HasKVM(Options{Root: fakeHost(t, map[string]string{"dev/kvm": "->/dev/null"})}))
+	require.False(t, HasKVM(Options{Root: fakeHost(t, map[string]string{"dev/kvm": "not a device"})}))
+	require.False(t, HasKVM(Options{Root: t.TempDir()}))
+}
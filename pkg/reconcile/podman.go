@@ -0,0 +1,93 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	k8sv1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// PodState is a Pod as Podman reports it.
+type PodState struct {
+	Name    string
+	Labels  map[string]string
+	Running bool
+}
+
+// Podman is what the reconciler needs from Podman. Only Pods carrying
+// ManagedLabel are listed, so Pods started by hand are never touched.
+type Podman interface {
+	// Pods lists the Pods managed by the reconciler.
+	Pods(ctx context.Context) ([]PodState, error)
+	// Play creates and starts pod, like podman kube play.
+	Play(ctx context.Context, pod *k8sv1.Pod) error
+	// Start starts the stopped Pod name.
+	Start(ctx context.Context, name string) error
+	// Remove stops and removes the Pod name. Named volumes are kept.
+	Remove(ctx context.Context, name string) error
+}
+
+// PodmanCLI runs the podman command.
+type PodmanCLI struct{}
+
+func (PodmanCLI) Pods(ctx context.Context) ([]PodState, error) {
+	out, err := podman(ctx, nil, "pod", "ps", "--filter", "label="+ManagedLabel+"=true", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	var listed []struct {
+		Name   string
+		Status string
+		Labels map[string]string
+	}
+	if err := json.Unmarshal(out, &listed); err != nil {
+		return nil, fmt.Errorf("failed to parse podman pod ps output: %v", err)
+	}
+	pods := make([]PodState, 0, len(listed))
+	for _, p := range listed {
+		pods = append(pods, PodState{
+			Name:    p.Name,
+			Labels:  p.Labels,
+			Running: p.Status == "Running" || p.Status == "Degraded",
+		})
+	}
+	return pods, nil
+}
+
+func (PodmanCLI) Play(ctx context.Context, pod *k8sv1.Pod) error {
+	data, err := yaml.Marshal(pod)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Pod: %v", err)
+	}
+	_, err = podman(ctx, data, "kube", "play", "-")
+	return err
+}
+
+func (PodmanCLI) Start(ctx context.Context, name string) error {
+	_, err := podman(ctx, nil, "pod", "start", name)
+	return err
+}
+
+func (PodmanCLI) Remove(ctx context.Context, name string) error {
+	_, err := podman(ctx, nil, "pod", "rm", "--force", name)
+	return err
+}
+
+func podman(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "podman", args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("podman %s: %v: %s", strings.Join(args[:2], " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
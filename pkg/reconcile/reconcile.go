@@ -0,0 +1,363 @@
+package reconcile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	k8sv1 "k8s.io/api/core/v1"
+	virtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
+)
+
+const (
+	// ManagedLabel marks the Pods the reconciler created.
+	ManagedLabel = "kubevirt-vm-to-pod/managed"
+	// ContentHashAnnotation holds the hash of the Pod as rendered. It is
+	// set as a label too, because podman pod ps lists labels only.
+	ContentHashAnnotation = "kubevirt-vm-to-pod/content-hash"
+
+	// debounce is how long the watcher waits for a burst of file events,
+	// such as an editor saving through a temporary file, to settle.
+	debounce = 500 * time.Millisecond
+)
+
+// Op is what the reconciler did to a Pod.
+type Op string
+
+const (
+	OpCreate   Op = "create"
+	OpRecreate Op = "recreate"
+	OpStart    Op = "start"
+	OpRemove   Op = "remove"
+	// OpInvalid is reported for manifests that cannot be turned into a Pod.
+	OpInvalid Op = "invalid"
+)
+
+// Action is a change the reconciler made, or failed to make when Err is set.
+type Action struct {
+	Op     Op
+	Pod    string
+	File   string
+	Reason string
+	Err    error
+}
+
+func (a Action) String() string {
+	s := fmt.Sprintf("%s %s", a.Op, a.Pod)
+	if a.Pod == "" {
+		s = fmt.Sprintf("%s %s", a.Op, a.File)
+	}
+	if a.Reason != "" {
+		s += ": " + a.Reason
+	}
+	if a.Err != nil {
+		s += fmt.Sprintf(" (failed: %v)", a.Err)
+	}
+	return s
+}
+
+// desiredPod is the Pod rendered from one manifest.
+type desiredPod struct {
+	file     string
+	sum      [sha256.Size]byte
+	strategy virtv1.VirtualMachineRunStrategy
+	pod      *k8sv1.Pod
+	hash     string
+}
+
+// Reconciler keeps the Podman Pods in sync with a directory of
+// VirtualMachine manifests, one VM per .yaml, .yml or .json file.
+type Reconciler struct {
+	dir         string
+	transformer *transformer.VMToPodTransformer
+	podman      Podman
+
+	// rendered caches the Pods by file, so only changed files are
+	// transformed again.
+	rendered map[string]*desiredPod
+}
+
+// New returns a reconciler for the manifests in dir.
+func New(dir string, t *transformer.VMToPodTransformer, podman Podman) *Reconciler {
+	return &Reconciler{
+		dir:         dir,
+		transformer: t,
+		podman:      podman,
+		rendered:    map[string]*desiredPod{},
+	}
+}
+
+// Reconcile makes one pass over the directory and returns what it changed.
+// VMs follow their runStrategy; a VM with neither runStrategy nor running
+// set is treated as Always. Pods whose manifest is gone are removed, but
+// only when every manifest could be read, so a bad edit never tears a VM
+// down. The error is set when the directory or Podman cannot be read.
+func (r *Reconciler) Reconcile(ctx context.Context) ([]Action, error) {
+	desired, actions, err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := r.podman.Pods(ctx)
+	if err != nil {
+		return actions, fmt.Errorf("failed to list Pods: %v", err)
+	}
+	existing := map[string]PodState{}
+	for _, p := range pods {
+		existing[p.Name] = p
+	}
+
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if a := r.sync(ctx, desired[name], existing); a != nil {
+			actions = append(actions, *a)
+		}
+	}
+
+	if hasInvalid(actions) {
+		return actions, nil
+	}
+	for _, p := range pods {
+		if _, ok := desired[p.Name]; ok {
+			continue
+		}
+		actions = append(actions, Action{
+			Op:     OpRemove,
+			Pod:    p.Name,
+			Reason: "manifest removed",
+			Err:    r.podman.Remove(ctx, p.Name),
+		})
+	}
+	return actions, nil
+}
+
+// sync brings the Pod of d in line with its runStrategy.
+func (r *Reconciler) sync(ctx context.Context, d *desiredPod, existing map[string]PodState) *Action {
+	name := d.pod.Name
+	current, exists := existing[name]
+	action := &Action{Pod: name, File: d.file}
+
+	switch d.strategy {
+	case virtv1.RunStrategyHalted:
+		if !exists {
+			return nil
+		}
+		action.Op, action.Reason = OpRemove, "runStrategy Halted"
+		action.Err = r.podman.Remove(ctx, name)
+		return action
+	case virtv1.RunStrategyManual:
+		// Started and stopped by hand; never created or replaced here.
+		return nil
+	case virtv1.RunStrategyAlways, virtv1.RunStrategyRerunOnFailure, virtv1.RunStrategyOnce:
+	default:
+		action.Op = OpInvalid
+		action.Err = fmt.Errorf("runStrategy %s is not supported in standalone mode", d.strategy)
+		return action
+	}
+
+	switch {
+	case !exists:
+		action.Op, action.Reason = OpCreate, "no Pod"
+		action.Err = r.podman.Play(ctx, d.pod)
+	case current.Labels[ContentHashAnnotation] != d.hash:
+		action.Op, action.Reason = OpRecreate, "rendered Pod changed"
+		if action.Err = r.podman.Remove(ctx, name); action.Err == nil {
+			action.Err = r.podman.Play(ctx, d.pod)
+		}
+	case !current.Running && d.strategy == virtv1.RunStrategyAlways:
+		// Once runs a single time, and RerunOnFailure is left to the
+		// Pod's OnFailure restart policy.
+		action.Op, action.Reason = OpStart, "runStrategy Always"
+		action.Err = r.podman.Start(ctx, name)
+	default:
+		return nil
+	}
+	return action
+}
+
+// load renders the Pods of all manifests in the directory, keyed by Pod
+// name. Manifests that fail are reported as OpInvalid actions.
+func (r *Reconciler) load(ctx context.Context) (map[string]*desiredPod, []Action, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %v", r.dir, err)
+	}
+
+	desired := map[string]*desiredPod{}
+	var actions []Action
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if entry.IsDir() || !isManifest(entry.Name()) {
+			continue
+		}
+		file := filepath.Join(r.dir, entry.Name())
+		seen[file] = true
+
+		d, err := r.render(ctx, file)
+		if err != nil {
+			actions = append(actions, Action{Op: OpInvalid, File: file, Err: err})
+			continue
+		}
+		if other, ok := desired[d.pod.Name]; ok {
+			actions = append(actions, Action{Op: OpInvalid, File: file, Err: fmt.Errorf("Pod %s is already defined by %s", d.pod.Name, other.file)})
+			continue
+		}
+		desired[d.pod.Name] = d
+	}
+
+	for file := range r.rendered {
+		if !seen[file] {
+			delete(r.rendered, file)
+		}
+	}
+	return desired, actions, nil
+}
+
+// render returns the Pod for file, transforming it only if it changed since
+// the last pass.
+func (r *Reconciler) render(ctx context.Context, file string) (*desiredPod, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	if d, ok := r.rendered[file]; ok && d.sum == sum {
+		return d, nil
+	}
+
+	vm := &virtv1.VirtualMachine{}
+	if err := yaml.Unmarshal(data, vm); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal VM: %v", err)
+	}
+	if vm.Kind != "VirtualMachine" {
+		return nil, fmt.Errorf("expected a VirtualMachine, got %q", vm.Kind)
+	}
+	strategy := virtv1.RunStrategyAlways
+	if vm.Spec.Running != nil || vm.Spec.RunStrategy != nil {
+		if strategy, err = vm.RunStrategy(); err != nil {
+			return nil, err
+		}
+	}
+
+	pod, err := r.transformer.TransformVMContext(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := ContentHash(pod)
+	if err != nil {
+		return nil, err
+	}
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Labels[ManagedLabel] = "true"
+	pod.Labels[ContentHashAnnotation] = hash
+	pod.Annotations[ContentHashAnnotation] = hash
+
+	d := &desiredPod{file: file, sum: sum, strategy: strategy, pod: pod, hash: hash}
+	r.rendered[file] = d
+	return d, nil
+}
+
+// Watch reconciles once, then again whenever a file in the directory
+// changes and every resync interval, which also catches Pods that stopped.
+// It calls report after every pass and returns when ctx is done.
+func (r *Reconciler) Watch(ctx context.Context, resync time.Duration, report func([]Action, error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %v", r.dir, err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(r.dir); err != nil {
+		return fmt.Errorf("failed to watch %s: %v", r.dir, err)
+	}
+
+	report(r.Reconcile(ctx))
+
+	ticker := time.NewTicker(resync)
+	defer ticker.Stop()
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if isManifest(event.Name) {
+				timer.Reset(debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			report(nil, fmt.Errorf("watch failed: %v", err))
+		case <-timer.C:
+			report(r.Reconcile(ctx))
+		case <-ticker.C:
+			report(r.Reconcile(ctx))
+		}
+	}
+}
+
+// ContentHash returns the hash of pod, ignoring the hash itself and the
+// randomized QEMU timeout KubeVirt puts in every rendering.
+func ContentHash(pod *k8sv1.Pod) (string, error) {
+	pod = pod.DeepCopy()
+	delete(pod.Labels, ContentHashAnnotation)
+	delete(pod.Labels, ManagedLabel)
+	delete(pod.Annotations, ContentHashAnnotation)
+	for i := range pod.Spec.Containers {
+		cmd := pod.Spec.Containers[i].Command
+		for j := 0; j+1 < len(cmd); j++ {
+			if cmd[j] == "--qemu-timeout" {
+				cmd[j+1] = ""
+			}
+		}
+	}
+
+	data, err := json.Marshal(pod)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash Pod: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	// Label values are limited to 63 characters.
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+func isManifest(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return !strings.HasPrefix(filepath.Base(name), ".")
+	}
+	return false
+}
+
+func hasInvalid(actions []Action) bool {
+	for _, a := range actions {
+		if a.Op == OpInvalid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	k8sv1 "k8s.io/api/core/v1"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
+)
+
+// fakePodman keeps Pods in memory and records the calls made to it.
+type fakePodman struct {
+	mu    sync.Mutex
+	pods  map[string]PodState
+	calls []string
+}
+
+func newFakePodman() *fakePodman {
+	return &fakePodman{pods: map[string]PodState{}}
+}
+
+func (f *fakePodman) Pods(ctx context.Context) ([]PodState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var pods []PodState
+	for _, p := range f.pods {
+		pods = append(pods, p)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods, nil
+}
+
+func (f *fakePodman) Play(ctx context.Context, pod *k8sv1.Pod) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "play "+pod.Name)
+	if _, ok := f.pods[pod.Name]; ok {
+		return fmt.Errorf("pod %s already exists", pod.Name)
+	}
+	f.pods[pod.Name] = PodState{Name: pod.Name, Labels: pod.Labels, Running: true}
+	return nil
+}
+
+func (f *fakePodman) Start(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "start "+name)
+	p := f.pods[name]
+	p.Running = true
+	f.pods[name] = p
+	return nil
+}
+
+func (f *fakePodman) Remove(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "rm "+name)
+	delete(f.pods, name)
+	return nil
+}
+
+func (f *fakePodman) stop(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := f.pods[name]
+	p.Running = false
+	f.pods[name] = p
+}
+
+func (f *fakePodman) takeCalls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+func vmManifest(name, runStrategy, memory string) string {
+	strategy := ""
+	if runStrategy != "" {
+		strategy = "  runStrategy: " + runStrategy + "\n"
+	}
+	return fmt.Sprintf(`apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: %s
+spec:
+%s  template:
+    spec:
+      domain:
+        resources:
+          requests:
+            memory: %s
+        devices: {}
+`, name, strategy, memory)
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+}
+
+func reconcile(t *testing.T, r *Reconciler) []string {
+	t.Helper()
+	actions, err := r.Reconcile(context.Background())
+	require.NoError(t, err)
+	var out []string
+	for _, a := range actions {
+		out = append(out, a.String())
+	}
+	return out
+}
+
+func TestReconcile(t *testing.T) {
+	dir := t.TempDir()
+	podman := newFakePodman()
+	tr := transformer.NewVMToPodTransformer(transformer.WithForcePasst(true))
+	r := New(dir, tr, podman)
+
+	writeFile(t, dir, "a.yaml", vmManifest("a", "", "64Mi"))
+	writeFile(t, dir, "b.yml", vmManifest("b", "Once", "64Mi"))
+	writeFile(t, dir, "notes.txt", "not a manifest")
+
+	require.Equal(t, []string{
+		"create virt-launcher-a: no Pod",
+		"create virt-launcher-b: no Pod",
+	}, reconcile(t, r))
+	require.Equal(t, "true", podman.pods["virt-launcher-a"].Labels[ManagedLabel])
+	require.Empty(t, reconcile(t, r))
+	podman.takeCalls()
+
+	t.Run("hash is stable across renderings", func(t *testing.T) {
+		require.Empty(t, reconcile(t, New(dir, tr, podman)))
+	})
+
+	t.Run("only changed Pods are recreated", func(t *testing.T) {
+		writeFile(t, dir, "a.yaml", vmManifest("a", "", "128Mi"))
+		require.Equal(t, []string{"recreate virt-launcher-a: rendered Pod changed"}, reconcile(t, r))
+		require.Equal(t, []string{"rm virt-launcher-a", "play virt-launcher-a"}, podman.takeCalls())
+	})
+
+	t.Run("stopped Pods are started for Always only", func(t *testing.T) {
+		podman.stop("virt-launcher-a")
+		podman.stop("virt-launcher-b")
+		require.Equal(t, []string{"start virt-launcher-a: runStrategy Always"}, reconcile(t, r))
+		podman.takeCalls()
+	})
+
+	t.Run("Halted removes and Manual leaves alone", func(t *testing.T) {
+		writeFile(t, dir, "b.yml", vmManifest("b", "Halted", "64Mi"))
+		require.Equal(t, []string{"remove virt-launcher-b: runStrategy Halted"}, reconcile(t, r))
+
+		writeFile(t, dir, "b.yml", vmManifest("b", "Manual", "64Mi"))
+		require.Empty(t, reconcile(t, r))
+		require.NotContains(t, podman.pods, "virt-launcher-b")
+		podman.takeCalls()
+	})
+
+	t.Run("invalid manifests block removals", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(dir, "b.yml")))
+		writeFile(t, dir, "c.yaml", vmManifest("c", "", "64Mi"))
+		writeFile(t, dir, "a.yaml", "kind: [")
+
+		actions := reconcile(t, r)
+		require.Len(t, actions, 2)
+		require.True(t, strings.HasPrefix(actions[0], "invalid "+filepath.Join(dir, "a.yaml")), actions[0])
+		require.Equal(t, "create virt-launcher-c: no Pod", actions[1])
+		require.Contains(t, podman.pods, "virt-launcher-a", "a Pod must survive a bad edit")
+	})
+
+	t.Run("Pods of deleted manifests are removed", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(dir, "a.yaml")))
+		require.Equal(t, []string{"remove virt-launcher-a: manifest removed"}, reconcile(t, r))
+	})
+
+	t.Run("duplicate VMs", func(t *testing.T) {
+		writeFile(t, dir, "d.yaml", vmManifest("c", "", "64Mi"))
+		actions := reconcile(t, r)
+		require.Len(t, actions, 1)
+		require.Contains(t, actions[0], "Pod virt-launcher-c is already defined by")
+		require.NoError(t, os.Remove(filepath.Join(dir, "d.yaml")))
+	})
+
+	t.Run("unsupported runStrategy", func(t *testing.T) {
+		writeFile(t, dir, "e.yaml", vmManifest("e", "WaitAsReceiver", "64Mi"))
+		actions := reconcile(t, r)
+		require.Len(t, actions, 1)
+		require.Contains(t, actions[0], "runStrategy WaitAsReceiver is not supported")
+	})
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	podman := newFakePodman()
+	r := New(dir, transformer.NewVMToPodTransformer(), podman)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	passes := make(chan []Action, 10)
+	go r.Watch(ctx, time.Hour, func(actions []Action, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		passes <- actions
+	})
+	require.Empty(t, <-passes)
+
+	writeFile(t, dir, "a.yaml", vmManifest("a", "", "64Mi"))
+	select {
+	case actions := <-passes:
+		require.Len(t, actions, 1)
+		require.Equal(t, OpCreate, actions[0].Op)
+	case <-time.After(10 * time.Second):
+		t.Fatal("file change was not reconciled")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	pod := &k8sv1.Pod{Spec: k8sv1.PodSpec{Containers: []k8sv1.Container{{
+		Name:    "compute",
+		Command: []string{"virt-launcher-monitor", "--qemu-timeout", "263s", "--name", "a"},
+	}}}}
+	hash, err := ContentHash(pod)
+	require.NoError(t, err)
+	require.Len(t, hash, 32)
+
+	other := pod.DeepCopy()
+	other.Spec.Containers[0].Command[2] = "344s"
+	other.Labels = map[string]string{ContentHashAnnotation: hash, ManagedLabel: "true"}
+	otherHash, err := ContentHash(other)
+	require.NoError(t, err)
+	require.Equal(t, hash, otherHash)
+	require.Equal(t, "344s", other.Spec.Containers[0].Command[2], "the Pod itself is not changed")
+
+	other.Spec.Containers[0].Command[4] = "b"
+	otherHash, err = ContentHash(other)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, otherHash)
+}
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	k8sv1 "k8s.io/api/core/v1"
+	virtv1 "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/transformer"
+)
+
+const (
+	// DefaultMaxBodyBytes is the default limit on the size of a request.
+	DefaultMaxBodyBytes = 1 << 20
+	// DefaultTimeout is the default time a transformation may take.
+	DefaultTimeout = 30 * time.Second
+
+	defaultLauncherImage = "quay.io/kubevirt/virt-launcher:v1.8.0"
+	defaultProxyImage    = "quay.io/vladikr/kubevirt-console-proxy:latest"
+
+	// maxCachedTransformers bounds the transformers kept for distinct
+	// option sets, as the options come from clients.
+	maxCachedTransformers = 64
+)
+
+// Options configures a Server.
+type Options struct {
+	// MaxBodyBytes is the largest request body accepted; larger requests
+	// get 413. Defaults to DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+	// Timeout bounds every transformation. Defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// TransformOptions are the transformer options a client may set, either as
+// query parameters of the same name or as "options" in a JSON envelope. They
+// mirror the command-line flags. Options that read files on the server, such
+// as instancetype files or SSH keys, are not offered.
+type TransformOptions struct {
+	NoPasst            bool   `json:"noPasst"`
+	MountDevices       bool   `json:"mountDevices"`
+	LauncherImage      string `json:"launcherImage"`
+	AddConsoleProxy    bool   `json:"addConsoleProxy"`
+	ProxyImage         string `json:"proxyImage"`
+	ProxyPort          int    `json:"proxyPort"`
+	ProxyPublish       bool   `json:"proxyPublish"`
+	ConsoleLog         bool   `json:"consoleLog"`
+	ConsoleLogMaxSize  int    `json:"consoleLogMaxSize"`
+	ConsoleLogMaxFiles int    `json:"consoleLogMaxFiles"`
+	ConsoleRecord      bool   `json:"consoleRecord"`
+	Emulation          bool   `json:"emulation"`
+	// Explain adds what every pipeline stage changed to the diagnostics.
+	Explain bool `json:"explain"`
+}
+
+// DefaultTransformOptions returns the options used for fields a client does
+// not set, the same as the command-line defaults.
+func DefaultTransformOptions() TransformOptions {
+	return TransformOptions{
+		MountDevices:       true,
+		LauncherImage:      defaultLauncherImage,
+		ProxyPort:          8080,
+		ConsoleLogMaxSize:  10,
+		ConsoleLogMaxFiles: 5,
+	}
+}
+
+// hostOptions are command-line options the server refuses, with why: they
+// would change the host the server runs on.
+var hostOptions = map[string]string{
+	"createMDEVs": "the server does not create mediated devices on its host",
+}
+
+// Limits on the console log options a client may set.
+const (
+	maxConsoleLogMaxSize  = 10240
+	maxConsoleLogMaxFiles = 100
+)
+
+// validate checks the numeric options, which are passed on to the Pod as
+// they are.
+func (o TransformOptions) validate() error {
+	if o.ProxyPort < 1 || o.ProxyPort > 65535 {
+		return badRequest("invalid proxyPort %d: expected 1-65535", o.ProxyPort)
+	}
+	if o.ConsoleLogMaxSize < 0 || o.ConsoleLogMaxSize > maxConsoleLogMaxSize {
+		return badRequest("invalid consoleLogMaxSize %d: expected 0-%d MiB", o.ConsoleLogMaxSize, maxConsoleLogMaxSize)
+	}
+	if o.ConsoleLogMaxFiles < 0 || o.ConsoleLogMaxFiles > maxConsoleLogMaxFiles {
+		return badRequest("invalid consoleLogMaxFiles %d: expected 0-%d", o.ConsoleLogMaxFiles, maxConsoleLogMaxFiles)
+	}
+	return nil
+}
+
+// Response is the body of a successful transformation.
+type Response struct {
+	Pod         *k8sv1.Pod  `json:"pod"`
+	Diagnostics Diagnostics `json:"diagnostics"`
+}
+
+// Diagnostics describes how the Pod was made.
+type Diagnostics struct {
+	// Warnings are things that need attention before running the Pod.
+	Warnings []string `json:"warnings,omitempty"`
+	// Options are the options the Pod was made with, defaults included.
+	Options TransformOptions `json:"options"`
+	// Explanation is set when the client asked for it.
+	Explanation *transformer.Explanation `json:"explanation,omitempty"`
+	// Duration is the time the transformation took.
+	Duration string `json:"duration"`
+}
+
+// ErrorResponse is the body of a failed request.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// envelope is a JSON request body carrying the VM and its options.
+type envelope struct {
+	VM      json.RawMessage `json:"vm"`
+	Options json.RawMessage `json:"options"`
+}
+
+// Server serves the transformer over HTTP:
+//
+//	POST /v1/transform  VM YAML or JSON, or {"vm": ..., "options": {...}}
+//	GET  /healthz       liveness
+//	GET  /metrics       Prometheus metrics
+type Server struct {
+	opts Options
+
+	mu           sync.Mutex
+	transformers map[transformerKey]*transformer.VMToPodTransformer
+
+	registry  *prometheus.Registry
+	requests  *prometheus.CounterVec
+	durations prometheus.Histogram
+	inFlight  prometheus.Gauge
+}
+
+// transformerKey is the part of TransformOptions that selects a transformer.
+type transformerKey TransformOptions
+
+// New returns a server with its own metrics registry.
+func New(opts Options) *Server {
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	s := &Server{
+		opts:         opts,
+		transformers: map[transformerKey]*transformer.VMToPodTransformer{},
+		registry:     prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kubevirt_vm_to_pod_transform_requests_total",
+			Help: "Transform requests by HTTP status code.",
+		}, []string{"code"}),
+		durations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "kubevirt_vm_to_pod_transform_duration_seconds",
+			Help:    "Time spent transforming VMs, including failed transformations.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "kubevirt_vm_to_pod_transform_requests_in_flight",
+			Help: "Transform requests being served.",
+		}),
+	}
+	s.registry.MustRegister(
+		s.requests,
+		s.durations,
+		s.inFlight,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return s
+}
+
+// Handler returns the HTTP handler of the server.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/transform", s.serveTransform)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "ok\n")
+	})
+	mux.Handle("GET /metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// requestError is an error with the HTTP status it is reported with.
+type requestError struct {
+	code int
+	err  error
+}
+
+func (e *requestError) Error() string { return e.err.Error() }
+
+func badRequest(format string, args ...interface{}) error {
+	return &requestError{code: http.StatusBadRequest, err: fmt.Errorf(format, args...)}
+}
+
+func (s *Server) serveTransform(w http.ResponseWriter, r *http.Request) {
+	s.inFlight.Inc()
+	defer s.inFlight.Dec()
+
+	resp, err := s.transform(w, r)
+	if err != nil {
+		code := http.StatusInternalServerError
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			code = reqErr.code
+		}
+		s.writeJSON(w, code, ErrorResponse{Error: err.Error()})
+		return
+	}
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	s.requests.WithLabelValues(strconv.Itoa(code)).Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) transform(w http.ResponseWriter, r *http.Request) (*Response, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.opts.MaxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, &requestError{code: http.StatusRequestEntityTooLarge, err: fmt.Errorf("request body exceeds %d bytes", tooLarge.Limit)}
+		}
+		return nil, badRequest("failed to read request: %v", err)
+	}
+
+	opts, err := parseQuery(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	vm, err := parseBody(body, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.opts.Timeout)
+	defer cancel()
+
+	t := s.transformer(opts)
+	start := time.Now()
+	var result *transformer.Result
+	if opts.Explain {
+		result, err = t.TransformVMDetailed(ctx, vm)
+	} else {
+		result, err = t.TransformVMResult(ctx, vm)
+	}
+	elapsed := time.Since(start)
+	s.durations.Observe(elapsed.Seconds())
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, &requestError{code: http.StatusServiceUnavailable, err: fmt.Errorf("transformation aborted: %v", err)}
+		}
+		return nil, &requestError{code: http.StatusUnprocessableEntity, err: fmt.Errorf("failed to transform VM to Pod: %v", err)}
+	}
+
+	return &Response{
+		Pod: result.Pod,
+		Diagnostics: Diagnostics{
+			Warnings:    result.Warnings,
+			Options:     opts,
+			Explanation: result.Explanation,
+			Duration:    elapsed.String(),
+		},
+	}, nil
+}
+
+// transformer returns the transformer for opts, reusing one built for the
+// same options.
+func (s *Server) transformer(opts TransformOptions) *transformer.VMToPodTransformer {
+	key := transformerKey(opts)
+	key.Explain = false
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.transformers[key]; ok {
+		return t
+	}
+
+	proxyImage := opts.ProxyImage
+	if proxyImage == "" {
+		proxyImage = defaultProxyImage
+	}
+	t := transformer.NewVMToPodTransformer(
+		transformer.WithLauncherImage(opts.LauncherImage),
+		transformer.WithAddConsoleProxy(opts.AddConsoleProxy, proxyImage, opts.ProxyPort),
+		transformer.WithForcePasst(!opts.NoPasst),
+		transformer.WithMountDevices(opts.MountDevices),
+		transformer.WithConsoleLog(opts.ConsoleLog, opts.ConsoleLogMaxSize, opts.ConsoleLogMaxFiles),
+		transformer.WithConsoleRecord(opts.ConsoleRecord),
+		transformer.WithPublishConsoleProxy(opts.ProxyPublish),
+		transformer.WithEmulation(opts.Emulation),
+		transformer.WithCreateMDEVs(false),
+	)
+	if len(s.transformers) < maxCachedTransformers {
+		s.transformers[key] = t
+	}
+	return t
+}
+
+// parseQuery returns the default options overridden by the query parameters.
+func parseQuery(q url.Values) (TransformOptions, error) {
+	opts := DefaultTransformOptions()
+	bools := map[string]*bool{
+		"noPasst":         &opts.NoPasst,
+		"mountDevices":    &opts.MountDevices,
+		"addConsoleProxy": &opts.AddConsoleProxy,
+		"proxyPublish":    &opts.ProxyPublish,
+		"consoleLog":      &opts.ConsoleLog,
+		"consoleRecord":   &opts.ConsoleRecord,
+		"emulation":       &opts.Emulation,
+		"explain":         &opts.Explain,
+	}
+	ints := map[string]*int{
+		"proxyPort":          &opts.ProxyPort,
+		"consoleLogMaxSize":  &opts.ConsoleLogMaxSize,
+		"consoleLogMaxFiles": &opts.ConsoleLogMaxFiles,
+	}
+	strs := map[string]*string{
+		"launcherImage": &opts.LauncherImage,
+		"proxyImage":    &opts.ProxyImage,
+	}
+
+	for name, values := range q {
+		value := values[len(values)-1]
+		switch {
+		case bools[name] != nil:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, badRequest("invalid value %q for %s: expected a boolean", value, name)
+			}
+			*bools[name] = b
+		case ints[name] != nil:
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, badRequest("invalid value %q for %s: expected an integer", value, name)
+			}
+			*ints[name] = i
+		case strs[name] != nil:
+			*strs[name] = value
+		case hostOptions[name] != "":
+			return opts, badRequest("option %s is not offered: %s", name, hostOptions[name])
+		default:
+			return opts, badRequest("unknown option %s", name)
+		}
+	}
+	return opts, nil
+}
+
+// parseBody parses a VM in YAML or JSON, or a JSON envelope whose options
+// override opts.
+func parseBody(body []byte, opts *TransformOptions) (*virtv1.VirtualMachine, error) {
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return nil, badRequest("request body is empty, expected a VirtualMachine")
+	}
+	data, err := yaml.YAMLToJSON(body)
+	if err != nil {
+		return nil, badRequest("failed to parse request: %v", err)
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err == nil && env.VM != nil {
+		if env.Options != nil {
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(env.Options, &fields); err == nil {
+				for name := range fields {
+					if hostOptions[name] != "" {
+						return nil, badRequest("option %s is not offered: %s", name, hostOptions[name])
+					}
+				}
+			}
+			dec := json.NewDecoder(strings.NewReader(string(env.Options)))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(opts); err != nil {
+				return nil, badRequest("invalid options: %v", err)
+			}
+		}
+		data = env.VM
+	}
+
+	vm := &virtv1.VirtualMachine{}
+	if err := json.Unmarshal(data, vm); err != nil {
+		return nil, badRequest("failed to unmarshal VM: %v", err)
+	}
+	if vm.Kind != "" && vm.Kind != "VirtualMachine" {
+		return nil, badRequest("expected a VirtualMachine, got %s", vm.Kind)
+	}
+	return vm, nil
+}
+
+// Listen listens on a TCP address or, with a unix: prefix, on a unix socket.
+// A stale socket left by an earlier run is replaced, but not one another
+// server still answers on.
+func Listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+		}
+		return l, nil
+	}
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another server is listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	return l, nil
+}
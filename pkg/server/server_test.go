@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+const testVM = `
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: testvm
+spec:
+  template:
+    spec:
+      domain:
+        resources:
+          requests:
+            memory: 64Mi
+        devices:
+          interfaces:
+          - name: default
+            masquerade: {}
+      networks:
+      - name: default
+        pod: {}
+      volumes:
+      - name: data
+        persistentVolumeClaim:
+          claimName: data-pvc
+`
+
+func post(t *testing.T, srv *httptest.Server, query, contentType, body string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Post(srv.URL+"/v1/transform"+query, contentType, strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, data
+}
+
+func TestTransform(t *testing.T) {
+	srv := httptest.NewServer(New(Options{MaxBodyBytes: 4096}).Handler())
+	defer srv.Close()
+
+	t.Run("YAML body", func(t *testing.T) {
+		code, data := post(t, srv, "", "application/yaml", testVM)
+		require.Equal(t, http.StatusOK, code, string(data))
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(data, &resp))
+		require.Equal(t, "virt-launcher-testvm", resp.Pod.Name)
+		require.Len(t, resp.Diagnostics.Warnings, 1)
+		require.Contains(t, resp.Diagnostics.Warnings[0], "PVC volumes")
+		require.Equal(t, DefaultTransformOptions(), resp.Diagnostics.Options)
+		require.Nil(t, resp.Diagnostics.Explanation)
+		require.Contains(t, string(data), "passtBinding")
+	})
+
+	t.Run("query options", func(t *testing.T) {
+		code, data := post(t, srv, "?noPasst=true&addConsoleProxy=true&proxyPort=9000&explain=true", "application/yaml", testVM)
+		require.Equal(t, http.StatusOK, code, string(data))
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(data, &resp))
+		require.NotContains(t, string(data), "passtBinding")
+		require.Len(t, resp.Pod.Spec.Containers, 2)
+		require.Equal(t, "console-proxy", resp.Pod.Spec.Containers[1].Name)
+		require.Equal(t, 9000, resp.Diagnostics.Options.ProxyPort)
+		require.NotNil(t, resp.Diagnostics.Explanation)
+		require.NotEmpty(t, resp.Diagnostics.Explanation.Stages)
+	})
+
+	t.Run("emulation", func(t *testing.T) {
+		code, data := post(t, srv, "?emulation=true", "application/yaml", testVM)
+		require.Equal(t, http.StatusOK, code, string(data))
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(data, &resp))
+		require.True(t, resp.Diagnostics.Options.Emulation)
+		require.Len(t, resp.Diagnostics.Warnings, 2)
+		require.Contains(t, resp.Diagnostics.Warnings[1], "software emulation")
+		require.Contains(t, resp.Pod.Spec.Containers[0].Command, "--allow-emulation")
+	})
+
+	t.Run("transformer warnings", func(t *testing.T) {
+		vm := strings.Replace(testVM, `          interfaces:`, `          gpus:
+          - name: gpu1
+            deviceName: example.com/GPU
+          interfaces:`, 1)
+		vm = strings.Replace(vm, `        pod: {}`, `        multus:
+          networkName: mynet`, 1)
+		code, data := post(t, srv, "", "application/yaml", vm)
+		require.Equal(t, http.StatusOK, code, string(data))
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(data, &resp))
+		warnings := strings.Join(resp.Diagnostics.Warnings, "\n")
+		require.Contains(t, warnings, `network "default" uses Multus`)
+		require.Contains(t, warnings, "unknown GPU vendor for device example.com/GPU")
+		require.Contains(t, warnings, "persistentVolumeClaim volumes")
+	})
+
+	t.Run("JSON envelope", func(t *testing.T) {
+		vm, err := yaml.YAMLToJSON([]byte(testVM))
+		require.NoError(t, err)
+		body := `{"vm": ` + string(vm) + `, "options": {"mountDevices": false}}`
+		code, data := post(t, srv, "?mountDevices=true", "application/json", body)
+		require.Equal(t, http.StatusOK, code, string(data))
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(data, &resp))
+		require.False(t, resp.Diagnostics.Options.MountDevices, "envelope options override the query")
+	})
+
+	t.Run("client errors", func(t *testing.T) {
+		for name, tc := range map[string]struct {
+			query string
+			body  string
+			code  int
+			err   string
+		}{
+			"empty body":         {body: "", code: http.StatusBadRequest, err: "empty"},
+			"invalid YAML":       {body: "kind: [", code: http.StatusBadRequest, err: "failed to parse request"},
+			"wrong kind":         {body: "kind: Pod", code: http.StatusBadRequest, err: "expected a VirtualMachine"},
+			"unknown option":     {query: "?bogus=1", body: testVM, code: http.StatusBadRequest, err: "unknown option bogus"},
+			"invalid option":     {query: "?noPasst=maybe", body: testVM, code: http.StatusBadRequest, err: "expected a boolean"},
+			"bad envelope":       {body: `{"vm": {}, "options": {"nope": true}}`, code: http.StatusBadRequest, err: "invalid options"},
+			"port out of range":  {query: "?proxyPort=70000", body: testVM, code: http.StatusBadRequest, err: "invalid proxyPort 70000"},
+			"negative log size":  {query: "?consoleLogMaxSize=-1", body: testVM, code: http.StatusBadRequest, err: "invalid consoleLogMaxSize -1"},
+			"too many log files": {body: `{"vm": {"kind": "VirtualMachine"}, "options": {"consoleLogMaxFiles": 1000}}`, code: http.StatusBadRequest, err: "invalid consoleLogMaxFiles 1000"},
+			"create mdevs":       {query: "?createMDEVs=true", body: testVM, code: http.StatusBadRequest, err: "option createMDEVs is not offered"},
+			"create mdevs body":  {body: `{"vm": {"kind": "VirtualMachine"}, "options": {"createMDEVs": true}}`, code: http.StatusBadRequest, err: "option createMDEVs is not offered"},
+			"too large":          {body: testVM + strings.Repeat("#", 4096), code: http.StatusRequestEntityTooLarge, err: "exceeds 4096 bytes"},
+			"transform error":    {body: strings.Replace(testVM, "persistentVolumeClaim:\n          claimName: data-pvc", "dataVolume:\n          name: dv", 1), code: http.StatusUnprocessableEntity, err: "DataVolume"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				code, data := post(t, srv, tc.query, "application/yaml", tc.body)
+				require.Equal(t, tc.code, code, string(data))
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(data, &resp))
+				require.Contains(t, resp.Error, tc.err)
+			})
+		}
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/v1/transform")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+func TestHealthAndMetrics(t *testing.T) {
+	srv := httptest.NewServer(New(Options{}).Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/healthz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	post(t, srv, "", "application/yaml", testVM)
+	post(t, srv, "", "application/yaml", "")
+
+	resp, err = http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `kubevirt_vm_to_pod_transform_requests_total{code="200"} 1`)
+	require.Contains(t, string(data), `kubevirt_vm_to_pod_transform_requests_total{code="400"} 1`)
+	require.Contains(t, string(data), "kubevirt_vm_to_pod_transform_duration_seconds_count 1")
+	require.Contains(t, string(data), "kubevirt_vm_to_pod_transform_requests_in_flight 0")
+}
+
+func TestTransformerCache(t *testing.T) {
+	s := New(Options{})
+	opts := DefaultTransformOptions()
+	first := s.transformer(opts)
+
+	opts.Explain = true
+	require.Same(t, first, s.transformer(opts), "explain does not need another transformer")
+
+	opts.NoPasst = true
+	require.NotSame(t, first, s.transformer(opts))
+}
+
+func TestListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serve.sock")
+
+	first, err := Listen("unix:" + path)
+	require.NoError(t, err)
+	_, err = Listen("unix:" + path)
+	require.EqualError(t, err, "another server is listening on "+path)
+
+	// A server that exited without removing its socket leaves it stale.
+	first.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, first.Close())
+	require.FileExists(t, path)
+	second, err := Listen("unix:" + path)
+	require.NoError(t, err, "a stale socket is replaced")
+	second.Close()
+}
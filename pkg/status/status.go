@@ -0,0 +1,292 @@
+package status
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt/pkg/network/vmispec"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/guestagent"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/launcher"
+)
+
+// Sources is everything known about a standalone VM. Only VMI and Compute are
+// required; the rest is missing while the VM boots or when the guest agent is
+// not running.
+type Sources struct {
+	// VMI is the VMI embedded in the Pod as STANDALONE_VMI.
+	VMI *v1.VirtualMachineInstance
+	// Compute is the state of the compute container.
+	Compute *launcher.ContainerInfo
+	// Domain is the libvirt domain, nil until virt-launcher defined it.
+	Domain *Domain
+	// Agent and GuestInterfaces come from the guest agent.
+	Agent           *v1.VirtualMachineInstanceGuestAgentInfo
+	GuestInterfaces []v1.VirtualMachineInstanceNetworkInterface
+	// NodeName is reported as the node running the VMI.
+	NodeName string
+}
+
+// Collect fills in the domain and guest agent parts of src by running virsh
+// in the running compute container through run. Until virt-launcher defined
+// the domain there is nothing to ask, and src is left as it is.
+func Collect(ctx context.Context, run launcher.RunFunc, src *Sources) error {
+	domain, err := launcher.Domain(ctx, run)
+	if err != nil {
+		return nil
+	}
+	out, err := run(ctx, "virsh", "domstate", "--reason", domain)
+	if err != nil {
+		return err
+	}
+	src.Domain = &Domain{}
+	src.Domain.State, src.Domain.Reason = ParseDomainState(string(out))
+	if xml, err := run(ctx, "virsh", "dumpxml", domain); err == nil {
+		if src.Domain.Interfaces, src.Domain.Disks, err = ParseDomainXML(xml); err != nil {
+			return err
+		}
+	}
+
+	agent := guestagent.New(run, domain)
+	if info, err := agent.Info(ctx); err == nil {
+		src.Agent = info
+		src.GuestInterfaces, _ = agent.Interfaces(ctx)
+	}
+	return nil
+}
+
+// Domain is the libvirt view of the VM.
+type Domain struct {
+	// State and Reason as printed by virsh domstate --reason, e.g.
+	// "running" and "booted".
+	State  string
+	Reason string
+	// Interfaces and Disks map KubeVirt device names to their domain
+	// devices.
+	Interfaces []DomainInterface
+	Disks      []DomainDisk
+}
+
+type DomainInterface struct {
+	Name string
+	MAC  string
+}
+
+type DomainDisk struct {
+	Name   string
+	Target string
+}
+
+// ParseDomainState parses the output of virsh domstate --reason.
+func ParseDomainState(out string) (state, reason string) {
+	out = strings.TrimSpace(out)
+	if i := strings.LastIndex(out, " ("); i >= 0 && strings.HasSuffix(out, ")") {
+		return out[:i], out[i+2 : len(out)-1]
+	}
+	return out, ""
+}
+
+// ParseDomainXML extracts the devices KubeVirt named from virsh dumpxml
+// output. KubeVirt sets the alias of every device to "ua-" followed by its
+// name in the VMI spec.
+func ParseDomainXML(data []byte) (interfaces []DomainInterface, disks []DomainDisk, err error) {
+	var dom struct {
+		Devices struct {
+			Interfaces []struct {
+				MAC struct {
+					Address string `xml:"address,attr"`
+				} `xml:"mac"`
+				Alias struct {
+					Name string `xml:"name,attr"`
+				} `xml:"alias"`
+			} `xml:"interface"`
+			Disks []struct {
+				Target struct {
+					Dev string `xml:"dev,attr"`
+				} `xml:"target"`
+				Alias struct {
+					Name string `xml:"name,attr"`
+				} `xml:"alias"`
+			} `xml:"disk"`
+		} `xml:"devices"`
+	}
+	if err := xml.Unmarshal(data, &dom); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse domain XML: %v", err)
+	}
+
+	for _, i := range dom.Devices.Interfaces {
+		if name, ok := strings.CutPrefix(i.Alias.Name, "ua-"); ok {
+			interfaces = append(interfaces, DomainInterface{Name: name, MAC: i.MAC.Address})
+		}
+	}
+	for _, d := range dom.Devices.Disks {
+		if name, ok := strings.CutPrefix(d.Alias.Name, "ua-"); ok {
+			disks = append(disks, DomainDisk{Name: name, Target: d.Target.Dev})
+		}
+	}
+	return interfaces, disks, nil
+}
+
+// Build returns a copy of the embedded VMI with the status virt-handler would
+// report for it.
+func Build(src Sources) *v1.VirtualMachineInstance {
+	vmi := src.VMI.DeepCopy()
+	vmi.Kind = "VirtualMachineInstance"
+	vmi.APIVersion = v1.GroupVersion.String()
+
+	status := &vmi.Status
+	status.Phase, status.PhaseTransitionTimestamps = phase(src)
+	status.NodeName = src.NodeName
+	status.LauncherContainerImageVersion = src.Compute.Image
+	if vmi.Spec.Domain.Machine != nil {
+		status.Machine = vmi.Spec.Domain.Machine.DeepCopy()
+	}
+	if src.Agent != nil {
+		status.GuestOSInfo = src.Agent.OS
+	}
+	status.Interfaces = interfaces(vmi, src)
+	status.VolumeStatus = volumes(vmi, src.Domain)
+	status.Conditions = conditions(status.Phase, src)
+	// A standalone VM has no other node to go to.
+	status.MigrationState = nil
+	return vmi
+}
+
+func phase(src Sources) (v1.VirtualMachineInstancePhase, []v1.VirtualMachineInstancePhaseTransitionTimestamp) {
+	at := func(p v1.VirtualMachineInstancePhase, t time.Time) (v1.VirtualMachineInstancePhase, []v1.VirtualMachineInstancePhaseTransitionTimestamp) {
+		if t.IsZero() {
+			return p, nil
+		}
+		return p, []v1.VirtualMachineInstancePhaseTransitionTimestamp{{Phase: p, PhaseTransitionTimestamp: metav1.NewTime(t)}}
+	}
+
+	if !src.Compute.Running {
+		if src.Compute.ExitCode == 0 {
+			return at(v1.Succeeded, src.Compute.FinishedAt)
+		}
+		return at(v1.Failed, src.Compute.FinishedAt)
+	}
+	if src.Domain == nil {
+		return at(v1.Scheduled, src.Compute.StartedAt)
+	}
+
+	switch src.Domain.State {
+	case "running", "paused", "idle", "blocked", "in shutdown", "pmsuspended":
+		return at(v1.Running, src.Compute.StartedAt)
+	case "shut off":
+		if src.Domain.Reason == "crashed" || src.Domain.Reason == "failed" {
+			return at(v1.Failed, time.Time{})
+		}
+		return at(v1.Succeeded, time.Time{})
+	case "crashed":
+		return at(v1.Failed, time.Time{})
+	default:
+		return at(v1.Unknown, time.Time{})
+	}
+}
+
+// interfaces merges the interfaces of the VMI spec with their domain MAC
+// addresses and, matched by MAC, what the guest agent reports. Guest
+// interfaces that match none are appended, as KubeVirt does.
+func interfaces(vmi *v1.VirtualMachineInstance, src Sources) []v1.VirtualMachineInstanceNetworkInterface {
+	macs := map[string]string{}
+	if src.Domain != nil {
+		for _, i := range src.Domain.Interfaces {
+			macs[i.Name] = strings.ToLower(i.MAC)
+		}
+	}
+	guest := map[string]v1.VirtualMachineInstanceNetworkInterface{}
+	for _, g := range src.GuestInterfaces {
+		guest[strings.ToLower(g.MAC)] = g
+	}
+
+	var result []v1.VirtualMachineInstanceNetworkInterface
+	for i, iface := range vmi.Spec.Domain.Devices.Interfaces {
+		s := v1.VirtualMachineInstanceNetworkInterface{
+			Name:             iface.Name,
+			PodInterfaceName: fmt.Sprintf("eth%d", i),
+			MAC:              strings.ToLower(iface.MacAddress),
+		}
+		if mac, ok := macs[iface.Name]; ok {
+			s.MAC = mac
+			s.InfoSource = vmispec.AddInfoSource(s.InfoSource, vmispec.InfoSourceDomain)
+		}
+		if g, ok := guest[s.MAC]; ok && s.MAC != "" {
+			s.IP, s.IPs, s.InterfaceName = g.IP, g.IPs, g.InterfaceName
+			s.InfoSource = vmispec.AddInfoSource(s.InfoSource, vmispec.InfoSourceGuestAgent)
+			delete(guest, s.MAC)
+		}
+		result = append(result, s)
+	}
+	for _, g := range src.GuestInterfaces {
+		if _, ok := guest[strings.ToLower(g.MAC)]; ok {
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+func volumes(vmi *v1.VirtualMachineInstance, domain *Domain) []v1.VolumeStatus {
+	targets := map[string]string{}
+	if domain != nil {
+		for _, d := range domain.Disks {
+			targets[d.Name] = d.Target
+		}
+	}
+
+	var result []v1.VolumeStatus
+	for _, vol := range vmi.Spec.Volumes {
+		s := v1.VolumeStatus{Name: vol.Name, Target: targets[vol.Name]}
+		if vol.PersistentVolumeClaim != nil {
+			s.PersistentVolumeClaimInfo = &v1.PersistentVolumeClaimInfo{ClaimName: vol.PersistentVolumeClaim.ClaimName}
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func conditions(phase v1.VirtualMachineInstancePhase, src Sources) []v1.VirtualMachineInstanceCondition {
+	ready := v1.VirtualMachineInstanceCondition{
+		Type:   v1.VirtualMachineInstanceReady,
+		Status: k8sv1.ConditionFalse,
+		Reason: v1.GuestNotRunningReason,
+	}
+	paused := src.Domain != nil && src.Domain.State == "paused"
+	if phase == v1.Running && !paused {
+		ready.Status, ready.Reason = k8sv1.ConditionTrue, ""
+	}
+	result := []v1.VirtualMachineInstanceCondition{ready}
+
+	if paused {
+		c := v1.VirtualMachineInstanceCondition{Type: v1.VirtualMachineInstancePaused, Status: k8sv1.ConditionTrue}
+		switch src.Domain.Reason {
+		case "user":
+			c.Reason, c.Message = "PausedByUser", "VMI was paused by user"
+		case "I/O error":
+			c.Reason, c.Message = "PausedIOError", "VMI was paused, low-level IO error detected"
+		default:
+			c.Reason, c.Message = "Paused", fmt.Sprintf("VMI was paused (%s)", src.Domain.Reason)
+		}
+		result = append(result, c)
+	}
+
+	if src.Agent != nil {
+		result = append(result, v1.VirtualMachineInstanceCondition{
+			Type:   v1.VirtualMachineInstanceAgentConnected,
+			Status: k8sv1.ConditionTrue,
+		})
+	}
+
+	return append(result, v1.VirtualMachineInstanceCondition{
+		Type:    v1.VirtualMachineInstanceIsMigratable,
+		Status:  k8sv1.ConditionFalse,
+		Reason:  v1.VirtualMachineInstanceReasonNotMigratable,
+		Message: "standalone VMs run on a single host and cannot be migrated",
+	})
+}
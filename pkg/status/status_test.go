@@ -0,0 +1,207 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1 "kubevirt.io/api/core/v1"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/launcher"
+)
+
+const domainXML = `<domain type="kvm">
+  <name>default_testvm</name>
+  <devices>
+    <disk type="file" device="disk">
+      <source file="/var/run/kubevirt-private/vmi-disks/rootdisk/disk.img"/>
+      <target dev="vda" bus="virtio"/>
+      <alias name="ua-rootdisk"/>
+    </disk>
+    <disk type="file" device="cdrom">
+      <target dev="sda" bus="sata"/>
+      <alias name="ua-cloudinitdisk"/>
+    </disk>
+    <interface type="ethernet">
+      <mac address="52:54:00:AA:BB:CC"/>
+      <alias name="ua-default"/>
+    </interface>
+    <interface type="ethernet">
+      <mac address="52:54:00:11:22:33"/>
+      <alias name="net0"/>
+    </interface>
+  </devices>
+</domain>`
+
+func testVMI() *v1.VirtualMachineInstance {
+	return &v1.VirtualMachineInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "testvm", Namespace: "default"},
+		Spec: v1.VirtualMachineInstanceSpec{
+			Domain: v1.DomainSpec{
+				Machine: &v1.Machine{Type: "q35"},
+				Devices: v1.Devices{
+					Interfaces: []v1.Interface{{Name: "default"}},
+				},
+			},
+			Volumes: []v1.Volume{
+				{Name: "rootdisk", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+					PersistentVolumeClaimVolumeSource: k8sv1.PersistentVolumeClaimVolumeSource{ClaimName: "rootdisk-pvc"},
+				}}},
+				{Name: "cloudinitdisk", VolumeSource: v1.VolumeSource{CloudInitNoCloud: &v1.CloudInitNoCloudSource{}}},
+			},
+		},
+	}
+}
+
+func TestParseDomainState(t *testing.T) {
+	for out, want := range map[string][2]string{
+		"running (booted)\n":  {"running", "booted"},
+		"paused (I/O error)":  {"paused", "I/O error"},
+		"shut off (shutdown)": {"shut off", "shutdown"},
+		"running":             {"running", ""},
+	} {
+		state, reason := ParseDomainState(out)
+		require.Equal(t, want, [2]string{state, reason}, out)
+	}
+}
+
+func TestParseDomainXML(t *testing.T) {
+	ifaces, disks, err := ParseDomainXML([]byte(domainXML))
+	require.NoError(t, err)
+	require.Equal(t, []DomainInterface{{Name: "default", MAC: "52:54:00:AA:BB:CC"}}, ifaces)
+	require.Equal(t, []DomainDisk{{Name: "rootdisk", Target: "vda"}, {Name: "cloudinitdisk", Target: "sda"}}, disks)
+
+	_, _, err = ParseDomainXML([]byte("<domain"))
+	require.Error(t, err)
+}
+
+func TestBuildRunning(t *testing.T) {
+	started := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	ifaces, disks, err := ParseDomainXML([]byte(domainXML))
+	require.NoError(t, err)
+
+	vmi := Build(Sources{
+		VMI:     testVMI(),
+		Compute: &launcher.ContainerInfo{Image: "quay.io/kubevirt/virt-launcher:v1.8.0", Running: true, StartedAt: started},
+		Domain:  &Domain{State: "running", Reason: "booted", Interfaces: ifaces, Disks: disks},
+		Agent:   &v1.VirtualMachineInstanceGuestAgentInfo{OS: v1.VirtualMachineInstanceGuestOSInfo{ID: "fedora", VersionID: "40"}},
+		GuestInterfaces: []v1.VirtualMachineInstanceNetworkInterface{
+			{MAC: "52:54:00:aa:bb:cc", InterfaceName: "eth0", IP: "10.0.2.2", IPs: []string{"10.0.2.2"}, InfoSource: "guest-agent"},
+			{MAC: "52:54:00:de:ad:00", InterfaceName: "docker0", IP: "172.17.0.1", IPs: []string{"172.17.0.1"}, InfoSource: "guest-agent"},
+		},
+		NodeName: "host1",
+	})
+
+	require.Equal(t, "kubevirt.io/v1", vmi.APIVersion)
+	require.Equal(t, "VirtualMachineInstance", vmi.Kind)
+	require.Equal(t, v1.Running, vmi.Status.Phase)
+	require.Equal(t, []v1.VirtualMachineInstancePhaseTransitionTimestamp{{Phase: v1.Running, PhaseTransitionTimestamp: metav1.NewTime(started)}}, vmi.Status.PhaseTransitionTimestamps)
+	require.Equal(t, "host1", vmi.Status.NodeName)
+	require.Equal(t, "quay.io/kubevirt/virt-launcher:v1.8.0", vmi.Status.LauncherContainerImageVersion)
+	require.Equal(t, &v1.Machine{Type: "q35"}, vmi.Status.Machine)
+	require.Equal(t, "fedora", vmi.Status.GuestOSInfo.ID)
+	require.Nil(t, vmi.Status.MigrationState)
+
+	require.Equal(t, []v1.VirtualMachineInstanceNetworkInterface{
+		{Name: "default", PodInterfaceName: "eth0", MAC: "52:54:00:aa:bb:cc", InterfaceName: "eth0", IP: "10.0.2.2", IPs: []string{"10.0.2.2"}, InfoSource: "domain, guest-agent"},
+		{MAC: "52:54:00:de:ad:00", InterfaceName: "docker0", IP: "172.17.0.1", IPs: []string{"172.17.0.1"}, InfoSource: "guest-agent"},
+	}, vmi.Status.Interfaces)
+
+	require.Equal(t, []v1.VolumeStatus{
+		{Name: "rootdisk", Target: "vda", PersistentVolumeClaimInfo: &v1.PersistentVolumeClaimInfo{ClaimName: "rootdisk-pvc"}},
+		{Name: "cloudinitdisk", Target: "sda"},
+	}, vmi.Status.VolumeStatus)
+
+	require.Equal(t, []v1.VirtualMachineInstanceConditionType{
+		v1.VirtualMachineInstanceReady,
+		v1.VirtualMachineInstanceAgentConnected,
+		v1.VirtualMachineInstanceIsMigratable,
+	}, conditionTypes(vmi))
+	require.Equal(t, k8sv1.ConditionTrue, vmi.Status.Conditions[0].Status)
+	require.Equal(t, k8sv1.ConditionFalse, vmi.Status.Conditions[2].Status)
+
+	require.Empty(t, testVMI().Status.Phase, "the source VMI must not be modified")
+}
+
+func TestBuildPhases(t *testing.T) {
+	running := &launcher.ContainerInfo{Running: true}
+	for _, tc := range []struct {
+		name    string
+		compute *launcher.ContainerInfo
+		domain  *Domain
+		phase   v1.VirtualMachineInstancePhase
+		ready   bool
+	}{
+		{"booting", running, nil, v1.Scheduled, false},
+		{"running", running, &Domain{State: "running"}, v1.Running, true},
+		{"paused", running, &Domain{State: "paused", Reason: "user"}, v1.Running, false},
+		{"shut down", running, &Domain{State: "shut off", Reason: "shutdown"}, v1.Succeeded, false},
+		{"crashed", running, &Domain{State: "shut off", Reason: "crashed"}, v1.Failed, false},
+		{"container exited", &launcher.ContainerInfo{ExitCode: 0}, nil, v1.Succeeded, false},
+		{"container failed", &launcher.ContainerInfo{ExitCode: 1}, nil, v1.Failed, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			vmi := Build(Sources{VMI: testVMI(), Compute: tc.compute, Domain: tc.domain})
+			require.Equal(t, tc.phase, vmi.Status.Phase)
+			ready := vmi.Status.Conditions[0]
+			require.Equal(t, v1.VirtualMachineInstanceReady, ready.Type)
+			require.Equal(t, tc.ready, ready.Status == k8sv1.ConditionTrue)
+			require.NotContains(t, conditionTypes(vmi), v1.VirtualMachineInstanceAgentConnected)
+		})
+	}
+}
+
+func TestCollectShutOff(t *testing.T) {
+	// A guest that shut down leaves its domain defined but not running;
+	// virsh list only shows it with --all.
+	virsh := func(ctx context.Context, args ...string) ([]byte, error) {
+		switch strings.Join(args, " ") {
+		case "virsh list --name":
+			return []byte("\n"), nil
+		case "virsh list --all --name":
+			return []byte("default_testvm\n\n"), nil
+		case "virsh domstate --reason default_testvm":
+			return []byte("shut off (shutdown)\n"), nil
+		case "virsh dumpxml default_testvm":
+			return []byte(domainXML), nil
+		}
+		return nil, errors.New("error: Requested operation is not valid: domain is not running")
+	}
+
+	src := Sources{VMI: testVMI(), Compute: &launcher.ContainerInfo{Running: true}}
+	require.NoError(t, Collect(context.Background(), virsh, &src))
+	require.Equal(t, "shut off", src.Domain.State)
+	require.Equal(t, "shutdown", src.Domain.Reason)
+	require.Nil(t, src.Agent)
+
+	vmi := Build(src)
+	require.Equal(t, v1.Succeeded, vmi.Status.Phase)
+	require.Equal(t, "vda", vmi.Status.VolumeStatus[0].Target)
+}
+
+func TestBuildPaused(t *testing.T) {
+	vmi := Build(Sources{
+		VMI:     testVMI(),
+		Compute: &launcher.ContainerInfo{Running: true},
+		Domain:  &Domain{State: "paused", Reason: "I/O error"},
+	})
+	require.Equal(t, v1.VirtualMachineInstanceCondition{
+		Type:    v1.VirtualMachineInstancePaused,
+		Status:  k8sv1.ConditionTrue,
+		Reason:  "PausedIOError",
+		Message: "VMI was paused, low-level IO error detected",
+	}, vmi.Status.Conditions[1])
+}
+
+func conditionTypes(vmi *v1.VirtualMachineInstance) []v1.VirtualMachineInstanceConditionType {
+	var types []v1.VirtualMachineInstanceConditionType
+	for _, c := range vmi.Status.Conditions {
+		types = append(types, c.Type)
+	}
+	return types
+}
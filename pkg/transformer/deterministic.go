@@ -0,0 +1,74 @@
+package transformer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	virtv1 "kubevirt.io/api/core/v1"
+)
+
+// dropGeneratedMetadata clears the metadata the cluster generates, such as
+// UIDs and timestamps, from a VMI built from a VM exported from a cluster.
+func dropGeneratedMetadata(vmi *virtv1.VirtualMachineInstance) {
+	vmi.UID = ""
+	vmi.ResourceVersion = ""
+	vmi.Generation = 0
+	vmi.CreationTimestamp = metav1.Time{}
+	vmi.DeletionTimestamp = nil
+	vmi.DeletionGracePeriodSeconds = nil
+	vmi.ManagedFields = nil
+	vmi.SelfLink = ""
+	for i := range vmi.OwnerReferences {
+		vmi.OwnerReferences[i].UID = ""
+	}
+}
+
+// sortPod sorts the volumes of pod by name and the mounts and env of every
+// container, and replaces the randomized QEMU timeout with its base value.
+// Container order is kept, since the first container is the default one.
+func sortPod(pod *k8sv1.Pod) {
+	sort.SliceStable(pod.Spec.Volumes, func(i, j int) bool {
+		return pod.Spec.Volumes[i].Name < pod.Spec.Volumes[j].Name
+	})
+	for i := range pod.Spec.InitContainers {
+		sortContainer(&pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		sortContainer(&pod.Spec.Containers[i])
+	}
+}
+
+func sortContainer(c *k8sv1.Container) {
+	// Parents sort before the mounts nested in them.
+	sort.SliceStable(c.VolumeMounts, func(i, j int) bool {
+		a, b := c.VolumeMounts[i], c.VolumeMounts[j]
+		if a.MountPath != b.MountPath {
+			return a.MountPath < b.MountPath
+		}
+		return a.Name < b.Name
+	})
+
+	// A variable can refer to the ones defined before it, so env using
+	// $(VAR) references keeps its order.
+	referencing := false
+	for _, env := range c.Env {
+		if strings.Contains(env.Value, "$(") {
+			referencing = true
+			break
+		}
+	}
+	if !referencing {
+		sort.SliceStable(c.Env, func(i, j int) bool {
+			return c.Env[i].Name < c.Env[j].Name
+		})
+	}
+
+	for j := 0; j+1 < len(c.Command); j++ {
+		if c.Command[j] == "--qemu-timeout" {
+			c.Command[j+1] = fmt.Sprintf("%ds", qemuTimeoutSeconds)
+		}
+	}
+}
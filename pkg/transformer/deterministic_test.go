@@ -0,0 +1,88 @@
+package transformer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	k8sv1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// renderDeterministic renders the VM in data the way the CLI prints it.
+func renderDeterministic(t *testing.T, data []byte) []byte {
+	t.Helper()
+	tr := NewVMToPodTransformer(
+		WithForcePasst(true),
+		WithMountDevices(true),
+		WithConsoleLog(true, 10, 5),
+		WithDeterministic(true),
+	)
+	vm, err := parseVM(data)
+	require.NoError(t, err)
+	pod, err := tr.TransformVM(vm)
+	require.NoError(t, err)
+	out, err := yaml.Marshal(pod)
+	require.NoError(t, err)
+	return out
+}
+
+func TestDeterministicGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "deterministic", "*-vm.yaml"))
+	require.NoError(t, err)
+	require.NotEmpty(t, inputs)
+
+	for _, input := range inputs {
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			data, err := os.ReadFile(input)
+			require.NoError(t, err)
+			out := renderDeterministic(t, data)
+			require.Equal(t, string(out), string(renderDeterministic(t, data)), "renders differ")
+
+			compareGolden(t, strings.TrimSuffix(input, "-vm.yaml")+"-pod.golden.yaml", out)
+		})
+	}
+}
+
+func TestDeterministicDropsGeneratedMetadata(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "deterministic", "exported-vm.yaml"))
+	require.NoError(t, err)
+	exported := renderDeterministic(t, data)
+
+	vm, err := parseVM(data)
+	require.NoError(t, err)
+	vm.UID = ""
+	vm.ResourceVersion = ""
+	vm.Generation = 0
+	vm.CreationTimestamp.Reset()
+	vm.ManagedFields = nil
+	clean, err := yaml.Marshal(vm)
+	require.NoError(t, err)
+
+	require.Equal(t, string(renderDeterministic(t, clean)), string(exported))
+	require.NotContains(t, string(exported), "5b0c9a40")
+	require.NotContains(t, string(exported), "2025-03-14")
+}
+
+func TestSortContainer(t *testing.T) {
+	c := k8sv1.Container{
+		Command: []string{"virt-launcher-monitor", "--qemu-timeout", "287s"},
+		VolumeMounts: []k8sv1.VolumeMount{
+			{Name: "b", MountPath: "/var/run/kubevirt/sockets"},
+			{Name: "a", MountPath: "/var/run/kubevirt"},
+			{Name: "c", MountPath: "/dev/kvm"},
+		},
+		Env: []k8sv1.EnvVar{{Name: "Z"}, {Name: "A"}},
+	}
+	sortContainer(&c)
+	require.Equal(t, []string{"virt-launcher-monitor", "--qemu-timeout", "240s"}, c.Command)
+	require.Equal(t, "/dev/kvm", c.VolumeMounts[0].MountPath)
+	require.Equal(t, "/var/run/kubevirt", c.VolumeMounts[1].MountPath, "parents are mounted first")
+	require.Equal(t, []k8sv1.EnvVar{{Name: "A"}, {Name: "Z"}}, c.Env)
+
+	c.Env = []k8sv1.EnvVar{{Name: "Z"}, {Name: "A", Value: "$(Z)/a"}}
+	sortContainer(&c)
+	require.Equal(t, "Z", c.Env[0].Name, "env with references keeps its order")
+}
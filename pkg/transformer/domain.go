@@ -0,0 +1,406 @@
+package transformer
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	virtv1 "kubevirt.io/api/core/v1"
+	ephemeraldisk "kubevirt.io/kubevirt/pkg/ephemeral-disk"
+	cmdv1 "kubevirt.io/kubevirt/pkg/handler-launcher-com/cmd/v1"
+	"kubevirt.io/kubevirt/pkg/network/domainspec"
+	"kubevirt.io/kubevirt/pkg/os/disk"
+	"kubevirt.io/kubevirt/pkg/virt-launcher/virtwrap/api"
+	"kubevirt.io/kubevirt/pkg/virt-launcher/virtwrap/converter"
+	"kubevirt.io/kubevirt/pkg/virt-launcher/virtwrap/converter/arch"
+	convertertypes "kubevirt.io/kubevirt/pkg/virt-launcher/virtwrap/converter/types"
+	"kubevirt.io/kubevirt/pkg/virt-launcher/virtwrap/converter/vcpu"
+	"kubevirt.io/kubevirt/pkg/virt-launcher/virtwrap/efi"
+)
+
+// ovmfPath is where the virt-launcher image ships the EFI firmware.
+const ovmfPath = "/usr/share/OVMF"
+
+// DomainPreview is the libvirt domain virt-launcher would define for a VM,
+// rendered offline with KubeVirt's converter.
+type DomainPreview struct {
+	Domain *api.DomainSpec
+	// QEMUDevices approximates the devices QEMU is started with.
+	QEMUDevices []QEMUDevice
+	// Notes lists the host facts that were assumed rather than read from
+	// the host the VM will run on.
+	Notes []string
+	// Warnings are things about the VM that need attention in standalone
+	// mode. They are not part of the XML.
+	Warnings []string
+}
+
+// QEMUDevice is a device as passed to QEMU with -device.
+type QEMUDevice struct {
+	// Driver is the QEMU device driver, e.g. virtio-blk-pci.
+	Driver string
+	// ID is the libvirt alias, which QEMU uses as the device id.
+	ID string
+	// Description says what the device is for.
+	Description string
+}
+
+// XML returns the domain XML with the notes and device list as leading
+// comments.
+func (p *DomainPreview) XML() ([]byte, error) {
+	data, err := xml.MarshalIndent(p.Domain, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal domain: %v", err)
+	}
+
+	var b strings.Builder
+	b.WriteString("  Rendered offline by kubevirt-vm-to-pod render-domain.\n")
+	if len(p.Notes) > 0 {
+		b.WriteString("\n  Assumed host facts:\n")
+		for _, n := range p.Notes {
+			fmt.Fprintf(&b, "  - %s\n", n)
+		}
+	}
+	if len(p.QEMUDevices) > 0 {
+		b.WriteString("\n  QEMU devices (approximate):\n")
+		for _, d := range p.QEMUDevices {
+			id := d.ID
+			if id == "" {
+				id = "-"
+			}
+			fmt.Fprintf(&b, "  %-36s %-20s %s\n", d.Driver, id, d.Description)
+		}
+	}
+	// "--" must not appear inside an XML comment.
+	comment := strings.ReplaceAll(b.String(), "--", "- -")
+	return []byte("<!--\n" + comment + "-->\n" + string(data) + "\n"), nil
+}
+
+func (t *VMToPodTransformer) RenderDomain(ctx context.Context, vmFile string) (*DomainPreview, error) {
+	data, err := os.ReadFile(vmFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM file: %v", err)
+	}
+	return t.renderDomainBytes(ctx, vmFile, data)
+}
+
+func (t *VMToPodTransformer) RenderDomainReader(ctx context.Context, r io.Reader) (*DomainPreview, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM from input: %v", err)
+	}
+	return t.renderDomainBytes(ctx, "", data)
+}
+
+// renderDomainBytes renders the domain of the VM in data, read from file,
+// which is only used to report findings in strict mode.
+func (t *VMToPodTransformer) renderDomainBytes(ctx context.Context, file string, data []byte) (*DomainPreview, error) {
+	vm, err := t.parse(file, data)
+	if err != nil {
+		return nil, err
+	}
+	w := &warner{}
+	vmi, err := t.vmiFromVM(ctx, vm, nil, w)
+	if err != nil {
+		return nil, err
+	}
+	populateInterfaceStatus(vmi)
+
+	preview := &DomainPreview{Warnings: w.warnings}
+	note := func(format string, args ...interface{}) {
+		preview.Notes = append(preview.Notes, fmt.Sprintf(format, args...))
+	}
+
+	goarch := vmi.Spec.Architecture
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	c := &convertertypes.ConverterContext{
+		Architecture:              arch.NewConverter(goarch),
+		VirtualMachine:            vmi,
+		HypervisorDeviceAvailable: !t.Emulation,
+		AllowEmulation:            t.Emulation,
+		HypervisorName:            virtv1.KvmHypervisorName,
+		EphemeraldiskCreator:      ephemeraldisk.NewEphemeralDiskCreator(filepath.Join("/var/run/kubevirt-ephemeral-disks", "disk-data")),
+		UseVirtioTransitional:     vmi.Spec.Domain.Devices.UseVirtioTransitional != nil && *vmi.Spec.Domain.Devices.UseVirtioTransitional,
+		FreePageReporting:         freePageReporting(vmi),
+		SerialConsoleLog:          false,
+		DisksInfo:                 map[string]*disk.DiskInfo{},
+		DomainAttachmentByInterfaceName: domainspec.DomainAttachmentByInterfaceName(
+			vmi.Spec.Domain.Devices.Interfaces, t.ClusterConfig.GetNetworkBindings()),
+	}
+	if t.Emulation {
+		note("/dev/kvm is not used, so the domain uses QEMU software emulation")
+	} else {
+		note("/dev/kvm is available, so the domain uses KVM rather than emulation")
+	}
+
+	for _, vol := range vmi.Spec.Volumes {
+		switch {
+		case vol.ContainerDisk != nil:
+			c.DisksInfo[vol.Name] = &disk.DiskInfo{Format: "qcow2"}
+			note("containerDisk %s is a qcow2 image (virt-launcher reads the format with qemu-img)", vol.Name)
+		case vol.PersistentVolumeClaim != nil, vol.DataVolume != nil:
+			note("volume %s is a filesystem-mode PVC holding disk.img", vol.Name)
+		}
+	}
+
+	if fw := vmi.Spec.Domain.Firmware; fw != nil && fw.Bootloader != nil && fw.Bootloader.EFI != nil {
+		secureBoot := fw.Bootloader.EFI.SecureBoot == nil || *fw.Bootloader.EFI.SecureBoot
+		c.EFIConfiguration = efiConfiguration(goarch, secureBoot)
+		note("EFI firmware is %s from the virt-launcher image", c.EFIConfiguration.EFICode)
+	}
+
+	if vmi.IsCPUDedicated() {
+		c.CPUSet, c.Topology = assumedCPUs(vmi)
+		note("the host has one NUMA node with CPUs 0-%d and no SMT siblings; real pinning follows the CPUs the container gets", len(c.CPUSet)-1)
+	}
+
+	domain := &api.Domain{}
+	if err := converter.Convert_v1_VirtualMachineInstance_To_api_Domain(vmi, domain, c); err != nil {
+		return nil, fmt.Errorf("failed to convert VMI to domain: %v", err)
+	}
+	api.NewDefaulter(c.Architecture.GetArchitecture()).SetObjectDefaults_Domain(domain)
+	preview.Domain = &domain.Spec
+
+	if cpu := domain.Spec.CPU; cpu.Mode == virtv1.CPUModeHostModel || cpu.Mode == virtv1.CPUModeHostPassthrough {
+		note("CPU mode %s is expanded by libvirt from the host CPU at start", cpu.Mode)
+	}
+	if numa := vmi.Spec.Domain.CPU; numa != nil && numa.NUMA != nil {
+		note("guest NUMA nodes are not mapped to host NUMA nodes and hugepages")
+	}
+	for _, iface := range domain.Spec.Devices.Interfaces {
+		if iface.Type == "" {
+			note("interface %s gets its tap device from virt-launcher at start", aliasName(iface.Alias))
+		}
+	}
+	for _, gpu := range vmi.Spec.Domain.Devices.GPUs {
+		note("GPU %s (%s) is assigned from the host devices at start and not rendered", gpu.Name, gpu.DeviceName)
+	}
+	for _, dev := range vmi.Spec.Domain.Devices.HostDevices {
+		note("host device %s (%s) is assigned from the host devices at start and not rendered", dev.Name, dev.DeviceName)
+	}
+
+	preview.QEMUDevices = qemuDevices(&domain.Spec)
+	return preview, nil
+}
+
+func freePageReporting(vmi *virtv1.VirtualMachineInstance) bool {
+	if b := vmi.Spec.Domain.Devices.AutoattachMemBalloon; b != nil && !*b {
+		return false
+	}
+	return !vmi.IsHighPerformanceVMI() && vmi.Annotations[virtv1.FreePageReportingDisabledAnnotation] != "true"
+}
+
+func efiConfiguration(goarch string, secureBoot bool) *convertertypes.EFIConfiguration {
+	code, vars := efi.EFICode, efi.EFIVars
+	switch {
+	case goarch == "arm64":
+		code, vars = efi.EFICodeAARCH64, efi.EFIVarsAARCH64
+	case secureBoot:
+		code, vars = efi.EFICodeSecureBoot, efi.EFIVarsSecureBoot
+	}
+	return &convertertypes.EFIConfiguration{
+		EFICode:      filepath.Join(ovmfPath, code),
+		EFIVars:      filepath.Join(ovmfPath, vars),
+		SecureLoader: secureBoot,
+	}
+}
+
+// assumedCPUs returns a CPU set and a single node host topology large enough
+// for the dedicated CPUs of vmi and its emulator thread.
+func assumedCPUs(vmi *virtv1.VirtualMachineInstance) ([]int, *cmdv1.Topology) {
+	n := int(vcpu.CalculateRequestedVCPUs(vcpu.GetCPUTopology(vmi))) + 1
+
+	cell := &cmdv1.Cell{}
+	set := make([]int, n)
+	for i := range set {
+		set[i] = i
+		cell.Cpus = append(cell.Cpus, &cmdv1.CPU{Id: uint32(i)})
+	}
+	return set, &cmdv1.Topology{NumaCells: []*cmdv1.Cell{cell}}
+}
+
+func aliasName(alias *api.Alias) string {
+	if alias == nil {
+		return ""
+	}
+	return alias.GetName()
+}
+
+func aliasID(alias *api.Alias) string {
+	if alias == nil {
+		return ""
+	}
+	if alias.IsUserDefined() {
+		return api.UserAliasPrefix + alias.GetName()
+	}
+	return alias.GetName()
+}
+
+// virtioDriver returns the QEMU driver of a virtio PCI device for a libvirt
+// model, e.g. virtio-blk-pci-non-transitional.
+func virtioDriver(base, model string) string {
+	switch model {
+	case "virtio-non-transitional":
+		return base + "-pci-non-transitional"
+	case "virtio-transitional":
+		return base + "-pci-transitional"
+	default:
+		return base + "-pci"
+	}
+}
+
+// qemuDevices maps the domain devices to the QEMU devices libvirt creates for
+// them. It covers the devices KubeVirt generates; platform devices that come
+// with the machine type are left out.
+func qemuDevices(spec *api.DomainSpec) []QEMUDevice {
+	var devices []QEMUDevice
+	add := func(driver string, alias *api.Alias, format string, args ...interface{}) {
+		devices = append(devices, QEMUDevice{Driver: driver, ID: aliasID(alias), Description: fmt.Sprintf(format, args...)})
+	}
+
+	for _, c := range spec.Devices.Controllers {
+		switch {
+		case c.Type == "scsi":
+			add(virtioDriver("virtio-scsi", c.Model), c.Alias, "SCSI controller %s", c.Index)
+		case c.Type == "virtio-serial":
+			add(virtioDriver("virtio-serial", c.Model), c.Alias, "virtio-serial controller %s", c.Index)
+		case c.Type == "usb" && c.Model != "none":
+			add(c.Model, c.Alias, "USB controller %s", c.Index)
+		case c.Type == "pci" && c.Model != "pcie-root" && c.Model != "pci-root":
+			add(c.Model, c.Alias, "PCI controller %s", c.Index)
+		}
+	}
+
+	for _, d := range spec.Devices.Disks {
+		source := d.Source.File
+		if source == "" {
+			source = d.Source.Dev
+		}
+		var driver string
+		switch d.Target.Bus {
+		case virtv1.DiskBusVirtio:
+			driver = virtioDriver("virtio-blk", d.Model)
+		case virtv1.DiskBusSATA:
+			driver = "ide-hd"
+			if d.Device == "cdrom" {
+				driver = "ide-cd"
+			}
+		case virtv1.DiskBusSCSI:
+			driver = "scsi-hd"
+			if d.Device == "cdrom" {
+				driver = "scsi-cd"
+			} else if d.Device == "lun" {
+				driver = "scsi-block"
+			}
+		case virtv1.DiskBusUSB:
+			driver = "usb-storage"
+		default:
+			driver = string(d.Target.Bus)
+		}
+		add(driver, d.Alias, "%s %s on %s (%s)", d.Device, aliasName(d.Alias), d.Target.Device, source)
+	}
+
+	for _, i := range spec.Devices.Interfaces {
+		driver := "virtio-net-pci"
+		if i.Model != nil {
+			if strings.HasPrefix(i.Model.Type, "virtio") {
+				driver = virtioDriver("virtio-net", i.Model.Type)
+			} else {
+				driver = i.Model.Type
+			}
+		}
+		backend := i.Type
+		if i.Backend != nil && i.Backend.Type != "" {
+			backend = i.Backend.Type
+		}
+		if backend == "" {
+			backend = "tap"
+		}
+		add(driver, i.Alias, "interface %s (%s backend)", aliasName(i.Alias), backend)
+	}
+
+	for _, f := range spec.Devices.Filesystems {
+		target := ""
+		if f.Target != nil {
+			target = f.Target.Dir
+		}
+		add("vhost-user-fs-pci", nil, "virtiofs %s", target)
+	}
+
+	for _, h := range spec.Devices.HostDevices {
+		switch h.Type {
+		case api.HostDevicePCI, api.HostDeviceMDev:
+			add("vfio-pci", h.Alias, "%s host device %s", h.Type, aliasName(h.Alias))
+		case "usb":
+			add("usb-host", h.Alias, "USB host device %s", aliasName(h.Alias))
+		}
+	}
+
+	for _, v := range spec.Devices.Video {
+		switch v.Model.Type {
+		case "vga":
+			add("VGA", nil, "display")
+		case "virtio":
+			add("virtio-vga", nil, "display")
+		case "bochs":
+			add("bochs-display", nil, "display")
+		default:
+			add(v.Model.Type, nil, "display")
+		}
+	}
+
+	for _, in := range spec.Devices.Inputs {
+		driver := fmt.Sprintf("usb-%s", in.Type)
+		if in.Type == "keyboard" {
+			driver = "usb-kbd"
+		}
+		if in.Bus == virtv1.InputBusVirtio {
+			driver = virtioDriver(fmt.Sprintf("virtio-%s", in.Type), in.Model)
+		}
+		add(driver, in.Alias, "%s input %s", in.Type, aliasName(in.Alias))
+	}
+
+	for _, s := range spec.Devices.Serials {
+		port := uint(0)
+		if s.Target != nil && s.Target.Port != nil {
+			port = *s.Target.Port
+		}
+		add("isa-serial", s.Alias, "serial port %d (%s)", port, s.Type)
+	}
+
+	for _, ch := range spec.Devices.Channels {
+		if ch.Target != nil && ch.Target.Type == "virtio" {
+			add("virtserialport", nil, "channel %s", ch.Target.Name)
+		}
+	}
+
+	if b := spec.Devices.Ballooning; b != nil && b.Model != "none" {
+		add(virtioDriver("virtio-balloon", b.Model), nil, "memory balloon")
+	}
+	if r := spec.Devices.Rng; r != nil {
+		add(virtioDriver("virtio-rng", r.Model), nil, "random number generator")
+	}
+	for _, w := range spec.Devices.Watchdogs {
+		add(w.Model, w.Alias, "watchdog (action %s)", w.Action)
+	}
+	for _, s := range spec.Devices.SoundCards {
+		add(s.Model, s.Alias, "sound card")
+	}
+	for _, tpm := range spec.Devices.TPMs {
+		add(tpm.Model, nil, "TPM %s", tpm.Backend.Version)
+	}
+	for _, r := range spec.Devices.Redirs {
+		add("usb-redir", nil, "USB redirection (%s)", r.Type)
+	}
+	if v := spec.Devices.VSOCK; v != nil {
+		add(virtioDriver("vhost-vsock", v.Model), nil, "vsock")
+	}
+	return devices
+}
@@ -0,0 +1,154 @@
+package transformer
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/validate"
+)
+
+const domainTestVM = `
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: testvm
+spec:
+  template:
+    spec:
+      domain:
+        cpu:
+          cores: 2
+          dedicatedCpuPlacement: true
+        firmware:
+          bootloader:
+            efi:
+              secureBoot: false
+        resources:
+          requests:
+            memory: 128Mi
+        devices:
+          disks:
+          - name: rootdisk
+            disk:
+              bus: virtio
+          - name: data
+            disk:
+              bus: scsi
+          interfaces:
+          - name: default
+            masquerade: {}
+      networks:
+      - name: default
+        pod: {}
+      volumes:
+      - name: rootdisk
+        containerDisk:
+          image: quay.io/containerdisks/fedora:40
+      - name: data
+        persistentVolumeClaim:
+          claimName: data-pvc
+`
+
+func TestRenderDomain(t *testing.T) {
+	t.Run("passt", func(t *testing.T) {
+		preview, err := NewVMToPodTransformer(WithForcePasst(true)).RenderDomainReader(context.Background(), strings.NewReader(domainTestVM))
+		require.NoError(t, err)
+
+		dom := preview.Domain
+		require.Equal(t, "default_testvm", dom.Name)
+		require.Equal(t, "kvm", dom.Type)
+
+		require.Len(t, dom.Devices.Disks, 2)
+		require.Equal(t, "vda", dom.Devices.Disks[0].Target.Device)
+		require.Equal(t, "qcow2", dom.Devices.Disks[0].BackingStore.Format.Type)
+		require.Equal(t, "sda", dom.Devices.Disks[1].Target.Device)
+
+		require.Len(t, dom.Devices.Interfaces, 1)
+		require.Equal(t, "vhostuser", dom.Devices.Interfaces[0].Type)
+		require.Equal(t, "passt", dom.Devices.Interfaces[0].Backend.Type)
+
+		require.NotNil(t, dom.OS.BootLoader)
+		require.Equal(t, "/usr/share/OVMF/OVMF_CODE.fd", dom.OS.BootLoader.Path)
+
+		require.NotNil(t, dom.CPUTune)
+		require.Len(t, dom.CPUTune.VCPUPin, 2)
+
+		drivers := map[string]string{}
+		for _, d := range preview.QEMUDevices {
+			drivers[d.ID] = d.Driver
+		}
+		require.Equal(t, "virtio-blk-pci-non-transitional", drivers["ua-rootdisk"])
+		require.Equal(t, "scsi-hd", drivers["ua-data"])
+		require.Equal(t, "virtio-net-pci-non-transitional", drivers["ua-default"])
+
+		notes := strings.Join(preview.Notes, "\n")
+		require.Contains(t, notes, "/dev/kvm")
+		require.Contains(t, notes, "containerDisk rootdisk is a qcow2 image")
+		require.Contains(t, notes, "volume data is a filesystem-mode PVC")
+		require.Contains(t, notes, "one NUMA node with CPUs 0-2")
+		require.Contains(t, notes, "CPU mode host-model")
+	})
+
+	t.Run("original binding", func(t *testing.T) {
+		preview, err := NewVMToPodTransformer().RenderDomainReader(context.Background(), strings.NewReader(domainTestVM))
+		require.NoError(t, err)
+		require.Equal(t, "ethernet", preview.Domain.Devices.Interfaces[0].Type)
+	})
+
+	t.Run("emulation", func(t *testing.T) {
+		preview, err := NewVMToPodTransformer(WithEmulation(true)).RenderDomainReader(context.Background(), strings.NewReader(domainTestVM))
+		require.NoError(t, err)
+		require.Equal(t, "qemu", preview.Domain.Type)
+		require.Equal(t, "custom", preview.Domain.CPU.Mode)
+		require.Equal(t, EmulationCPUModel, preview.Domain.CPU.Model)
+		notes := strings.Join(preview.Notes, "\n")
+		require.Contains(t, notes, "QEMU software emulation")
+		require.NotContains(t, notes, "CPU mode host-model")
+	})
+
+	t.Run("invalid VM", func(t *testing.T) {
+		_, err := NewVMToPodTransformer().RenderDomainReader(context.Background(), strings.NewReader("kind: ["))
+		require.Error(t, err)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		vm := strings.Replace(domainTestVM, "      domain:\n", "      domain:\n        cpus:\n          cores: 2\n", 1)
+		_, err := NewVMToPodTransformer().RenderDomainReader(context.Background(), strings.NewReader(vm))
+		require.NoError(t, err, "the typo is silently dropped without strict mode")
+
+		_, err = NewVMToPodTransformer(WithStrict(true)).RenderDomainReader(context.Background(), strings.NewReader(vm))
+		var verr *validate.Error
+		require.ErrorAs(t, err, &verr)
+		require.Len(t, verr.Findings, 1)
+		require.Contains(t, verr.Findings[0].String(), "spec.template.spec.domain.cpus: is a forbidden property")
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := NewVMToPodTransformer().RenderDomainReader(ctx, strings.NewReader(domainTestVM))
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestDomainPreviewXML(t *testing.T) {
+	preview, err := NewVMToPodTransformer(WithForcePasst(true)).RenderDomainReader(context.Background(), strings.NewReader(domainTestVM))
+	require.NoError(t, err)
+	preview.Notes = append(preview.Notes, "a note with -- in it")
+
+	data, err := preview.XML()
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(data, []byte("<!--\n")))
+	require.Contains(t, string(data), "virtio-net-pci-non-transitional")
+
+	// The comment must not break the document.
+	var dom struct {
+		Name string `xml:"name"`
+	}
+	require.NoError(t, xml.Unmarshal(data, &dom))
+	require.Equal(t, "default_testvm", dom.Name)
+}
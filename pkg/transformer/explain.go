@@ -0,0 +1,283 @@
+package transformer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ChangeOp is the kind of a change to a field.
+type ChangeOp string
+
+const (
+	ChangeAdded   ChangeOp = "added"
+	ChangeRemoved ChangeOp = "removed"
+	ChangeUpdated ChangeOp = "changed"
+)
+
+// Explanation records what every stage of the transformation did to the VM,
+// VMI and Pod.
+type Explanation struct {
+	Stages []Stage `json:"stages"`
+}
+
+// Stage is one step of the transformation and the fields it changed.
+type Stage struct {
+	// Name is the function that ran, e.g. SetVirtualMachineDefaults.
+	Name string `json:"name"`
+	// Object is the kind of the object the stage changed.
+	Object string `json:"object"`
+	// Cause says why the stage ran: a KubeVirt default, standalone mode
+	// or the option that enabled it.
+	Cause string `json:"cause"`
+	// Description is set for stages whose changes are not listed field by
+	// field.
+	Description string   `json:"description,omitempty"`
+	Changes     []Change `json:"changes"`
+}
+
+// Change is a field a stage added, removed or changed. Path uses dots for
+// object fields, [i] for list items and [name=x] for items with a name.
+type Change struct {
+	Path string      `json:"path"`
+	Op   ChangeOp    `json:"op"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// maxTextValue is the length at which WriteText cuts values.
+const maxTextValue = 120
+
+// WriteText writes the explanation in a human-readable form: "+" for added,
+// "-" for removed and "~" for changed fields.
+func (e *Explanation) WriteText(w io.Writer) {
+	for i, s := range e.Stages {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s: %s (%s)\n", s.Object, s.Name, s.Cause)
+		if s.Description != "" {
+			fmt.Fprintf(w, "  %s\n", s.Description)
+		}
+		if len(s.Changes) == 0 && s.Description == "" {
+			fmt.Fprintln(w, "  no changes")
+		}
+		for _, c := range s.Changes {
+			switch c.Op {
+			case ChangeAdded:
+				fmt.Fprintf(w, "  + %s: %s\n", c.Path, textValue(c.New))
+			case ChangeRemoved:
+				fmt.Fprintf(w, "  - %s: %s\n", c.Path, textValue(c.Old))
+			default:
+				fmt.Fprintf(w, "  ~ %s: %s -> %s\n", c.Path, textValue(c.Old), textValue(c.New))
+			}
+		}
+	}
+}
+
+func textValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	s := string(data)
+	if len(s) > maxTextValue {
+		s = s[:maxTextValue] + "..."
+	}
+	return s
+}
+
+// explainer records stages into an Explanation. A nil explainer only runs the
+// stages, so the normal transformation pays nothing for it.
+type explainer struct {
+	explanation Explanation
+}
+
+// stage runs fn, which modifies obj in place, and records the fields it
+// changed.
+func (e *explainer) stage(name, object, cause string, obj interface{}, fn func() error) error {
+	if e == nil {
+		return fn()
+	}
+	before, err := snapshot(obj)
+	if err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	after, err := snapshot(obj)
+	if err != nil {
+		return err
+	}
+	e.record(name, object, cause, before, after)
+	return nil
+}
+
+// record adds a stage that turned before into after, both snapshots.
+func (e *explainer) record(name, object, cause string, before, after interface{}) {
+	if e == nil {
+		return
+	}
+	e.explanation.Stages = append(e.explanation.Stages, Stage{
+		Name:    name,
+		Object:  object,
+		Cause:   cause,
+		Changes: diff("", before, after),
+	})
+}
+
+// describe adds a stage that is summarized rather than diffed.
+func (e *explainer) describe(name, object, cause, description string) {
+	if e == nil {
+		return
+	}
+	e.explanation.Stages = append(e.explanation.Stages, Stage{
+		Name:        name,
+		Object:      object,
+		Cause:       cause,
+		Description: description,
+	})
+}
+
+// snapshot returns obj in its generic JSON form.
+func snapshot(obj interface{}) (interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot %T: %v", obj, err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("failed to snapshot %T: %v", obj, err)
+	}
+	return v, nil
+}
+
+func diff(path string, before, after interface{}) []Change {
+	switch b := before.(type) {
+	case map[string]interface{}:
+		if a, ok := after.(map[string]interface{}); ok {
+			return diffMaps(path, b, a)
+		}
+	case []interface{}:
+		if a, ok := after.([]interface{}); ok {
+			return diffLists(path, b, a)
+		}
+	}
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	switch {
+	case before == nil:
+		return []Change{{Path: path, Op: ChangeAdded, New: after}}
+	case after == nil:
+		return []Change{{Path: path, Op: ChangeRemoved, Old: before}}
+	}
+	return []Change{{Path: path, Op: ChangeUpdated, Old: before, New: after}}
+}
+
+func diffMaps(path string, before, after map[string]interface{}) []Change {
+	keys := make([]string, 0, len(before)+len(after))
+	for k := range before {
+		keys = append(keys, k)
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []Change
+	for _, k := range keys {
+		p := fieldPath(path, k)
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		switch {
+		case !inAfter:
+			changes = append(changes, Change{Path: p, Op: ChangeRemoved, Old: b})
+		case !inBefore:
+			changes = append(changes, Change{Path: p, Op: ChangeAdded, New: a})
+		default:
+			changes = append(changes, diff(p, b, a)...)
+		}
+	}
+	return changes
+}
+
+// diffLists matches list items by name when all of them have one, as for
+// containers, volumes or interfaces, and by index otherwise.
+func diffLists(path string, before, after []interface{}) []Change {
+	bNames, bOK := itemNames(before)
+	aNames, aOK := itemNames(after)
+	if !bOK || !aOK {
+		var changes []Change
+		for i := 0; i < len(before) || i < len(after); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(after):
+				changes = append(changes, Change{Path: p, Op: ChangeRemoved, Old: before[i]})
+			case i >= len(before):
+				changes = append(changes, Change{Path: p, Op: ChangeAdded, New: after[i]})
+			default:
+				changes = append(changes, diff(p, before[i], after[i])...)
+			}
+		}
+		return changes
+	}
+
+	afterByName := map[string]interface{}{}
+	for i, name := range aNames {
+		afterByName[name] = after[i]
+	}
+	var changes []Change
+	seen := map[string]bool{}
+	for i, name := range bNames {
+		p := fmt.Sprintf("%s[name=%s]", path, name)
+		seen[name] = true
+		if a, ok := afterByName[name]; ok {
+			changes = append(changes, diff(p, before[i], a)...)
+		} else {
+			changes = append(changes, Change{Path: p, Op: ChangeRemoved, Old: before[i]})
+		}
+	}
+	for i, name := range aNames {
+		if !seen[name] {
+			changes = append(changes, Change{Path: fmt.Sprintf("%s[name=%s]", path, name), Op: ChangeAdded, New: after[i]})
+		}
+	}
+	return changes
+}
+
+// itemNames returns the unique names of the items of a list, or false if not
+// every item has one.
+func itemNames(list []interface{}) ([]string, bool) {
+	names := make([]string, 0, len(list))
+	seen := map[string]bool{}
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, ok := m["name"].(string)
+		if !ok || seen[name] {
+			return nil, false
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, true
+}
+
+func fieldPath(path, key string) string {
+	if strings.ContainsAny(key, "./") {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,118 @@
+package transformer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	before := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{"kubevirt.io/a": "1"},
+		},
+		"spec": map[string]interface{}{
+			"restartPolicy": "Never",
+			"containers": []interface{}{
+				map[string]interface{}{"name": "compute", "image": "old"},
+				map[string]interface{}{"name": "gone"},
+			},
+			"args": []interface{}{"a", "b"},
+		},
+	}
+	after := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{"kubevirt.io/a": "1", "kubevirt.io/b": "2"},
+		},
+		"spec": map[string]interface{}{
+			"restartPolicy": "OnFailure",
+			"containers": []interface{}{
+				map[string]interface{}{"name": "proxy"},
+				map[string]interface{}{"name": "compute", "image": "new"},
+			},
+			"args": []interface{}{"a"},
+		},
+	}
+
+	require.Equal(t, []Change{
+		{Path: `metadata.annotations["kubevirt.io/b"]`, Op: ChangeAdded, New: "2"},
+		{Path: "spec.args[1]", Op: ChangeRemoved, Old: "b"},
+		{Path: "spec.containers[name=compute].image", Op: ChangeUpdated, Old: "old", New: "new"},
+		{Path: "spec.containers[name=gone]", Op: ChangeRemoved, Old: map[string]interface{}{"name": "gone"}},
+		{Path: "spec.containers[name=proxy]", Op: ChangeAdded, New: map[string]interface{}{"name": "proxy"}},
+		{Path: "spec.restartPolicy", Op: ChangeUpdated, Old: "Never", New: "OnFailure"},
+	}, diff("", before, after))
+
+	require.Empty(t, diff("", before, before))
+}
+
+func TestTransformDetailed(t *testing.T) {
+	vmYAML := `
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: testvm
+spec:
+  template:
+    spec:
+      domain:
+        resources:
+          requests:
+            memory: 64Mi
+        devices:
+          interfaces:
+          - name: default
+            masquerade: {}
+      networks:
+      - name: default
+        pod: {}
+`
+	tr := NewVMToPodTransformer(WithForcePasst(true), WithAddConsoleProxy(true, "proxy:latest", 8080))
+	result, err := tr.TransformDetailed(context.Background(), strings.NewReader(vmYAML))
+	require.NoError(t, err)
+
+	pod, err := tr.TransformReader(strings.NewReader(vmYAML))
+	require.NoError(t, err)
+	// The Pod holds a randomized timeout, so compare the parts that are stable.
+	require.Equal(t, pod.Name, result.Pod.Name)
+	require.Equal(t, containerNames(pod), containerNames(result.Pod))
+	require.Equal(t, pod.Spec.Volumes, result.Pod.Spec.Volumes)
+
+	stages := map[string]Stage{}
+	for _, s := range result.Explanation.Stages {
+		stages[s.Name] = s
+	}
+	for _, name := range []string{
+		"SetVirtualMachineDefaults",
+		"SetupVMIFromVM",
+		"SetDefaultVirtualMachineInstance",
+		"ApplyNewVMIMutations",
+		"SetDefaultNetworkInterface",
+		"RenderLaunchManifest",
+		"cleanupForStandalone",
+	} {
+		require.Contains(t, stages, name)
+	}
+	require.NotContains(t, stages, "publishConsoleProxy", "disabled options must not show up")
+
+	require.Equal(t, "WithForcePasst", stages["forcePasstBinding"].Cause)
+	require.Contains(t, stages["forcePasstBinding"].Changes, Change{
+		Path: "spec.domain.devices.interfaces[name=default].masquerade",
+		Op:   ChangeRemoved,
+		Old:  map[string]interface{}{},
+	})
+
+	proxy := stages["addConsoleProxySidecar"]
+	require.Equal(t, "WithAddConsoleProxy", proxy.Cause)
+	require.Equal(t, "spec.containers[name=console-proxy]", proxy.Changes[0].Path)
+	require.Equal(t, ChangeAdded, proxy.Changes[0].Op)
+
+	var out bytes.Buffer
+	result.Explanation.WriteText(&out)
+	require.Contains(t, out.String(), "VirtualMachineInstance: forcePasstBinding (WithForcePasst)\n")
+	require.Contains(t, out.String(), "  - spec.domain.devices.interfaces[name=default].masquerade: {}\n")
+	require.Contains(t, out.String(), "Pod: RenderLaunchManifest")
+}
@@ -0,0 +1,175 @@
+package transformer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	k8sv1 "k8s.io/api/core/v1"
+	v1 "kubevirt.io/api/core/v1"
+)
+
+// FuzzTransformReader feeds arbitrary input to TransformReader. Errors are
+// fine; panics are not, and every Pod it does render must hold the
+// properties checked by checkPodProperties. The corpus VMs seed it, along
+// with the inputs in testdata/fuzz/FuzzTransformReader that crashed it once:
+//
+//	go test ./pkg/transformer -run '^$' -fuzz FuzzTransformReader
+func FuzzTransformReader(f *testing.F) {
+	vms, err := filepath.Glob(filepath.Join("testdata", "vms", "*.yaml"))
+	require.NoError(f, err)
+	vms = append(vms,
+		filepath.Join("testdata", "deterministic", "exported-vm.yaml"),
+		filepath.Join("..", "..", "test-vm.yaml"),
+		filepath.Join("..", "..", "test-vm-fedora.yaml"),
+		filepath.Join("..", "..", "demo-vm.yaml"),
+	)
+	for _, vm := range vms {
+		data, err := os.ReadFile(vm)
+		require.NoError(f, err)
+		f.Add(data)
+	}
+	f.Add([]byte(`{"kind":"VirtualMachine","metadata":{"name":"a"},"spec":{}}`))
+	f.Add([]byte("kind: VirtualMachine\nmetadata:\n  generateName: a\nspec:\n  template:\n    spec: {}\n"))
+
+	tr := NewVMToPodTransformer(
+		WithForcePasst(true),
+		WithMountDevices(true),
+		WithAddConsoleProxy(true, "quay.io/vladikr/kubevirt-console-proxy:latest", 8080),
+		WithConsoleLog(true, 10, 5),
+	)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pod, err := tr.TransformReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		checkPodProperties(t, pod)
+	})
+}
+
+// checkPodProperties checks what every rendered Pod must hold: a name, a
+// compute container with the VMI embedded, unique volume names, mounts of
+// existing volumes only, and every VMI interface connected to a Pod network.
+func checkPodProperties(t *testing.T, pod *k8sv1.Pod) {
+	t.Helper()
+	require.NotEmpty(t, pod.Name)
+
+	volumes := map[string]bool{}
+	for _, v := range pod.Spec.Volumes {
+		require.False(t, volumes[v.Name], "duplicate volume %q", v.Name)
+		volumes[v.Name] = true
+	}
+
+	var compute *k8sv1.Container
+	for i, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		if c.Name == "compute" && i >= len(pod.Spec.InitContainers) {
+			compute = &pod.Spec.Containers[i-len(pod.Spec.InitContainers)]
+		}
+		for _, m := range c.VolumeMounts {
+			require.True(t, volumes[m.Name], "container %s mounts missing volume %q", c.Name, m.Name)
+		}
+	}
+	require.NotNil(t, compute, "no compute container")
+
+	var vmi v1.VirtualMachineInstance
+	for _, env := range compute.Env {
+		if env.Name == "STANDALONE_VMI" {
+			require.NoError(t, json.Unmarshal([]byte(env.Value), &vmi))
+		}
+	}
+	require.NotEmpty(t, vmi.Name, "no STANDALONE_VMI")
+	checkPasstProperties(t, &vmi.Spec)
+}
+
+// checkPasstProperties checks the spec after forcePasstBinding: every
+// interface uses Passt and is connected to a Pod network, and interface and
+// network names are unique.
+func checkPasstProperties(t *testing.T, spec *v1.VirtualMachineInstanceSpec) {
+	t.Helper()
+	networks := map[string]v1.Network{}
+	for _, net := range spec.Networks {
+		_, dup := networks[net.Name]
+		require.False(t, dup, "duplicate network %q", net.Name)
+		networks[net.Name] = net
+	}
+	require.NotEmpty(t, networks, "no Pod network")
+
+	ifaces := map[string]bool{}
+	for _, iface := range spec.Domain.Devices.Interfaces {
+		require.False(t, ifaces[iface.Name], "duplicate interface %q", iface.Name)
+		ifaces[iface.Name] = true
+		require.NotNil(t, iface.PasstBinding, "interface %q does not use Passt", iface.Name)
+		net, ok := networks[iface.Name]
+		require.True(t, ok, "interface %q has no network", iface.Name)
+		require.NotNil(t, net.Pod, "interface %q is not on a Pod network", iface.Name)
+	}
+}
+
+// randomNetworkSpec returns a VMI spec with unique but otherwise random
+// interfaces and networks, drawn from a small set of names so they overlap.
+func randomNetworkSpec(r *rand.Rand) *v1.VirtualMachineInstanceSpec {
+	names := []string{"default", "eth0", "eth1", "storage"}
+	spec := &v1.VirtualMachineInstanceSpec{}
+	for _, name := range names {
+		if r.Intn(2) == 0 {
+			continue
+		}
+		iface := v1.Interface{Name: name}
+		switch r.Intn(4) {
+		case 0:
+			iface.Masquerade = &v1.InterfaceMasquerade{}
+		case 1:
+			iface.Bridge = &v1.InterfaceBridge{}
+		case 2:
+			iface.SRIOV = &v1.InterfaceSRIOV{}
+		}
+		spec.Domain.Devices.Interfaces = append(spec.Domain.Devices.Interfaces, iface)
+	}
+	for _, i := range r.Perm(len(names)) {
+		if r.Intn(2) == 0 {
+			continue
+		}
+		net := v1.Network{Name: names[i]}
+		if r.Intn(2) == 0 {
+			net.Pod = &v1.PodNetwork{}
+		} else {
+			net.Multus = &v1.MultusNetwork{NetworkName: "nad-" + names[i]}
+		}
+		spec.Networks = append(spec.Networks, net)
+	}
+	return spec
+}
+
+func TestForcePasstBindingProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var before string
+	defer func() {
+		if t.Failed() {
+			t.Logf("input: %s", before)
+		}
+	}()
+	for i := 0; i < 2000 && !t.Failed(); i++ {
+		spec := randomNetworkSpec(r)
+		before = fmt.Sprintf("%+v %+v", spec.Domain.Devices.Interfaces, spec.Networks)
+		forcePasstBinding(spec)
+		checkPasstProperties(t, spec)
+	}
+}
+
+func TestTransformProperties(t *testing.T) {
+	tr := NewVMToPodTransformer(WithForcePasst(true), WithMountDevices(true), WithConsoleLog(true, 10, 5))
+	vms, err := filepath.Glob(filepath.Join("testdata", "vms", "*.yaml"))
+	require.NoError(t, err)
+	for _, vm := range vms {
+		t.Run(filepath.Base(vm), func(t *testing.T) {
+			pod, err := tr.Transform(vm)
+			require.NoError(t, err)
+			checkPodProperties(t, pod)
+		})
+	}
+}
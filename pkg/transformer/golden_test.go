@@ -0,0 +1,140 @@
+package transformer
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+// goldenOptionSets are the option sets every corpus VM is rendered with.
+// Output is always deterministic, so the golden files only change when the
+// rendering does.
+var goldenOptionSets = []struct {
+	name string
+	opts []TransformerOption
+}{
+	{"default", []TransformerOption{WithForcePasst(true), WithMountDevices(true)}},
+	{"no-passt", []TransformerOption{WithMountDevices(true)}},
+	{"kubernetes", nil},
+	{"console", []TransformerOption{
+		WithForcePasst(true),
+		WithMountDevices(true),
+		WithAddConsoleProxy(true, "quay.io/vladikr/kubevirt-console-proxy:latest", 8080),
+		WithPublishConsoleProxy(true),
+		WithConsoleLog(true, 10, 5),
+		WithConsoleRecord(true),
+	}},
+}
+
+// goldenVMs returns the corpus: the VMs under testdata/vms and the example
+// VMs at the top of the repository.
+func goldenVMs(t *testing.T) []string {
+	t.Helper()
+	vms, err := filepath.Glob(filepath.Join("testdata", "vms", "*.yaml"))
+	require.NoError(t, err)
+	return append(vms,
+		filepath.Join("..", "..", "test-vm.yaml"),
+		filepath.Join("..", "..", "test-vm-fedora.yaml"),
+		filepath.Join("..", "..", "demo-vm.yaml"),
+	)
+}
+
+// TestGolden renders every corpus VM with every option set and compares the
+// Pods with testdata/golden/<vm>/<option set>.yaml. Run
+// go test ./pkg/transformer -run TestGolden -update to refresh them.
+func TestGolden(t *testing.T) {
+	for _, vmFile := range goldenVMs(t) {
+		vm := strings.TrimSuffix(filepath.Base(vmFile), filepath.Ext(vmFile))
+		data, err := os.ReadFile(vmFile)
+		require.NoError(t, err)
+
+		for _, set := range goldenOptionSets {
+			t.Run(vm+"/"+set.name, func(t *testing.T) {
+				tr := NewVMToPodTransformer(append(set.opts, WithDeterministic(true))...)
+				pod, err := tr.TransformReader(bytes.NewReader(data))
+				require.NoError(t, err)
+				out, err := yaml.Marshal(pod)
+				require.NoError(t, err)
+				compareGolden(t, filepath.Join("testdata", "golden", vm, set.name+".yaml"), out)
+			})
+		}
+	}
+}
+
+// compareGolden compares got with the golden file, or rewrites the file with
+// -update. Mismatches are reported field by field, with the embedded VMI
+// expanded, rather than as two walls of YAML.
+func compareGolden(t *testing.T, golden string, got []byte) {
+	t.Helper()
+	if *update {
+		require.NoError(t, os.MkdirAll(filepath.Dir(golden), 0755))
+		require.NoError(t, os.WriteFile(golden, got, 0644))
+		return
+	}
+
+	want, err := os.ReadFile(golden)
+	if os.IsNotExist(err) {
+		t.Fatalf("%s does not exist, run go test -update to create it", golden)
+	}
+	require.NoError(t, err)
+	if bytes.Equal(want, got) {
+		return
+	}
+
+	changes, err := goldenDiff(want, got)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	if len(changes) == 0 {
+		fmt.Fprintln(&buf, "  the fields are equal, only the formatting differs")
+	}
+	explanation := &Explanation{Stages: []Stage{{Name: golden, Object: "Pod", Cause: "golden -> rendered", Changes: changes}}}
+	explanation.WriteText(&buf)
+	t.Errorf("rendered Pod differs from the golden file, run go test -update if the change is expected:\n%s", buf.String())
+}
+
+// goldenDiff returns the fields that differ between two Pod YAMLs.
+func goldenDiff(want, got []byte) ([]Change, error) {
+	var before, after interface{}
+	if err := yaml.Unmarshal(want, &before); err != nil {
+		return nil, fmt.Errorf("failed to parse golden file: %v", err)
+	}
+	if err := yaml.Unmarshal(got, &after); err != nil {
+		return nil, fmt.Errorf("failed to parse rendered Pod: %v", err)
+	}
+	expandEmbeddedVMI(before)
+	expandEmbeddedVMI(after)
+	return diff("", before, after), nil
+}
+
+// expandEmbeddedVMI replaces the STANDALONE_VMI JSON string in a generic Pod
+// with the object it holds, so VMI changes are diffed field by field.
+func expandEmbeddedVMI(pod interface{}) {
+	p, _ := pod.(map[string]interface{})
+	spec, _ := p["spec"].(map[string]interface{})
+	containers, _ := spec["containers"].([]interface{})
+	for _, c := range containers {
+		container, _ := c.(map[string]interface{})
+		env, _ := container["env"].([]interface{})
+		for _, e := range env {
+			variable, _ := e.(map[string]interface{})
+			value, ok := variable["value"].(string)
+			if !ok || variable["name"] != "STANDALONE_VMI" {
+				continue
+			}
+			var vmi interface{}
+			if json.Unmarshal([]byte(value), &vmi) == nil {
+				variable["value"] = vmi
+			}
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package transformer
+
+import (
+	"fmt"
+
+	k8sv1 "k8s.io/api/core/v1"
+	virtv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt/pkg/defaults"
+	"kubevirt.io/kubevirt/pkg/network/vmispec"
+	"kubevirt.io/kubevirt/pkg/util"
+	"kubevirt.io/kubevirt/pkg/virt-api/webhooks/mutating-webhook/mutators"
+	vmCtrl "kubevirt.io/kubevirt/pkg/virt-controller/watch/vm"
+
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/hostdevices"
+)
+
+// Names of the built-in steps, for inserting steps around them with
+// WithStepBefore and WithStepAfter or dropping them with WithoutStep. Steps
+// of options that are off are not in the pipeline.
+const (
+	// VMI steps, run before the Pod is rendered.
+	StepSetDefaultVMI              = "SetDefaultVirtualMachineInstance"
+	StepApplyVMIMutations          = "ApplyNewVMIMutations"
+	StepSetDefaultNetworkInterface = "SetDefaultNetworkInterface"
+	StepSetDefaultVolumeDisk       = "SetDefaultVolumeDisk"
+	StepAutoAttachInputDevice      = "AutoAttachInputDevice"
+	StepForcePasst                 = "forcePasstBinding"
+	StepEmulationCPUModel          = "setEmulationCPUModel"
+
+	// Pod steps, run after the Pod is rendered.
+	StepStandalonePodName    = "setStandalonePodName"
+	StepConsoleProxy         = "addConsoleProxySidecar"
+	StepPublishConsoleProxy  = "publishConsoleProxy"
+	StepConsoleSSH           = "addConsoleSSH"
+	StepConsoleLog           = "addConsoleLogVolume"
+	StepMountDevices         = "mountHostDevices"
+	StepMemlockAnnotation    = "addMemlockAnnotation"
+	StepEmulationWarning     = "addEmulationWarning"
+	StepCleanupForStandalone = "cleanupForStandalone"
+	StepPersistenceWarnings  = "addPersistenceWarnings"
+)
+
+// VMIMutator changes the VMI before the Pod is rendered from it.
+type VMIMutator func(vm *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance) error
+
+// PodMutator changes the rendered Pod. Changes to the VMI are still embedded
+// in the Pod.
+type PodMutator func(vm *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error
+
+// Step is a named step of the pipeline. Exactly one of MutateVMI and
+// MutatePod is set, which decides whether the step runs before or after the
+// Pod is rendered.
+type Step struct {
+	Name string
+	// Cause is shown by --explain; it defaults to "custom step".
+	Cause     string
+	MutateVMI VMIMutator
+	MutatePod PodMutator
+}
+
+// stepEdit is a change to the built-in pipeline requested by an option.
+type stepEdit struct {
+	step   Step
+	anchor string
+	after  bool
+	remove bool
+}
+
+// WithStep appends a step to the VMI or Pod steps.
+func WithStep(step Step) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.stepEdits = append(t.stepEdits, stepEdit{step: step, after: true})
+	}
+}
+
+// WithStepBefore inserts a step before the step named anchor.
+func WithStepBefore(anchor string, step Step) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.stepEdits = append(t.stepEdits, stepEdit{step: step, anchor: anchor})
+	}
+}
+
+// WithStepAfter inserts a step after the step named anchor.
+func WithStepAfter(anchor string, step Step) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.stepEdits = append(t.stepEdits, stepEdit{step: step, anchor: anchor, after: true})
+	}
+}
+
+// WithoutStep removes the step named name.
+func WithoutStep(name string) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.stepEdits = append(t.stepEdits, stepEdit{anchor: name, remove: true})
+	}
+}
+
+// Steps returns the names of the VMI steps and the Pod steps, in the order
+// they run.
+func (t *VMToPodTransformer) Steps() (vmiSteps, podSteps []string) {
+	for _, s := range t.vmiSteps {
+		vmiSteps = append(vmiSteps, s.Name)
+	}
+	for _, s := range t.podSteps {
+		podSteps = append(podSteps, s.Name)
+	}
+	return vmiSteps, podSteps
+}
+
+// buildPipeline registers the built-in steps for the enabled options and
+// applies the edits of WithStep and friends. An invalid edit is returned by
+// every Transform call.
+func (t *VMToPodTransformer) buildPipeline() {
+	t.vmiSteps, t.podSteps, t.pipelineErr = t.steps(nil)
+}
+
+// steps returns the steps of the pipeline. The built-in Pod steps report
+// their warnings to w, so every transformation builds its own.
+func (t *VMToPodTransformer) steps(w *warner) (vmiSteps, podSteps []Step, err error) {
+	p := &pipeline{vmiSteps: t.builtinVMISteps(), podSteps: t.builtinPodSteps(w)}
+	for _, edit := range t.stepEdits {
+		if err := p.apply(edit); err != nil {
+			return nil, nil, err
+		}
+	}
+	return p.vmiSteps, p.podSteps, nil
+}
+
+// pipeline is the VMI and Pod steps while the edits are applied.
+type pipeline struct {
+	vmiSteps []Step
+	podSteps []Step
+}
+
+func (p *pipeline) apply(edit stepEdit) error {
+	if edit.remove {
+		for _, steps := range []*[]Step{&p.vmiSteps, &p.podSteps} {
+			if i := stepIndex(*steps, edit.anchor); i >= 0 {
+				*steps = append((*steps)[:i], (*steps)[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("cannot remove step %q: no such step", edit.anchor)
+	}
+
+	step := edit.step
+	if step.Name == "" {
+		return fmt.Errorf("pipeline steps must have a name")
+	}
+	if (step.MutateVMI == nil) == (step.MutatePod == nil) {
+		return fmt.Errorf("step %q must set exactly one of MutateVMI and MutatePod", step.Name)
+	}
+	if stepIndex(p.vmiSteps, step.Name) >= 0 || stepIndex(p.podSteps, step.Name) >= 0 {
+		return fmt.Errorf("step %q is already in the pipeline", step.Name)
+	}
+	if step.Cause == "" {
+		step.Cause = "custom step"
+	}
+
+	steps := &p.podSteps
+	if step.MutateVMI != nil {
+		steps = &p.vmiSteps
+	}
+	if edit.anchor == "" {
+		*steps = append(*steps, step)
+		return nil
+	}
+
+	i := stepIndex(*steps, edit.anchor)
+	if i < 0 {
+		kind := "Pod"
+		if step.MutateVMI != nil {
+			kind = "VMI"
+		}
+		return fmt.Errorf("cannot insert step %q: no %s step %q", step.Name, kind, edit.anchor)
+	}
+	if edit.after {
+		i++
+	}
+	*steps = append((*steps)[:i], append([]Step{step}, (*steps)[i:]...)...)
+	return nil
+}
+
+func stepIndex(steps []Step, name string) int {
+	for i, s := range steps {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *VMToPodTransformer) builtinVMISteps() []Step {
+	steps := []Step{
+		{Name: StepSetDefaultVMI, Cause: "KubeVirt defaults", MutateVMI: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance) error {
+			if err := defaults.SetDefaultVirtualMachineInstance(t.ClusterConfig, vmi); err != nil {
+				return fmt.Errorf("failed to set VMI defaults: %v", err)
+			}
+			return nil
+		}},
+		{Name: StepApplyVMIMutations, Cause: "KubeVirt mutating webhook", MutateVMI: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance) error {
+			if err := mutators.ApplyNewVMIMutations(vmi, t.ClusterConfig); err != nil {
+				return fmt.Errorf("failed to apply VMI mutations: %v", err)
+			}
+			return nil
+		}},
+		{Name: StepSetDefaultNetworkInterface, Cause: "KubeVirt defaults", MutateVMI: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance) error {
+			if err := vmispec.SetDefaultNetworkInterface(t.ClusterConfig, &vmi.Spec); err != nil {
+				return fmt.Errorf("failed to set default network: %v", err)
+			}
+			return nil
+		}},
+		{Name: StepSetDefaultVolumeDisk, Cause: "KubeVirt defaults", MutateVMI: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance) error {
+			util.SetDefaultVolumeDisk(&vmi.Spec)
+			return nil
+		}},
+		{Name: StepAutoAttachInputDevice, Cause: "KubeVirt VM controller", MutateVMI: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance) error {
+			vmCtrl.AutoAttachInputDevice(vmi)
+			return nil
+		}},
+	}
+	if t.ForcePasst {
+		steps = append(steps, Step{Name: StepForcePasst, Cause: "WithForcePasst", MutateVMI: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance) error {
+			forcePasstBinding(&vmi.Spec)
+			return nil
+		}})
+	}
+	if t.Emulation {
+		steps = append(steps, Step{Name: StepEmulationCPUModel, Cause: "WithEmulation", MutateVMI: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance) error {
+			setEmulationCPUModel(vmi)
+			return nil
+		}})
+	}
+	return steps
+}
+
+func (t *VMToPodTransformer) builtinPodSteps(w *warner) []Step {
+	steps := []Step{
+		{Name: StepStandalonePodName, Cause: "podman kube play needs a name", MutatePod: func(_ *virtv1.VirtualMachine, _ *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+			setStandalonePodName(pod)
+			return nil
+		}},
+	}
+
+	if t.AddConsoleProxy || t.ConsoleLog || t.ConsoleRecord || t.PublishProxy || t.SSHAuthorizedKeys != "" {
+		steps = append(steps, Step{Name: StepConsoleProxy, Cause: t.consoleProxyCause(), MutatePod: func(_ *virtv1.VirtualMachine, _ *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+			addConsoleProxySidecar(pod, t.ProxyImage, t.ProxyPort)
+			return nil
+		}})
+	}
+	if t.PublishProxy {
+		steps = append(steps, Step{Name: StepPublishConsoleProxy, Cause: "WithPublishConsoleProxy", MutatePod: func(_ *virtv1.VirtualMachine, _ *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+			publishConsoleProxy(pod, t.ProxyPort)
+			return nil
+		}})
+	}
+	if t.SSHAuthorizedKeys != "" {
+		steps = append(steps, Step{Name: StepConsoleSSH, Cause: "WithConsoleSSH", MutatePod: func(_ *virtv1.VirtualMachine, _ *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+			return addConsoleSSH(pod, t.ProxyPort, t.SSHAuthorizedKeys, t.SSHHostKey)
+		}})
+	}
+	if t.ConsoleLog || t.ConsoleRecord {
+		cause := enabledOptions(map[string]bool{"WithConsoleLog": t.ConsoleLog, "WithConsoleRecord": t.ConsoleRecord})
+		steps = append(steps, Step{Name: StepConsoleLog, Cause: cause, MutatePod: func(vm *virtv1.VirtualMachine, _ *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+			addConsoleLogVolume(pod, vm.Name)
+			if t.ConsoleLog {
+				addConsoleProxyArgs(pod,
+					fmt.Sprintf("-log-file=%s/%s", ConsoleLogDir, ConsoleLogFile),
+					fmt.Sprintf("-log-max-size=%d", t.ConsoleLogMaxSize),
+					fmt.Sprintf("-log-max-files=%d", t.ConsoleLogMaxFiles),
+				)
+			}
+			if t.ConsoleRecord {
+				addConsoleProxyArgs(pod, fmt.Sprintf("-record-dir=%s", ConsoleLogDir))
+			}
+			return nil
+		}})
+	}
+	if t.MountDevices {
+		steps = append(steps, Step{Name: StepMountDevices, Cause: "WithMountDevices", MutatePod: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+			var devices *hostdevices.Allocator
+			if t.DeviceMap != nil {
+				devices = hostdevices.NewAllocator(t.DeviceMap, hostdevices.Host{Root: t.HostRoot})
+				devices.CreateMDEVs = t.CreateMDEVs
+			}
+			return mountHostDevices(pod, vmi, t.Emulation, devices, w)
+		}})
+	}
+	// VFIO needs the locked memory limit whether or not the device nodes
+	// are mounted here.
+	steps = append(steps, Step{Name: StepMemlockAnnotation, Cause: "GPUs and host devices", MutatePod: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+		addMemlockAnnotation(pod, vmi)
+		return nil
+	}})
+	if t.Emulation {
+		steps = append(steps, Step{Name: StepEmulationWarning, Cause: "WithEmulation", MutatePod: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+			addEmulationWarning(pod, vmi)
+			return nil
+		}})
+	}
+
+	return append(steps,
+		Step{Name: StepCleanupForStandalone, Cause: "standalone mode", MutatePod: func(_ *virtv1.VirtualMachine, vmi *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+			cleanupForStandalone(pod, vmi, w)
+			return nil
+		}},
+		// Add persistence warning annotations for volumes that require special setup
+		Step{Name: StepPersistenceWarnings, Cause: "volumes that need host setup", MutatePod: func(vm *virtv1.VirtualMachine, _ *virtv1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+			addPersistenceWarnings(pod, vm)
+			return nil
+		}},
+	)
+}
+
+// warner collects the warnings of one transformation.
+type warner struct {
+	warnings []string
+}
+
+// warn records a warning; a nil warner drops it.
+func (w *warner) warn(format string, args ...interface{}) {
+	if w != nil {
+		w.warnings = append(w.warnings, fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,150 @@
+package transformer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	k8sv1 "k8s.io/api/core/v1"
+	v1 "kubevirt.io/api/core/v1"
+)
+
+const pipelineTestVM = `
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: testvm
+spec:
+  template:
+    spec:
+      domain:
+        resources:
+          requests:
+            memory: 64Mi
+        devices: {}
+`
+
+func TestPipelineSteps(t *testing.T) {
+	t.Run("built-in steps follow the options", func(t *testing.T) {
+		vmiSteps, podSteps := NewVMToPodTransformer().Steps()
+		require.NotContains(t, vmiSteps, StepForcePasst)
+		require.Equal(t, []string{StepStandalonePodName, StepMemlockAnnotation, StepCleanupForStandalone, StepPersistenceWarnings}, podSteps)
+
+		vmiSteps, podSteps = NewVMToPodTransformer(
+			WithForcePasst(true),
+			WithAddConsoleProxy(true, "proxy:latest", 8080),
+			WithMountDevices(true),
+		).Steps()
+		require.Equal(t, StepForcePasst, vmiSteps[len(vmiSteps)-1])
+		require.Equal(t, []string{
+			StepStandalonePodName,
+			StepConsoleProxy,
+			StepMountDevices,
+			StepMemlockAnnotation,
+			StepCleanupForStandalone,
+			StepPersistenceWarnings,
+		}, podSteps)
+	})
+
+	t.Run("custom steps are placed around anchors", func(t *testing.T) {
+		noop := func(name string) Step {
+			return Step{Name: name, MutatePod: func(*v1.VirtualMachine, *v1.VirtualMachineInstance, *k8sv1.Pod) error { return nil }}
+		}
+		_, podSteps := NewVMToPodTransformer(
+			WithStep(noop("last")),
+			WithStepBefore(StepCleanupForStandalone, noop("before")),
+			WithStepAfter(StepStandalonePodName, noop("after")),
+			WithoutStep(StepPersistenceWarnings),
+		).Steps()
+		require.Equal(t, []string{StepStandalonePodName, "after", StepMemlockAnnotation, "before", StepCleanupForStandalone, "last"}, podSteps)
+	})
+
+	t.Run("invalid edits fail the transformation", func(t *testing.T) {
+		podStep := Step{Name: "x", MutatePod: func(*v1.VirtualMachine, *v1.VirtualMachineInstance, *k8sv1.Pod) error { return nil }}
+		for name, opt := range map[string]TransformerOption{
+			"unknown anchor":    WithStepAfter("nope", podStep),
+			"wrong phase":       WithStepAfter(StepSetDefaultVMI, podStep),
+			"unknown removal":   WithoutStep("nope"),
+			"duplicate name":    WithStep(Step{Name: StepCleanupForStandalone, MutatePod: podStep.MutatePod}),
+			"no mutator":        WithStep(Step{Name: "x"}),
+			"both mutators":     WithStep(Step{Name: "x", MutatePod: podStep.MutatePod, MutateVMI: func(*v1.VirtualMachine, *v1.VirtualMachineInstance) error { return nil }}),
+			"missing step name": WithStep(Step{MutatePod: podStep.MutatePod}),
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := NewVMToPodTransformer(opt).TransformReader(strings.NewReader(pipelineTestVM))
+				require.ErrorContains(t, err, "invalid pipeline")
+			})
+		}
+	})
+}
+
+func TestPipelineMutators(t *testing.T) {
+	t.Run("label and sidecar", func(t *testing.T) {
+		tr := NewVMToPodTransformer(
+			WithStep(Step{Name: "team-label", MutatePod: func(_ *v1.VirtualMachine, _ *v1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+				if pod.Labels == nil {
+					pod.Labels = map[string]string{}
+				}
+				pod.Labels["team"] = "infra"
+				return nil
+			}}),
+			WithStepBefore(StepCleanupForStandalone, Step{Name: "metrics-sidecar", MutatePod: func(_ *v1.VirtualMachine, _ *v1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+				pod.Spec.Containers = append(pod.Spec.Containers, k8sv1.Container{Name: "metrics", Image: "metrics:latest"})
+				return nil
+			}}),
+		)
+		pod, err := tr.TransformReader(strings.NewReader(pipelineTestVM))
+		require.NoError(t, err)
+		require.Equal(t, "infra", pod.Labels["team"])
+		require.Equal(t, "compute, metrics", containerNames(pod))
+	})
+
+	t.Run("VMI steps run before rendering and are embedded", func(t *testing.T) {
+		tr := NewVMToPodTransformer(WithStepAfter(StepSetDefaultVMI, Step{Name: "annotate", MutateVMI: func(_ *v1.VirtualMachine, vmi *v1.VirtualMachineInstance) error {
+			if vmi.Annotations == nil {
+				vmi.Annotations = map[string]string{}
+			}
+			vmi.Annotations["example.com/owner"] = "infra"
+			return nil
+		}}))
+		pod, err := tr.TransformReader(strings.NewReader(pipelineTestVM))
+		require.NoError(t, err)
+
+		var vmi v1.VirtualMachineInstance
+		for _, env := range pod.Spec.Containers[0].Env {
+			if env.Name == "STANDALONE_VMI" {
+				require.NoError(t, json.Unmarshal([]byte(env.Value), &vmi))
+			}
+		}
+		require.Equal(t, "infra", vmi.Annotations["example.com/owner"])
+	})
+
+	t.Run("errors name the step", func(t *testing.T) {
+		tr := NewVMToPodTransformer(WithStep(Step{Name: "broken", MutatePod: func(*v1.VirtualMachine, *v1.VirtualMachineInstance, *k8sv1.Pod) error {
+			return fmt.Errorf("boom")
+		}}))
+		_, err := tr.TransformReader(strings.NewReader(pipelineTestVM))
+		require.EqualError(t, err, "step broken: boom")
+	})
+
+	t.Run("explain shows custom steps", func(t *testing.T) {
+		tr := NewVMToPodTransformer(WithStep(Step{Name: "team-label", MutatePod: func(_ *v1.VirtualMachine, _ *v1.VirtualMachineInstance, pod *k8sv1.Pod) error {
+			pod.Labels["team"] = "infra"
+			return nil
+		}}))
+		result, err := tr.TransformDetailed(context.Background(), strings.NewReader(pipelineTestVM))
+		require.NoError(t, err)
+		for _, s := range result.Explanation.Stages {
+			if s.Name == "team-label" {
+				require.Equal(t, "custom step", s.Cause)
+				require.Equal(t, []Change{{Path: "metadata.labels.team", Op: ChangeAdded, New: "infra"}}, s.Changes)
+				return
+			}
+		}
+		t.Fatal("custom step missing from the explanation")
+	})
+}
@@ -1,21 +1,23 @@
 package transformer
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"sort"
 	"strings"
 
 	k8sv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/apimachinery/pkg/runtime"
 
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/hostdevices"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/validate"
 	virtv1 "kubevirt.io/api/core/v1"
-	"kubevirt.io/kubevirt/pkg/util"
-	"kubevirt.io/kubevirt/pkg/virt-api/webhooks/mutating-webhook/mutators"
-	"kubevirt.io/kubevirt/pkg/network/vmispec"
 	"kubevirt.io/kubevirt/pkg/testutils"
 	"kubevirt.io/kubevirt/pkg/virt-controller/services"
 	vmCtrl "kubevirt.io/kubevirt/pkg/virt-controller/watch/vm"
@@ -23,16 +25,22 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/tools/cache"
 	"kubevirt.io/kubevirt/pkg/defaults"
+	"kubevirt.io/kubevirt/pkg/hypervisor"
+	"kubevirt.io/kubevirt/pkg/util"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 
 )
 
+// VMToPodTransformer turns VirtualMachines into standalone virt-launcher Pods.
+// It is safe for concurrent use once constructed: every transformation gets
+// its own PVC stubs and template service, and only the read-only cluster
+// config and pipeline are shared.
 type VMToPodTransformer struct {
 	ClusterConfig 		*virtconfig.ClusterConfig
-	TemplateSvc   		*services.TemplateService
-	pvcCache		cache.Indexer
+	resourceQuotaStore	cache.Store
+	namespaceStore		cache.Store
 	LauncherImage 		string
 	InstancetypeFile 	string
 	PreferenceFile   	string
@@ -41,6 +49,57 @@ type VMToPodTransformer struct {
 	ProxyPort       	int
 	ForcePasst      	bool
 	MountDevices    	bool
+	ConsoleLog      	bool
+	ConsoleLogMaxSize	int
+	ConsoleLogMaxFiles	int
+	ConsoleRecord   	bool
+	PublishProxy    	bool
+	SSHAuthorizedKeys	string
+	SSHHostKey      	string
+	Deterministic   	bool
+	Strict          	bool
+	Emulation       	bool
+	DeviceMap       	*hostdevices.DeviceMap
+	HostRoot        	string
+	CreateMDEVs     	bool
+
+	stepEdits   []stepEdit
+	vmiSteps    []Step
+	podSteps    []Step
+	pipelineErr error
+}
+
+const (
+	// ConsoleLogDir is where the console proxy writes the serial console log
+	// and recordings.
+	ConsoleLogDir = "/var/log/console"
+	// ConsoleLogFile is the name of the active serial console log file.
+	ConsoleLogFile = "serial.log"
+	// ConsoleSSHDir is where the SSH key files are mounted in the console
+	// proxy sidecar.
+	ConsoleSSHDir = "/etc/console-proxy"
+	// PersistenceWarningAnnotation holds the warnings about volumes that need
+	// host setup, separated by " | ".
+	PersistenceWarningAnnotation = "kubevirt-vm-to-pod/persistence-warning"
+	// EmulationWarningAnnotation is set on Pods that run the VM with
+	// software emulation.
+	EmulationWarningAnnotation = "kubevirt-vm-to-pod/emulation-warning"
+	// EmulationCPUModel replaces the host CPU models on amd64 under
+	// software emulation, which has no host CPU to model. QEMU emulates all
+	// of it, and it covers the x86-64-v2 baseline of current distributions.
+	EmulationCPUModel = "Nehalem"
+	// HostDeviceWarningAnnotation holds the warnings about host devices
+	// assigned from the device map, separated by " | ".
+	HostDeviceWarningAnnotation = "kubevirt-vm-to-pod/host-device-warning"
+	// MemlockAnnotation is set on Pods with VFIO devices to the locked
+	// memory limit virt-launcher needs, e.g. 2300Mi.
+	MemlockAnnotation = "kubevirt-vm-to-pod/memlock"
+)
+
+// ConsoleLogVolumeName returns the name of the Podman named volume holding the
+// serial console log of vmName.
+func ConsoleLogVolumeName(vmName string) string {
+	return vmName + "-console-log"
 }
 
 type TransformerOption func(*VMToPodTransformer)
@@ -71,6 +130,49 @@ func WithAddConsoleProxy(enabled bool, image string, port int) TransformerOption
 	}
 }
 
+// WithConsoleLog makes the console proxy sidecar capture all serial console
+// output to a log file on a named volume, rotating it after maxSizeMB and
+// keeping maxFiles rotated files. The sidecar is added even without
+// WithAddConsoleProxy.
+func WithConsoleLog(enabled bool, maxSizeMB, maxFiles int) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.ConsoleLog = enabled
+		t.ConsoleLogMaxSize = maxSizeMB
+		t.ConsoleLogMaxFiles = maxFiles
+	}
+}
+
+// WithConsoleRecord makes the console proxy sidecar record serial console
+// output as asciicast v2 files on the console log volume, one file per proxy
+// start. The sidecar is added even without WithAddConsoleProxy.
+func WithConsoleRecord(enabled bool) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.ConsoleRecord = enabled
+	}
+}
+
+// WithPublishConsoleProxy makes the console proxy sidecar listen on TCP as
+// well and publishes its port on the host loopback address, so the console can
+// be reached without access to the Pod's volumes. The sidecar is added even
+// without WithAddConsoleProxy.
+func WithPublishConsoleProxy(enabled bool) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.PublishProxy = enabled
+	}
+}
+
+// WithConsoleSSH makes the console proxy sidecar serve the serial console over
+// SSH on the proxy port, published on the host. Only the keys in the
+// authorizedKeysFile on the host may connect. hostKeyFile is optional; without
+// it the proxy generates a new host key on every start. The sidecar is added
+// even without WithAddConsoleProxy.
+func WithConsoleSSH(authorizedKeysFile, hostKeyFile string) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.SSHAuthorizedKeys = authorizedKeysFile
+		t.SSHHostKey = hostKeyFile
+	}
+}
+
 func WithForcePasst(enabled bool) TransformerOption {
 	return func(t *VMToPodTransformer) {
 		t.ForcePasst = enabled
@@ -83,7 +185,72 @@ func WithMountDevices(enabled bool) TransformerOption {
 	}
 }
 
+// WithDeterministic makes identical input render to identical bytes: volumes,
+// mounts and env are sorted, the QEMU timeout is not randomized and the
+// cluster-generated metadata is dropped from the embedded VMI.
+func WithDeterministic(enabled bool) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.Deterministic = enabled
+	}
+}
+
+// WithStrict rejects VMs the KubeVirt API would: unknown fields, duplicate
+// keys, values the OpenAPI schema forbids and specs the validating webhook
+// denies. The error is a *validate.Error listing every finding.
+func WithStrict(enabled bool) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.Strict = enabled
+	}
+}
+
+// WithEmulation runs the VM with QEMU software emulation instead of KVM, for
+// hosts without /dev/kvm such as CI runners. It sets useEmulation in the
+// KubeVirt configuration, does not mount /dev/kvm, replaces host CPU models
+// with EmulationCPUModel and marks the Pod with EmulationWarningAnnotation.
+func WithEmulation(enabled bool) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.Emulation = enabled
+	}
+}
+
+// WithDeviceMap assigns host devices to GPUs and host devices by the resource
+// names in m and mounts the device nodes of the assigned devices, found in
+// the sysfs below root, instead of guessing them by GPU index. An empty root
+// means /.
+func WithDeviceMap(m *hostdevices.DeviceMap, root string) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.DeviceMap = m
+		t.HostRoot = root
+	}
+}
+
+// WithCreateMDEVs creates the mediated devices of the device map on the host
+// when no free one exists, instead of failing the transformation.
+func WithCreateMDEVs(enabled bool) TransformerOption {
+	return func(t *VMToPodTransformer) {
+		t.CreateMDEVs = enabled
+	}
+}
+
 func NewVMToPodTransformer(opts ...TransformerOption) *VMToPodTransformer {
+	t := &VMToPodTransformer{
+		resourceQuotaStore: cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
+		namespaceStore:     cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc),
+		LauncherImage:      defaultLauncherImage,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.ClusterConfig = newClusterConfig(t.Emulation)
+	t.buildPipeline()
+
+	return t
+}
+
+// newClusterConfig returns the configuration of a fake KubeVirt deployment
+// for rendering standalone Pods.
+func newClusterConfig(emulation bool) *virtconfig.ClusterConfig {
 	kv := &virtv1.KubeVirt{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "kubevirt",
@@ -92,6 +259,9 @@ func NewVMToPodTransformer(opts ...TransformerOption) *VMToPodTransformer {
 		Spec: virtv1.KubeVirtSpec{
 			Configuration: virtv1.KubeVirtConfiguration{
 				DeveloperConfiguration: &virtv1.DeveloperConfiguration{},
+				// The guest-console-log container relies on the Kubernetes
+				// logging stack; in standalone mode the console proxy
+				// captures serial output instead (see WithConsoleLog).
 				VirtualMachineOptions: &virtv1.VirtualMachineOptions{
 					DisableSerialConsoleLog: &virtv1.DisableSerialConsoleLog{},
 				},
@@ -101,19 +271,39 @@ func NewVMToPodTransformer(opts ...TransformerOption) *VMToPodTransformer {
 			Phase: virtv1.KubeVirtPhaseDeploying,
 		},
 	}
-	kv.Spec.Configuration.DeveloperConfiguration.FeatureGates = []string{"ImageVolume", "HostDisk"}
+	// ExternalNetResourceInjection keeps the template from looking up the
+	// NetworkAttachmentDefinitions of Multus networks, which needs the
+	// Kubernetes API; their device plugin resources do not apply here.
+	// HostDevices only matters to validation, which rejects hostDevices and
+	// gpus without it; the template renders them either way.
+	kv.Spec.Configuration.DeveloperConfiguration.FeatureGates = []string{"ImageVolume", "HostDisk", "HostDevices", "ExternalNetResourceInjection"}
 
-	config, _, _ := testutils.NewFakeClusterConfigUsingKV(kv)
+	kv.Spec.Configuration.DeveloperConfiguration.UseEmulation = emulation
 
-    pvcCache := cache.NewIndexer(cache.DeletionHandlingMetaNamespaceKeyFunc, nil)
-    resourceQuotaStore := cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc)
-    namespaceStore := cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc)
+	config, _, _ := testutils.NewFakeClusterConfigUsingKV(kv)
+	return config
+}
 
-	launcherImage := "quay.io/kubevirt/virt-launcher:v1.8.0"
+const (
+	// defaultLauncherImage is the virt-launcher image matching the KubeVirt
+	// version the transformer is built against.
+	defaultLauncherImage = "quay.io/kubevirt/virt-launcher:v1.8.0"
+	// qemuTimeoutSeconds is the base of the QEMU start timeout. KubeVirt
+	// adds a random jitter to it unless the output is deterministic.
+	qemuTimeoutSeconds = 240
+)
 
-	templateSvc := services.NewTemplateService(
+// templateService returns a template service that renders Pods against the
+// PVCs in pvcCache. The service keeps no other state between renders, so one
+// per transformation is cheap.
+func (t *VMToPodTransformer) templateService(pvcCache cache.Indexer) *services.TemplateService {
+	launcherImage := t.LauncherImage
+	if launcherImage == "" {
+		launcherImage = defaultLauncherImage
+	}
+	return services.NewTemplateService(
 		launcherImage,
-		240,
+		qemuTimeoutSeconds,
 		"/var/run/kubevirt",
 		"/var/run/kubevirt-ephemeral-disks",
 		"/var/run/kubevirt/container-disks",
@@ -121,131 +311,339 @@ func NewVMToPodTransformer(opts ...TransformerOption) *VMToPodTransformer {
 		"pull-secret-1",
 		pvcCache,
 		nil,
-		config,
+		t.ClusterConfig,
 		107,
 		"quay.io/kubevirt/vm-export:latest",
-		resourceQuotaStore,
-		namespaceStore,
+		t.resourceQuotaStore,
+		t.namespaceStore,
 	)
+}
 
-	t := &VMToPodTransformer{
-		ClusterConfig: config,
-		TemplateSvc:   templateSvc,
-		pvcCache:      pvcCache,
-		LauncherImage: launcherImage,
-	}
-
-	for _, opt := range opts {
-		opt(t)
-	}
+// Transform transforms the VM in vmFile. It is TransformContext with
+// context.Background().
+func (t *VMToPodTransformer) Transform(vmFile string) (*k8sv1.Pod, error) {
+	return t.TransformContext(context.Background(), vmFile)
+}
 
-	return t
+// TransformContext transforms the VM in vmFile, stopping early once ctx is
+// done.
+func (t *VMToPodTransformer) TransformContext(ctx context.Context, vmFile string) (*k8sv1.Pod, error) {
+	return resultPod(t.TransformResult(ctx, vmFile))
 }
 
-func (t *VMToPodTransformer) Transform(vmFile string) (*k8sv1.Pod, error) {
+// TransformResult is TransformContext returning the warnings with the Pod.
+func (t *VMToPodTransformer) TransformResult(ctx context.Context, vmFile string) (*Result, error) {
 	data, err := ioutil.ReadFile(vmFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read VM file: %v", err)
 	}
-	return t.transformBytes(data)
+	return t.transformBytes(ctx, vmFile, data)
 }
 
+// TransformReader transforms the VM read from r. It is
+// TransformReaderContext with context.Background().
 func (t *VMToPodTransformer) TransformReader(r io.Reader) (*k8sv1.Pod, error) {
+	return t.TransformReaderContext(context.Background(), r)
+}
+
+// TransformReaderContext transforms the VM read from r, stopping early once
+// ctx is done.
+func (t *VMToPodTransformer) TransformReaderContext(ctx context.Context, r io.Reader) (*k8sv1.Pod, error) {
+	return resultPod(t.TransformReaderResult(ctx, r))
+}
+
+// TransformReaderResult is TransformReaderContext returning the warnings with
+// the Pod.
+func (t *VMToPodTransformer) TransformReaderResult(ctx context.Context, r io.Reader) (*Result, error) {
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read VM from input: %v", err)
 	}
-	return t.transformBytes(data)
+	return t.transformBytes(ctx, "", data)
 }
 
-func (t *VMToPodTransformer) transformBytes(data []byte) (*k8sv1.Pod, error) {
-	vm := &virtv1.VirtualMachine{}
-	if err := yaml.Unmarshal(data, vm); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal VM: %v", err)
+// TransformVM transforms an already parsed VM. vm is not modified. It is
+// TransformVMContext with context.Background().
+func (t *VMToPodTransformer) TransformVM(vm *virtv1.VirtualMachine) (*k8sv1.Pod, error) {
+	return t.TransformVMContext(context.Background(), vm)
+}
+
+// TransformVMContext transforms an already parsed VM, stopping early once
+// ctx is done. vm is not modified.
+func (t *VMToPodTransformer) TransformVMContext(ctx context.Context, vm *virtv1.VirtualMachine) (*k8sv1.Pod, error) {
+	return resultPod(t.TransformVMResult(ctx, vm))
+}
+
+// TransformVMResult is TransformVMContext returning the warnings with the
+// Pod.
+func (t *VMToPodTransformer) TransformVMResult(ctx context.Context, vm *virtv1.VirtualMachine) (*Result, error) {
+	if vm == nil {
+		return nil, fmt.Errorf("no VM given")
 	}
+	return t.transform(ctx, vm.DeepCopy(), nil)
+}
 
-	if err := validateForStandalone(vm); err != nil {
+func resultPod(result *Result, err error) (*k8sv1.Pod, error) {
+	if err != nil {
 		return nil, err
 	}
+	return result.Pod, nil
+}
 
-	t.stubPVCsForVM(vm)
+// transformBytes transforms the VM in data, read from file, which is only
+// used to report findings in strict mode.
+func (t *VMToPodTransformer) transformBytes(ctx context.Context, file string, data []byte) (*Result, error) {
+	vm, err := t.parse(file, data)
+	if err != nil {
+		return nil, err
+	}
+	return t.transform(ctx, vm, nil)
+}
 
-	if vm.ObjectMeta.Namespace == "" {
-		vm.ObjectMeta.Namespace = "default"
+// parse decodes a VM, validating it first in strict mode.
+func (t *VMToPodTransformer) parse(file string, data []byte) (*virtv1.VirtualMachine, error) {
+	if t.Strict {
+		if findings := validate.Validate(file, data, t.ClusterConfig); len(findings) > 0 {
+			return nil, &validate.Error{Findings: findings}
+		}
 	}
+	return parseVM(data)
+}
 
-	// Apply VM defaults
-	defaults.SetVirtualMachineDefaults(vm, t.ClusterConfig, nil)
+func parseVM(data []byte) (*virtv1.VirtualMachine, error) {
+	vm := &virtv1.VirtualMachine{}
+	if err := yaml.Unmarshal(data, vm); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal VM: %v", err)
+	}
+	return vm, nil
+}
 
-	vmi := vmCtrl.SetupVMIFromVM(vm)
+// Result is a Pod together with the warnings about it and, for the Detailed
+// variants, the explanation of how it was made.
+type Result struct {
+	Pod *k8sv1.Pod
+	// Warnings are things that need attention before running the Pod.
+	Warnings    []string
+	Explanation *Explanation
+}
 
-	if err := defaults.SetDefaultVirtualMachineInstance(t.ClusterConfig, vmi); err != nil {
-		return nil, fmt.Errorf("failed to set VMI defaults: %v", err)
+// TransformDetailed transforms a VM like TransformReader and records what
+// every stage changed on the way.
+func (t *VMToPodTransformer) TransformDetailed(ctx context.Context, r io.Reader) (*Result, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VM from input: %v", err)
 	}
-	if err := mutators.ApplyNewVMIMutations(vmi, t.ClusterConfig); err != nil {
-		return nil, fmt.Errorf("failed to apply VMI mutations: %v", err)
+	vm, err := t.parse("", data)
+	if err != nil {
+		return nil, err
+	}
+	e := &explainer{}
+	result, err := t.transform(ctx, vm, e)
+	if err != nil {
+		return nil, err
 	}
+	result.Explanation = &e.explanation
+	return result, nil
+}
 
-	if err := vmispec.SetDefaultNetworkInterface(t.ClusterConfig, &vmi.Spec); err != nil {
-		return nil, fmt.Errorf("failed to set default network: %v", err)
+// TransformVMDetailed is TransformDetailed for an already parsed VM. vm is not
+// modified.
+func (t *VMToPodTransformer) TransformVMDetailed(ctx context.Context, vm *virtv1.VirtualMachine) (*Result, error) {
+	if vm == nil {
+		return nil, fmt.Errorf("no VM given")
 	}
+	e := &explainer{}
+	result, err := t.transform(ctx, vm.DeepCopy(), e)
+	if err != nil {
+		return nil, err
+	}
+	result.Explanation = &e.explanation
+	return result, nil
+}
 
-	util.SetDefaultVolumeDisk(&vmi.Spec)
-	vmCtrl.AutoAttachInputDevice(vmi)
+// transform runs the pipeline on vm, which it modifies.
+func (t *VMToPodTransformer) transform(ctx context.Context, vm *virtv1.VirtualMachine, e *explainer) (*Result, error) {
+	if t.PublishProxy && t.SSHAuthorizedKeys != "" {
+		return nil, fmt.Errorf("publishing the console proxy and its SSH gateway both use the proxy port, enable only one")
+	}
 
-	if t.ForcePasst {
-		forcePasstBinding(&vmi.Spec)
+	w := &warner{}
+	vmi, err := t.vmiFromVM(ctx, vm, e, w)
+	if err != nil {
+		return nil, err
+	}
+	_, podSteps, err := t.steps(w)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipeline: %v", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	pod, err := t.TemplateSvc.RenderLaunchManifest(vmi)
+	pod, err := t.templateService(pvcStubs(vm)).RenderLaunchManifest(vmi)
 	if err != nil {
 		return nil, fmt.Errorf("failed to render Pod: %v", err)
 	}
+	e.describe("RenderLaunchManifest", "Pod", "KubeVirt virt-launcher template",
+		fmt.Sprintf("rendered the virt-launcher Pod with containers %s", containerNames(pod)))
 
-	// add type
+	for _, step := range podSteps {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := e.stage(step.Name, "Pod", step.Cause, pod, func() error {
+			return step.MutatePod(vm, vmi, pod)
+		}); err != nil {
+			return nil, fmt.Errorf("step %s: %v", step.Name, err)
+		}
+	}
+
+	// Populate VMI interface status with PodInterfaceName.
+	// In Kubernetes, virt-handler sets this; for standalone mode we must do it ourselves.
+	e.stage("populateInterfaceStatus", "VirtualMachineInstance", "standalone mode, no virt-handler", vmi, func() error {
+		populateInterfaceStatus(vmi)
+		return nil
+	})
+	if t.Deterministic {
+		e.stage("dropGeneratedMetadata", "VirtualMachineInstance", "deterministic output", vmi, func() error {
+			dropGeneratedMetadata(vmi)
+			return nil
+		})
+	}
+
+	vmiJSON, err := json.Marshal(vmi)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal VMI: %v", err)
+	}
+	e.stage("embed VMI", "Pod", "standalone mode", pod, func() error {
+		for i, c := range pod.Spec.Containers {
+			if c.Name == "compute" {
+				pod.Spec.Containers[i].Env = append(c.Env,
+					k8sv1.EnvVar{Name: "STANDALONE_VMI", Value: string(vmiJSON)},
+					k8sv1.EnvVar{Name: "VIRSH_DEFAULT_CONNECT_URI", Value: "qemu+unix:///session?socket=/var/run/libvirt/virtqemud-sock"},
+				)
+				break
+			}
+		}
+		return nil
+	})
+	if t.Deterministic {
+		e.stage("sortPod", "Pod", "deterministic output", pod, func() error {
+			sortPod(pod)
+			return nil
+		})
+	}
+
+	return &Result{Pod: pod, Warnings: append(w.warnings, annotationWarnings(pod)...)}, nil
+}
+
+// annotationWarnings returns the warnings the Pod carries in annotations.
+func annotationWarnings(pod *k8sv1.Pod) []string {
+	var warnings []string
+	for _, key := range []string{PersistenceWarningAnnotation, EmulationWarningAnnotation, HostDeviceWarningAnnotation} {
+		if warning := pod.Annotations[key]; warning != "" {
+			warnings = append(warnings, strings.Split(warning, " | ")...)
+		}
+	}
+	return warnings
+}
+
+// setStandalonePodName sets the type and turns generateName into a name, as
+// podman kube play needs one.
+func setStandalonePodName(pod *k8sv1.Pod) {
 	pod.TypeMeta = metav1.TypeMeta{
-        Kind:       "Pod",
-        APIVersion: "v1",
-    }
+		Kind:       "Pod",
+		APIVersion: "v1",
+	}
 
-	// Convert generateName to name for standalone pods (required by podman kube play)
 	if pod.ObjectMeta.GenerateName != "" && pod.ObjectMeta.Name == "" {
-		pod.ObjectMeta.Name = pod.ObjectMeta.GenerateName[:len(pod.ObjectMeta.GenerateName)-1]
+		pod.ObjectMeta.Name = strings.TrimSuffix(pod.ObjectMeta.GenerateName, "-")
 		pod.ObjectMeta.GenerateName = ""
 	}
+}
 
-	if t.AddConsoleProxy {
-		addConsoleProxySidecar(pod, t.ProxyImage, t.ProxyPort)
+// vmiFromVM returns the VMI KubeVirt would create for vm, with all defaults,
+// mutations and VMI steps applied. The VM defaults are applied to vm.
+// Warnings about vm go to w.
+func (t *VMToPodTransformer) vmiFromVM(ctx context.Context, vm *virtv1.VirtualMachine, e *explainer, w *warner) (*virtv1.VirtualMachineInstance, error) {
+	if t.pipelineErr != nil {
+		return nil, fmt.Errorf("invalid pipeline: %v", t.pipelineErr)
 	}
 
-	if t.MountDevices {
-		mountHostDevices(pod, vmi)
+	if err := validateForStandalone(vm, w); err != nil {
+		return nil, err
 	}
 
-	cleanupForStandalone(pod, vmi)
+	e.stage("default namespace", "VirtualMachine", "no namespace set", vm, func() error {
+		if vm.ObjectMeta.Namespace == "" {
+			vm.ObjectMeta.Namespace = "default"
+		}
+		return nil
+	})
 
-	// Add persistence warning annotations for volumes that require special setup
-	addPersistenceWarnings(pod, vm)
+	// Apply VM defaults
+	e.stage("SetVirtualMachineDefaults", "VirtualMachine", "KubeVirt defaults", vm, func() error {
+		defaults.SetVirtualMachineDefaults(vm, t.ClusterConfig, nil)
+		return nil
+	})
 
-	// Populate VMI interface status with PodInterfaceName.
-	// In Kubernetes, virt-handler sets this; for standalone mode we must do it ourselves.
-	populateInterfaceStatus(vmi)
+	vmi := vmCtrl.SetupVMIFromVM(vm)
+	if e != nil {
+		before, err := snapshot(&virtv1.VirtualMachineInstance{ObjectMeta: vm.Spec.Template.ObjectMeta, Spec: vm.Spec.Template.Spec})
+		if err != nil {
+			return nil, err
+		}
+		after, err := snapshot(vmi)
+		if err != nil {
+			return nil, err
+		}
+		e.record("SetupVMIFromVM", "VirtualMachineInstance", "KubeVirt VM controller, compared to the VM template", before, after)
+	}
 
-	vmiJSON, err := json.Marshal(vmi)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal VMI: %v", err)
+	for _, step := range t.vmiSteps {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := e.stage(step.Name, "VirtualMachineInstance", step.Cause, vmi, func() error {
+			return step.MutateVMI(vm, vmi)
+		}); err != nil {
+			return nil, fmt.Errorf("step %s: %v", step.Name, err)
+		}
 	}
-	for i, c := range pod.Spec.Containers {
-		if c.Name == "compute" {
-			pod.Spec.Containers[i].Env = append(c.Env,
-				k8sv1.EnvVar{Name: "STANDALONE_VMI", Value: string(vmiJSON)},
-				k8sv1.EnvVar{Name: "VIRSH_DEFAULT_CONNECT_URI", Value: "qemu+unix:///session?socket=/var/run/libvirt/virtqemud-sock"},
-			)
-			break
+
+	return vmi, nil
+}
+
+// consoleProxyCause names the options that add the console proxy sidecar.
+func (t *VMToPodTransformer) consoleProxyCause() string {
+	return enabledOptions(map[string]bool{
+		"WithAddConsoleProxy":     t.AddConsoleProxy,
+		"WithConsoleLog":          t.ConsoleLog,
+		"WithConsoleRecord":       t.ConsoleRecord,
+		"WithPublishConsoleProxy": t.PublishProxy,
+		"WithConsoleSSH":          t.SSHAuthorizedKeys != "",
+	})
+}
+
+// enabledOptions returns the sorted names of the enabled options.
+func enabledOptions(options map[string]bool) string {
+	var names []string
+	for name, enabled := range options {
+		if enabled {
+			names = append(names, name)
 		}
 	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
 
-	return pod, nil
+func containerNames(pod *k8sv1.Pod) string {
+	var names []string
+	for _, c := range pod.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, ", ")
 }
 
 func addConsoleProxySidecar(pod *k8sv1.Pod, proxyImage string, proxyPort int) {
@@ -272,10 +670,128 @@ func addConsoleProxySidecar(pod *k8sv1.Pod, proxyImage string, proxyPort int) {
 	})
 }
 
-func mountHostDevices(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance) {
+// addConsoleLogVolume mounts a named volume into the console proxy sidecar for
+// the serial console log and recordings, so they survive pod restarts and can
+// be read from the host with the logs subcommand.
+func addConsoleLogVolume(pod *k8sv1.Pod, vmName string) {
+	volName := "console-log"
+	pod.Spec.Volumes = append(pod.Spec.Volumes, k8sv1.Volume{
+		Name: volName,
+		VolumeSource: k8sv1.VolumeSource{
+			PersistentVolumeClaim: &k8sv1.PersistentVolumeClaimVolumeSource{
+				ClaimName: ConsoleLogVolumeName(vmName),
+			},
+		},
+	})
+
+	for i, c := range pod.Spec.Containers {
+		if c.Name == "console-proxy" {
+			pod.Spec.Containers[i].VolumeMounts = append(c.VolumeMounts, k8sv1.VolumeMount{
+				Name:      volName,
+				MountPath: ConsoleLogDir,
+			})
+			break
+		}
+	}
+}
+
+// publishConsoleProxy switches the console proxy sidecar to listen on both its
+// unix socket and TCP, and publishes the TCP port on 127.0.0.1 only: the
+// console is unauthenticated.
+func publishConsoleProxy(pod *k8sv1.Pod, proxyPort int) {
+	for i, c := range pod.Spec.Containers {
+		if c.Name != "console-proxy" {
+			continue
+		}
+		for j, arg := range c.Command {
+			if arg == "-listen=unix" {
+				pod.Spec.Containers[i].Command[j] = "-listen=unix,tcp"
+			}
+		}
+		pod.Spec.Containers[i].Ports = append(c.Ports, k8sv1.ContainerPort{
+			Name:          "console",
+			ContainerPort: int32(proxyPort),
+			HostPort:      int32(proxyPort),
+			HostIP:        "127.0.0.1",
+			Protocol:      k8sv1.ProtocolTCP,
+		})
+		break
+	}
+}
+
+// addConsoleSSH enables the console proxy's SSH gateway on proxyPort and
+// mounts the key files from the host read-only. Unlike the WebSocket endpoint
+// the port is published on all host addresses, since every client has to
+// authenticate.
+func addConsoleSSH(pod *k8sv1.Pod, proxyPort int, authorizedKeysFile, hostKeyFile string) error {
+	hostPathFile := k8sv1.HostPathFile
+	args := []string{fmt.Sprintf("-ssh-port=%d", proxyPort)}
+	var mounts []k8sv1.VolumeMount
+
+	for _, f := range []struct {
+		volume, hostPath, name, flag string
+	}{
+		{"console-ssh-authorized-keys", authorizedKeysFile, "authorized_keys", "-ssh-authorized-keys"},
+		{"console-ssh-host-key", hostKeyFile, "ssh_host_key", "-ssh-host-key"},
+	} {
+		if f.hostPath == "" {
+			continue
+		}
+		// hostPath volumes need absolute paths
+		path, err := filepath.Abs(f.hostPath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %v", f.hostPath, err)
+		}
+		pod.Spec.Volumes = append(pod.Spec.Volumes, k8sv1.Volume{
+			Name: f.volume,
+			VolumeSource: k8sv1.VolumeSource{
+				HostPath: &k8sv1.HostPathVolumeSource{
+					Path: path,
+					Type: &hostPathFile,
+				},
+			},
+		})
+		mountPath := ConsoleSSHDir + "/" + f.name
+		mounts = append(mounts, k8sv1.VolumeMount{Name: f.volume, MountPath: mountPath, ReadOnly: true})
+		args = append(args, fmt.Sprintf("%s=%s", f.flag, mountPath))
+	}
+
+	for i, c := range pod.Spec.Containers {
+		if c.Name != "console-proxy" {
+			continue
+		}
+		pod.Spec.Containers[i].Command = append(c.Command, args...)
+		pod.Spec.Containers[i].VolumeMounts = append(c.VolumeMounts, mounts...)
+		pod.Spec.Containers[i].Ports = append(c.Ports, k8sv1.ContainerPort{
+			Name:          "ssh",
+			ContainerPort: int32(proxyPort),
+			HostPort:      int32(proxyPort),
+			Protocol:      k8sv1.ProtocolTCP,
+		})
+		break
+	}
+	return nil
+}
+
+func addConsoleProxyArgs(pod *k8sv1.Pod, args ...string) {
+	for i, c := range pod.Spec.Containers {
+		if c.Name == "console-proxy" {
+			pod.Spec.Containers[i].Command = append(c.Command, args...)
+			break
+		}
+	}
+}
+
+// mountHostDevices mounts the devices the compute container needs. With an
+// allocator from a device map, GPUs and host devices get the exact device
+// nodes of the host devices they are assigned; without one, GPU nodes are
+// guessed by index and host devices only get /dev/vfio/vfio, with a warning
+// to w.
+func mountHostDevices(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance, emulation bool, devices *hostdevices.Allocator, w *warner) error {
 	hostPathCharDev := k8sv1.HostPathCharDev
 
-	// Always mount KVM devices
+	// Always mount KVM devices, except /dev/kvm under software emulation,
+	// where hosts do not have it
 	kvmDevices := []struct {
 		name string
 		path string
@@ -286,6 +802,9 @@ func mountHostDevices(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance) {
 	}
 
 	for _, dev := range kvmDevices {
+		if emulation && dev.name == "kvm" {
+			continue
+		}
 		mountDevice(pod, dev.name, dev.path, &hostPathCharDev)
 	}
 
@@ -312,7 +831,11 @@ func mountHostDevices(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance) {
 	}
 
 	// Mount GPU devices if requested in VMI
-	if vmi != nil && vmi.Spec.Domain.Devices.GPUs != nil {
+	if vmi != nil && devices != nil {
+		if err := mountMappedDevices(pod, vmi, devices); err != nil {
+			return err
+		}
+	} else if vmi != nil && vmi.Spec.Domain.Devices.GPUs != nil {
 		for i, gpu := range vmi.Spec.Domain.Devices.GPUs {
 			// Detect vendor from deviceName
 			vendor := detectGPUVendor(gpu.DeviceName)
@@ -339,27 +862,181 @@ func mountHostDevices(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance) {
 
 			default:
 				// Generic GPU - try to mount common devices
-				fmt.Fprintf(os.Stderr, "Warning: Unknown GPU vendor for device %s, mounting generic DRI devices\n", gpu.DeviceName)
+				w.warn("unknown GPU vendor for device %s, mounting generic DRI devices", gpu.DeviceName)
 				mountDevice(pod, fmt.Sprintf("dri-card%d", i), fmt.Sprintf("/dev/dri/card%d", i), &hostPathCharDev)
 			}
 		}
 	}
 
-	// Mount PCI hostdevices if requested in VMI
-	if vmi != nil && vmi.Spec.Domain.Devices.HostDevices != nil {
+	// Mount PCI hostdevices if requested in VMI, unless a device map
+	// resolved them above
+	if vmi != nil && devices == nil && vmi.Spec.Domain.Devices.HostDevices != nil {
 		for i, hostdev := range vmi.Spec.Domain.Devices.HostDevices {
 			// For PCI hostdevices, we need to mount the vfio device
 			// Format: /dev/vfio/X where X is the IOMMU group number
 			// This is complex and requires parsing PCI addresses
-			fmt.Fprintf(os.Stderr, "Warning: PCI hostdevice %s detected. Mounting /dev/vfio/* requires manual configuration\n", hostdev.Name)
+			w.warn("PCI hostdevice %s detected. Mounting /dev/vfio/* requires manual configuration", hostdev.Name)
 
 			// Mount vfio devices (common for SR-IOV and GPU passthrough)
 			if i == 0 {
 				// Mount /dev/vfio/vfio (VFIO container)
-				mountDevice(pod, "vfio", "/dev/vfio/vfio", &hostPathCharDev)
+				mountDeviceOnce(pod, "vfio", "/dev/vfio/vfio", &hostPathCharDev)
 			}
 		}
 	}
+	return nil
+}
+
+// mountMappedDevices assigns host devices to the GPUs and host devices of
+// vmi, mounts their device nodes and passes them to virt-launcher in the
+// variables it reads them from: PCI addresses in PCI_RESOURCE_<resource
+// name>, mdev UUIDs in MDEV_PCI_RESOURCE_<resource name> and USB bus:device
+// addresses in USB_RESOURCE_<resource name>. PCI host devices must be bound
+// to vfio-pci; PCI GPUs that are not get a warning.
+func mountMappedDevices(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance, devices *hostdevices.Allocator) error {
+	hostPathCharDev := k8sv1.HostPathCharDev
+	var envNames, warnings []string
+	envValues := map[string][]string{}
+	assign := func(prefix, resource, id string, nodes []string) {
+		for _, node := range nodes {
+			mountDeviceOnce(pod, deviceVolumeName(node), node, &hostPathCharDev)
+		}
+		name := util.ResourceNameToEnvVar(prefix, resource)
+		if _, ok := envValues[name]; !ok {
+			envNames = append(envNames, name)
+		}
+		envValues[name] = append(envValues[name], id)
+	}
+	assignMDEV := func(resource string) error {
+		mdev, err := devices.AllocateMDEV(resource)
+		if err != nil {
+			return err
+		}
+		if len(mdev.Nodes()) == 0 {
+			return fmt.Errorf("mediated device %s is in no IOMMU group; load the vfio_mdev module", mdev.UUID)
+		}
+		assign(virtv1.MDevResourcePrefix, resource, mdev.UUID, mdev.Nodes())
+		return nil
+	}
+
+	for _, gpu := range vmi.Spec.Domain.Devices.GPUs {
+		if devices.IsMDEV(gpu.DeviceName) {
+			if err := assignMDEV(gpu.DeviceName); err != nil {
+				return fmt.Errorf("GPU %s: %v", gpu.Name, err)
+			}
+			continue
+		}
+		dev, err := devices.AllocatePCI(gpu.DeviceName)
+		if err != nil {
+			return fmt.Errorf("GPU %s: %v", gpu.Name, err)
+		}
+		nodes := dev.Nodes(devices.Host())
+		if len(nodes) == 0 {
+			driver := "no driver"
+			if dev.Driver != "" {
+				driver = "driver " + dev.Driver
+			}
+			return fmt.Errorf("GPU %s: PCI device %s is bound to %s, which has no device nodes to mount; bind it to vfio-pci", gpu.Name, dev.Address, driver)
+		}
+		if err := dev.CheckVFIO(); err != nil {
+			warnings = append(warnings, fmt.Sprintf("GPU %s: %v; virt-launcher only passes through devices bound to vfio-pci", gpu.Name, err))
+		}
+		assign(virtv1.PCIResourcePrefix, gpu.DeviceName, dev.Address, nodes)
+	}
+	for _, hostDev := range vmi.Spec.Domain.Devices.HostDevices {
+		if devices.IsMDEV(hostDev.DeviceName) {
+			if err := assignMDEV(hostDev.DeviceName); err != nil {
+				return fmt.Errorf("host device %s: %v", hostDev.Name, err)
+			}
+			continue
+		}
+		if devices.IsUSB(hostDev.DeviceName) {
+			usb, err := devices.AllocateUSB(hostDev.DeviceName)
+			if err != nil {
+				return fmt.Errorf("host device %s: %v", hostDev.Name, err)
+			}
+			for _, dev := range usb {
+				assign(virtv1.USBResourcePrefix, hostDev.DeviceName, dev.Address(), []string{dev.Node})
+			}
+			continue
+		}
+		dev, err := devices.AllocatePCI(hostDev.DeviceName)
+		if err != nil {
+			return fmt.Errorf("host device %s: %v", hostDev.Name, err)
+		}
+		if err := dev.CheckVFIO(); err != nil {
+			return fmt.Errorf("host device %s: %v", hostDev.Name, err)
+		}
+		assign(virtv1.PCIResourcePrefix, hostDev.DeviceName, dev.Address, dev.Nodes(devices.Host()))
+	}
+
+	for i, c := range pod.Spec.Containers {
+		if c.Name != "compute" {
+			continue
+		}
+		for _, name := range envNames {
+			pod.Spec.Containers[i].Env = append(pod.Spec.Containers[i].Env, k8sv1.EnvVar{
+				Name:  name,
+				Value: strings.Join(envValues[name], ","),
+			})
+		}
+		break
+	}
+	if len(warnings) > 0 {
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[HostDeviceWarningAnnotation] = strings.Join(warnings, " | ")
+	}
+	return nil
+}
+
+// addMemlockAnnotation records the locked memory limit virt-launcher needs
+// for VFIO, which pins all guest memory. In a cluster virt-handler raises
+// the limit of the running VM; standalone, the container runtime must.
+func addMemlockAnnotation(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance) {
+	if vmi == nil || !util.IsVFIOVMI(vmi) {
+		return
+	}
+	arch := vmi.Spec.Architecture
+	if arch == "" {
+		arch = goruntime.GOARCH
+	}
+	memlock := hypervisor.NewLauncherHypervisorResources(virtv1.KvmHypervisorName).GetMemoryOverhead(vmi, arch, nil)
+	switch domain := vmi.Spec.Domain; {
+	case domain.Memory != nil && domain.Memory.MaxGuest != nil:
+		memlock.Add(*domain.Memory.MaxGuest)
+	case !domain.Resources.Requests.Memory().IsZero():
+		memlock.Add(*domain.Resources.Requests.Memory())
+	case domain.Memory != nil && domain.Memory.Guest != nil:
+		memlock.Add(*domain.Memory.Guest)
+	}
+	const mi = 1 << 20
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[MemlockAnnotation] = fmt.Sprintf("%dMi", (memlock.Value()+mi-1)/mi)
+}
+
+// deviceVolumeName names the volume of a device node after its path below
+// /dev, e.g. vfio-12 for /dev/vfio/12. /dev/vfio/vfio keeps the name vfio.
+func deviceVolumeName(path string) string {
+	if path == "/dev/vfio/vfio" {
+		return "vfio"
+	}
+	return strings.ReplaceAll(strings.TrimPrefix(path, "/dev/"), "/", "-")
+}
+
+// mountDeviceOnce mounts devicePath unless the Pod already mounts it, as for
+// the control nodes shared by several GPUs or an IOMMU group holding several
+// devices.
+func mountDeviceOnce(pod *k8sv1.Pod, volumeName, devicePath string, pathType *k8sv1.HostPathType) {
+	for _, v := range pod.Spec.Volumes {
+		if v.HostPath != nil && v.HostPath.Path == devicePath {
+			return
+		}
+	}
+	mountDevice(pod, volumeName, devicePath, pathType)
 }
 
 func mountDevice(pod *k8sv1.Pod, volumeName, devicePath string, pathType *k8sv1.HostPathType) {
@@ -411,13 +1088,19 @@ func forcePasstBinding(spec *virtv1.VirtualMachineInstanceSpec) {
 		}
 	}
 	if !hasPodNetwork {
-		// Add default pod network if none exists
-		spec.Networks = append([]virtv1.Network{virtv1.Network{
-			Name: "default",
-			NetworkSource: virtv1.NetworkSource{
-				Pod: &virtv1.PodNetwork{},
-			},
-		}}, spec.Networks...)
+		if net := findNetwork(spec, "default"); net != nil {
+			// Turn a Multus network named default into the pod network
+			// rather than adding a second network of the same name.
+			setPodNetwork(net)
+		} else {
+			// Add default pod network if none exists
+			spec.Networks = append([]virtv1.Network{virtv1.Network{
+				Name: "default",
+				NetworkSource: virtv1.NetworkSource{
+					Pod: &virtv1.PodNetwork{},
+				},
+			}}, spec.Networks...)
+		}
 	}
 
 	// Force all interfaces to Passt
@@ -436,38 +1119,59 @@ func forcePasstBinding(spec *virtv1.VirtualMachineInstanceSpec) {
 	// Match interfaces to pod networks
 	for i := range spec.Domain.Devices.Interfaces {
 		iface := &spec.Domain.Devices.Interfaces[i]
-		found := false
-		for j := range spec.Networks {
-			net := &spec.Networks[j]
-			if net.Name == iface.Name {
-				net.Pod = &virtv1.PodNetwork{}
-				net.Multus = nil
-				found = true
-				break
-			}
+		if net := findNetwork(spec, iface.Name); net != nil {
+			setPodNetwork(net)
+			continue
 		}
-		if !found {
-			// Link to default pod network
+		// Link to default pod network, unless another interface is
+		// connected to it already; interface names must stay unique.
+		if !hasInterface(spec, "default") {
 			iface.Name = "default"
-			// Check if default network already exists
-			defaultExists := false
-			for _, net := range spec.Networks {
-				if net.Name == "default" {
-					defaultExists = true
-					break
-				}
-			}
-			if !defaultExists {
-				spec.Networks = append(spec.Networks, virtv1.Network{
-					Name: "default",
-					NetworkSource: virtv1.NetworkSource{Pod: &virtv1.PodNetwork{}},
-				})
-			}
+		}
+		if net := findNetwork(spec, iface.Name); net != nil {
+			setPodNetwork(net)
+		} else {
+			spec.Networks = append(spec.Networks, virtv1.Network{
+				Name:          iface.Name,
+				NetworkSource: virtv1.NetworkSource{Pod: &virtv1.PodNetwork{}},
+			})
+		}
+	}
+}
+
+func findNetwork(spec *virtv1.VirtualMachineInstanceSpec, name string) *virtv1.Network {
+	for i := range spec.Networks {
+		if spec.Networks[i].Name == name {
+			return &spec.Networks[i]
 		}
 	}
+	return nil
 }
 
-func validateForStandalone(vm *virtv1.VirtualMachine) error {
+func hasInterface(spec *virtv1.VirtualMachineInstanceSpec, name string) bool {
+	for _, iface := range spec.Domain.Devices.Interfaces {
+		if iface.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func setPodNetwork(net *virtv1.Network) {
+	net.Pod = &virtv1.PodNetwork{}
+	net.Multus = nil
+}
+
+func validateForStandalone(vm *virtv1.VirtualMachine, w *warner) error {
+	if vm.Kind != "" && vm.Kind != "VirtualMachine" {
+		return fmt.Errorf("expected a VirtualMachine, got %q", vm.Kind)
+	}
+	if vm.Name == "" {
+		return fmt.Errorf("VM has no metadata.name")
+	}
+	if vm.Spec.Template == nil {
+		return fmt.Errorf("VM has no spec.template")
+	}
 	spec := vm.Spec.Template.Spec
 
 	var errors []string
@@ -505,8 +1209,8 @@ func validateForStandalone(vm *virtv1.VirtualMachine) error {
 		}
 	}
 
-	for _, w := range warnings {
-		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	for _, warning := range warnings {
+		w.warn("%s", warning)
 	}
 
 	if len(errors) > 0 {
@@ -530,13 +1234,14 @@ func populateInterfaceStatus(vmi *virtv1.VirtualMachineInstance) {
 	}
 }
 
-// stubPVCsForVM pre-populates the PVC cache with minimal stub objects for every
+// pvcStubs returns a fresh PVC cache with minimal stub objects for every
 // persistentVolumeClaim volume referenced in the VM spec. RenderLaunchManifest
 // looks up each PVC by namespace/name and fails if it is absent; in standalone
 // mode there is no Kubernetes API to provide real PVCs. The stubs carry enough
 // metadata for the template service to proceed: Filesystem volume mode and
 // ReadWriteOnce access, which is what a Podman named volume provides.
-func (t *VMToPodTransformer) stubPVCsForVM(vm *virtv1.VirtualMachine) {
+func pvcStubs(vm *virtv1.VirtualMachine) cache.Indexer {
+	pvcCache := cache.NewIndexer(cache.DeletionHandlingMetaNamespaceKeyFunc, nil)
 	ns := vm.Namespace
 	if ns == "" {
 		ns = "default"
@@ -557,11 +1262,12 @@ func (t *VMToPodTransformer) stubPVCsForVM(vm *virtv1.VirtualMachine) {
 				VolumeMode:  &filesystemMode,
 			},
 		}
-		_ = t.pvcCache.Add(pvc)
+		_ = pvcCache.Add(pvc)
 	}
+	return pvcCache
 }
 
-func cleanupForStandalone(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance) {
+func cleanupForStandalone(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance, w *warner) {
 	// Remove Kubernetes-specific node selectors that don't apply to standalone execution
 	if pod.Spec.NodeSelector != nil {
 		delete(pod.Spec.NodeSelector, virtv1.CPUManager)
@@ -574,9 +1280,9 @@ func cleanupForStandalone(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance) {
 	// Warn about dedicated CPU placement — CPU pinning must be configured
 	// at the container runtime level (e.g., podman --cpuset-cpus)
 	if vmi.Spec.Domain.CPU != nil && vmi.Spec.Domain.CPU.DedicatedCPUPlacement {
-		fmt.Fprintf(os.Stderr, "Warning: VM requests dedicatedCpuPlacement. "+
-			"For standalone execution, configure CPU pinning via the container runtime "+
-			"(e.g., podman run --cpuset-cpus=0-3)\n")
+		w.warn("VM requests dedicatedCpuPlacement. " +
+			"For standalone execution, configure CPU pinning via the container runtime " +
+			"(e.g., podman run --cpuset-cpus=0-3)")
 	}
 
 	// Set restart policy to allow retries for container disk race conditions
@@ -630,8 +1336,35 @@ func addPersistenceWarnings(pod *k8sv1.Pod, vm *virtv1.VirtualMachine) {
 	}
 
 	if len(warnings) > 0 {
-		pod.Annotations["kubevirt-vm-to-pod/persistence-warning"] = strings.Join(warnings, " | ")
+		pod.Annotations[PersistenceWarningAnnotation] = strings.Join(warnings, " | ")
 	}
 }
 
 var codec = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+
+// setEmulationCPUModel replaces the host CPU models, which need KVM, with
+// EmulationCPUModel. Arm64 is left alone, as KubeVirt only supports
+// host-passthrough there. Named models are the user's choice and are kept.
+func setEmulationCPUModel(vmi *virtv1.VirtualMachineInstance) {
+	if vmi.Spec.Architecture != "" && vmi.Spec.Architecture != "amd64" {
+		return
+	}
+	if vmi.Spec.Domain.CPU == nil {
+		vmi.Spec.Domain.CPU = &virtv1.CPU{}
+	}
+	switch vmi.Spec.Domain.CPU.Model {
+	case "", virtv1.CPUModeHostModel, virtv1.CPUModeHostPassthrough:
+		vmi.Spec.Domain.CPU.Model = EmulationCPUModel
+	}
+}
+
+func addEmulationWarning(pod *k8sv1.Pod, vmi *virtv1.VirtualMachineInstance) {
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	model := "the host CPU model"
+	if vmi.Spec.Domain.CPU != nil && vmi.Spec.Domain.CPU.Model != "" {
+		model = "CPU model " + vmi.Spec.Domain.CPU.Model
+	}
+	pod.Annotations[EmulationWarningAnnotation] = fmt.Sprintf("software emulation: the VM runs without KVM, on %s, typically 10 to 50 times slower than with hardware virtualization. Use it for smoke tests, not for workloads or timing-sensitive tests.", model)
+}
@@ -1,13 +1,22 @@
 package transformer
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/hostdevices"
+	"github.com/vladikr/kubevirt-vm-to-pod/pkg/validate"
 
 	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	v1 "kubevirt.io/api/core/v1"
 )
 
@@ -216,6 +225,186 @@ spec:
 		require.NoError(t, err)
 		require.Len(t, pod.Spec.Containers, 1) // compute only
 	})
+
+	t.Run("console log adds proxy with log volume", func(t *testing.T) {
+		vmYAML := []byte(`
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: testvm
+spec:
+  template:
+    spec:
+      domain:
+        devices: {}
+      volumes: []
+`)
+
+		tmpFile, err := os.CreateTemp("", "vm.yaml")
+		require.NoError(t, err)
+		defer os.Remove(tmpFile.Name())
+		_, err = tmpFile.Write(vmYAML)
+		require.NoError(t, err)
+
+		transformer := NewVMToPodTransformer(
+			WithAddConsoleProxy(false, "test-proxy-image", 8080),
+			WithConsoleLog(true, 20, 3),
+		)
+		pod, err := transformer.Transform(tmpFile.Name())
+		require.NoError(t, err)
+
+		require.Len(t, pod.Spec.Containers, 2) // compute + console-proxy
+		proxyContainer := pod.Spec.Containers[1]
+		require.Equal(t, "console-proxy", proxyContainer.Name)
+		require.Contains(t, proxyContainer.Command, "-log-file=/var/log/console/serial.log")
+		require.Contains(t, proxyContainer.Command, "-log-max-size=20")
+		require.Contains(t, proxyContainer.Command, "-log-max-files=3")
+		require.Contains(t, proxyContainer.VolumeMounts, k8sv1.VolumeMount{Name: "console-log", MountPath: "/var/log/console"})
+
+		var logVolume *k8sv1.Volume
+		for i := range pod.Spec.Volumes {
+			if pod.Spec.Volumes[i].Name == "console-log" {
+				logVolume = &pod.Spec.Volumes[i]
+			}
+		}
+		require.NotNil(t, logVolume)
+		require.NotNil(t, logVolume.PersistentVolumeClaim)
+		require.Equal(t, "testvm-console-log", logVolume.PersistentVolumeClaim.ClaimName)
+	})
+
+	t.Run("console record adds record dir on log volume", func(t *testing.T) {
+		vmYAML := []byte(`
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: testvm
+spec:
+  template:
+    spec:
+      domain:
+        devices: {}
+      volumes: []
+`)
+
+		tmpFile, err := os.CreateTemp("", "vm.yaml")
+		require.NoError(t, err)
+		defer os.Remove(tmpFile.Name())
+		_, err = tmpFile.Write(vmYAML)
+		require.NoError(t, err)
+
+		transformer := NewVMToPodTransformer(
+			WithAddConsoleProxy(false, "test-proxy-image", 8080),
+			WithConsoleRecord(true),
+		)
+		pod, err := transformer.Transform(tmpFile.Name())
+		require.NoError(t, err)
+
+		require.Len(t, pod.Spec.Containers, 2) // compute + console-proxy
+		proxyContainer := pod.Spec.Containers[1]
+		require.Contains(t, proxyContainer.Command, "-record-dir=/var/log/console")
+		require.NotContains(t, proxyContainer.Command, "-log-file=/var/log/console/serial.log")
+		require.Contains(t, proxyContainer.VolumeMounts, k8sv1.VolumeMount{Name: "console-log", MountPath: "/var/log/console"})
+	})
+
+	t.Run("publish proxy listens on tcp and loopback host port", func(t *testing.T) {
+		vmYAML := []byte(`
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: testvm
+spec:
+  template:
+    spec:
+      domain:
+        devices: {}
+      volumes: []
+`)
+
+		tmpFile, err := os.CreateTemp("", "vm.yaml")
+		require.NoError(t, err)
+		defer os.Remove(tmpFile.Name())
+		_, err = tmpFile.Write(vmYAML)
+		require.NoError(t, err)
+
+		transformer := NewVMToPodTransformer(
+			WithAddConsoleProxy(false, "test-proxy-image", 9090),
+			WithPublishConsoleProxy(true),
+		)
+		pod, err := transformer.Transform(tmpFile.Name())
+		require.NoError(t, err)
+
+		require.Len(t, pod.Spec.Containers, 2) // compute + console-proxy
+		proxyContainer := pod.Spec.Containers[1]
+		require.Contains(t, proxyContainer.Command, "-listen=unix,tcp")
+		require.NotContains(t, proxyContainer.Command, "-listen=unix")
+		require.Equal(t, []k8sv1.ContainerPort{{
+			Name:          "console",
+			ContainerPort: 9090,
+			HostPort:      9090,
+			HostIP:        "127.0.0.1",
+			Protocol:      k8sv1.ProtocolTCP,
+		}}, proxyContainer.Ports)
+	})
+
+	t.Run("console ssh mounts keys and publishes the proxy port", func(t *testing.T) {
+		vmYAML := []byte(`
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: testvm
+spec:
+  template:
+    spec:
+      domain:
+        devices: {}
+      volumes: []
+`)
+
+		tmpFile, err := os.CreateTemp("", "vm.yaml")
+		require.NoError(t, err)
+		defer os.Remove(tmpFile.Name())
+		_, err = tmpFile.Write(vmYAML)
+		require.NoError(t, err)
+
+		transformer := NewVMToPodTransformer(
+			WithAddConsoleProxy(false, "test-proxy-image", 2222),
+			WithConsoleSSH("/home/user/.ssh/authorized_keys", ""),
+		)
+		pod, err := transformer.Transform(tmpFile.Name())
+		require.NoError(t, err)
+
+		require.Len(t, pod.Spec.Containers, 2) // compute + console-proxy
+		proxyContainer := pod.Spec.Containers[1]
+		require.Contains(t, proxyContainer.Command, "-ssh-port=2222")
+		require.Contains(t, proxyContainer.Command, "-ssh-authorized-keys=/etc/console-proxy/authorized_keys")
+		require.NotContains(t, proxyContainer.Command, "-ssh-host-key=/etc/console-proxy/ssh_host_key")
+		require.Contains(t, proxyContainer.VolumeMounts, k8sv1.VolumeMount{
+			Name: "console-ssh-authorized-keys", MountPath: "/etc/console-proxy/authorized_keys", ReadOnly: true,
+		})
+		require.Equal(t, []k8sv1.ContainerPort{{
+			Name:          "ssh",
+			ContainerPort: 2222,
+			HostPort:      2222,
+			Protocol:      k8sv1.ProtocolTCP,
+		}}, proxyContainer.Ports)
+
+		var keysVolume *k8sv1.Volume
+		for i := range pod.Spec.Volumes {
+			if pod.Spec.Volumes[i].Name == "console-ssh-authorized-keys" {
+				keysVolume = &pod.Spec.Volumes[i]
+			}
+		}
+		require.NotNil(t, keysVolume)
+		require.NotNil(t, keysVolume.HostPath)
+		require.Equal(t, "/home/user/.ssh/authorized_keys", keysVolume.HostPath.Path)
+
+		_, err = NewVMToPodTransformer(
+			WithAddConsoleProxy(false, "test-proxy-image", 2222),
+			WithConsoleSSH("/home/user/.ssh/authorized_keys", ""),
+			WithPublishConsoleProxy(true),
+		).Transform(tmpFile.Name())
+		require.Error(t, err)
+	})
 }
 
 func TestVolumeSupport(t *testing.T) {
@@ -497,6 +686,51 @@ spec:
 		require.NotNil(t, vmi.Spec.Domain.Devices.Interfaces[0].Masquerade, "Should preserve Masquerade binding")
 		require.Nil(t, vmi.Spec.Domain.Devices.Interfaces[0].PasstBinding, "Should not have Passt binding")
 	})
+
+	t.Run("without force-passt keeps Multus networks", func(t *testing.T) {
+		vm := `
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: testvm-multus
+spec:
+  template:
+    spec:
+      domain:
+        devices:
+          interfaces:
+          - name: default
+            masquerade: {}
+          - name: eth1
+            bridge: {}
+      networks:
+      - name: default
+        pod: {}
+      - name: eth1
+        multus:
+          networkName: mynet
+`
+		// Without ExternalNetResourceInjection the template looks up the
+		// NetworkAttachmentDefinition through the Kubernetes API, which
+		// standalone rendering has no client for.
+		pod, err := NewVMToPodTransformer(WithForcePasst(false)).TransformReader(strings.NewReader(vm))
+		require.NoError(t, err)
+
+		var vmi v1.VirtualMachineInstance
+		for _, env := range pod.Spec.Containers[0].Env {
+			if env.Name == "STANDALONE_VMI" {
+				require.NoError(t, json.Unmarshal([]byte(env.Value), &vmi))
+			}
+		}
+		require.Len(t, vmi.Spec.Networks, 2)
+		require.NotNil(t, vmi.Spec.Networks[1].Multus)
+		require.Equal(t, "mynet", vmi.Spec.Networks[1].Multus.NetworkName)
+		require.NotNil(t, vmi.Spec.Domain.Devices.Interfaces[1].Bridge)
+
+		for name := range pod.Spec.Containers[0].Resources.Limits {
+			require.True(t, strings.HasPrefix(string(name), "devices.kubevirt.io/"), "no device plugin resource of the network: %s", name)
+		}
+	})
 }
 
 func TestDataVolumeError(t *testing.T) {
@@ -535,6 +769,288 @@ spec:
 	})
 }
 
+func TestMalformedVM(t *testing.T) {
+	for _, tc := range []struct {
+		name, vm, err string
+	}{
+		{"no template", "kind: VirtualMachine\nmetadata:\n  name: a\nspec: {}\n", "no spec.template"},
+		{"no name", "kind: VirtualMachine\nspec:\n  template:\n    spec: {}\n", "no metadata.name"},
+		{"not a VM", "kind: Pod\nmetadata:\n  name: a\n", `expected a VirtualMachine, got "Pod"`},
+		{"empty", "", "no metadata.name"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewVMToPodTransformer().TransformReader(strings.NewReader(tc.vm))
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.err)
+		})
+	}
+
+	t.Run("generateName without trailing dash", func(t *testing.T) {
+		pod := &k8sv1.Pod{ObjectMeta: metav1.ObjectMeta{GenerateName: "v"}}
+		setStandalonePodName(pod)
+		require.Equal(t, "v", pod.Name)
+		require.Empty(t, pod.GenerateName)
+	})
+}
+
+func TestStrict(t *testing.T) {
+	vm := `apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: typo
+spec:
+  template:
+    spec:
+      domain:
+        cpus:
+          cores: 2
+        devices: {}
+`
+	_, err := NewVMToPodTransformer().TransformReader(strings.NewReader(vm))
+	require.NoError(t, err, "the typo is silently dropped without strict mode")
+
+	_, err = NewVMToPodTransformer(WithStrict(true)).TransformReader(strings.NewReader(vm))
+	var verr *validate.Error
+	require.ErrorAs(t, err, &verr)
+	require.Len(t, verr.Findings, 1)
+	require.Equal(t, "<input>:9:9: spec.template.spec.domain.cpus: is a forbidden property", verr.Findings[0].String())
+
+	// gpu-vm needs the HostDevices feature gate to pass the webhook.
+	for _, vmFile := range goldenVMs(t) {
+		_, err := NewVMToPodTransformer(WithStrict(true)).Transform(vmFile)
+		require.NoError(t, err, vmFile)
+	}
+}
+
+func TestEmulation(t *testing.T) {
+	render := func(t *testing.T, vm string, opts ...TransformerOption) (*k8sv1.Pod, *v1.VirtualMachineInstance) {
+		t.Helper()
+		pod, err := NewVMToPodTransformer(append(opts, WithMountDevices(true))...).TransformReader(strings.NewReader(vm))
+		require.NoError(t, err)
+		compute := pod.Spec.Containers[0]
+		require.Equal(t, "compute", compute.Name)
+		vmi := &v1.VirtualMachineInstance{}
+		for _, env := range compute.Env {
+			if env.Name == "STANDALONE_VMI" {
+				require.NoError(t, json.Unmarshal([]byte(env.Value), vmi))
+			}
+		}
+		return pod, vmi
+	}
+	vm, err := os.ReadFile("../../test-vm.yaml")
+	require.NoError(t, err)
+
+	t.Run("enabled", func(t *testing.T) {
+		pod, vmi := render(t, string(vm), WithEmulation(true))
+		compute := pod.Spec.Containers[0]
+		require.Contains(t, compute.Command, "--allow-emulation")
+		require.NotContains(t, compute.Resources.Limits, k8sv1.ResourceName("devices.kubevirt.io/kvm"))
+		for _, vol := range pod.Spec.Volumes {
+			require.NotEqual(t, "kvm", vol.Name)
+		}
+		require.Contains(t, pod.Spec.Volumes, k8sv1.Volume{Name: "tun", VolumeSource: k8sv1.VolumeSource{HostPath: &k8sv1.HostPathVolumeSource{Path: "/dev/net/tun", Type: hostPathType(k8sv1.HostPathCharDev)}}})
+		require.Equal(t, EmulationCPUModel, vmi.Spec.Domain.CPU.Model)
+		require.Contains(t, pod.Annotations[EmulationWarningAnnotation], "CPU model Nehalem")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		pod, vmi := render(t, string(vm))
+		require.NotContains(t, pod.Spec.Containers[0].Command, "--allow-emulation")
+		require.NotContains(t, pod.Annotations, EmulationWarningAnnotation)
+		require.True(t, vmi.Spec.Domain.CPU == nil || vmi.Spec.Domain.CPU.Model != EmulationCPUModel)
+		var kvm bool
+		for _, vol := range pod.Spec.Volumes {
+			kvm = kvm || vol.Name == "kvm"
+		}
+		require.True(t, kvm)
+	})
+
+	t.Run("named CPU model is kept", func(t *testing.T) {
+		named := strings.Replace(string(vm), "        devices: {}\n", "        devices: {}\n        cpu:\n          model: Skylake-Client\n", 1)
+		pod, vmi := render(t, named, WithEmulation(true))
+		require.Equal(t, "Skylake-Client", vmi.Spec.Domain.CPU.Model)
+		require.Contains(t, pod.Annotations[EmulationWarningAnnotation], "CPU model Skylake-Client")
+	})
+}
+
+func TestDeviceMap(t *testing.T) {
+	vm, err := os.ReadFile("testdata/vms/gpu-vm.yaml")
+	require.NoError(t, err)
+	twoGPUs := strings.Replace(string(vm), "          hostDevices:\n", "          - name: gpu2\n            deviceName: nvidia.com/GA102GL_A10\n          hostDevices:\n", 1)
+
+	// Two A10s, one bound to vfio-pci in IOMMU group 42 and one to the
+	// NVIDIA driver as /dev/nvidia3, and an E810 NIC sharing group 42.
+	root := t.TempDir()
+	for path, content := range map[string]string{
+		"sys/bus/pci/devices/0000:3b:00.0/vendor":          "0x10de",
+		"sys/bus/pci/devices/0000:3b:00.0/device":          "0x2236",
+		"sys/bus/pci/devices/0000:3b:00.0/driver":          "->../../../bus/pci/drivers/vfio-pci",
+		"sys/bus/pci/devices/0000:3b:00.0/iommu_group":     "->../../../kernel/iommu_groups/42",
+		"sys/bus/pci/devices/0000:af:00.0/vendor":          "0x10de",
+		"sys/bus/pci/devices/0000:af:00.0/device":          "0x2236",
+		"sys/bus/pci/devices/0000:af:00.0/driver":          "->../../../bus/pci/drivers/nvidia",
+		"proc/driver/nvidia/gpus/0000:af:00.0/information": "Device Minor: \t 3\n",
+		"dev/nvidiactl": "",
+		"sys/bus/pci/devices/0000:3b:00.1/vendor":      "0x8086",
+		"sys/bus/pci/devices/0000:3b:00.1/device":      "0x1592",
+		"sys/bus/pci/devices/0000:3b:00.1/driver":      "->../../../bus/pci/drivers/vfio-pci",
+		"sys/bus/pci/devices/0000:3b:00.1/iommu_group": "->../../../kernel/iommu_groups/42",
+	} {
+		path = filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		if target, ok := strings.CutPrefix(content, "->"); ok {
+			require.NoError(t, os.Symlink(target, path))
+		} else {
+			require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		}
+	}
+	m := &hostdevices.DeviceMap{PermittedHostDevices: v1.PermittedHostDevices{
+		PciHostDevices: []v1.PciHostDevice{
+			{PCIVendorSelector: "10DE:2236", ResourceName: "nvidia.com/GA102GL_A10"},
+			{PCIVendorSelector: "8086:1592", ResourceName: "intel.com/E810"},
+		},
+	}}
+	transform := func(vm string, opts ...TransformerOption) (*k8sv1.Pod, error) {
+		return NewVMToPodTransformer(append(opts, WithMountDevices(true))...).TransformReader(strings.NewReader(vm))
+	}
+	hostPaths := func(pod *k8sv1.Pod) map[string]string {
+		paths := map[string]string{}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.HostPath != nil {
+				paths[vol.Name] = vol.HostPath.Path
+			}
+		}
+		return paths
+	}
+
+	t.Run("exact nodes", func(t *testing.T) {
+		pod, err := transform(twoGPUs, WithDeviceMap(m, root))
+		require.NoError(t, err)
+		paths := hostPaths(pod)
+		require.Equal(t, "/dev/vfio/vfio", paths["vfio"])
+		require.Equal(t, "/dev/vfio/42", paths["vfio-42"])
+		require.Equal(t, "/dev/nvidia3", paths["nvidia3"])
+		require.Equal(t, "/dev/nvidiactl", paths["nvidiactl"])
+		require.NotContains(t, paths, "nvidia0")
+		require.NotContains(t, paths, "nvidia-uvm")
+
+		var mounts int
+		for _, m := range pod.Spec.Containers[0].VolumeMounts {
+			if m.MountPath == "/dev/vfio/vfio" {
+				mounts++
+			}
+		}
+		require.Equal(t, 1, mounts, "the VFIO container is mounted once for the GPU and the host device")
+
+		env := map[string]string{}
+		for _, e := range pod.Spec.Containers[0].Env {
+			env[e.Name] = e.Value
+		}
+		require.Equal(t, "0000:3b:00.0,0000:af:00.0", env["PCI_RESOURCE_NVIDIA_COM_GA102GL_A10"])
+		require.Equal(t, "0000:3b:00.1", env["PCI_RESOURCE_INTEL_COM_E810"])
+		require.Equal(t, "GPU gpu2: PCI device 0000:af:00.0 is bound to nvidia, not vfio-pci; bind it to vfio-pci: sudo driverctl set-override 0000:af:00.0 vfio-pci; virt-launcher only passes through devices bound to vfio-pci",
+			pod.Annotations[HostDeviceWarningAnnotation])
+		require.Equal(t, "3344Mi", pod.Annotations[MemlockAnnotation])
+	})
+
+	t.Run("host device not bound to vfio-pci", func(t *testing.T) {
+		pinned := *m
+		pinned.PciHostDevices = append(pinned.PciHostDevices, v1.PciHostDevice{PCIVendorSelector: "10DE:2236", ResourceName: "intel.com/E810"})
+		pinned.PCIAddresses = map[string][]string{"intel.com/E810": {"0000:af:00.0"}}
+		_, err := transform(string(vm), WithDeviceMap(&pinned, root))
+		require.ErrorContains(t, err, "host device nic1: PCI device 0000:af:00.0 is bound to nvidia, not vfio-pci; bind it to vfio-pci: sudo driverctl set-override 0000:af:00.0 vfio-pci")
+	})
+
+	t.Run("pinned address", func(t *testing.T) {
+		pinned := *m
+		pinned.PCIAddresses = map[string][]string{"nvidia.com/GA102GL_A10": {"0000:af:00.0"}}
+		pod, err := transform(string(vm), WithDeviceMap(&pinned, root))
+		require.NoError(t, err)
+		require.Equal(t, "/dev/nvidia3", hostPaths(pod)["nvidia3"])
+		require.Equal(t, "/dev/vfio/42", hostPaths(pod)["vfio-42"], "for the host device")
+	})
+
+	t.Run("not enough devices", func(t *testing.T) {
+		three := strings.Replace(twoGPUs, "          hostDevices:\n", "          - name: gpu3\n            deviceName: nvidia.com/GA102GL_A10\n          hostDevices:\n", 1)
+		_, err := transform(three, WithDeviceMap(m, root))
+		require.ErrorContains(t, err, "GPU gpu3: all 2 PCI devices of resource nvidia.com/GA102GL_A10 are already assigned")
+	})
+
+	t.Run("mediated device", func(t *testing.T) {
+		typeDir := filepath.Join(root, "sys/class/mdev_bus/0000:3b:00.0/mdev_supported_types/nvidia-592")
+		require.NoError(t, os.MkdirAll(typeDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(typeDir, "name"), []byte("NVIDIA A10-4Q\n"), 0644))
+		mdevDir := filepath.Join(root, "sys/bus/mdev/devices/0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a")
+		require.NoError(t, os.MkdirAll(mdevDir, 0755))
+		require.NoError(t, os.Symlink(typeDir, filepath.Join(mdevDir, "mdev_type")))
+		require.NoError(t, os.Symlink("../../../kernel/iommu_groups/120", filepath.Join(mdevDir, "iommu_group")))
+
+		vgpu := strings.Replace(string(vm), "nvidia.com/GA102GL_A10", "nvidia.com/NVIDIA_A10-4Q", 1)
+		mdevMap := *m
+		mdevMap.MediatedDevices = []v1.MediatedHostDevice{{MDEVNameSelector: "NVIDIA A10-4Q", ResourceName: "nvidia.com/NVIDIA_A10-4Q"}}
+		pod, err := transform(vgpu, WithDeviceMap(&mdevMap, root))
+		require.NoError(t, err)
+		paths := hostPaths(pod)
+		require.Equal(t, "/dev/vfio/120", paths["vfio-120"])
+		require.NotContains(t, paths, "nvidia0", "no raw GPU nodes for a vGPU")
+		env := map[string]string{}
+		for _, e := range pod.Spec.Containers[0].Env {
+			env[e.Name] = e.Value
+		}
+		require.Equal(t, "0e3c4a9e-8c69-4b07-9e55-4f1d1a0c4e9a", env["MDEV_PCI_RESOURCE_NVIDIA_COM_NVIDIA_A10-4Q"])
+		require.NotContains(t, env, "PCI_RESOURCE_NVIDIA_COM_NVIDIA_A10-4Q")
+
+		two := strings.Replace(vgpu, "          hostDevices:\n", "          - name: gpu2\n            deviceName: nvidia.com/NVIDIA_A10-4Q\n          hostDevices:\n", 1)
+		_, err = transform(two, WithDeviceMap(&mdevMap, root))
+		require.ErrorContains(t, err, "GPU gpu2: no free mediated device of resource nvidia.com/NVIDIA_A10-4Q (NVIDIA A10-4Q) on the host")
+	})
+
+	t.Run("USB device", func(t *testing.T) {
+		usbDir := filepath.Join(root, "sys/bus/usb/devices/1-4")
+		require.NoError(t, os.MkdirAll(usbDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(usbDir, "idVendor"), []byte("1050\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(usbDir, "uevent"), []byte("DEVNAME=bus/usb/001/004\nPRODUCT=1050/407/526\nBUSNUM=001\nDEVNUM=004\n"), 0644))
+
+		key := strings.Replace(string(vm), "          - name: nic1\n            deviceName: intel.com/E810\n", "          - name: nic1\n            deviceName: intel.com/E810\n          - name: key\n            deviceName: yubico.com/yubikey\n", 1)
+		usbMap := *m
+		usbMap.USB = []v1.USBHostDevice{{ResourceName: "yubico.com/yubikey", Selectors: []v1.USBSelector{{Vendor: "1050", Product: "0407"}}}}
+		pod, err := transform(key, WithDeviceMap(&usbMap, root))
+		require.NoError(t, err)
+		require.Equal(t, "/dev/bus/usb/001/004", hostPaths(pod)["bus-usb-001-004"])
+		env := map[string]string{}
+		for _, e := range pod.Spec.Containers[0].Env {
+			env[e.Name] = e.Value
+		}
+		require.Equal(t, "1:4", env["USB_RESOURCE_YUBICO_COM_YUBIKEY"])
+		require.Equal(t, "0000:3b:00.1", env["PCI_RESOURCE_INTEL_COM_E810"])
+
+		two := strings.Replace(key, "deviceName: yubico.com/yubikey\n", "deviceName: yubico.com/yubikey\n          - name: key2\n            deviceName: yubico.com/yubikey\n", 1)
+		_, err = transform(two, WithDeviceMap(&usbMap, root))
+		require.ErrorContains(t, err, "host device key2: no free USB devices of resource yubico.com/yubikey (1050:0407) on the host")
+	})
+
+	t.Run("without a map", func(t *testing.T) {
+		pod, err := transform(twoGPUs)
+		require.NoError(t, err)
+		require.Equal(t, "/dev/nvidia1", hostPaths(pod)["nvidia1"])
+		require.NotContains(t, hostPaths(pod), "vfio-42")
+		require.Equal(t, "3344Mi", pod.Annotations[MemlockAnnotation])
+	})
+
+	t.Run("without mounting devices", func(t *testing.T) {
+		for _, opts := range [][]TransformerOption{nil, {WithDeviceMap(m, root)}} {
+			pod, err := NewVMToPodTransformer(append(opts, WithMountDevices(false))...).TransformReader(strings.NewReader(twoGPUs))
+			require.NoError(t, err)
+			require.Empty(t, hostPaths(pod))
+			require.Equal(t, "3344Mi", pod.Annotations[MemlockAnnotation], "the limit is needed however the devices get into the container")
+		}
+	})
+}
+
+func hostPathType(t k8sv1.HostPathType) *k8sv1.HostPathType {
+	return &t
+}
+
 func TestPersistenceWarnings(t *testing.T) {
 	t.Run("PVC volume adds persistence warning annotation", func(t *testing.T) {
 		vmYAML := []byte(`
@@ -679,3 +1195,169 @@ spec:
 		require.False(t, ok, "Should not have persistence warning annotation for ephemeral VM")
 	})
 }
+
+func TestWarnings(t *testing.T) {
+	vm := `
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: testvm-warnings
+spec:
+  template:
+    spec:
+      domain:
+        cpu:
+          cores: 2
+          dedicatedCpuPlacement: true
+        resources:
+          requests:
+            memory: 64Mi
+        devices:
+          hostDevices:
+          - name: nic1
+            deviceName: intel.com/x710
+          interfaces:
+          - name: eth1
+            bridge: {}
+      networks:
+      - name: eth1
+        multus:
+          networkName: mynet
+      volumes:
+      - name: data
+        persistentVolumeClaim:
+          claimName: data-pvc
+`
+	tr := NewVMToPodTransformer(WithForcePasst(true), WithMountDevices(true))
+	for i := 0; i < 2; i++ {
+		result, err := tr.TransformReaderResult(context.Background(), strings.NewReader(vm))
+		require.NoError(t, err)
+		require.Len(t, result.Warnings, 4, "every call collects its own warnings: %q", result.Warnings)
+		require.Contains(t, result.Warnings[0], `network "eth1" uses Multus`)
+		require.Contains(t, result.Warnings[1], "PCI hostdevice nic1 detected")
+		require.Contains(t, result.Warnings[2], "dedicatedCpuPlacement")
+		require.Contains(t, result.Warnings[3], "persistentVolumeClaim volumes")
+		require.Nil(t, result.Explanation)
+	}
+
+	result, err := tr.TransformDetailed(context.Background(), strings.NewReader(vm))
+	require.NoError(t, err)
+	require.Len(t, result.Warnings, 4)
+}
+
+func concurrencyTestVM(name, claim string) *v1.VirtualMachine {
+	return &v1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.VirtualMachineSpec{
+			Template: &v1.VirtualMachineInstanceTemplateSpec{
+				Spec: v1.VirtualMachineInstanceSpec{
+					Domain: v1.DomainSpec{
+						Resources: v1.ResourceRequirements{
+							Requests: k8sv1.ResourceList{k8sv1.ResourceMemory: resource.MustParse("64Mi")},
+						},
+					},
+					Volumes: []v1.Volume{{
+						Name: "data",
+						VolumeSource: v1.VolumeSource{
+							PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+								PersistentVolumeClaimVolumeSource: k8sv1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+func TestTransformVM(t *testing.T) {
+	t.Run("input VM is not modified", func(t *testing.T) {
+		vm := concurrencyTestVM("testvm", "data-pvc")
+		orig := vm.DeepCopy()
+
+		pod, err := NewVMToPodTransformer().TransformVM(vm)
+		require.NoError(t, err)
+		require.Equal(t, "virt-launcher-testvm", pod.Name)
+		require.Equal(t, orig, vm)
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := NewVMToPodTransformer().TransformVMContext(ctx, concurrencyTestVM("testvm", "data-pvc"))
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("concurrent use", func(t *testing.T) {
+		tr := NewVMToPodTransformer(WithForcePasst(true), WithAddConsoleProxy(true, "proxy:latest", 8080))
+
+		var wg sync.WaitGroup
+		errs := make([]error, 16)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				name := fmt.Sprintf("vm%d", i)
+				pod, err := tr.TransformVM(concurrencyTestVM(name, name+"-pvc"))
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				for _, vol := range pod.Spec.Volumes {
+					if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName != name+"-pvc" {
+						errs[i] = fmt.Errorf("%s got claim %s", name, vol.PersistentVolumeClaim.ClaimName)
+						return
+					}
+				}
+				if pod.Name != "virt-launcher-"+name {
+					errs[i] = fmt.Errorf("%s got Pod %s", name, pod.Name)
+				}
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+	})
+}
+
+func BenchmarkNewVMToPodTransformer(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		NewVMToPodTransformer(WithForcePasst(true))
+	}
+}
+
+// BenchmarkTransformShared reuses one transformer, as a service would.
+// Compare with BenchmarkTransformNewEachCall for the construction cost.
+func BenchmarkTransformShared(b *testing.B) {
+	tr := NewVMToPodTransformer(WithForcePasst(true))
+	vm := concurrencyTestVM("testvm", "data-pvc")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tr.TransformVM(vm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTransformNewEachCall(b *testing.B) {
+	vm := concurrencyTestVM("testvm", "data-pvc")
+	for i := 0; i < b.N; i++ {
+		if _, err := NewVMToPodTransformer(WithForcePasst(true)).TransformVM(vm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTransformParallel(b *testing.B) {
+	tr := NewVMToPodTransformer(WithForcePasst(true))
+	vm := concurrencyTestVM("testvm", "data-pvc")
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := tr.TransformVM(vm); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,320 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	openapierrors "github.com/go-openapi/errors"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8svalidation "k8s.io/apimachinery/pkg/util/validation"
+	k8sfield "k8s.io/apimachinery/pkg/util/validation/field"
+	virtv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt/pkg/virt-api/definitions"
+	"kubevirt.io/kubevirt/pkg/virt-api/webhooks/validating-webhook/admitters"
+	virtconfig "kubevirt.io/kubevirt/pkg/virt-config"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// Sources of findings.
+const (
+	// SourceYAML is for input that is not valid YAML or has duplicate keys.
+	SourceYAML = "yaml"
+	// SourceSchema is for fields the KubeVirt OpenAPI schema rejects, such
+	// as unknown or misspelled fields and values of the wrong type.
+	SourceSchema = "schema"
+	// SourceWebhook is for specs the KubeVirt validating webhook rejects.
+	SourceWebhook = "webhook"
+)
+
+var vmGVK = schema.GroupVersionKind{Group: "kubevirt.io", Version: "v1", Kind: "VirtualMachine"}
+
+// Finding is a problem in a VM manifest and where it is.
+type Finding struct {
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	// Field is the path of the field, e.g.
+	// spec.template.spec.domain.devices.disks[0].name.
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+	Source  string `json:"source"`
+}
+
+// String formats the finding like a compiler error:
+// file:line:column: field: message.
+func (f Finding) String() string {
+	file := f.File
+	if file == "" {
+		file = "<input>"
+	}
+	s := fmt.Sprintf("%s:%d:%d: ", file, f.Line, f.Column)
+	if f.Field != "" {
+		s += f.Field + ": "
+	}
+	return s + f.Message
+}
+
+// Error is returned for a VM with findings.
+type Error struct {
+	Findings []Finding
+}
+
+func (e *Error) Error() string {
+	lines := make([]string, 0, len(e.Findings))
+	for _, f := range e.Findings {
+		lines = append(lines, "  "+f.String())
+	}
+	return fmt.Sprintf("invalid VM:\n%s", strings.Join(lines, "\n"))
+}
+
+// Validate checks the VirtualMachine manifest in data, read from file, and
+// returns its findings ordered by position. It decodes strictly, checks the
+// KubeVirt OpenAPI schema and runs the validation of the KubeVirt webhook
+// with config. The webhook only runs once the manifest passes the schema,
+// as its messages are confusing for fields the schema already rejects.
+func Validate(file string, data []byte, config *virtconfig.ClusterConfig) []Finding {
+	v := &validator{file: file}
+	v.validate(data, config)
+	sort.SliceStable(v.findings, func(i, j int) bool {
+		a, b := v.findings[i], v.findings[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return v.findings
+}
+
+type validator struct {
+	file     string
+	root     yaml.Node
+	findings []Finding
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+func (v *validator) validate(data []byte, config *virtconfig.ClusterConfig) {
+	if err := yaml.Unmarshal(data, &v.root); err != nil {
+		line := 1
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+		}
+		v.findings = append(v.findings, Finding{File: v.file, Line: line, Column: 1, Message: strings.TrimPrefix(err.Error(), "yaml: "), Source: SourceYAML})
+		return
+	}
+	if len(v.root.Content) == 0 {
+		v.add("", "the manifest is empty", SourceYAML)
+		return
+	}
+	v.checkDuplicateKeys(&v.root, "")
+
+	var obj map[string]interface{}
+	if err := sigsyaml.Unmarshal(data, &obj); err != nil {
+		v.add("", fmt.Sprintf("failed to decode: %v", err), SourceYAML)
+		return
+	}
+	if kind, _ := obj["kind"].(string); kind != vmGVK.Kind {
+		v.add("kind", fmt.Sprintf("expected %s, got %q", vmGVK.Kind, kind), SourceSchema)
+		return
+	}
+	if apiVersion, _ := obj["apiVersion"].(string); apiVersion != vmGVK.GroupVersion().String() {
+		v.add("apiVersion", fmt.Sprintf("expected %s, got %q", vmGVK.GroupVersion(), apiVersion), SourceSchema)
+	}
+
+	before := len(v.findings)
+	v.checkName(obj)
+	for _, err := range definitions.Validator.Validate(vmGVK, obj) {
+		v.addSchemaError(err)
+	}
+	if len(v.findings) > before {
+		return
+	}
+
+	vm := &virtv1.VirtualMachine{}
+	if err := sigsyaml.Unmarshal(data, vm); err != nil {
+		v.add("", fmt.Sprintf("failed to decode: %v", err), SourceSchema)
+		return
+	}
+	if vm.Spec.Template == nil {
+		v.add("spec.template", "is required", SourceSchema)
+		return
+	}
+	for _, cause := range admitters.ValidateVirtualMachineSpec(k8sfield.NewPath("spec"), &vm.Spec, config, false) {
+		v.add(cause.Field, trimField(cause.Message, cause.Field), SourceWebhook)
+	}
+}
+
+// trimField drops the field path a webhook message starts with, which is
+// reported separately. The webhook spells the last segment with the Go field
+// name, e.g. disks[0].Name for disks[0].name.
+func trimField(message, field string) string {
+	first, rest, ok := strings.Cut(message, " ")
+	if ok && strings.EqualFold(first, field) {
+		return rest
+	}
+	return message
+}
+
+// checkName checks metadata.name the way the Kubernetes API server does;
+// the schema leaves metadata open.
+func (v *validator) checkName(obj map[string]interface{}) {
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	if name == "" {
+		v.add("metadata.name", "is required", SourceSchema)
+		return
+	}
+	for _, msg := range k8svalidation.IsDNS1123Subdomain(name) {
+		v.add("metadata.name", msg, SourceSchema)
+	}
+}
+
+var schemaErrorField = regexp.MustCompile(`^(\S+) in body (.*)$`)
+
+// addSchemaError adds an error of the OpenAPI validator. Their messages
+// start with the field path, which is reported separately.
+func (v *validator) addSchemaError(err error) {
+	var composite *openapierrors.CompositeError
+	if errors.As(err, &composite) && len(composite.Errors) > 0 {
+		for _, err := range composite.Errors {
+			v.addSchemaError(err)
+		}
+		return
+	}
+	field, message := "", err.Error()
+	var verr *openapierrors.Validation
+	if errors.As(err, &verr) {
+		field = verr.Name
+	}
+	// Forbidden properties are reported on their parent, but the message
+	// names the property itself.
+	if m := schemaErrorField.FindStringSubmatch(message); m != nil {
+		field, message = m[1], m[2]
+	}
+	v.add(field, message, SourceSchema)
+}
+
+func (v *validator) add(field, message, source string) {
+	node := locate(&v.root, nil, pathSegments(field))
+	v.findings = append(v.findings, Finding{
+		File:    v.file,
+		Line:    node.Line,
+		Column:  node.Column,
+		Field:   field,
+		Message: message,
+		Source:  source,
+	})
+}
+
+// checkDuplicateKeys reports keys defined twice in a mapping. Decoders keep
+// the last one silently.
+func (v *validator) checkDuplicateKeys(n *yaml.Node, path string) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			v.checkDuplicateKeys(c, path)
+		}
+	case yaml.MappingNode:
+		seen := map[string]*yaml.Node{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			field := key.Value
+			if path != "" {
+				field = path + "." + key.Value
+			}
+			if first, ok := seen[key.Value]; ok {
+				v.findings = append(v.findings, Finding{
+					File:    v.file,
+					Line:    key.Line,
+					Column:  key.Column,
+					Field:   field,
+					Message: fmt.Sprintf("duplicate key, first defined at line %d", first.Line),
+					Source:  SourceYAML,
+				})
+				continue
+			}
+			seen[key.Value] = key
+			v.checkDuplicateKeys(n.Content[i+1], field)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			v.checkDuplicateKeys(c, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// pathSegments splits a field path into keys and list indexes. It accepts
+// the webhook form, a.b[0].c and labels[some/key], and the OpenAPI form,
+// a.b.0.c.
+func pathSegments(path string) []string {
+	var segs []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			segs = append(segs, cur.String())
+			cur.Reset()
+		}
+	}
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '.':
+			flush()
+		case '[':
+			flush()
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				cur.WriteString(path[i+1:])
+				i = len(path)
+				continue
+			}
+			segs = append(segs, path[i+1:i+end])
+			i += end
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flush()
+	return segs
+}
+
+// locate returns the node of the field at segs below n: the key of a mapping
+// entry or the item of a list. For fields that do not exist it returns the
+// closest parent that does, at is the node that introduced n.
+func locate(n, at *yaml.Node, segs []string) *yaml.Node {
+	for n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	if n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	if at == nil {
+		at = n
+	}
+	if len(segs) == 0 {
+		return at
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		// Keys can contain dots, as in kubevirt.io/label, so try the
+		// longest key first.
+		for k := len(segs); k >= 1; k-- {
+			key := strings.Join(segs[:k], ".")
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == key {
+					return locate(n.Content[i+1], n.Content[i], segs[k:])
+				}
+			}
+		}
+	case yaml.SequenceNode:
+		if i, err := strconv.Atoi(segs[0]); err == nil && i >= 0 && i < len(n.Content) {
+			return locate(n.Content[i], n.Content[i], segs[1:])
+		}
+	}
+	return at
+}
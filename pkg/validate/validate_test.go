@@ -0,0 +1,163 @@
+package validate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	virtv1 "kubevirt.io/api/core/v1"
+	"kubevirt.io/kubevirt/pkg/testutils"
+	virtconfig "kubevirt.io/kubevirt/pkg/virt-config"
+)
+
+func testConfig() *virtconfig.ClusterConfig {
+	config, _, _ := testutils.NewFakeClusterConfigUsingKV(&virtv1.KubeVirt{
+		ObjectMeta: metav1.ObjectMeta{Name: "kubevirt", Namespace: "kubevirt"},
+		Spec: virtv1.KubeVirtSpec{Configuration: virtv1.KubeVirtConfiguration{
+			DeveloperConfiguration: &virtv1.DeveloperConfiguration{FeatureGates: []string{"HostDisk", "HostDevices"}},
+		}},
+	})
+	return config
+}
+
+const badVM = `apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: bad
+spec:
+  runStrategy: Always
+  template:
+    spec:
+      domain:
+        cpus:
+          cores: 2
+        devices: {}
+`
+
+func TestValidate(t *testing.T) {
+	config := testConfig()
+
+	t.Run("misspelled field", func(t *testing.T) {
+		findings := Validate("vm.yaml", []byte(badVM), config)
+		require.Equal(t, []Finding{{
+			File:    "vm.yaml",
+			Line:    10,
+			Column:  9,
+			Field:   "spec.template.spec.domain.cpus",
+			Message: "is a forbidden property",
+			Source:  SourceSchema,
+		}}, findings)
+		require.Equal(t, "vm.yaml:10:9: spec.template.spec.domain.cpus: is a forbidden property", findings[0].String())
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		findings := Validate("vm.yaml", []byte(`apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: a
+spec:
+  template:
+    spec:
+      domain:
+        cpu:
+          cores: two
+        devices: {}
+`), config)
+		require.Len(t, findings, 1)
+		require.Equal(t, 10, findings[0].Line)
+		require.Equal(t, "spec.template.spec.domain.cpu.cores", findings[0].Field)
+	})
+
+	t.Run("webhook rules", func(t *testing.T) {
+		findings := Validate("vm.yaml", []byte(`apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: a
+spec:
+  runStrategy: Always
+  template:
+    spec:
+      domain:
+        devices:
+          disks:
+          - name: rootdisk
+            disk:
+              bus: virtio
+      volumes:
+      - name: root
+        containerDisk:
+          image: quay.io/containerdisks/fedora:41
+`), config)
+		require.NotEmpty(t, findings)
+		for _, f := range findings {
+			require.Equal(t, SourceWebhook, f.Source)
+		}
+		require.Equal(t, "spec.template.spec.domain.devices.disks[0].name", findings[0].Field)
+		require.Equal(t, "'rootdisk' not found.", findings[0].Message)
+		require.Equal(t, 12, findings[0].Line)
+		require.Equal(t, 13, findings[0].Column)
+		require.Equal(t, "vm.yaml:12:13: spec.template.spec.domain.devices.disks[0].name: 'rootdisk' not found.", findings[0].String())
+	})
+
+	t.Run("duplicate key", func(t *testing.T) {
+		findings := Validate("", []byte("apiVersion: kubevirt.io/v1\nkind: VirtualMachine\nmetadata:\n  name: a\n  name: b\nspec:\n  template:\n    spec:\n      domain:\n        devices: {}\n"), config)
+		require.NotEmpty(t, findings)
+		require.Equal(t, Finding{Line: 5, Column: 3, Field: "metadata.name", Message: "duplicate key, first defined at line 4", Source: SourceYAML}, findings[0])
+		require.Equal(t, "<input>:5:3: metadata.name: duplicate key, first defined at line 4", findings[0].String())
+	})
+
+	t.Run("invalid YAML", func(t *testing.T) {
+		findings := Validate("vm.yaml", []byte("kind: VirtualMachine\nmetadata:\n\tname: a\n"), config)
+		require.Len(t, findings, 1)
+		require.Equal(t, SourceYAML, findings[0].Source)
+		require.Equal(t, 3, findings[0].Line)
+	})
+
+	t.Run("not a VM", func(t *testing.T) {
+		findings := Validate("pod.yaml", []byte("apiVersion: v1\nkind: Pod\nmetadata:\n  name: a\n"), config)
+		require.Equal(t, []Finding{{File: "pod.yaml", Line: 2, Column: 1, Field: "kind", Message: `expected VirtualMachine, got "Pod"`, Source: SourceSchema}}, findings)
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		findings := Validate("vm.yaml", []byte("apiVersion: kubevirt.io/v1\nkind: VirtualMachine\nmetadata:\n  name: My_VM\nspec:\n  template:\n    spec:\n      domain:\n        devices: {}\n"), config)
+		require.NotEmpty(t, findings)
+		require.Equal(t, "metadata.name", findings[0].Field)
+		require.Equal(t, 4, findings[0].Line)
+	})
+
+	t.Run("corpus VMs are valid", func(t *testing.T) {
+		vms, err := filepath.Glob(filepath.Join("..", "transformer", "testdata", "vms", "*.yaml"))
+		require.NoError(t, err)
+		vms = append(vms,
+			filepath.Join("..", "..", "test-vm.yaml"),
+			filepath.Join("..", "..", "test-vm-fedora.yaml"),
+			filepath.Join("..", "..", "demo-vm.yaml"),
+		)
+		for _, vm := range vms {
+			data, err := os.ReadFile(vm)
+			require.NoError(t, err)
+			require.Empty(t, Validate(vm, data, config), vm)
+		}
+	})
+}
+
+func TestTrimField(t *testing.T) {
+	field := "spec.template.spec.domain.devices.disks[1].name"
+	for message, want := range map[string]string{
+		"spec.template.spec.domain.devices.disks[1].Name 'root' not found.":                                                      "'root' not found.",
+		"spec.template.spec.domain.devices.disks[1].name 'root' not found.":                                                      "'root' not found.",
+		"spec.template.spec.domain.devices.disks[1] and spec.template.spec.domain.devices.disks[0] must not have the same Name.": "spec.template.spec.domain.devices.disks[1] and spec.template.spec.domain.devices.disks[0] must not have the same Name.",
+		"Masquerade interface only implemented with pod network":                                                                 "Masquerade interface only implemented with pod network",
+	} {
+		require.Equal(t, want, trimField(message, field))
+	}
+}
+
+func TestPathSegments(t *testing.T) {
+	require.Equal(t, []string{"spec", "template", "spec", "networks", "0", "name"}, pathSegments("spec.template.spec.networks[0].name"))
+	require.Equal(t, []string{"spec", "template", "spec", "networks", "0", "name"}, pathSegments("spec.template.spec.networks.0.name"))
+	require.Equal(t, []string{"metadata", "labels", "kubevirt.io/size"}, pathSegments("metadata.labels[kubevirt.io/size]"))
+	require.Empty(t, pathSegments(""))
+}
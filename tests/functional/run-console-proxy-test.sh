@@ -13,8 +13,12 @@ REPO_ROOT="$(cd "$TEST_DIR/../.." && pwd)"
 VM_FILE="$TEST_DIR/test-vm.yaml"
 POD_YAML="$TEST_DIR/test-pod-with-proxy.yaml"
 BINARY="$REPO_ROOT/kubevirt-vm-to-pod"
-POD_NAME="virt-launcher-cirros-test"
+VM_NAME="cirros-test"
+POD_NAME="virt-launcher-$VM_NAME"
 PROXY_PORT=8080
+CONSOLE_LOG="$TEST_DIR/console-session.log"
+GUEST_USER="cirros"
+GUEST_PASSWORD="gocubsgo"
 TEST_TIMEOUT=180
 
 echo_success() { echo -e "${GREEN}✓${NC} $1"; }
@@ -26,7 +30,7 @@ cleanup() {
     if podman pod exists "$POD_NAME" 2>/dev/null; then
         podman pod rm -f "$POD_NAME" 2>/dev/null || true
     fi
-    rm -f "$POD_YAML"
+    rm -f "$POD_YAML" "$CONSOLE_LOG"
     echo_success "Cleanup complete"
 }
 
@@ -48,10 +52,10 @@ if [ ! -f "$BINARY" ]; then
     echo_success "Binary built successfully"
 fi
 
-# Step 2: Generate Pod YAML with console proxy, force-passt, and device mounting
-echo_info "Generating Pod YAML with console proxy, force-passt, and device mounting..."
+# Step 2: Generate Pod YAML with console proxy, passt (default), and device mounting
+echo_info "Generating Pod YAML with console proxy, passt, and device mounting..."
 cd "$REPO_ROOT"
-"$BINARY" --vm-file="$VM_FILE" --add-console-proxy --force-passt --mount-devices > "$POD_YAML"
+"$BINARY" --vm-file="$VM_FILE" --add-console-proxy --mount-devices > "$POD_YAML"
 
 if [ ! -s "$POD_YAML" ]; then
     echo_error "Failed to generate Pod YAML"
@@ -124,21 +128,21 @@ if [ -z "$PROXY_CONTAINER" ]; then
 fi
 echo_success "Console proxy container: $PROXY_CONTAINER"
 
-# Step 6: Check console proxy is listening
-echo_info "Checking console proxy port..."
-sleep 2  # Give proxy time to start listening
-
-if podman exec "$PROXY_CONTAINER" netstat -tln 2>/dev/null | grep -q ":$PROXY_PORT" || \
-   podman exec "$PROXY_CONTAINER" ss -tln 2>/dev/null | grep -q ":$PROXY_PORT"; then
-    echo_success "Console proxy is listening on port $PROXY_PORT"
-else
-    echo_info "Console proxy port check skipped (netstat/ss not available)"
-    echo_info "Checking proxy logs instead..."
-    PROXY_LOGS=$(podman logs "$PROXY_CONTAINER" 2>&1 || echo "")
-    if [ -n "$PROXY_LOGS" ]; then
-        echo "$PROXY_LOGS" | head -10
-    fi
-fi
+# Step 6: Log in through the console proxy socket and run a command
+echo_info "Logging in over the serial console..."
+set +e
+"$BINARY" console "$VM_NAME" --method unix \
+    --login "$GUEST_USER" --password "$GUEST_PASSWORD" \
+    --step 'send=uname -s' --step 'expect=Linux' \
+    --timeout "${TEST_TIMEOUT}s" > "$CONSOLE_LOG"
+CONSOLE_RC=$?
+set -e
+case $CONSOLE_RC in
+    0) echo_success "Logged in and ran a command over the serial console" ;;
+    2) echo_error "Timed out waiting for the guest on the serial console"; tail -20 "$CONSOLE_LOG"; exit 1 ;;
+    3) echo_error "Guest rejected the login"; tail -20 "$CONSOLE_LOG"; exit 1 ;;
+    *) echo_error "Serial console session failed (exit code $CONSOLE_RC)"; tail -20 "$CONSOLE_LOG"; exit 1 ;;
+esac
 
 # Step 7: Check shared volume mount
 echo_info "Verifying shared kubevirt-private volume..."
@@ -185,6 +189,7 @@ echo_info "Features verified:"
 echo "  ✓ Console proxy sidecar running"
 echo "  ✓ Force-passt binding applied"
 echo "  ✓ Shared volume mounted"
+echo "  ✓ Serial console login"
 echo ""
 echo_info "To view proxy logs: podman logs -f $PROXY_CONTAINER"
 echo_info "To view compute logs: podman logs -f $COMPUTE_CONTAINER"